@@ -1,190 +0,0 @@
-// Copyright 2014 beego Author. All Rights Reserved.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-//      http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-// Package memcache for cache provider
-//
-// depend on github.com/bradfitz/gomemcache/memcache
-//
-// go install github.com/bradfitz/gomemcache/memcache
-//
-// Usage:
-// import(
-//   _ "github.com/henrylee2cn/lessgo/cache/memcache"
-//   "github.com/henrylee2cn/lessgo/cache"
-// )
-//
-//  bm, err := cache.NewCache("memcache", `{"conn":"127.0.0.1:11211"}`)
-//
-//  more docs http://beego.me/docs/module/cache.md
-package memcache
-
-import (
-	"encoding/json"
-	"errors"
-	"strings"
-
-	"github.com/bradfitz/gomemcache/memcache"
-
-	"time"
-
-	"github.com/henrylee2cn/lessgoext/cache"
-)
-
-// Cache Memcache adapter.
-type Cache struct {
-	conn     *memcache.Client
-	conninfo []string
-}
-
-// NewMemCache create new memcache adapter.
-func NewMemCache() cache.Cache {
-	return &Cache{}
-}
-
-// Get get value from memcache.
-func (rc *Cache) Get(key string) interface{} {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return err
-		}
-	}
-	if item, err := rc.conn.Get(key); err == nil {
-		return string(item.Value)
-	}
-	return nil
-}
-
-// GetMulti get value from memcache.
-func (rc *Cache) GetMulti(keys []string) []interface{} {
-	size := len(keys)
-	var rv []interface{}
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			for i := 0; i < size; i++ {
-				rv = append(rv, err)
-			}
-			return rv
-		}
-	}
-	mv, err := rc.conn.GetMulti(keys)
-	if err == nil {
-		for _, v := range mv {
-			rv = append(rv, string(v.Value))
-		}
-		return rv
-	}
-	for i := 0; i < size; i++ {
-		rv = append(rv, err)
-	}
-	return rv
-}
-
-// Put put value to memcache. only support string.
-func (rc *Cache) Put(key string, val interface{}, timeout time.Duration) error {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return err
-		}
-	}
-	v, ok := val.(string)
-	if !ok {
-		return errors.New("val must string")
-	}
-	item := memcache.Item{Key: key, Value: []byte(v), Expiration: int32(timeout / time.Second)}
-	return rc.conn.Set(&item)
-}
-
-// Delete delete value in memcache.
-func (rc *Cache) Delete(key string) error {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return err
-		}
-	}
-	return rc.conn.Delete(key)
-}
-
-// Incr increase counter.
-func (rc *Cache) Incr(key string) error {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return err
-		}
-	}
-	_, err := rc.conn.Increment(key, 1)
-	return err
-}
-
-// Decr decrease counter.
-func (rc *Cache) Decr(key string) error {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return err
-		}
-	}
-	_, err := rc.conn.Decrement(key, 1)
-	return err
-}
-
-// IsExist check value exists in memcache.
-func (rc *Cache) IsExist(key string) bool {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return false
-		}
-	}
-	_, err := rc.conn.Get(key)
-	if err != nil {
-		return false
-	}
-	return true
-}
-
-// ClearAll clear all cached in memcache.
-func (rc *Cache) ClearAll() error {
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return err
-		}
-	}
-	return rc.conn.FlushAll()
-}
-
-// StartAndGC start memcache adapter.
-// config string is like {"conn":"connection info"}.
-// if connecting error, return.
-func (rc *Cache) StartAndGC(config string) error {
-	var cf map[string]string
-	json.Unmarshal([]byte(config), &cf)
-	if _, ok := cf["conn"]; !ok {
-		return errors.New("config has no conn key")
-	}
-	rc.conninfo = strings.Split(cf["conn"], ";")
-	if rc.conn == nil {
-		if err := rc.connectInit(); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-// connect to memcache and keep the connection.
-func (rc *Cache) connectInit() error {
-	rc.conn = memcache.New(rc.conninfo...)
-	return nil
-}
-
-func init() {
-	cache.Register("memcache", NewMemCache)
-}
@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+)
+
+// errNotInteger is returned by IncrBy and DecrBy if the cached value is not an integer.
+var errNotInteger = errors.New("item val is not an integer")
+
+// addValue adds n to the cached integer v and returns the new value to store and its int64 value.
+// if values are stored encoded by codec, v is decoded and the sum is encoded again,
+// otherwise the sum keeps the type of v.
+func addValue(codec Codec, v interface{}, n int64) (interface{}, int64, error) {
+	if codec == nil {
+		return addInt(v, n)
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, 0, errNotInteger
+	}
+	var i int64
+	if err := codec.Unmarshal(b, &i); err != nil {
+		return nil, 0, errNotInteger
+	}
+	i += n
+	b, err := codec.Marshal(i)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b, i, nil
+}
+
+// addInt adds n to the integer v, keeping the type of v.
+func addInt(v interface{}, n int64) (interface{}, int64, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		sum := rv.Int() + n
+		nv := reflect.New(rv.Type()).Elem()
+		nv.SetInt(sum)
+		if nv.Int() != sum || (n > 0 && sum < rv.Int()) || (n < 0 && sum > rv.Int()) {
+			return nil, 0, errors.New("item val overflows")
+		}
+		return nv.Interface(), sum, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n < 0 && rv.Uint() < uint64(-n) {
+			return nil, 0, errors.New("item val is less than 0")
+		}
+		sum := rv.Uint() + uint64(n)
+		nv := reflect.New(rv.Type()).Elem()
+		nv.SetUint(sum)
+		if nv.Uint() != sum || (n > 0 && sum < rv.Uint()) {
+			return nil, 0, errors.New("item val overflows")
+		}
+		return nv.Interface(), int64(sum), nil
+	}
+	return nil, 0, errNotInteger
+}
+
+// encodeValue encodes v by codec, or returns it as it is if codec is nil.
+func encodeValue(codec Codec, v interface{}) (interface{}, error) {
+	if codec == nil {
+		return v, nil
+	}
+	return codec.Marshal(v)
+}
+
+// valueEqual reports whether the cached value v equals old.
+// if values are stored encoded by codec, old is encoded and compared byte by byte.
+func valueEqual(codec Codec, v, old interface{}) (bool, error) {
+	if codec == nil {
+		return reflect.DeepEqual(v, old), nil
+	}
+	b, err := codec.Marshal(old)
+	if err != nil {
+		return false, err
+	}
+	cur, ok := v.([]byte)
+	return ok && bytes.Equal(cur, b), nil
+}
@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testAtomicCache(t *testing.T, bm AtomicCache) {
+	timeout := 10 * time.Second
+	if n, err := bm.IncrBy("counter", 5); err != nil || n != 5 {
+		t.Error("IncrBy of missing key err", n, err)
+	}
+	if n, err := bm.IncrBy("counter", 3); err != nil || n != 8 {
+		t.Error("IncrBy err", n, err)
+	}
+	if n, err := bm.DecrBy("counter", 10); err != nil || n != -2 {
+		t.Error("DecrBy err", n, err)
+	}
+	bm.Put("name", "astaxie", timeout)
+	if _, err := bm.IncrBy("name", 1); err == nil {
+		t.Error("IncrBy of string should fail")
+	}
+
+	if ok, err := bm.SetNX("lock", "a", timeout); err != nil || !ok {
+		t.Error("SetNX of missing key err", ok, err)
+	}
+	if ok, err := bm.SetNX("lock", "b", timeout); err != nil || ok {
+		t.Error("SetNX of existing key should not set", ok, err)
+	}
+	var s string
+	if err := GetInto(bm, "lock", &s); err != nil || s != "a" {
+		t.Error("SetNX should keep the old value", s, err)
+	}
+
+	if ok, err := bm.CompareAndSwap("lock", "b", "c", timeout); err != nil || ok {
+		t.Error("CompareAndSwap with wrong old value should not set", ok, err)
+	}
+	if ok, err := bm.CompareAndSwap("lock", "a", "c", timeout); err != nil || !ok {
+		t.Error("CompareAndSwap err", ok, err)
+	}
+	if err := GetInto(bm, "lock", &s); err != nil || s != "c" {
+		t.Error("CompareAndSwap should set the new value", s, err)
+	}
+	if ok, err := bm.CompareAndSwap("none", "a", "c", timeout); err != nil || ok {
+		t.Error("CompareAndSwap of missing key should not set", ok, err)
+	}
+	if ok, err := bm.CompareAndDelete("lock", "a"); err != nil || ok {
+		t.Error("CompareAndDelete with wrong old value should not delete", ok, err)
+	}
+	if ok, err := bm.CompareAndDelete("lock", "c"); err != nil || !ok || bm.IsExist("lock") {
+		t.Error("CompareAndDelete err", ok, err)
+	}
+
+	bm.Put("expired", "a", time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if ok, err := bm.SetNX("expired", "b", timeout); err != nil || !ok {
+		t.Error("SetNX of expired key err", ok, err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bm.IncrBy("parallel", 1)
+		}()
+	}
+	wg.Wait()
+	if n, err := bm.IncrBy("parallel", 0); err != nil || n != 20 {
+		t.Error("IncrBy is not atomic", n, err)
+	}
+}
+
+func TestMemoryCacheAtomic(t *testing.T) {
+	bm, err := NewCache("memory", `{"interval":0}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	testAtomicCache(t, bm.(AtomicCache))
+
+	bm.Put("uint", uint(1), 0)
+	if _, err = bm.(AtomicCache).DecrBy("uint", 2); err == nil {
+		t.Error("DecrBy of uint below 0 should fail")
+	}
+}
+
+func TestMemoryCacheAtomicCodec(t *testing.T) {
+	bm, err := NewCache("memory", `{"interval":0,"codec":"json"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	testAtomicCache(t, bm.(AtomicCache))
+	testCodecIncr(t, bm)
+
+	sc, err := NewCache("shardedmemory", `{"interval":0,"codec":"json"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	testCodecIncr(t, sc)
+}
+
+// testCodecIncr checks Incr and Decr of a counter stored encoded by a codec.
+func testCodecIncr(t *testing.T, bm Cache) {
+	bm.Put("incr", 1, 0)
+	if err := bm.Incr("incr"); err != nil {
+		t.Error("Incr of encoded counter err", err)
+	}
+	if err := bm.Incr("incr"); err != nil {
+		t.Error("Incr of encoded counter err", err)
+	}
+	if err := bm.Decr("incr"); err != nil {
+		t.Error("Decr of encoded counter err", err)
+	}
+	var n int64
+	if err := GetInto(bm, "incr", &n); err != nil || n != 2 {
+		t.Error("Incr and Decr of encoded counter", n, err)
+	}
+	bm.Put("name", "astaxie", 0)
+	if err := bm.Incr("name"); err == nil {
+		t.Error("Incr of encoded string should fail")
+	}
+	if err := bm.Decr("none"); err != ErrCacheMiss {
+		t.Error("Decr of missing key", err)
+	}
+}
+
+func TestFileCacheAtomic(t *testing.T) {
+	bm, err := NewCache("file", `{"CachePath":"cache_atomic","FileSuffix":".bin","DirectoryLevel":2,"EmbedExpiry":0}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	defer os.RemoveAll("cache_atomic")
+	testAtomicCache(t, bm.(AtomicCache))
+}
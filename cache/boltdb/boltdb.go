@@ -0,0 +1,523 @@
+// Package boltdb for cache provider
+//
+// an embedded on-disk cache: the entries are kept in one bolt B+tree file with their expiry time,
+// and a background sweeper removes the expired ones.
+// it persists like the file adapter without a file per key, and needs no server like redis.
+//
+// depend on go.etcd.io/bbolt
+//
+// go install go.etcd.io/bbolt
+//
+// Usage:
+// import(
+//   _ "github.com/henrylee2cn/lessgoext/cache/boltdb"
+//   "github.com/henrylee2cn/lessgoext/cache"
+// )
+//
+//  bm, err := cache.NewCache("boltdb", `{"path":"data/cache.db","interval":"60"}`)
+package boltdb
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/henrylee2cn/lessgoext/cache"
+)
+
+var (
+	// DefaultPath is the database file if the config has no path.
+	DefaultPath = "cache.db"
+	// DefaultBucket is the bucket of the entries if the config has no bucket.
+	DefaultBucket = "cache"
+	// DefaultInterval is the period of the expiry sweeper in seconds.
+	DefaultInterval = 60
+	// OpenTimeout bounds the wait for a database file locked by another process.
+	OpenTimeout = time.Second
+)
+
+// sweepBatch is the number of expired entries removed by one write transaction,
+// so the sweeper does not hold the write lock for long.
+const sweepBatch = 1000
+
+var errNotInteger = errors.New("boltdb: value is not an integer")
+
+// Cache is bolt cache adapter.
+//
+// an entry is stored under its key as the expiry time in unix nanoseconds (8 bytes big endian, 0 means forever)
+// followed by the value, and indexed by expiry time and key in a second bucket for the sweeper.
+type Cache struct {
+	db       *bolt.DB
+	bucket   []byte // key -> expiry + value
+	expiry   []byte // expiry + key -> nothing
+	interval time.Duration
+	codec    cache.Codec // nil means values are gob encoded
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// value wraps the values gob encoded, so any registered type can be decoded back.
+type value struct {
+	Data interface{}
+}
+
+// NewBoltCache create new bolt cache with no config.
+// the database is opened in method StartAndGC.
+func NewBoltCache() cache.Cache {
+	return &Cache{}
+}
+
+// Get cache from bolt.
+// if non-existed or expired, return nil.
+func (bc *Cache) Get(key string) interface{} {
+	var v interface{}
+	bc.db.View(func(tx *bolt.Tx) error {
+		if payload := bc.get(tx, key); payload != nil {
+			v = bc.decode(payload)
+		}
+		return nil
+	})
+	return v
+}
+
+// GetMulti gets caches from bolt in one transaction.
+// if non-existed or expired, the value is nil.
+func (bc *Cache) GetMulti(keys []string) []interface{} {
+	rv := make([]interface{}, len(keys))
+	bc.db.View(func(tx *bolt.Tx) error {
+		for i, key := range keys {
+			if payload := bc.get(tx, key); payload != nil {
+				rv[i] = bc.decode(payload)
+			}
+		}
+		return nil
+	})
+	return rv
+}
+
+// Put cache to bolt.
+// timeout 0 means forever.
+// if a codec is configured, the value is stored encoded, read it back by cache.GetInto.
+// otherwise it is gob encoded, so gob.Register the custom types.
+func (bc *Cache) Put(key string, val interface{}, timeout time.Duration) error {
+	payload, err := bc.encode(val)
+	if err != nil {
+		return err
+	}
+	var exp int64
+	if timeout > 0 {
+		exp = time.Now().Add(timeout).UnixNano()
+	}
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		return bc.put(tx, key, exp, payload)
+	})
+}
+
+// Delete cache in bolt.
+func (bc *Cache) Delete(key string) error {
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		return bc.remove(tx, key)
+	})
+}
+
+// Incr increase counter in bolt, keeping its expiry time.
+// it supports int, int32, int64, uint, uint32 and uint64,
+// or the integers encoded by the codec if one is configured.
+func (bc *Cache) Incr(key string) error {
+	return bc.add(key, 1)
+}
+
+// Decr decrease counter in bolt, keeping its expiry time.
+func (bc *Cache) Decr(key string) error {
+	return bc.add(key, -1)
+}
+
+// IsExist check cache exist in bolt.
+func (bc *Cache) IsExist(key string) bool {
+	var ok bool
+	bc.db.View(func(tx *bolt.Tx) error {
+		ok = bc.get(tx, key) != nil
+		return nil
+	})
+	return ok
+}
+
+// ClearAll deletes all caches in bolt.
+func (bc *Cache) ClearAll() error {
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bc.bucket, bc.expiry} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Codec returns the codec of bolt cache, nil if values are gob encoded.
+func (bc *Cache) Codec() cache.Codec {
+	return bc.codec
+}
+
+// StartAndGC opens the database and starts the expiry sweeper.
+// config is like {"path":"cache.db","bucket":"cache","interval":"60"},
+// interval is the period of the sweeper in seconds, 0 disables it.
+// the optional codec, like {"codec":"json"}, encodes values by it instead of gob.
+func (bc *Cache) StartAndGC(config string) error {
+	var cf map[string]string
+	json.Unmarshal([]byte(config), &cf)
+	path := cf["path"]
+	if path == "" {
+		path = DefaultPath
+	}
+	bucket := cf["bucket"]
+	if bucket == "" {
+		bucket = DefaultBucket
+	}
+	interval := DefaultInterval
+	if v, ok := cf["interval"]; ok {
+		var err error
+		if interval, err = strconv.Atoi(v); err != nil {
+			return errors.New("boltdb: invalid interval " + strconv.Quote(v))
+		}
+	}
+	codec, err := cache.GetCodec(cf["codec"])
+	if err != nil {
+		return err
+	}
+	bc.bucket = []byte(bucket)
+	bc.expiry = []byte(bucket + ".expiry")
+	bc.interval = time.Duration(interval) * time.Second
+	bc.codec = codec
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if bc.db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: OpenTimeout}); err != nil {
+		return err
+	}
+	err = bc.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bc.bucket, bc.expiry} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = bc.sweep()
+	}
+	if err != nil {
+		bc.db.Close()
+		return err
+	}
+	if bc.interval > 0 {
+		bc.stop = make(chan struct{})
+		bc.done = make(chan struct{})
+		go bc.vacuum()
+	}
+	return nil
+}
+
+// Close stops the sweeper and closes the database.
+func (bc *Cache) Close() error {
+	if bc.stop != nil {
+		close(bc.stop)
+		<-bc.done
+		bc.stop = nil
+	}
+	return bc.db.Close()
+}
+
+// vacuum sweeps the expired entries every interval until Close.
+func (bc *Cache) vacuum() {
+	defer close(bc.done)
+	ticker := time.NewTicker(bc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bc.stop:
+			return
+		case <-ticker.C:
+			bc.sweep()
+		}
+	}
+}
+
+// sweep removes the expired entries, walking the expiry index from the oldest.
+func (bc *Cache) sweep() error {
+	for {
+		var n int
+		err := bc.db.Update(func(tx *bolt.Tx) error {
+			now := time.Now().UnixNano()
+			var expired [][]byte
+			c := tx.Bucket(bc.expiry).Cursor()
+			for k, _ := c.First(); k != nil && len(expired) < sweepBatch; k, _ = c.Next() {
+				if int64(binary.BigEndian.Uint64(k)) > now {
+					break
+				}
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			// a cursor skips items if they are deleted while iterating.
+			for _, k := range expired {
+				if err := tx.Bucket(bc.bucket).Delete(k[8:]); err != nil {
+					return err
+				}
+				if err := tx.Bucket(bc.expiry).Delete(k); err != nil {
+					return err
+				}
+			}
+			n = len(expired)
+			return nil
+		})
+		if err != nil || n < sweepBatch {
+			return err
+		}
+	}
+}
+
+// get returns the value of key in tx, nil if non-existed or expired.
+// it is valid during tx only.
+func (bc *Cache) get(tx *bolt.Tx, key string) []byte {
+	v := tx.Bucket(bc.bucket).Get([]byte(key))
+	if len(v) < 8 {
+		return nil
+	}
+	if exp := int64(binary.BigEndian.Uint64(v)); exp != 0 && exp <= time.Now().UnixNano() {
+		return nil
+	}
+	return v[8:]
+}
+
+// put stores payload as the value of key expiring at exp in tx, replacing the old one.
+func (bc *Cache) put(tx *bolt.Tx, key string, exp int64, payload []byte) error {
+	if err := bc.remove(tx, key); err != nil {
+		return err
+	}
+	v := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint64(v, uint64(exp))
+	copy(v[8:], payload)
+	if err := tx.Bucket(bc.bucket).Put([]byte(key), v); err != nil {
+		return err
+	}
+	if exp == 0 {
+		return nil
+	}
+	return tx.Bucket(bc.expiry).Put(indexKey(exp, key), []byte{})
+}
+
+// remove deletes key and its expiry index in tx.
+func (bc *Cache) remove(tx *bolt.Tx, key string) error {
+	b := tx.Bucket(bc.bucket)
+	v := b.Get([]byte(key))
+	if v == nil {
+		return nil
+	}
+	if exp := int64(binary.BigEndian.Uint64(v)); exp != 0 {
+		if err := tx.Bucket(bc.expiry).Delete(indexKey(exp, key)); err != nil {
+			return err
+		}
+	}
+	return b.Delete([]byte(key))
+}
+
+// indexKey returns the key of the expiry index of key.
+func indexKey(exp int64, key string) []byte {
+	k := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(k, uint64(exp))
+	copy(k[8:], key)
+	return k
+}
+
+// add adds n to the integer value of key, keeping its expiry time.
+func (bc *Cache) add(key string, n int64) error {
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		payload := bc.get(tx, key)
+		if payload == nil {
+			return cache.ErrCacheMiss
+		}
+		var v interface{}
+		if bc.codec != nil {
+			var i int64
+			if err := bc.codec.Unmarshal(payload, &i); err != nil {
+				return errNotInteger
+			}
+			v = i + n
+		} else {
+			var err error
+			if v, err = addInt(bc.decode(payload), n); err != nil {
+				return err
+			}
+		}
+		payload, err := bc.encode(v)
+		if err != nil {
+			return err
+		}
+		exp := int64(binary.BigEndian.Uint64(tx.Bucket(bc.bucket).Get([]byte(key))))
+		return bc.put(tx, key, exp, payload)
+	})
+}
+
+// addInt adds n to the integer v, keeping its type.
+func addInt(v interface{}, n int64) (interface{}, error) {
+	switch i := v.(type) {
+	case int:
+		return i + int(n), nil
+	case int32:
+		return i + int32(n), nil
+	case int64:
+		return i + n, nil
+	case uint, uint32, uint64:
+		u := toUint64(i)
+		if n < 0 && u < uint64(-n) {
+			return nil, errors.New("boltdb: unsigned value is less than 0")
+		}
+		u += uint64(n)
+		switch i.(type) {
+		case uint:
+			return uint(u), nil
+		case uint32:
+			return uint32(u), nil
+		}
+		return u, nil
+	}
+	return nil, errNotInteger
+}
+
+// toUint64 converts the unsigned integer v to uint64.
+func toUint64(v interface{}) uint64 {
+	switch u := v.(type) {
+	case uint:
+		return uint64(u)
+	case uint32:
+		return uint64(u)
+	case uint64:
+		return u
+	}
+	return 0
+}
+
+// encode encodes val by the codec if configured, or by gob.
+func (bc *Cache) encode(val interface{}) ([]byte, error) {
+	if bc.codec != nil {
+		return bc.codec.Marshal(val)
+	}
+	return cache.GobEncode(&value{val})
+}
+
+// decode decodes payload read in a transaction, returning nil if it is broken.
+// with a codec the encoded bytes are returned, copied out of the transaction.
+func (bc *Cache) decode(payload []byte) interface{} {
+	if bc.codec != nil {
+		return append([]byte(nil), payload...)
+	}
+	var v value
+	if err := cache.GobDecode(payload, &v); err != nil {
+		return nil
+	}
+	return v.Data
+}
+
+// CacheV2 is the cache.CacheV2 version of bolt cache adapter.
+// bolt has no deadline support, so ctx is only checked before each call.
+type CacheV2 struct {
+	*Cache
+}
+
+// NewBoltCacheV2 create new bolt cache.CacheV2 with no config.
+func NewBoltCacheV2() cache.CacheV2 {
+	return &CacheV2{NewBoltCache().(*Cache)}
+}
+
+// Get cache from bolt.
+// if non-existed or expired, return cache.ErrCacheMiss.
+func (bc *CacheV2) Get(ctx context.Context, key string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		payload := bc.get(tx, key)
+		if payload == nil {
+			return cache.ErrCacheMiss
+		}
+		v = bc.decode(payload)
+		return nil
+	})
+	return v, err
+}
+
+// GetMulti gets caches from bolt in one transaction.
+// if non-existed or expired, the value is nil.
+func (bc *CacheV2) GetMulti(ctx context.Context, keys []string) ([]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return bc.Cache.GetMulti(keys), nil
+}
+
+// Put cache to bolt.
+func (bc *CacheV2) Put(ctx context.Context, key string, val interface{}, timeout time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bc.Cache.Put(key, val, timeout)
+}
+
+// Delete cache in bolt.
+func (bc *CacheV2) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bc.Cache.Delete(key)
+}
+
+// Incr increase counter in bolt.
+// if non-existed or expired, return cache.ErrCacheMiss.
+func (bc *CacheV2) Incr(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bc.Cache.Incr(key)
+}
+
+// Decr decrease counter in bolt.
+// if non-existed or expired, return cache.ErrCacheMiss.
+func (bc *CacheV2) Decr(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bc.Cache.Decr(key)
+}
+
+// IsExist check cache exist in bolt.
+func (bc *CacheV2) IsExist(ctx context.Context, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return bc.Cache.IsExist(key), nil
+}
+
+// ClearAll deletes all caches in bolt.
+func (bc *CacheV2) ClearAll(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bc.Cache.ClearAll()
+}
+
+func init() {
+	cache.Register("boltdb", NewBoltCache)
+	cache.RegisterV2("boltdb", NewBoltCacheV2)
+}
@@ -0,0 +1,144 @@
+package boltdb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/henrylee2cn/lessgoext/cache"
+)
+
+func TestBoltCache(t *testing.T) {
+	defer os.RemoveAll("cache_bolt")
+	bm, err := cache.NewCache("boltdb", `{"path":"cache_bolt/cache.db","interval":"0"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	defer bm.(*Cache).Close()
+	timeoutDuration := 10 * time.Second
+	if err = bm.Put("astaxie", 1, timeoutDuration); err != nil {
+		t.Error("set Error", err)
+	}
+	if !bm.IsExist("astaxie") {
+		t.Error("check err")
+	}
+	if v := bm.Get("astaxie"); v.(int) != 1 {
+		t.Error("get err")
+	}
+
+	if err = bm.Incr("astaxie"); err != nil {
+		t.Error("Incr Error", err)
+	}
+	if v := bm.Get("astaxie"); v.(int) != 2 {
+		t.Error("get err")
+	}
+	if err = bm.Decr("astaxie"); err != nil {
+		t.Error("Decr Error", err)
+	}
+	if v := bm.Get("astaxie"); v.(int) != 1 {
+		t.Error("get err")
+	}
+	if err = bm.Incr("none"); err != cache.ErrCacheMiss {
+		t.Error("Incr of a missing key should miss", err)
+	}
+	bm.Delete("astaxie")
+	if bm.IsExist("astaxie") {
+		t.Error("delete err")
+	}
+
+	//test string
+	if err = bm.Put("astaxie", "author", timeoutDuration); err != nil {
+		t.Error("set Error", err)
+	}
+	if v := bm.Get("astaxie"); v.(string) != "author" {
+		t.Error("get err")
+	}
+
+	//test GetMulti
+	if err = bm.Put("astaxie1", "author1", timeoutDuration); err != nil {
+		t.Error("set Error", err)
+	}
+	vv := bm.GetMulti([]string{"astaxie", "none", "astaxie1"})
+	if len(vv) != 3 || vv[0].(string) != "author" || vv[1] != nil || vv[2].(string) != "author1" {
+		t.Error("GetMulti ERROR", vv)
+	}
+
+	// test clear all
+	if err = bm.ClearAll(); err != nil {
+		t.Error("clear all err")
+	}
+	if bm.IsExist("astaxie") {
+		t.Error("clear all err")
+	}
+}
+
+func TestBoltCacheExpiry(t *testing.T) {
+	defer os.RemoveAll("cache_bolt_expiry")
+	bm, err := cache.NewCache("boltdb", `{"path":"cache_bolt_expiry/cache.db","interval":"0"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	bc := bm.(*Cache)
+	defer bc.Close()
+	bc.Put("short", "a", 10*time.Millisecond)
+	bc.Put("long", "a", time.Minute)
+	bc.Put("forever", "a", 0)
+	bc.Put("short", "b", 20*time.Millisecond) // replaces the index entry too
+	time.Sleep(30 * time.Millisecond)
+	if bc.IsExist("short") || !bc.IsExist("long") || !bc.IsExist("forever") {
+		t.Error("expiry err")
+	}
+	if err = bc.sweep(); err != nil {
+		t.Error("sweep err", err)
+	}
+	bc.db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket(bc.bucket).Stats().KeyN; n != 2 {
+			t.Error("sweep should remove the expired entries", n)
+		}
+		if n := tx.Bucket(bc.expiry).Stats().KeyN; n != 1 {
+			t.Error("sweep should remove the expired index", n)
+		}
+		return nil
+	})
+}
+
+func TestBoltCachePersistence(t *testing.T) {
+	defer os.RemoveAll("cache_bolt_persist")
+	config := `{"path":"cache_bolt_persist/cache.db","interval":"1","codec":"json"}`
+	bm, err := cache.NewCache("boltdb", config)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	type user struct{ Name string }
+	bm.Put("user", user{"astaxie"}, time.Minute)
+	bm.Put("counter", 1, time.Minute)
+	if err = bm.Incr("counter"); err != nil {
+		t.Error("Incr err", err)
+	}
+	if err = bm.(*Cache).Close(); err != nil {
+		t.Error("close err", err)
+	}
+
+	// a restarted process reads the entries back.
+	bm, err = cache.NewCache("boltdb", config)
+	if err != nil {
+		t.Fatal("reopen err", err)
+	}
+	defer bm.(*Cache).Close()
+	var u user
+	if err = cache.GetInto(bm, "user", &u); err != nil || u.Name != "astaxie" {
+		t.Error("GetInto err", u, err)
+	}
+	var n int
+	if err = cache.GetInto(bm, "counter", &n); err != nil || n != 2 {
+		t.Error("counter err", n, err)
+	}
+
+	v2 := &CacheV2{bm.(*Cache)}
+	if _, err = v2.Get(context.Background(), "none"); err != cache.ErrCacheMiss {
+		t.Error("V2 Get should miss", err)
+	}
+}
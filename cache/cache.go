@@ -67,6 +67,47 @@ type Cache interface {
 	StartAndGC(config string) error
 }
 
+// TagCache is implemented by the adapters supporting bulk invalidation,
+// so entries of one user or tenant can be purged without ClearAll.
+// usage:
+//	tc := c.(cache.TagCache)
+//	tc.PutWithTags("user:1:profile", profile, time.Hour, "user:1")
+//	tc.InvalidateTag("user:1")   // deletes every key put with tag "user:1"
+//	tc.DeletePrefix("user:1:")   // deletes every key starts with "user:1:"
+type TagCache interface {
+	Cache
+	// set cached value with key, expire time and tags.
+	PutWithTags(key string, val interface{}, timeout time.Duration, tags ...string) error
+	// delete all cached values put with tag.
+	InvalidateTag(tag string) error
+	// delete all cached values whose key starts with prefix.
+	DeletePrefix(prefix string) error
+}
+
+// AtomicCache is implemented by the adapters supporting atomic counters and conditional writes,
+// the building blocks of rate limiters and locks.
+// usage:
+//	ac := c.(cache.AtomicCache)
+//	n, err := ac.IncrBy("hits", 10)                          // n is the new value
+//	ok, err := ac.SetNX("lock", "owner-1", 30*time.Second)   // ok if "lock" was absent
+//	ok, err = ac.CompareAndSwap("lock", "owner-1", "owner-2", 30*time.Second)
+type AtomicCache interface {
+	Cache
+	// add n to cached int value by key and return the new value,
+	// a missing key counts from 0 and is kept without expiry.
+	IncrBy(key string, n int64) (int64, error)
+	// subtract n from cached int value by key and return the new value.
+	DecrBy(key string, n int64) (int64, error)
+	// set cached value only if key does not exist, known as Add in memcache.
+	// it reports whether the value was set.
+	SetNX(key string, val interface{}, timeout time.Duration) (bool, error)
+	// set cached value to new only if it equals old, and report whether it was set.
+	// a missing key never equals old.
+	CompareAndSwap(key string, old, new interface{}, timeout time.Duration) (bool, error)
+	// delete cached value only if it equals old, and report whether it was deleted.
+	CompareAndDelete(key string, old interface{}) (bool, error)
+}
+
 // Instance is a function create a new Cache Instance
 type Instance func() Cache
 
@@ -166,3 +166,81 @@ func TestFileCache(t *testing.T) {
 
 	os.RemoveAll("cache")
 }
+
+func TestMemoryCacheEvict(t *testing.T) {
+	// lru: the least recently read key leaves first.
+	bm, err := NewCache("memory", `{"interval":0,"maxEntries":2,"policy":"lru"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	bm.Put("a", 1, 0)
+	bm.Put("b", 2, 0)
+	bm.Get("a")
+	bm.Put("c", 3, 0)
+	if !bm.IsExist("a") || bm.IsExist("b") || !bm.IsExist("c") {
+		t.Error("lru evict err")
+	}
+
+	// fifo: the oldest inserted key leaves first, reads don't matter.
+	bm, err = NewCache("memory", `{"interval":0,"maxEntries":2,"policy":"fifo"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	bm.Put("a", 1, 0)
+	bm.Put("b", 2, 0)
+	bm.Get("a")
+	bm.Put("c", 3, 0)
+	if bm.IsExist("a") || !bm.IsExist("b") || !bm.IsExist("c") {
+		t.Error("fifo evict err")
+	}
+
+	// lfu: the least read key leaves first.
+	bm, err = NewCache("memory", `{"interval":0,"maxEntries":2,"policy":"lfu"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	bm.Put("a", 1, 0)
+	bm.Put("b", 2, 0)
+	bm.Get("a")
+	bm.Get("a")
+	bm.Get("b")
+	bm.Put("c", 3, 0)
+	if !bm.IsExist("a") || bm.IsExist("b") || !bm.IsExist("c") {
+		t.Error("lfu evict err")
+	}
+
+	// maxBytes
+	bm, err = NewCache("memory", `{"interval":0,"maxBytes":20}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	bm.Put("a", "123456789", 0)
+	bm.Put("b", "123456789", 0)
+	bm.Put("c", "123456789", 0)
+	if bm.IsExist("a") || !bm.IsExist("b") || !bm.IsExist("c") {
+		t.Error("maxBytes evict err")
+	}
+	if err = bm.Put("d", "123456789012345678901", 0); err == nil {
+		t.Error("oversized item should be rejected")
+	}
+	bm.Delete("b")
+	bm.Put("d", "123456789", 0)
+	if !bm.IsExist("c") || !bm.IsExist("d") {
+		t.Error("maxBytes accounting err")
+	}
+
+	// an encoded counter grows with its digits.
+	bm, err = NewCache("memory", `{"interval":0,"maxBytes":100,"codec":"json"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	bm.Put("n", 9, 0)
+	bm.(AtomicCache).IncrBy("n", 991)
+	if mc := bm.(*MemoryCache); mc.usedBytes != int64(len("n1000")) {
+		t.Error("maxBytes incr accounting err", mc.usedBytes)
+	}
+
+	if _, err = NewCache("memory", `{"maxEntries":2,"policy":"random"}`); err == nil {
+		t.Error("unknown policy should fail")
+	}
+}
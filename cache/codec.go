@@ -0,0 +1,217 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// Codec encodes cache values into bytes and back.
+// an adapter configured with a codec stores every value encoded by it,
+// so a struct put into any backend comes back as the same struct by GetInto.
+type Codec interface {
+	// Marshal encodes v.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data into v, v must be a non-nil pointer.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Coder is implemented by the adapters which can be configured with a codec.
+// Codec returns nil if the adapter stores raw values.
+type Coder interface {
+	Codec() Codec
+}
+
+// Builtin codecs.
+var (
+	// GobCodec encodes values by encoding/gob.
+	GobCodec Codec = gobCodec{}
+	// JSONCodec encodes values by encoding/json.
+	// it keeps integers readable for backends like redis, so Incr and Decr still work.
+	JSONCodec Codec = jsonCodec{}
+	// MsgpackCodec encodes values in the compact MessagePack binary format.
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+var codecs = map[string]Codec{
+	"gob":     GobCodec,
+	"json":    JSONCodec,
+	"msgpack": MsgpackCodec,
+}
+
+// RegisterCodec makes a codec available by the name in adapter config, like {"codec":"name"}.
+// If RegisterCodec is called twice with the same name or if codec is nil,
+// it panics.
+func RegisterCodec(name string, codec Codec) {
+	if codec == nil {
+		panic("cache: RegisterCodec codec is nil")
+	}
+	if _, ok := codecs[name]; ok {
+		panic("cache: RegisterCodec called twice for codec " + name)
+	}
+	codecs[name] = codec
+}
+
+// GetCodec returns the codec registered by name.
+// empty name returns nil, which means no codec.
+func GetCodec(name string) (Codec, error) {
+	if name == "" {
+		return nil, nil
+	}
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("cache: unknown codec %q", name)
+	}
+	return codec, nil
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GetInto gets the value of key from c and stores it in the value pointed to by dst.
+// if c is configured with a codec, the stored bytes are decoded by it,
+// otherwise the raw value is assigned or converted to dst.
+// if non-existed or expired, return ErrCacheMiss.
+func GetInto(c Cache, key string, dst interface{}) error {
+	v, err := getValue(c, key)
+	if err != nil {
+		return err
+	}
+	return decodeInto(c, v, dst)
+}
+
+// getValue gets the value of key from c, ErrCacheMiss if non-existed or expired.
+func getValue(c Cache, key string) (interface{}, error) {
+	switch fc := c.(type) {
+	case *FileCache:
+		// file adapter returns "" on miss, which is a legal value too.
+		return (&FileCacheV2{fc}).Get(context.Background(), key)
+	}
+	if v := c.Get(key); v != nil {
+		return v, nil
+	}
+	return nil, ErrCacheMiss
+}
+
+// GetIntoContext is the CacheV2 version of GetInto.
+func GetIntoContext(ctx context.Context, c CacheV2, key string, dst interface{}) error {
+	v, err := c.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	return decodeInto(c, v, dst)
+}
+
+// decodeInto stores v got from adapter c into dst.
+func decodeInto(c interface{}, v interface{}, dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("cache: dst must be a non-nil pointer")
+	}
+	if cd, ok := c.(Coder); ok && cd.Codec() != nil {
+		switch b := v.(type) {
+		case []byte:
+			return cd.Codec().Unmarshal(b, dst)
+		case string:
+			return cd.Codec().Unmarshal([]byte(b), dst)
+		}
+	}
+	return assignValue(v, rv.Elem())
+}
+
+// assignValue assigns the raw value v to dst, converting between
+// numbers, strings and bytes if needed.
+func assignValue(v interface{}, dst reflect.Value) error {
+	sv := reflect.ValueOf(v)
+	if sv.Type().AssignableTo(dst.Type()) {
+		dst.Set(sv)
+		return nil
+	}
+	if isNumberKind(sv.Kind()) && isNumberKind(dst.Kind()) {
+		dst.Set(sv.Convert(dst.Type()))
+		return nil
+	}
+	s, ok := stringOf(v)
+	if !ok {
+		return fmt.Errorf("cache: can not assign %T to %s", v, dst.Type())
+	}
+	switch dst.Kind() {
+	case reflect.String:
+		dst.SetString(s)
+		return nil
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			dst.SetBytes([]byte(s))
+			return nil
+		}
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		dst.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, dst.Type().Bits())
+		if err != nil {
+			return err
+		}
+		dst.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, dst.Type().Bits())
+		if err != nil {
+			return err
+		}
+		dst.SetUint(u)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, dst.Type().Bits())
+		if err != nil {
+			return err
+		}
+		dst.SetFloat(f)
+		return nil
+	}
+	return fmt.Errorf("cache: can not assign %T to %s", v, dst.Type())
+}
+
+func stringOf(v interface{}) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case []byte:
+		return string(s), true
+	}
+	return "", false
+}
+
+func isNumberKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64 && k != reflect.Uintptr
+}
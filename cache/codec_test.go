@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type codecUser struct {
+	Name    string
+	Age     int
+	Score   float64
+	Tags    []string
+	Attrs   map[string]int
+	Avatar  []byte
+	Created time.Time
+	Friend  *codecUser
+	Skip    string `msgpack:"-"`
+}
+
+func newCodecUser() codecUser {
+	return codecUser{
+		Name:    "astaxie",
+		Age:     -300,
+		Score:   99.5,
+		Tags:    []string{"go", "cache"},
+		Attrs:   map[string]int{"level": 70000},
+		Avatar:  []byte{0, 1, 2},
+		Created: time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC),
+		Friend:  &codecUser{Name: "henrylee2cn", Age: 1 << 40},
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	want := newCodecUser()
+	for name, codec := range map[string]Codec{"gob": GobCodec, "json": JSONCodec, "msgpack": MsgpackCodec} {
+		b, err := codec.Marshal(want)
+		if err != nil {
+			t.Fatal(name, "marshal err", err)
+		}
+		var got codecUser
+		if err = codec.Unmarshal(b, &got); err != nil {
+			t.Fatal(name, "unmarshal err", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+
+	if _, err := GetCodec("none"); err == nil {
+		t.Error("unknown codec should fail")
+	}
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	b, err := MsgpackCodec.Marshal(map[string]interface{}{
+		"nil":   nil,
+		"bool":  true,
+		"neg":   -1,
+		"big":   uint64(1) << 63,
+		"list":  []interface{}{"a", 1.5},
+		"long":  string(make([]byte, 300)),
+		"small": int8(-100),
+	})
+	if err != nil {
+		t.Fatal("marshal err", err)
+	}
+	var got map[string]interface{}
+	if err = MsgpackCodec.Unmarshal(b, &got); err != nil {
+		t.Fatal("unmarshal err", err)
+	}
+	if got["nil"] != nil || got["bool"] != true || got["neg"] != int64(-1) ||
+		got["big"] != uint64(1)<<63 || got["small"] != int64(-100) || len(got["long"].(string)) != 300 {
+		t.Errorf("got %#v", got)
+	}
+	if list := got["list"].([]interface{}); list[0] != "a" || list[1] != 1.5 {
+		t.Errorf("got %#v", list)
+	}
+
+	var small int8
+	b, _ = MsgpackCodec.Marshal(1000)
+	if err = MsgpackCodec.Unmarshal(b, &small); err == nil {
+		t.Error("overflow should fail")
+	}
+	if err = MsgpackCodec.Unmarshal(b[:1], &small); err == nil {
+		t.Error("short data should fail")
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	want := newCodecUser()
+
+	// raw values are assigned or converted.
+	bm, _ := NewCache("memory", `{"interval":0}`)
+	bm.Put("user", want, 0)
+	bm.Put("num", "42", 0)
+	var got codecUser
+	if err := GetInto(bm, "user", &got); err != nil || !reflect.DeepEqual(got, want) {
+		t.Error("GetInto raw err", err)
+	}
+	var n int64
+	if err := GetInto(bm, "num", &n); err != nil || n != 42 {
+		t.Error("GetInto convert err", err)
+	}
+	if err := GetInto(bm, "none", &n); err != ErrCacheMiss {
+		t.Error("GetInto miss err", err)
+	}
+
+	// encoded values are decoded by the adapter's codec.
+	for _, c := range []struct{ adapter, config string }{
+		{"memory", `{"interval":0,"codec":"msgpack"}`},
+		{"shardedmemory", `{"interval":0,"codec":"json"}`},
+		{"file", `{"CachePath":"cache_codec","codec":"gob"}`},
+	} {
+		bm, err := NewCache(c.adapter, c.config)
+		if err != nil {
+			t.Fatal(c.adapter, "init err", err)
+		}
+		if err = bm.Put("user", want, 10*time.Second); err != nil {
+			t.Error(c.adapter, "set Error", err)
+		}
+		got = codecUser{}
+		if err = GetInto(bm, "user", &got); err != nil || !reflect.DeepEqual(got, want) {
+			t.Error(c.adapter, "GetInto err", err)
+		}
+		if err = GetInto(bm, "none", &got); err != ErrCacheMiss {
+			t.Error(c.adapter, "GetInto miss err", err)
+		}
+	}
+	os.RemoveAll("cache_codec")
+
+	// counters of file cache still work with a codec.
+	bm, _ = NewCache("file", `{"CachePath":"cache_codec","codec":"json"}`)
+	defer os.RemoveAll("cache_codec")
+	bm.Put("counter", 1, 0)
+	bm.Incr("counter")
+	var i int
+	if err := GetInto(bm, "counter", &i); err != nil || i != 2 {
+		t.Error("file Incr with codec err", err, i)
+	}
+}
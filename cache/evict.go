@@ -0,0 +1,228 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"reflect"
+)
+
+// Eviction policies supported by the memory adapter.
+const (
+	EvictLRU  = "lru"  // evict the least recently used item
+	EvictLFU  = "lfu"  // evict the least frequently used item
+	EvictFIFO = "fifo" // evict the oldest inserted item
+)
+
+// evictPolicy decides which key leaves the cache when it is full.
+// it is not safe for concurrent use, the caller must hold the lock.
+type evictPolicy interface {
+	// add records a newly inserted key.
+	add(key string)
+	// access records a read of key.
+	access(key string)
+	// remove forgets key.
+	remove(key string)
+	// victim returns the key which should be evicted next.
+	victim() (string, bool)
+}
+
+func newEvictPolicy(name string) (evictPolicy, error) {
+	switch name {
+	case "", EvictLRU:
+		return newListPolicy(true), nil
+	case EvictFIFO:
+		return newListPolicy(false), nil
+	case EvictLFU:
+		return newLFUPolicy(), nil
+	}
+	return nil, fmt.Errorf("cache: unknown eviction policy %q", name)
+}
+
+// listPolicy implements LRU and FIFO on a doubly linked list,
+// the front is the newest key and the back is the next victim.
+type listPolicy struct {
+	ll       *list.List
+	elements map[string]*list.Element
+	// moveOnAccess is true for LRU and false for FIFO.
+	moveOnAccess bool
+}
+
+func newListPolicy(moveOnAccess bool) *listPolicy {
+	return &listPolicy{
+		ll:           list.New(),
+		elements:     make(map[string]*list.Element),
+		moveOnAccess: moveOnAccess,
+	}
+}
+
+func (p *listPolicy) add(key string) {
+	if e, ok := p.elements[key]; ok {
+		p.ll.MoveToFront(e)
+		return
+	}
+	p.elements[key] = p.ll.PushFront(key)
+}
+
+func (p *listPolicy) access(key string) {
+	if !p.moveOnAccess {
+		return
+	}
+	if e, ok := p.elements[key]; ok {
+		p.ll.MoveToFront(e)
+	}
+}
+
+func (p *listPolicy) remove(key string) {
+	if e, ok := p.elements[key]; ok {
+		p.ll.Remove(e)
+		delete(p.elements, key)
+	}
+}
+
+func (p *listPolicy) victim() (string, bool) {
+	e := p.ll.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+// lfuEntry is the heap node of lfuPolicy.
+type lfuEntry struct {
+	key   string
+	hits  uint64
+	tick  uint64 // last access, breaks ties between equal hits
+	index int
+}
+
+// lfuPolicy implements LFU on a min-heap ordered by hits then by last access.
+type lfuPolicy struct {
+	entries lfuHeap
+	keys    map[string]*lfuEntry
+	tick    uint64
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{keys: make(map[string]*lfuEntry)}
+}
+
+func (p *lfuPolicy) add(key string) {
+	p.tick++
+	if e, ok := p.keys[key]; ok {
+		e.tick = p.tick
+		heap.Fix(&p.entries, e.index)
+		return
+	}
+	e := &lfuEntry{key: key, tick: p.tick}
+	p.keys[key] = e
+	heap.Push(&p.entries, e)
+}
+
+func (p *lfuPolicy) access(key string) {
+	e, ok := p.keys[key]
+	if !ok {
+		return
+	}
+	p.tick++
+	e.hits++
+	e.tick = p.tick
+	heap.Fix(&p.entries, e.index)
+}
+
+func (p *lfuPolicy) remove(key string) {
+	if e, ok := p.keys[key]; ok {
+		heap.Remove(&p.entries, e.index)
+		delete(p.keys, key)
+	}
+}
+
+func (p *lfuPolicy) victim() (string, bool) {
+	if len(p.entries) == 0 {
+		return "", false
+	}
+	return p.entries[0].key, true
+}
+
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].hits != h[j].hits {
+		return h[i].hits < h[j].hits
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
+
+// approxSize estimates how many bytes v holds in memory.
+// it is only used to enforce maxBytes, so exactness is not required.
+func approxSize(v interface{}) int64 {
+	switch x := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(len(x))
+	case []byte:
+		return int64(len(x))
+	}
+	return sizeOfValue(reflect.ValueOf(v), 0)
+}
+
+func sizeOfValue(v reflect.Value, depth int) int64 {
+	// stop walking deep or cyclic structures.
+	if depth > 8 {
+		return 0
+	}
+	switch v.Kind() {
+	case reflect.Invalid:
+		return 0
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		return int64(v.Type().Size()) + sizeOfValue(v.Elem(), depth+1)
+	case reflect.Slice, reflect.Array:
+		var n int64
+		for i := 0; i < v.Len(); i++ {
+			n += sizeOfValue(v.Index(i), depth+1)
+		}
+		return n
+	case reflect.Map:
+		var n int64
+		for _, k := range v.MapKeys() {
+			n += sizeOfValue(k, depth+1) + sizeOfValue(v.MapIndex(k), depth+1)
+		}
+		return n
+	case reflect.Struct:
+		var n int64
+		for i := 0; i < v.NumField(); i++ {
+			n += sizeOfValue(v.Field(i), depth+1)
+		}
+		return n
+	}
+	return int64(v.Type().Size())
+}
@@ -16,16 +16,22 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,6 +41,8 @@ type FileCacheItem struct {
 	Data       interface{}
 	Lastaccess time.Time
 	Expired    time.Time
+	Key        string   // original key, file names are hashed
+	Tags       []string // tags of PutWithTags
 }
 
 // FileCache Config
@@ -46,13 +54,28 @@ var (
 )
 
 // FileCache is cache adapter for file storage.
+// files are written to a temp file and renamed, so readers never see a partial file,
+// and the read-modify-write operations lock the key across the processes on one host.
 type FileCache struct {
 	CachePath      string
 	FileSuffix     string
 	DirectoryLevel int
 	EmbedExpiry    int
+	Interval       int   // seconds between sweeps of the expired files, 0 disables the sweeper
+	MaxBytes       int64 // quota of the cache files in bytes, 0 means unlimited
+	codec          Codec // nil means values are gob encoded as they are
+
+	usedBytes int64 // bytes of the cache files, recounted by every sweep
+	sweepMu   sync.Mutex
+	keyMu     [fileLockStripes]sync.Mutex
 }
 
+// fileLockDir is the directory under CachePath holding the key lock files.
+const fileLockDir = ".lock"
+
+// fileLockStripes is the number of key lock files, keys are spread over them by hash.
+const fileLockStripes = 256
+
 // NewFileCache Create new file cache with no config.
 // the level and expiry need set in method StartAndGC as config string.
 func NewFileCache() Cache {
@@ -62,6 +85,11 @@ func NewFileCache() Cache {
 
 // StartAndGC will start and begin gc for file cache.
 // the config need to be like {CachePath:"/cache","FileSuffix":".bin","DirectoryLevel":2,"EmbedExpiry":0}
+// the optional Interval, like {"Interval":"60"}, is the seconds between sweeps of the expired files,
+// it defaults to DefaultEvery and 0 disables the sweeper.
+// the optional MaxBytes, like {"MaxBytes":"1073741824"}, is a quota of the cache files,
+// once exceeded the oldest written files are removed.
+// the optional codec, like {"codec":"json"}, encodes values by it instead of gob with registered types.
 func (fc *FileCache) StartAndGC(config string) error {
 
 	var cfg map[string]string
@@ -78,12 +106,33 @@ func (fc *FileCache) StartAndGC(config string) error {
 	if _, ok := cfg["EmbedExpiry"]; !ok {
 		cfg["EmbedExpiry"] = strconv.FormatInt(int64(FileCacheEmbedExpiry.Seconds()), 10)
 	}
+	if _, ok := cfg["Interval"]; !ok {
+		cfg["Interval"] = strconv.Itoa(DefaultEvery)
+	}
+	if _, ok := cfg["MaxBytes"]; !ok {
+		cfg["MaxBytes"] = "0"
+	}
 	fc.CachePath = cfg["CachePath"]
 	fc.FileSuffix = cfg["FileSuffix"]
 	fc.DirectoryLevel, _ = strconv.Atoi(cfg["DirectoryLevel"])
 	fc.EmbedExpiry, _ = strconv.Atoi(cfg["EmbedExpiry"])
+	fc.Interval, _ = strconv.Atoi(cfg["Interval"])
+	fc.MaxBytes, _ = strconv.ParseInt(cfg["MaxBytes"], 10, 64)
+	if fc.MaxBytes < 0 {
+		return errors.New("MaxBytes must not be negative")
+	}
+	codec, err := GetCodec(cfg["codec"])
+	if err != nil {
+		return err
+	}
+	fc.codec = codec
 
 	fc.Init()
+	// count the bytes of the existing files.
+	if err = fc.sweep(); err != nil {
+		return err
+	}
+	go fc.vaccuum()
 	return nil
 }
 
@@ -94,11 +143,16 @@ func (fc *FileCache) Init() {
 	}
 }
 
-// get cached file name. it's md5 encoded.
-func (fc *FileCache) getCacheFileName(key string) string {
+// keyHash returns the md5 hex of key.
+func keyHash(key string) string {
 	m := md5.New()
 	io.WriteString(m, key)
-	keyMd5 := hex.EncodeToString(m.Sum(nil))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// get cached file name. it's md5 encoded.
+func (fc *FileCache) getCacheFileName(key string) string {
+	keyMd5 := keyHash(key)
 	cachePath := fc.CachePath
 	switch fc.DirectoryLevel {
 	case 2:
@@ -142,57 +196,258 @@ func (fc *FileCache) GetMulti(keys []string) []interface{} {
 // Put value into file cache.
 // timeout means how long to keep this file, unit of ms.
 // if timeout equals FileCacheEmbedExpiry(default is 0), cache this item forever.
+// if a codec is configured, the value is stored encoded, read it back by GetInto.
 func (fc *FileCache) Put(key string, val interface{}, timeout time.Duration) error {
-	gob.Register(val)
+	return fc.put(key, val, timeout, nil)
+}
 
-	item := FileCacheItem{Data: val}
+// PutWithTags puts value into file cache like Put, and tags it for InvalidateTag.
+func (fc *FileCache) PutWithTags(key string, val interface{}, timeout time.Duration, tags ...string) error {
+	return fc.put(key, val, timeout, tags)
+}
+
+func (fc *FileCache) put(key string, val interface{}, timeout time.Duration, tags []string) error {
+	if fc.codec != nil {
+		b, err := fc.codec.Marshal(val)
+		if err != nil {
+			return err
+		}
+		val = b
+	} else {
+		gob.Register(val)
+	}
+
+	item := FileCacheItem{Data: val, Key: key, Tags: tags}
 	if timeout == FileCacheEmbedExpiry {
 		item.Expired = time.Now().Add((86400 * 365 * 10) * time.Second) // ten years
 	} else {
 		item.Expired = time.Now().Add(timeout)
 	}
+	return fc.writeItem(&item)
+}
+
+// readItem reads the cached item of key, nil if non-exist or expired.
+func (fc *FileCache) readItem(key string) *FileCacheItem {
+	fileData, err := FileGetContents(fc.getCacheFileName(key))
+	if err != nil {
+		return nil
+	}
+	var item FileCacheItem
+	if GobDecode(fileData, &item) != nil || item.Expired.Before(time.Now()) {
+		return nil
+	}
+	return &item
+}
+
+// writeItem writes item to its cache file,
+// and sweeps the cache if it exceeds the quota.
+func (fc *FileCache) writeItem(item *FileCacheItem) error {
 	item.Lastaccess = time.Now()
 	data, err := GobEncode(item)
 	if err != nil {
 		return err
 	}
-	return FilePutContents(fc.getCacheFileName(key), data)
+	filename := fc.getCacheFileName(item.Key)
+	var oldSize int64
+	if info, err := os.Stat(filename); err == nil {
+		oldSize = info.Size()
+	}
+	if err = FilePutContents(filename, data); err != nil {
+		return err
+	}
+	used := atomic.AddInt64(&fc.usedBytes, int64(len(data))-oldSize)
+	if fc.MaxBytes > 0 && used > fc.MaxBytes {
+		return fc.sweep()
+	}
+	return nil
 }
 
 // Delete file cache value.
 func (fc *FileCache) Delete(key string) error {
-	filename := fc.getCacheFileName(key)
-	if ok, _ := exists(filename); ok {
-		return os.Remove(filename)
+	return fc.removeFile(fc.getCacheFileName(key))
+}
+
+// removeFile removes a cache file and uncounts its bytes.
+func (fc *FileCache) removeFile(filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err = os.Remove(filename); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
 	}
+	atomic.AddInt64(&fc.usedBytes, -info.Size())
 	return nil
 }
 
+// lockKey locks key against the other goroutines, and the other processes using CachePath
+// where flock is supported, until unlock is called.
+// keys are spread over fileLockStripes lock files, which are never removed.
+func (fc *FileCache) lockKey(key string) (unlock func(), err error) {
+	stripe := keyHash(key)[:2]
+	i, _ := strconv.ParseUint(stripe, 16, 8)
+	mu := &fc.keyMu[int(i)%fileLockStripes]
+	mu.Lock()
+	dir := filepath.Join(fc.CachePath, fileLockDir)
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		mu.Unlock()
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, stripe), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		mu.Unlock()
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+		mu.Unlock()
+	}, nil
+}
+
 // Incr will increase cached int value.
 // fc value is saving forever unless Delete.
 func (fc *FileCache) Incr(key string) error {
-	data := fc.Get(key)
+	unlock, err := fc.lockKey(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	data, ok := fc.getInt(key)
 	var incr int
-	if reflect.TypeOf(data).Name() != "int" {
+	if !ok {
 		incr = 0
 	} else {
-		incr = data.(int) + 1
+		incr = data + 1
 	}
-	fc.Put(key, incr, FileCacheEmbedExpiry)
-	return nil
+	return fc.Put(key, incr, FileCacheEmbedExpiry)
 }
 
 // Decr will decrease cached int value.
 func (fc *FileCache) Decr(key string) error {
-	data := fc.Get(key)
+	unlock, err := fc.lockKey(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	data, ok := fc.getInt(key)
 	var decr int
-	if reflect.TypeOf(data).Name() != "int" || data.(int)-1 <= 0 {
+	if !ok || data-1 <= 0 {
 		decr = 0
 	} else {
-		decr = data.(int) - 1
+		decr = data - 1
 	}
-	fc.Put(key, decr, FileCacheEmbedExpiry)
-	return nil
+	return fc.Put(key, decr, FileCacheEmbedExpiry)
+}
+
+// IncrBy adds n to cached integer value and returns the new value.
+// a missing or expired key counts from 0 as int64 and is kept forever.
+func (fc *FileCache) IncrBy(key string, n int64) (int64, error) {
+	unlock, err := fc.lockKey(key)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	item := fc.readItem(key)
+	if item == nil {
+		return n, fc.put(key, n, FileCacheEmbedExpiry, nil)
+	}
+	v, sum, err := addValue(fc.codec, item.Data, n)
+	if err != nil {
+		return 0, err
+	}
+	item.Data = v
+	return sum, fc.writeItem(item)
+}
+
+// DecrBy subtracts n from cached integer value and returns the new value.
+func (fc *FileCache) DecrBy(key string, n int64) (int64, error) {
+	return fc.IncrBy(key, -n)
+}
+
+// SetNX puts value into file cache only if key does not exist or is expired,
+// and reports whether it was put.
+func (fc *FileCache) SetNX(key string, val interface{}, timeout time.Duration) (bool, error) {
+	unlock, err := fc.lockKey(key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	if fc.readItem(key) != nil {
+		return false, nil
+	}
+	return true, fc.put(key, val, timeout, nil)
+}
+
+// CompareAndSwap puts new into file cache only if the cached value equals old,
+// and reports whether it was put. values are compared by reflect.DeepEqual,
+// or byte by byte if a codec is configured.
+func (fc *FileCache) CompareAndSwap(key string, old, new interface{}, timeout time.Duration) (bool, error) {
+	unlock, err := fc.lockKey(key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	item := fc.readItem(key)
+	if item == nil {
+		return false, nil
+	}
+	if ok, err := valueEqual(fc.codec, item.Data, old); !ok || err != nil {
+		return false, err
+	}
+	return true, fc.put(key, new, timeout, nil)
+}
+
+// CompareAndDelete deletes the cache file only if the cached value equals old,
+// and reports whether it was deleted.
+func (fc *FileCache) CompareAndDelete(key string, old interface{}) (bool, error) {
+	unlock, err := fc.lockKey(key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	item := fc.readItem(key)
+	if item == nil {
+		return false, nil
+	}
+	if ok, err := valueEqual(fc.codec, item.Data, old); !ok || err != nil {
+		return false, err
+	}
+	return true, fc.Delete(key)
+}
+
+// getInt returns the cached int value and whether it is an int.
+func (fc *FileCache) getInt(key string) (int, bool) {
+	data := fc.Get(key)
+	if fc.codec != nil {
+		b, ok := data.([]byte)
+		if !ok {
+			return 0, false
+		}
+		var i int
+		if fc.codec.Unmarshal(b, &i) != nil {
+			return 0, false
+		}
+		return i, true
+	}
+	i, ok := data.(int)
+	return i, ok
+}
+
+// Codec returns the codec of file cache, nil if values are gob encoded as they are.
+func (fc *FileCache) Codec() Codec {
+	return fc.codec
 }
 
 // IsExist check value is exist.
@@ -202,11 +457,177 @@ func (fc *FileCache) IsExist(key string) bool {
 }
 
 // ClearAll will clean cached files.
-// not implemented.
+// only the files with FileSuffix are removed, so CachePath may be shared.
 func (fc *FileCache) ClearAll() error {
+	return fc.walkFiles(func(path string, info os.FileInfo) error {
+		return fc.removeFile(path)
+	})
+}
+
+// vaccuum sweeps the cache every Interval seconds.
+func (fc *FileCache) vaccuum() {
+	if fc.Interval < 1 {
+		return
+	}
+	for {
+		<-time.After(time.Duration(fc.Interval) * time.Second)
+		fc.sweep()
+	}
+}
+
+// fileTempMaxAge is the age after which the sweeper removes a temp file left by a crashed writer.
+const fileTempMaxAge = time.Hour
+
+// sweep removes the expired files, and the oldest written files until the cache is
+// below 90% of MaxBytes if it exceeds the quota. it recounts the used bytes.
+func (fc *FileCache) sweep() error {
+	fc.sweepMu.Lock()
+	defer fc.sweepMu.Unlock()
+	type liveFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var (
+		live []liveFile
+		used int64
+		now  = time.Now()
+	)
+	err := filepath.Walk(fc.CachePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == fileLockDir && path != fc.CachePath {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.Contains(info.Name(), fileTempInfix) {
+			if now.Sub(info.ModTime()) > fileTempMaxAge {
+				os.Remove(path)
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, fc.FileSuffix) {
+			return nil
+		}
+		if info.Size() > 0 {
+			item, ok := readItemMeta(path)
+			if !ok {
+				return nil
+			}
+			if !item.Expired.Before(now) {
+				live = append(live, liveFile{path, info.Size(), info.ModTime()})
+				used += info.Size()
+				return nil
+			}
+		}
+		// expired, or an empty file created by reading a missing key in older versions.
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if fc.MaxBytes > 0 && used > fc.MaxBytes {
+		sort.Slice(live, func(i, j int) bool { return live[i].modTime.Before(live[j].modTime) })
+		target := fc.MaxBytes / 10 * 9
+		for _, f := range live {
+			if used <= target {
+				break
+			}
+			if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			used -= f.size
+		}
+	}
+	atomic.StoreInt64(&fc.usedBytes, used)
 	return nil
 }
 
+// InvalidateTag deletes all cached files put with tag.
+// it reads every cached file, so it is slow with many files.
+func (fc *FileCache) InvalidateTag(tag string) error {
+	return fc.removeItems(func(item *fileItemMeta) bool {
+		for _, t := range item.Tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// DeletePrefix deletes all cached files whose key starts with prefix.
+// it reads every cached file, so it is slow with many files.
+func (fc *FileCache) DeletePrefix(prefix string) error {
+	return fc.removeItems(func(item *fileItemMeta) bool {
+		return strings.HasPrefix(item.Key, prefix)
+	})
+}
+
+// fileItemMeta is FileCacheItem without Data,
+// decoding into it needs no gob registration of the data type.
+type fileItemMeta struct {
+	Lastaccess time.Time
+	Expired    time.Time
+	Key        string
+	Tags       []string
+}
+
+// walkFiles calls fn with every cache file under CachePath.
+func (fc *FileCache) walkFiles(fn func(path string, info os.FileInfo) error) error {
+	return filepath.Walk(fc.CachePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == fileLockDir && path != fc.CachePath {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, fc.FileSuffix) || strings.Contains(info.Name(), fileTempInfix) {
+			return nil
+		}
+		return fn(path, info)
+	})
+}
+
+// readItemMeta reads the meta of a cache file, false if it can not be read or decoded.
+func readItemMeta(path string) (*fileItemMeta, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var item fileItemMeta
+	if gob.NewDecoder(bytes.NewReader(data)).Decode(&item) != nil {
+		return nil, false
+	}
+	return &item, true
+}
+
+// removeItems removes the cached files matched by match.
+func (fc *FileCache) removeItems(match func(item *fileItemMeta) bool) error {
+	return fc.walkFiles(func(path string, info os.FileInfo) error {
+		item, ok := readItemMeta(path)
+		if !ok || !match(item) {
+			return nil
+		}
+		return fc.removeFile(path)
+	})
+}
+
 // check file exist.
 func exists(path string) (bool, error) {
 	_, err := os.Stat(path)
@@ -220,9 +641,9 @@ func exists(path string) (bool, error) {
 }
 
 // FileGetContents Get bytes to file.
-// if non-exist, create this file.
+// if non-exist, return the error.
 func FileGetContents(filename string) (data []byte, e error) {
-	f, e := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, os.ModePerm)
+	f, e := os.Open(filename)
 	if e != nil {
 		return
 	}
@@ -239,15 +660,30 @@ func FileGetContents(filename string) (data []byte, e error) {
 	return
 }
 
+// fileTempInfix is in the names of the temp files written by FilePutContents.
+const fileTempInfix = ".tmp"
+
 // FilePutContents Put bytes to file.
-// if non-exist, create this file.
+// the bytes are written to a temp file in the same directory which then replaces the file,
+// so a concurrent reader sees either the old or the new content.
 func FilePutContents(filename string, content []byte) error {
-	fp, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, os.ModePerm)
+	fp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+fileTempInfix)
 	if err != nil {
 		return err
 	}
-	defer fp.Close()
-	_, err = fp.Write(content)
+	tmp := fp.Name()
+	if _, err = fp.Write(content); err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
 	return err
 }
 
@@ -262,13 +698,116 @@ func GobEncode(data interface{}) ([]byte, error) {
 	return buf.Bytes(), err
 }
 
-// GobDecode Gob decodes file cache item.
-func GobDecode(data []byte, to *FileCacheItem) error {
+// GobDecode Gob decodes file cache item, or any value encoded by GobEncode.
+// to must be a pointer.
+func GobDecode(data []byte, to interface{}) error {
 	buf := bytes.NewBuffer(data)
 	dec := gob.NewDecoder(buf)
-	return dec.Decode(&to)
+	return dec.Decode(to)
+}
+
+// FileCacheV2 is the CacheV2 version of file adapter.
+type FileCacheV2 struct {
+	*FileCache
+}
+
+// NewFileCacheV2 Create new CacheV2 file cache with no config.
+func NewFileCacheV2() CacheV2 {
+	return &FileCacheV2{NewFileCache().(*FileCache)}
+}
+
+// Get value from file cache.
+// if non-exist or expired, return ErrCacheMiss.
+// if the file can not be read or decoded, return the error.
+func (fc *FileCacheV2) Get(ctx context.Context, key string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	filename := fc.getCacheFileName(key)
+	ok, err := exists(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	fileData, err := FileGetContents(filename)
+	if err != nil {
+		return nil, err
+	}
+	var to FileCacheItem
+	if err = GobDecode(fileData, &to); err != nil {
+		return nil, err
+	}
+	if to.Expired.Before(time.Now()) {
+		return nil, ErrCacheMiss
+	}
+	return to.Data, nil
+}
+
+// GetMulti gets values from file cache.
+// if non-exist or expired, the value is nil.
+func (fc *FileCacheV2) GetMulti(ctx context.Context, keys []string) ([]interface{}, error) {
+	rc := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		v, err := fc.Get(ctx, key)
+		if err != nil && err != ErrCacheMiss {
+			return nil, err
+		}
+		rc = append(rc, v)
+	}
+	return rc, nil
+}
+
+// Put value into file cache.
+func (fc *FileCacheV2) Put(ctx context.Context, key string, val interface{}, timeout time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fc.FileCache.Put(key, val, timeout)
+}
+
+// Delete file cache value.
+func (fc *FileCacheV2) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fc.FileCache.Delete(key)
+}
+
+// Incr will increase cached int value.
+func (fc *FileCacheV2) Incr(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fc.FileCache.Incr(key)
+}
+
+// Decr will decrease cached int value.
+func (fc *FileCacheV2) Decr(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fc.FileCache.Decr(key)
+}
+
+// IsExist check value is exist.
+func (fc *FileCacheV2) IsExist(ctx context.Context, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return exists(fc.getCacheFileName(key))
+}
+
+// ClearAll will clean cached files.
+func (fc *FileCacheV2) ClearAll(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fc.FileCache.ClearAll()
 }
 
 func init() {
 	Register("file", NewFileCache)
+	RegisterV2("file", NewFileCacheV2)
 }
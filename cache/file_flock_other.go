@@ -0,0 +1,19 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package cache
+
+import (
+	"os"
+)
+
+// lockFile does nothing where flock is not supported,
+// so keys are locked among the goroutines of one process only.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile does nothing where flock is not supported.
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFileCacheClearAll(t *testing.T) {
+	bm, err := NewCache("file", `{"CachePath":"cache_clear","FileSuffix":".bin","DirectoryLevel":2,"Interval":"0"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	defer os.RemoveAll("cache_clear")
+	ioutil.WriteFile(filepath.Join("cache_clear", "other.txt"), []byte("keep"), 0666)
+	bm.Put("a", "a", 10*time.Second)
+	bm.Put("b", "b", 10*time.Second)
+	if err = bm.ClearAll(); err != nil {
+		t.Error("ClearAll err", err)
+	}
+	if bm.IsExist("a") || bm.IsExist("b") {
+		t.Error("ClearAll should delete all cache files")
+	}
+	if _, err = os.Stat(filepath.Join("cache_clear", "other.txt")); err != nil {
+		t.Error("ClearAll should keep other files", err)
+	}
+	bm.Get("missing")
+	if bm.IsExist("missing") {
+		t.Error("Get should not create the file of a missing key")
+	}
+}
+
+func TestFileCacheSweep(t *testing.T) {
+	bm, err := NewCache("file", `{"CachePath":"cache_sweep","FileSuffix":".bin","DirectoryLevel":"1","Interval":"0","MaxBytes":"2000"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	defer os.RemoveAll("cache_sweep")
+	fc := bm.(*FileCache)
+
+	fc.Put("expired", "a", time.Millisecond)
+	fc.Put("kept", "a", 10*time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if err = fc.sweep(); err != nil {
+		t.Error("sweep err", err)
+	}
+	if fc.IsExist("expired") || !fc.IsExist("kept") {
+		t.Error("sweep should remove the expired files only")
+	}
+
+	value := strings.Repeat("x", 300)
+	for i := 0; i < 10; i++ {
+		if err = fc.Put(fmt.Sprintf("key%d", i), value, 10*time.Second); err != nil {
+			t.Error("set Error", err)
+		}
+		time.Sleep(5 * time.Millisecond) // order the modification times
+	}
+	if used := atomic.LoadInt64(&fc.usedBytes); used > fc.MaxBytes {
+		t.Error("quota exceeded", used)
+	}
+	if fc.IsExist("key0") || !fc.IsExist("key9") {
+		t.Error("quota should remove the oldest files")
+	}
+}
+
+func TestFileCacheMultiProcess(t *testing.T) {
+	// two FileCaches on one path stand for two processes, their keys are locked by flock.
+	config := `{"CachePath":"cache_multi","FileSuffix":".bin","DirectoryLevel":2,"Interval":"0"}`
+	defer os.RemoveAll("cache_multi")
+	var caches [2]AtomicCache
+	for i := range caches {
+		bm, err := NewCache("file", config)
+		if err != nil {
+			t.Fatal("init err", err)
+		}
+		caches[i] = bm.(AtomicCache)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(c AtomicCache) {
+			defer wg.Done()
+			if _, err := c.IncrBy("counter", 1); err != nil {
+				t.Error("IncrBy err", err)
+			}
+		}(caches[i%2])
+	}
+	wg.Wait()
+	if n, err := caches[0].IncrBy("counter", 0); err != nil || n != 20 {
+		t.Error("IncrBy is not atomic across caches", n, err)
+	}
+}
@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LoadFunc loads the value of a missed key, usually from the database.
+type LoadFunc func(key string) (interface{}, error)
+
+// Loader is a read-through wrapper of any Cache.
+// concurrent misses of the same key are collapsed into one call of LoadFunc,
+// so a hot key expiring under load hits the database only once per process.
+// usage:
+//	bm, _ := cache.NewCache("redis", `{"conn":":6039"}`)
+//	loader := cache.NewLoader(bm)
+//	loader.Stale = time.Minute // optional
+//	v, err := loader.GetOrLoad("user:1", 10*time.Minute, func(key string) (interface{}, error) {
+//		return queryUser(1)
+//	})
+type Loader struct {
+	Cache
+
+	// Stale is how long a value may still be served after its ttl,
+	// while it is being refreshed in the background.
+	// 0 means expired values are never served.
+	Stale time.Duration
+
+	// OnRefreshError is called when a background refresh fails.
+	// Optional.
+	OnRefreshError func(key string, err error)
+
+	mu    sync.Mutex
+	calls map[string]*loadCall
+}
+
+// loadCall is an in-flight or finished LoadFunc call.
+type loadCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// freshSuffix names the companion key which marks a value as fresh when Stale is set.
+// a key shared by several processes stays stale-aware across all of them.
+const freshSuffix = "#fresh"
+
+// NewLoader returns a Loader reading through c.
+func NewLoader(c Cache) *Loader {
+	return &Loader{
+		Cache: c,
+		calls: make(map[string]*loadCall),
+	}
+}
+
+// GetOrLoad returns the cached value of key.
+// on a miss it calls load, puts the result into the cache for ttl and returns it,
+// goroutines missing the same key meanwhile wait for that call instead of loading again.
+// if Stale is set, a value older than ttl is returned as it is
+// and refreshed by load in the background.
+func (l *Loader) GetOrLoad(key string, ttl time.Duration, load LoadFunc) (interface{}, error) {
+	if v, err := getValue(l.Cache, key); err == nil {
+		if l.Stale > 0 && !l.Cache.IsExist(key+freshSuffix) {
+			l.refresh(key, ttl, load)
+		}
+		return v, nil
+	}
+	return l.do(key, func() (interface{}, error) {
+		// another process may have filled it while we were waiting.
+		if v, err := getValue(l.Cache, key); err == nil && (l.Stale == 0 || l.Cache.IsExist(key+freshSuffix)) {
+			return v, nil
+		}
+		return l.load(key, ttl, load)
+	})
+}
+
+// load calls load and puts the result into the cache.
+func (l *Loader) load(key string, ttl time.Duration, load LoadFunc) (interface{}, error) {
+	v, err := load(key)
+	if err != nil {
+		return nil, err
+	}
+	if l.Stale > 0 {
+		if err = l.Cache.Put(key, v, ttl+l.Stale); err != nil {
+			return v, err
+		}
+		return v, l.Cache.Put(key+freshSuffix, "1", ttl)
+	}
+	return v, l.Cache.Put(key, v, ttl)
+}
+
+// refresh reloads key in the background, unless it is being loaded already.
+func (l *Loader) refresh(key string, ttl time.Duration, load LoadFunc) {
+	l.mu.Lock()
+	_, ok := l.calls[key]
+	l.mu.Unlock()
+	if ok {
+		return
+	}
+	go func() {
+		_, err := l.do(key, func() (interface{}, error) {
+			return l.load(key, ttl, load)
+		})
+		if err != nil && l.OnRefreshError != nil {
+			l.OnRefreshError(key, err)
+		}
+	}()
+}
+
+// do calls fn once for all concurrent callers of the same key.
+func (l *Loader) do(key string, fn func() (interface{}, error)) (val interface{}, err error) {
+	l.mu.Lock()
+	if c, ok := l.calls[key]; ok {
+		l.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := new(loadCall)
+	c.wg.Add(1)
+	l.calls[key] = c
+	l.mu.Unlock()
+
+	defer func() {
+		if p := recover(); p != nil {
+			c.val, c.err = nil, fmt.Errorf("cache: load %q panic: %v", key, p)
+			val, err = c.val, c.err
+		}
+		c.wg.Done()
+		l.mu.Lock()
+		delete(l.calls, key)
+		l.mu.Unlock()
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err
+}
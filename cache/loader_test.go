@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoaderGetOrLoad(t *testing.T) {
+	bm, _ := NewCache("memory", `{"interval":0}`)
+	loader := NewLoader(bm)
+
+	var loads int32
+	load := func(key string) (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(50 * time.Millisecond)
+		return "value of " + key, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := loader.GetOrLoad("astaxie", time.Minute, load)
+			if err != nil || v.(string) != "value of astaxie" {
+				t.Error("GetOrLoad err", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if loads != 1 {
+		t.Error("concurrent misses should load once, loaded", loads)
+	}
+	if v := bm.Get("astaxie"); v.(string) != "value of astaxie" {
+		t.Error("loaded value is not cached")
+	}
+
+	// errors and panics are returned and not cached.
+	if _, err := loader.GetOrLoad("err", time.Minute, func(string) (interface{}, error) {
+		return nil, errors.New("db down")
+	}); err == nil || bm.IsExist("err") {
+		t.Error("load error err", err)
+	}
+	if _, err := loader.GetOrLoad("panic", time.Minute, func(string) (interface{}, error) {
+		panic("boom")
+	}); err == nil {
+		t.Error("load panic err")
+	}
+}
+
+func TestLoaderStale(t *testing.T) {
+	bm, _ := NewCache("memory", `{"interval":0}`)
+	loader := NewLoader(bm)
+	loader.Stale = time.Minute
+
+	var loads int32
+	refreshed := make(chan struct{}, 1)
+	load := func(key string) (interface{}, error) {
+		n := atomic.AddInt32(&loads, 1)
+		if n > 1 {
+			defer func() { refreshed <- struct{}{} }()
+		}
+		return int(n), nil
+	}
+	if v, _ := loader.GetOrLoad("astaxie", 20*time.Millisecond, load); v.(int) != 1 {
+		t.Error("first load err", v)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// expired but within Stale: the old value is served and refreshed in the background.
+	if v, _ := loader.GetOrLoad("astaxie", 20*time.Millisecond, load); v.(int) != 1 {
+		t.Error("stale value err", v)
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("stale value is not refreshed")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if v, _ := loader.GetOrLoad("astaxie", 20*time.Millisecond, load); v.(int) != 2 {
+		t.Error("refreshed value err", v)
+	}
+}
@@ -0,0 +1,240 @@
+// Package lock provides distributed mutexes on top of the cache adapters.
+//
+// a lock is a cache key holding a random owner token for a ttl:
+// it is taken by SetNX, renewed by CompareAndSwap and released by CompareAndDelete,
+// so only the owner can renew or release it, and a crashed owner's lock expires.
+// on redis this is the single-instance Redlock algorithm (SET NX PX and lua scripts),
+// and on memory it locks within the process.
+//
+// ssdb has no conditional set or delete, so an expired owner could renew or release the lock of another process:
+// it is not a cache.AtomicCache and NewLocker refuses it, also when wrapped by cache/metrics.
+//
+// Usage:
+// import(
+//   "github.com/henrylee2cn/lessgoext/cache"
+//   "github.com/henrylee2cn/lessgoext/cache/lock"
+// )
+//
+//  bm, err := cache.NewCache("redis", `{"conn":"127.0.0.1:6379"}`)
+//  locker, err := lock.NewLocker(bm)
+//  err = locker.Run(ctx, "cron:report", 30*time.Second, func(ctx context.Context) error {
+//  	return buildReport(ctx)
+//  })
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/henrylee2cn/lessgoext/cache"
+)
+
+var (
+	// ErrNotObtained is returned when the lock is held by another owner.
+	ErrNotObtained = errors.New("lock: not obtained")
+	// ErrNotHeld is returned when renewing or releasing a lock which expired
+	// or was taken over by another owner.
+	ErrNotHeld = errors.New("lock: not held")
+
+	errTTL    = errors.New("lock: ttl is shorter than MinTTL")
+	errAtomic = errors.New("lock: cache adapter does not support atomic operations")
+)
+
+// MinTTL is the shortest ttl of a lock, shorter ones are eaten up by the clock drift.
+const MinTTL = 10 * time.Millisecond
+
+var (
+	// DefaultPrefix is prepended to the lock keys.
+	DefaultPrefix = "lock:"
+	// DefaultRetryDelay is the wait between the tries of Acquire.
+	DefaultRetryDelay = 100 * time.Millisecond
+)
+
+// Locker creates locks on a cache adapter.
+type Locker struct {
+	c cache.AtomicCache
+	// Prefix is prepended to the lock keys.
+	Prefix string
+	// RetryDelay is the wait between the tries of Acquire.
+	RetryDelay time.Duration
+}
+
+// NewLocker returns a Locker on c, which must implement cache.AtomicCache.
+// a wrapper like the one of cache/metrics is accepted only if the adapter it wraps implements it too.
+func NewLocker(c cache.Cache) (*Locker, error) {
+	ac, ok := c.(cache.AtomicCache)
+	if !ok {
+		return nil, errAtomic
+	}
+	for inner := c; ; {
+		w, ok := inner.(interface{ Unwrap() cache.Cache })
+		if !ok {
+			break
+		}
+		if inner = w.Unwrap(); !isAtomic(inner) {
+			return nil, errAtomic
+		}
+	}
+	return &Locker{
+		c:          ac,
+		Prefix:     DefaultPrefix,
+		RetryDelay: DefaultRetryDelay,
+	}, nil
+}
+
+// isAtomic reports whether c implements cache.AtomicCache.
+func isAtomic(c cache.Cache) bool {
+	_, ok := c.(cache.AtomicCache)
+	return ok
+}
+
+// Lock is an obtained lock.
+type Lock struct {
+	locker *Locker
+	key    string
+	token  string
+	until  time.Time
+}
+
+// Obtain tries to take the lock named key for ttl once.
+// it returns ErrNotObtained if the lock is held by another owner.
+func (lk *Locker) Obtain(key string, ttl time.Duration) (*Lock, error) {
+	if ttl < MinTTL {
+		return nil, errTTL
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	ok, err := lk.c.SetNX(lk.Prefix+key, token, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotObtained
+	}
+	l := &Lock{locker: lk, key: key, token: token}
+	if !l.extend(start, ttl) {
+		// the call took longer than ttl, the lock may be taken by another owner already.
+		l.Release()
+		return nil, ErrNotObtained
+	}
+	return l, nil
+}
+
+// Acquire takes the lock named key for ttl, retrying until ctx is done.
+func (lk *Locker) Acquire(ctx context.Context, key string, ttl time.Duration) (*Lock, error) {
+	for {
+		l, err := lk.Obtain(key, ttl)
+		if err != ErrNotObtained {
+			return l, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lk.RetryDelay):
+		}
+	}
+}
+
+// Run takes the lock named key, retrying until ctx is done, and calls fn while holding it.
+// the lock is renewed every ttl/3, if it is lost meanwhile the ctx of fn is canceled.
+// the lock is released after fn returns.
+func (lk *Locker) Run(ctx context.Context, key string, ttl time.Duration, fn func(ctx context.Context) error) error {
+	l, err := lk.Acquire(ctx, key, ttl)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if l.Refresh(ttl) != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	err = fn(ctx)
+	cancel()
+	<-done
+	if rerr := l.Release(); err == nil && rerr != ErrNotHeld {
+		err = rerr
+	}
+	return err
+}
+
+// Key returns the name of the lock.
+func (l *Lock) Key() string {
+	return l.key
+}
+
+// Token returns the random owner token of the lock.
+func (l *Lock) Token() string {
+	return l.token
+}
+
+// Until returns the time until which the lock is surely held,
+// it is ahead of the expiry in the cache by the allowed clock drift.
+func (l *Lock) Until() time.Time {
+	return l.until
+}
+
+// Refresh renews the lock for ttl from now.
+// it returns ErrNotHeld if the lock expired or was taken over by another owner.
+func (l *Lock) Refresh(ttl time.Duration) error {
+	if ttl < MinTTL {
+		return errTTL
+	}
+	start := time.Now()
+	ok, err := l.locker.c.CompareAndSwap(l.locker.Prefix+l.key, l.token, l.token, ttl)
+	if err != nil {
+		return err
+	}
+	if !ok || !l.extend(start, ttl) {
+		return ErrNotHeld
+	}
+	return nil
+}
+
+// Release releases the lock.
+// it returns ErrNotHeld if the lock expired or was taken over by another owner.
+func (l *Lock) Release() error {
+	ok, err := l.locker.c.CompareAndDelete(l.locker.Prefix+l.key, l.token)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotHeld
+	}
+	return nil
+}
+
+// extend sets the validity of the lock set at start for ttl, as Redlock computes it:
+// ttl minus the elapsed time and the clock drift. it reports whether any validity is left.
+func (l *Lock) extend(start time.Time, ttl time.Duration) bool {
+	drift := ttl/100 + 2*time.Millisecond
+	l.until = start.Add(ttl - drift)
+	return time.Now().Before(l.until)
+}
+
+// newToken returns a random owner token.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,144 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/lessgoext/cache"
+	"github.com/henrylee2cn/lessgoext/cache/metrics"
+)
+
+func newMemoryLocker(t *testing.T) *Locker {
+	bm, err := cache.NewCache("memory", `{"interval":0}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	lk, err := NewLocker(bm)
+	if err != nil {
+		t.Fatal("NewLocker err", err)
+	}
+	lk.RetryDelay = time.Millisecond
+	return lk
+}
+
+// plainCache hides the atomic operations of the adapter, like ssdb which has no conditional writes.
+type plainCache struct {
+	cache.Cache
+}
+
+func TestNewLocker(t *testing.T) {
+	bm, err := cache.NewCache("memory", `{"interval":0}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	if _, err = NewLocker(metrics.Wrap("lock_atomic", bm)); err != nil {
+		t.Error("NewLocker of wrapped atomic cache err", err)
+	}
+	if _, err = NewLocker(plainCache{bm}); err != errAtomic {
+		t.Error("NewLocker of non-atomic cache", err)
+	}
+	if _, err = NewLocker(metrics.Wrap("lock_plain", plainCache{bm})); err != errAtomic {
+		t.Error("NewLocker of wrapped non-atomic cache", err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	lk := newMemoryLocker(t)
+	l, err := lk.Obtain("job", time.Second)
+	if err != nil {
+		t.Fatal("Obtain err", err)
+	}
+	if _, err = lk.Obtain("job", time.Second); err != ErrNotObtained {
+		t.Error("Obtain of held lock should fail", err)
+	}
+	if err = l.Refresh(time.Second); err != nil {
+		t.Error("Refresh err", err)
+	}
+	if err = l.Release(); err != nil {
+		t.Error("Release err", err)
+	}
+	if err = l.Release(); err != ErrNotHeld {
+		t.Error("Release of released lock should fail", err)
+	}
+	if err = l.Refresh(time.Second); err != ErrNotHeld {
+		t.Error("Refresh of released lock should fail", err)
+	}
+
+	// an expired lock can be taken by another owner, and the old owner can not release it.
+	l, _ = lk.Obtain("job", 20*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	l2, err := lk.Obtain("job", time.Second)
+	if err != nil {
+		t.Fatal("Obtain of expired lock err", err)
+	}
+	if err = l.Release(); err != ErrNotHeld {
+		t.Error("Release by the old owner should fail", err)
+	}
+	if err = l2.Release(); err != nil {
+		t.Error("Release err", err)
+	}
+
+	if _, err = lk.Obtain("job", time.Millisecond); err == nil {
+		t.Error("ttl shorter than MinTTL should fail")
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	lk := newMemoryLocker(t)
+	l, _ := lk.Obtain("job", time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := lk.Acquire(ctx, "job", time.Second); err != context.DeadlineExceeded {
+		t.Error("Acquire of held lock should time out", err)
+	}
+	l.Release()
+	if _, err := lk.Acquire(context.Background(), "job", time.Second); err != nil {
+		t.Error("Acquire err", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	lk := newMemoryLocker(t)
+	var (
+		mu      sync.Mutex
+		running int
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := lk.Run(context.Background(), "job", 30*time.Millisecond, func(ctx context.Context) error {
+				mu.Lock()
+				running++
+				if running > 1 {
+					t.Error("lock is held by two owners")
+				}
+				mu.Unlock()
+				// outlive the ttl, the lock is renewed meanwhile.
+				time.Sleep(50 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return ctx.Err()
+			})
+			if err != nil {
+				t.Error("Run err", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	errJob := errors.New("job failed")
+	if err := lk.Run(context.Background(), "job", time.Second, func(context.Context) error {
+		return errJob
+	}); err != errJob {
+		t.Error("Run should return the error of fn", err)
+	}
+	if _, err := lk.Obtain("job", time.Second); err != nil {
+		t.Error("Run should release the lock", err)
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2014 beego Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memcache for cache provider
+//
+// depend on github.com/bradfitz/gomemcache/memcache
+//
+// go install github.com/bradfitz/gomemcache/memcache
+//
+// Usage:
+// import(
+//   _ "github.com/henrylee2cn/lessgo/cache/memcache"
+//   "github.com/henrylee2cn/lessgo/cache"
+// )
+//
+//  bm, err := cache.NewCache("memcache", `{"conn":"127.0.0.1:11211"}`)
+//
+// several servers are separated by ';', the keys are spread over them by consistent hashing:
+//  bm, err := cache.NewCache("memcache", `{"conn":"10.0.0.1:11211;10.0.0.2:11211"}`)
+//
+//  more docs http://beego.me/docs/module/cache.md
+package memcache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"github.com/henrylee2cn/lessgoext/cache"
+)
+
+// Cache Memcache adapter.
+type Cache struct {
+	conn     *memcache.Client
+	conninfo []string
+	codec    cache.Codec // nil means only string values are accepted
+}
+
+// NewMemCache create new memcache adapter.
+func NewMemCache() cache.Cache {
+	return &Cache{}
+}
+
+// Get get value from memcache.
+func (rc *Cache) Get(key string) interface{} {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return err
+		}
+	}
+	if item, err := rc.conn.Get(key); err == nil {
+		return string(item.Value)
+	}
+	return nil
+}
+
+// GetMulti get value from memcache.
+// the values are in the order of keys, nil if non-existed or expired.
+func (rc *Cache) GetMulti(keys []string) []interface{} {
+	size := len(keys)
+	var rv []interface{}
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			for i := 0; i < size; i++ {
+				rv = append(rv, err)
+			}
+			return rv
+		}
+	}
+	mv, err := rc.conn.GetMulti(keys)
+	if err == nil {
+		for _, key := range keys {
+			if item, ok := mv[key]; ok {
+				rv = append(rv, string(item.Value))
+			} else {
+				rv = append(rv, nil)
+			}
+		}
+		return rv
+	}
+	for i := 0; i < size; i++ {
+		rv = append(rv, err)
+	}
+	return rv
+}
+
+// Put put value to memcache. only support string.
+// if a codec is configured, any value is accepted and stored encoded,
+// read it back by cache.GetInto.
+func (rc *Cache) Put(key string, val interface{}, timeout time.Duration) error {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return err
+		}
+	}
+	if rc.codec != nil {
+		b, err := rc.codec.Marshal(val)
+		if err != nil {
+			return err
+		}
+		val = string(b)
+	}
+	v, ok := val.(string)
+	if !ok {
+		return errors.New("val must string")
+	}
+	item := memcache.Item{Key: key, Value: []byte(v), Expiration: expiration(timeout)}
+	return rc.conn.Set(&item)
+}
+
+// maxRelativeExpiration is the longest expiration memcache takes as relative to now,
+// a longer one is taken as a unix time.
+const maxRelativeExpiration = 30 * 24 * time.Hour
+
+// expiration converts timeout to the expiration time of an item.
+func expiration(timeout time.Duration) int32 {
+	if timeout > maxRelativeExpiration {
+		return int32(time.Now().Add(timeout).Unix())
+	}
+	return int32(timeout / time.Second)
+}
+
+// Delete delete value in memcache.
+func (rc *Cache) Delete(key string) error {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return err
+		}
+	}
+	return rc.conn.Delete(key)
+}
+
+// Incr increase counter, atomically by the server.
+// the value must be the decimal string of an unsigned integer.
+func (rc *Cache) Incr(key string) error {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return err
+		}
+	}
+	_, err := rc.conn.Increment(key, 1)
+	return err
+}
+
+// Decr decrease counter, atomically by the server.
+// memcache never decreases a counter below 0.
+func (rc *Cache) Decr(key string) error {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return err
+		}
+	}
+	_, err := rc.conn.Decrement(key, 1)
+	return err
+}
+
+// IsExist check value exists in memcache.
+func (rc *Cache) IsExist(key string) bool {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return false
+		}
+	}
+	_, err := rc.conn.Get(key)
+	if err != nil {
+		return false
+	}
+	return true
+}
+
+// ClearAll clear all cached in memcache.
+func (rc *Cache) ClearAll() error {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return err
+		}
+	}
+	return rc.conn.FlushAll()
+}
+
+// StartAndGC start memcache adapter.
+// config string is like {"conn":"connection info"},
+// several servers are separated by ';' and the keys are spread over them by consistent hashing.
+// the optional codec, like {"codec":"json"}, lets Put accept any value.
+// if connecting error, return.
+func (rc *Cache) StartAndGC(config string) error {
+	var cf map[string]string
+	json.Unmarshal([]byte(config), &cf)
+	if _, ok := cf["conn"]; !ok {
+		return errors.New("config has no conn key")
+	}
+	rc.conninfo = strings.Split(cf["conn"], ";")
+	codec, err := cache.GetCodec(cf["codec"])
+	if err != nil {
+		return err
+	}
+	rc.codec = codec
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Codec returns the codec of the adapter, nil if only string values are accepted.
+func (rc *Cache) Codec() cache.Codec {
+	return rc.codec
+}
+
+// connect to memcache and keep the connection.
+func (rc *Cache) connectInit() error {
+	r, err := newRing(rc.conninfo...)
+	if err != nil {
+		return err
+	}
+	rc.conn = memcache.NewFromSelector(r)
+	return nil
+}
+
+// CacheV2 is the cache.CacheV2 version of Memcache adapter.
+// the memcache client has no deadline support, so ctx is only checked before each call.
+type CacheV2 struct {
+	*Cache
+}
+
+// NewMemCacheV2 create new memcache cache.CacheV2 adapter.
+func NewMemCacheV2() cache.CacheV2 {
+	return &CacheV2{NewMemCache().(*Cache)}
+}
+
+// check returns the error of ctx, and connects to memcache if not connected yet.
+func (rc *CacheV2) check(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if rc.conn == nil {
+		return rc.connectInit()
+	}
+	return nil
+}
+
+// convertErr maps the client's miss error to cache.ErrCacheMiss.
+func convertErr(err error) error {
+	if err == memcache.ErrCacheMiss {
+		return cache.ErrCacheMiss
+	}
+	return err
+}
+
+// Get get value from memcache.
+// if non-existed or expired, return cache.ErrCacheMiss.
+func (rc *CacheV2) Get(ctx context.Context, key string) (interface{}, error) {
+	if err := rc.check(ctx); err != nil {
+		return nil, err
+	}
+	item, err := rc.conn.Get(key)
+	if err != nil {
+		return nil, convertErr(err)
+	}
+	return string(item.Value), nil
+}
+
+// GetMulti get values from memcache.
+// if non-existed or expired, the value is nil.
+func (rc *CacheV2) GetMulti(ctx context.Context, keys []string) ([]interface{}, error) {
+	if err := rc.check(ctx); err != nil {
+		return nil, err
+	}
+	mv, err := rc.conn.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if item, ok := mv[key]; ok {
+			rv[i] = string(item.Value)
+		}
+	}
+	return rv, nil
+}
+
+// Put put value to memcache. only support string.
+func (rc *CacheV2) Put(ctx context.Context, key string, val interface{}, timeout time.Duration) error {
+	if err := rc.check(ctx); err != nil {
+		return err
+	}
+	return rc.Cache.Put(key, val, timeout)
+}
+
+// Delete delete value in memcache.
+func (rc *CacheV2) Delete(ctx context.Context, key string) error {
+	if err := rc.check(ctx); err != nil {
+		return err
+	}
+	return convertErr(rc.conn.Delete(key))
+}
+
+// Incr increase counter.
+func (rc *CacheV2) Incr(ctx context.Context, key string) error {
+	if err := rc.check(ctx); err != nil {
+		return err
+	}
+	_, err := rc.conn.Increment(key, 1)
+	return convertErr(err)
+}
+
+// Decr decrease counter.
+func (rc *CacheV2) Decr(ctx context.Context, key string) error {
+	if err := rc.check(ctx); err != nil {
+		return err
+	}
+	_, err := rc.conn.Decrement(key, 1)
+	return convertErr(err)
+}
+
+// IsExist check value exists in memcache.
+func (rc *CacheV2) IsExist(ctx context.Context, key string) (bool, error) {
+	if err := rc.check(ctx); err != nil {
+		return false, err
+	}
+	_, err := rc.conn.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ClearAll clear all cached in memcache.
+func (rc *CacheV2) ClearAll(ctx context.Context) error {
+	if err := rc.check(ctx); err != nil {
+		return err
+	}
+	return rc.conn.FlushAll()
+}
+
+func init() {
+	cache.Register("memcache", NewMemCache)
+	cache.RegisterV2("memcache", NewMemCacheV2)
+}
@@ -0,0 +1,197 @@
+// Copyright 2014 beego Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memcache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/lessgoext/cache"
+	"github.com/henrylee2cn/lessgoext/cache/memcache/memcachetest"
+)
+
+func TestMemcacheCache(t *testing.T) {
+	srv, err := memcachetest.NewServer()
+	if err != nil {
+		t.Fatal("memcached stand-in err", err)
+	}
+	defer srv.Close()
+	bm, err := cache.NewCache("memcache", `{"conn": "`+srv.Addr()+`"}`)
+	if err != nil {
+		t.Error("init err")
+	}
+	timeoutDuration := 10 * time.Second
+	if err = bm.Put("astaxie", "1", timeoutDuration); err != nil {
+		t.Error("set Error", err)
+	}
+	if !bm.IsExist("astaxie") {
+		t.Error("check err")
+	}
+
+	time.Sleep(11 * time.Second)
+
+	if bm.IsExist("astaxie") {
+		t.Error("check err")
+	}
+	if err = bm.Put("astaxie", "1", timeoutDuration); err != nil {
+		t.Error("set Error", err)
+	}
+
+	if v, err := strconv.Atoi(bm.Get("astaxie").(string)); err != nil || v != 1 {
+		t.Error("get err")
+	}
+
+	if err = bm.Incr("astaxie"); err != nil {
+		t.Error("Incr Error", err)
+	}
+
+	if v, err := strconv.Atoi(bm.Get("astaxie").(string)); err != nil || v != 2 {
+		t.Error("get err")
+	}
+
+	if err = bm.Decr("astaxie"); err != nil {
+		t.Error("Decr Error", err)
+	}
+
+	if v, err := strconv.Atoi(bm.Get("astaxie").(string)); err != nil || v != 1 {
+		t.Error("get err")
+	}
+	bm.Delete("astaxie")
+	if bm.IsExist("astaxie") {
+		t.Error("delete err")
+	}
+
+	//test string
+	if err = bm.Put("astaxie", "author", timeoutDuration); err != nil {
+		t.Error("set Error", err)
+	}
+	if !bm.IsExist("astaxie") {
+		t.Error("check err")
+	}
+
+	if v := bm.Get("astaxie").(string); v != "author" {
+		t.Error("get err")
+	}
+
+	//test GetMulti
+	if err = bm.Put("astaxie1", "author1", timeoutDuration); err != nil {
+		t.Error("set Error", err)
+	}
+	if !bm.IsExist("astaxie1") {
+		t.Error("check err")
+	}
+
+	vv := bm.GetMulti([]string{"astaxie", "astaxie1"})
+	if len(vv) != 2 {
+		t.Error("GetMulti ERROR")
+	}
+	if vv[0].(string) != "author" {
+		t.Error("GetMulti ERROR")
+	}
+	if vv[1].(string) != "author1" {
+		t.Error("GetMulti ERROR")
+	}
+	if vv = bm.GetMulti([]string{"none", "astaxie"}); vv[0] != nil || vv[1] != "author" {
+		t.Error("GetMulti should keep the order of keys", vv)
+	}
+
+	// test clear all
+	if err = bm.ClearAll(); err != nil {
+		t.Error("clear all err")
+	}
+}
+
+func TestMemcacheMultiServer(t *testing.T) {
+	var servers []*memcachetest.Server
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		srv, err := memcachetest.NewServer()
+		if err != nil {
+			t.Fatal("memcached stand-in err", err)
+		}
+		defer srv.Close()
+		servers = append(servers, srv)
+		addrs = append(addrs, srv.Addr())
+	}
+	bm, err := cache.NewCache("memcache", `{"conn":"`+strings.Join(addrs, ";")+`"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		if err = bm.Put(keys[i], strconv.Itoa(i), time.Minute); err != nil {
+			t.Error("set Error", err)
+		}
+	}
+	for _, srv := range servers {
+		if n := len(srv.Keys()); n < 10 {
+			t.Error("keys should be spread over the servers", n)
+		}
+	}
+	for i, v := range bm.GetMulti(keys) {
+		if v != strconv.Itoa(i) {
+			t.Error("GetMulti err", i, v)
+		}
+	}
+	if err = bm.Incr("key1"); err != nil {
+		t.Error("Incr err", err)
+	}
+	if v := bm.Get("key1"); v != "2" {
+		t.Error("Incr err", v)
+	}
+	if err = bm.ClearAll(); err != nil {
+		t.Error("ClearAll err", err)
+	}
+	for _, srv := range servers {
+		if keys := srv.Keys(); len(keys) != 0 {
+			t.Error("ClearAll should flush every server", keys)
+		}
+	}
+}
+
+func TestRing(t *testing.T) {
+	r3, err := newRing("10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211")
+	if err != nil {
+		t.Fatal("newRing err", err)
+	}
+	r4, err := newRing("10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211", "10.0.0.4:11211")
+	if err != nil {
+		t.Fatal("newRing err", err)
+	}
+	const n = 10000
+	moved := 0
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%d", i)
+		a3, _ := r3.PickServer(key)
+		a4, _ := r4.PickServer(key)
+		if a3.String() != a4.String() {
+			if a4.String() != "10.0.0.4:11211" {
+				t.Fatal("a key moved between the old servers", key)
+			}
+			moved++
+		}
+	}
+	// the new server takes about a quarter of the keys.
+	if moved < n/8 || moved > n*3/8 {
+		t.Error("unbalanced ring", moved)
+	}
+	if _, err = (&ring{}).PickServer("a"); err == nil {
+		t.Error("an empty ring should fail")
+	}
+}
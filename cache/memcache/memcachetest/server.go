@@ -0,0 +1,334 @@
+// Package memcachetest provides an in-process memcached server for tests.
+//
+// it speaks the memcached text protocol: get, gets, set, add, replace, append, prepend,
+// cas, delete, incr, decr, touch, flush_all, version and quit.
+//
+// Usage:
+//
+//	srv, err := memcachetest.NewServer()
+//	defer srv.Close()
+//	bm, err := cache.NewCache("memcache", `{"conn":"`+srv.Addr()+`"}`)
+package memcachetest
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// relativeLimit is the largest expiration time in seconds taken as relative to now,
+// larger ones are unix times.
+const relativeLimit = 60 * 60 * 24 * 30
+
+// Server is an in-process memcached server.
+type Server struct {
+	ln net.Listener
+
+	mu     sync.Mutex
+	items  map[string]*item
+	casID  uint64
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+type item struct {
+	value  []byte
+	flags  uint32
+	cas    uint64
+	expire time.Time // zero means forever
+}
+
+// NewServer starts a server on a random port of 127.0.0.1.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:    ln,
+		items: make(map[string]*item),
+		conns: make(map[net.Conn]struct{}),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and closes all connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	return s.ln.Close()
+}
+
+// Keys returns the live keys, sorted.
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.items))
+	for key := range s.items {
+		if s.lookup(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			rw.WriteString("ERROR\r\n")
+		} else if args[0] == "quit" {
+			return
+		} else if err = s.exec(rw, args); err != nil {
+			return
+		}
+		if err = rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// exec runs a command and writes its response,
+// it returns an error only if the connection broke.
+func (s *Server) exec(rw *bufio.ReadWriter, args []string) error {
+	switch args[0] {
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return s.store(rw, args)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch args[0] {
+	case "get", "gets":
+		if len(args) < 2 {
+			rw.WriteString("ERROR\r\n")
+			return nil
+		}
+		for _, key := range args[1:] {
+			it := s.lookup(key)
+			if it == nil {
+				continue
+			}
+			rw.WriteString("VALUE " + key + " " + strconv.FormatUint(uint64(it.flags), 10) + " " + strconv.Itoa(len(it.value)))
+			if args[0] == "gets" {
+				rw.WriteString(" " + strconv.FormatUint(it.cas, 10))
+			}
+			rw.WriteString("\r\n")
+			rw.Write(it.value)
+			rw.WriteString("\r\n")
+		}
+		rw.WriteString("END\r\n")
+	case "delete":
+		if len(args) < 2 {
+			rw.WriteString("ERROR\r\n")
+		} else if s.lookup(args[1]) == nil {
+			rw.WriteString("NOT_FOUND\r\n")
+		} else {
+			delete(s.items, args[1])
+			rw.WriteString("DELETED\r\n")
+		}
+	case "incr", "decr":
+		if len(args) < 3 {
+			rw.WriteString("ERROR\r\n")
+			return nil
+		}
+		delta, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			rw.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+			return nil
+		}
+		it := s.lookup(args[1])
+		if it == nil {
+			rw.WriteString("NOT_FOUND\r\n")
+			return nil
+		}
+		n, err := strconv.ParseUint(string(it.value), 10, 64)
+		if err != nil {
+			rw.WriteString("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+			return nil
+		}
+		if args[0] == "incr" {
+			n += delta // wraps around like memcached
+		} else if delta > n {
+			n = 0 // memcached never decrements below 0
+		} else {
+			n -= delta
+		}
+		it.value = []byte(strconv.FormatUint(n, 10))
+		it.cas = s.nextCAS()
+		rw.WriteString(string(it.value) + "\r\n")
+	case "touch":
+		if len(args) < 3 {
+			rw.WriteString("ERROR\r\n")
+			return nil
+		}
+		exp, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			rw.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return nil
+		}
+		it := s.lookup(args[1])
+		if it == nil {
+			rw.WriteString("NOT_FOUND\r\n")
+			return nil
+		}
+		it.expire = expireTime(exp)
+		rw.WriteString("TOUCHED\r\n")
+	case "flush_all":
+		s.items = make(map[string]*item)
+		rw.WriteString("OK\r\n")
+	case "version":
+		rw.WriteString("VERSION 1.6.0-memcachetest\r\n")
+	default:
+		rw.WriteString("ERROR\r\n")
+	}
+	return nil
+}
+
+// store runs a storage command: <cmd> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+func (s *Server) store(rw *bufio.ReadWriter, args []string) error {
+	n := 5
+	if args[0] == "cas" {
+		n = 6
+	}
+	if len(args) < n {
+		rw.WriteString("ERROR\r\n")
+		return nil
+	}
+	flags, err1 := strconv.ParseUint(args[2], 10, 32)
+	exp, err2 := strconv.ParseInt(args[3], 10, 64)
+	size, err3 := strconv.Atoi(args[4])
+	var cas uint64
+	var err4 error
+	if args[0] == "cas" {
+		cas, err4 = strconv.ParseUint(args[5], 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 {
+		rw.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(rw, data); err != nil {
+		return err
+	}
+	if string(data[size:]) != "\r\n" {
+		rw.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return nil
+	}
+	value := data[:size]
+	noreply := args[len(args)-1] == "noreply"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.lookup(args[1])
+	reply := "STORED"
+	switch args[0] {
+	case "add":
+		if old != nil {
+			reply = "NOT_STORED"
+		}
+	case "replace", "append", "prepend":
+		if old == nil {
+			reply = "NOT_STORED"
+		}
+	case "cas":
+		if old == nil {
+			reply = "NOT_FOUND"
+		} else if old.cas != cas {
+			reply = "EXISTS"
+		}
+	}
+	if reply == "STORED" {
+		it := &item{value: value, flags: uint32(flags), expire: expireTime(exp)}
+		switch args[0] {
+		case "append":
+			it = old
+			it.value = append(append([]byte(nil), old.value...), value...)
+		case "prepend":
+			it = old
+			it.value = append(append([]byte(nil), value...), old.value...)
+		}
+		it.cas = s.nextCAS()
+		s.items[args[1]] = it
+	}
+	if !noreply {
+		rw.WriteString(reply + "\r\n")
+	}
+	return nil
+}
+
+// lookup returns the live item of key, removing it if expired.
+func (s *Server) lookup(key string) *item {
+	it, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	if !it.expire.IsZero() && !time.Now().Before(it.expire) {
+		delete(s.items, key)
+		return nil
+	}
+	return it
+}
+
+func (s *Server) nextCAS() uint64 {
+	s.casID++
+	return s.casID
+}
+
+// expireTime converts an expiration time of the protocol.
+// 0 means forever, up to 30 days it is relative, beyond it is a unix time, negative means expired.
+func expireTime(exp int64) time.Time {
+	switch {
+	case exp == 0:
+		return time.Time{}
+	case exp < 0:
+		return time.Unix(0, 0)
+	case exp <= relativeLimit:
+		return time.Now().Add(time.Duration(exp) * time.Second)
+	}
+	return time.Unix(exp, 0)
+}
@@ -0,0 +1,85 @@
+package memcache
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// pointsPerServer is the number of points of every server on the ring.
+const pointsPerServer = 160
+
+// ring is a consistent hash ring of memcache servers, the way of ketama.
+// adding or removing a server only moves the keys of the ring ranges it takes or gives back,
+// instead of nearly all keys like hashing modulo the number of servers.
+// it implements memcache.ServerSelector.
+type ring struct {
+	points  []point
+	servers []net.Addr
+}
+
+type point struct {
+	hash uint32
+	addr net.Addr
+}
+
+// newRing places servers on a ring, each is a host:port or the path of a unix socket.
+func newRing(servers ...string) (*ring, error) {
+	r := &ring{
+		points:  make([]point, 0, len(servers)*pointsPerServer),
+		servers: make([]net.Addr, 0, len(servers)),
+	}
+	for _, server := range servers {
+		addr, err := resolve(server)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, addr)
+		// a md5 digest gives 4 points.
+		for i := 0; i < pointsPerServer/4; i++ {
+			digest := md5.Sum([]byte(server + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				r.points = append(r.points, point{binary.LittleEndian.Uint32(digest[j*4:]), addr})
+			}
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r, nil
+}
+
+// resolve resolves server like memcache.ServerList does.
+func resolve(server string) (net.Addr, error) {
+	if strings.Contains(server, "/") {
+		return net.ResolveUnixAddr("unix", server)
+	}
+	return net.ResolveTCPAddr("tcp", server)
+}
+
+// PickServer returns the server of the first point clockwise from the hash of key.
+func (r *ring) PickServer(key string) (net.Addr, error) {
+	if len(r.points) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+	digest := md5.Sum([]byte(key))
+	h := binary.LittleEndian.Uint32(digest[:])
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].addr, nil
+}
+
+// Each calls f for every server, stopping at the first error.
+func (r *ring) Each(f func(net.Addr) error) error {
+	for _, addr := range r.servers {
+		if err := f(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
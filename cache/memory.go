@@ -15,8 +15,13 @@
 package cache
 
 import (
+	"context"
+	"encoding/gob"
 	"encoding/json"
 	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
@@ -31,6 +36,8 @@ type MemoryItem struct {
 	val         interface{}
 	createdTime time.Time
 	lifespan    time.Duration
+	size        int64 // approximate bytes, only tracked when maxBytes is set
+	tags        []string
 }
 
 func (mi *MemoryItem) isExpire() bool {
@@ -41,13 +48,40 @@ func (mi *MemoryItem) isExpire() bool {
 	return time.Now().Sub(mi.createdTime) > mi.lifespan
 }
 
+// add adds n to the item value, which is encoded by codec if it is not nil,
+// and returns the new value.
+// the caller must hold the write lock of the item's owner.
+func (mi *MemoryItem) add(codec Codec, n int64) (int64, error) {
+	v, sum, err := addValue(codec, mi.val, n)
+	if err != nil {
+		return 0, err
+	}
+	mi.val = v
+	return sum, nil
+}
+
 // MemoryCache is Memory cache adapter.
 // it contains a RW locker for safe map storage.
+// if maxEntries or maxBytes is set, items are evicted by the configured policy
+// once the cache is full.
 type MemoryCache struct {
 	sync.RWMutex
 	dur   time.Duration
 	items map[string]*MemoryItem
 	Every int // run an expiration check Every clock time
+
+	maxEntries int   // max number of items, 0 means unlimited
+	maxBytes   int64 // max approximate bytes of keys and values, 0 means unlimited
+	usedBytes  int64
+	policy     string
+	evict      evictPolicy // nil when the cache is unbounded
+	evictions  uint64      // items evicted to make room
+
+	codec Codec // nil means values are stored as they are
+
+	snapshot string // snapshot file, empty means none
+
+	tags map[string]map[string]struct{} // tag -> keys
 }
 
 // NewMemoryCache returns a new MemoryCache.
@@ -59,15 +93,30 @@ func NewMemoryCache() Cache {
 // Get cache from memory.
 // if non-existed or expired, return nil.
 func (bc *MemoryCache) Get(name string) interface{} {
-	bc.RLock()
-	defer bc.RUnlock()
+	v, _ := bc.get(name)
+	return v
+}
+
+// get returns the cached value and whether it is present and not expired.
+func (bc *MemoryCache) get(name string) (interface{}, bool) {
+	if bc.evict != nil {
+		// the eviction policy records every access, so it needs the write lock.
+		bc.Lock()
+		defer bc.Unlock()
+	} else {
+		bc.RLock()
+		defer bc.RUnlock()
+	}
 	if itm, ok := bc.items[name]; ok {
 		if itm.isExpire() {
-			return nil
+			return nil, false
 		}
-		return itm.val
+		if bc.evict != nil {
+			bc.evict.access(name)
+		}
+		return itm.val, true
 	}
-	return nil
+	return nil, false
 }
 
 // GetMulti gets caches from memory.
@@ -82,13 +131,113 @@ func (bc *MemoryCache) GetMulti(names []string) []interface{} {
 
 // Put cache to memory.
 // if lifespan is 0, it will be forever till restart.
+// if the cache is bounded, it evicts other items to make room first.
+// if a codec is configured, the value is stored encoded, read it back by GetInto.
 func (bc *MemoryCache) Put(name string, value interface{}, lifespan time.Duration) error {
+	return bc.put(name, value, lifespan, nil)
+}
+
+// PutWithTags puts cache to memory like Put, and tags it for InvalidateTag.
+func (bc *MemoryCache) PutWithTags(name string, value interface{}, lifespan time.Duration, tags ...string) error {
+	return bc.put(name, value, lifespan, tags)
+}
+
+func (bc *MemoryCache) put(name string, value interface{}, lifespan time.Duration, tags []string) error {
+	value, err := encodeValue(bc.codec, value)
+	if err != nil {
+		return err
+	}
 	bc.Lock()
 	defer bc.Unlock()
-	bc.items[name] = &MemoryItem{
+	return bc.set(name, value, lifespan, tags)
+}
+
+// set stores the encoded value, evicting other items to make room if bounded.
+// the caller must hold the write lock.
+func (bc *MemoryCache) set(name string, value interface{}, lifespan time.Duration, tags []string) error {
+	itm := &MemoryItem{
 		val:         value,
 		createdTime: time.Now(),
 		lifespan:    lifespan,
+		tags:        tags,
+	}
+	if bc.maxBytes > 0 {
+		itm.size = int64(len(name)) + approxSize(value)
+		if itm.size > bc.maxBytes {
+			return errors.New("item size exceeds maxBytes")
+		}
+	}
+	bc.removeItem(name)
+	if bc.evict != nil {
+		bc.makeRoom(itm.size)
+		bc.usedBytes += itm.size
+		bc.evict.add(name)
+	}
+	bc.items[name] = itm
+	for _, tag := range tags {
+		if bc.tags == nil {
+			bc.tags = make(map[string]map[string]struct{})
+		}
+		if bc.tags[tag] == nil {
+			bc.tags[tag] = make(map[string]struct{})
+		}
+		bc.tags[tag][name] = struct{}{}
+	}
+	return nil
+}
+
+// makeRoom evicts items until one more item of size bytes fits.
+// the caller must hold the write lock.
+func (bc *MemoryCache) makeRoom(size int64) {
+	for (bc.maxEntries > 0 && len(bc.items) >= bc.maxEntries) ||
+		(bc.maxBytes > 0 && bc.usedBytes+size > bc.maxBytes) {
+		name, ok := bc.evict.victim()
+		if !ok {
+			return
+		}
+		bc.removeItem(name)
+		bc.evictions++
+	}
+}
+
+// removeItem deletes an item and its eviction and tag bookkeeping.
+// the caller must hold the write lock.
+func (bc *MemoryCache) removeItem(name string) {
+	itm, ok := bc.items[name]
+	if !ok {
+		return
+	}
+	delete(bc.items, name)
+	if bc.evict != nil {
+		bc.usedBytes -= itm.size
+		bc.evict.remove(name)
+	}
+	for _, tag := range itm.tags {
+		delete(bc.tags[tag], name)
+		if len(bc.tags[tag]) == 0 {
+			delete(bc.tags, tag)
+		}
+	}
+}
+
+// InvalidateTag deletes all caches put with tag.
+func (bc *MemoryCache) InvalidateTag(tag string) error {
+	bc.Lock()
+	defer bc.Unlock()
+	for name := range bc.tags[tag] {
+		bc.removeItem(name)
+	}
+	return nil
+}
+
+// DeletePrefix deletes all caches whose key starts with prefix.
+func (bc *MemoryCache) DeletePrefix(prefix string) error {
+	bc.Lock()
+	defer bc.Unlock()
+	for name := range bc.items {
+		if strings.HasPrefix(name, prefix) {
+			bc.removeItem(name)
+		}
 	}
 	return nil
 }
@@ -98,9 +247,9 @@ func (bc *MemoryCache) Delete(name string) error {
 	bc.Lock()
 	defer bc.Unlock()
 	if _, ok := bc.items[name]; !ok {
-		return errors.New("key not exist")
+		return ErrCacheMiss
 	}
-	delete(bc.items, name)
+	bc.removeItem(name)
 	if _, ok := bc.items[name]; ok {
 		return errors.New("delete key error")
 	}
@@ -108,72 +257,124 @@ func (bc *MemoryCache) Delete(name string) error {
 }
 
 // Incr increase cache counter in memory.
-// it supports int,int32,int64,uint,uint32,uint64.
+// it supports all (u)int types, or the integers encoded by the codec.
 func (bc *MemoryCache) Incr(key string) error {
-	bc.RLock()
-	defer bc.RUnlock()
+	bc.Lock()
+	defer bc.Unlock()
 	itm, ok := bc.items[key]
 	if !ok {
-		return errors.New("key not exist")
-	}
-	switch itm.val.(type) {
-	case int:
-		itm.val = itm.val.(int) + 1
-	case int32:
-		itm.val = itm.val.(int32) + 1
-	case int64:
-		itm.val = itm.val.(int64) + 1
-	case uint:
-		itm.val = itm.val.(uint) + 1
-	case uint32:
-		itm.val = itm.val.(uint32) + 1
-	case uint64:
-		itm.val = itm.val.(uint64) + 1
-	default:
-		return errors.New("item val is not (u)int (u)int32 (u)int64")
+		return ErrCacheMiss
 	}
-	return nil
+	return bc.add(key, itm, 1)
 }
 
 // Decr decrease counter in memory.
 func (bc *MemoryCache) Decr(key string) error {
-	bc.RLock()
-	defer bc.RUnlock()
+	bc.Lock()
+	defer bc.Unlock()
 	itm, ok := bc.items[key]
 	if !ok {
-		return errors.New("key not exist")
-	}
-	switch itm.val.(type) {
-	case int:
-		itm.val = itm.val.(int) - 1
-	case int64:
-		itm.val = itm.val.(int64) - 1
-	case int32:
-		itm.val = itm.val.(int32) - 1
-	case uint:
-		if itm.val.(uint) > 0 {
-			itm.val = itm.val.(uint) - 1
-		} else {
-			return errors.New("item val is less than 0")
-		}
-	case uint32:
-		if itm.val.(uint32) > 0 {
-			itm.val = itm.val.(uint32) - 1
-		} else {
-			return errors.New("item val is less than 0")
-		}
-	case uint64:
-		if itm.val.(uint64) > 0 {
-			itm.val = itm.val.(uint64) - 1
-		} else {
-			return errors.New("item val is less than 0")
-		}
-	default:
-		return errors.New("item val is not int int64 int32")
+		return ErrCacheMiss
+	}
+	return bc.add(key, itm, -1)
+}
+
+// IncrBy adds n to cache counter in memory and returns the new value.
+// it supports all (u)int types, a missing or expired key counts from 0 as int64.
+func (bc *MemoryCache) IncrBy(key string, n int64) (int64, error) {
+	bc.Lock()
+	defer bc.Unlock()
+	itm, ok := bc.items[key]
+	if !ok || itm.isExpire() {
+		v, err := encodeValue(bc.codec, n)
+		if err != nil {
+			return 0, err
+		}
+		return n, bc.set(key, v, 0, nil)
+	}
+	sum, err := itm.add(bc.codec, n)
+	if err != nil {
+		return 0, err
+	}
+	bc.resize(key, itm)
+	return sum, nil
+}
+
+// add adds n to the counter itm of key, the caller must hold the write lock.
+func (bc *MemoryCache) add(key string, itm *MemoryItem, n int64) error {
+	if _, err := itm.add(bc.codec, n); err != nil {
+		return err
 	}
+	bc.resize(key, itm)
 	return nil
 }
 
+// resize updates the size of itm of key after its value changed, the caller must hold the write lock.
+func (bc *MemoryCache) resize(key string, itm *MemoryItem) {
+	if bc.maxBytes > 0 {
+		// an encoded counter changes its size with the number of digits.
+		size := int64(len(key)) + approxSize(itm.val)
+		bc.usedBytes += size - itm.size
+		itm.size = size
+	}
+}
+
+// DecrBy subtracts n from cache counter in memory and returns the new value.
+func (bc *MemoryCache) DecrBy(key string, n int64) (int64, error) {
+	return bc.IncrBy(key, -n)
+}
+
+// SetNX puts cache to memory only if name does not exist or is expired,
+// and reports whether it was put.
+func (bc *MemoryCache) SetNX(name string, value interface{}, lifespan time.Duration) (bool, error) {
+	value, err := encodeValue(bc.codec, value)
+	if err != nil {
+		return false, err
+	}
+	bc.Lock()
+	defer bc.Unlock()
+	if itm, ok := bc.items[name]; ok && !itm.isExpire() {
+		return false, nil
+	}
+	return true, bc.set(name, value, lifespan, nil)
+}
+
+// CompareAndSwap puts new to memory only if the cached value equals old,
+// and reports whether it was put. values are compared by reflect.DeepEqual,
+// or byte by byte if a codec is configured.
+func (bc *MemoryCache) CompareAndSwap(name string, old, new interface{}, lifespan time.Duration) (bool, error) {
+	new, err := encodeValue(bc.codec, new)
+	if err != nil {
+		return false, err
+	}
+	bc.Lock()
+	defer bc.Unlock()
+	itm, ok := bc.items[name]
+	if !ok || itm.isExpire() {
+		return false, nil
+	}
+	if ok, err = valueEqual(bc.codec, itm.val, old); !ok || err != nil {
+		return false, err
+	}
+	return true, bc.set(name, new, lifespan, nil)
+}
+
+// CompareAndDelete deletes cache in memory only if the cached value equals old,
+// and reports whether it was deleted.
+func (bc *MemoryCache) CompareAndDelete(name string, old interface{}) (bool, error) {
+	bc.Lock()
+	defer bc.Unlock()
+	itm, ok := bc.items[name]
+	if !ok || itm.isExpire() {
+		return false, nil
+	}
+	if ok, err := valueEqual(bc.codec, itm.val, old); !ok || err != nil {
+		return false, err
+	}
+	bc.removeItem(name)
+	return true, nil
+}
+
 // IsExist check cache exist in memory.
 func (bc *MemoryCache) IsExist(name string) bool {
 	bc.RLock()
@@ -189,24 +390,171 @@ func (bc *MemoryCache) ClearAll() error {
 	bc.Lock()
 	defer bc.Unlock()
 	bc.items = make(map[string]*MemoryItem)
+	bc.tags = nil
+	if bc.evict != nil {
+		bc.evict, _ = newEvictPolicy(bc.policy)
+		bc.usedBytes = 0
+	}
 	return nil
 }
 
+// memoryConfig is the JSON config of memory adapter.
+type memoryConfig struct {
+	Interval   int    `json:"interval"`
+	MaxEntries int    `json:"maxEntries"`
+	MaxBytes   int64  `json:"maxBytes"`
+	Policy     string `json:"policy"`
+	Codec      string `json:"codec"`
+
+	Snapshot         string `json:"snapshot"`
+	SnapshotInterval int    `json:"snapshotInterval"`
+}
+
 // StartAndGC start memory cache. it will check expiration in every clock time.
+// config is like {"interval":60,"maxEntries":10000,"maxBytes":67108864,"policy":"lru"},
+// maxEntries and maxBytes are optional and 0 means unlimited,
+// policy is one of "lru"(default), "lfu" and "fifo".
+// the optional codec, like {"codec":"gob"}, stores values encoded instead of as they are.
+// the optional snapshot, like {"snapshot":"data/cache.snap","snapshotInterval":300},
+// is a file the live items are loaded from now, and saved to every snapshotInterval seconds
+// and by method Snapshot, which is to be called on shutdown.
 func (bc *MemoryCache) StartAndGC(config string) error {
-	var cf map[string]int
+	cf := memoryConfig{Interval: DefaultEvery}
 	json.Unmarshal([]byte(config), &cf)
-	if _, ok := cf["interval"]; !ok {
-		cf = make(map[string]int)
-		cf["interval"] = DefaultEvery
+	if cf.MaxEntries < 0 || cf.MaxBytes < 0 {
+		return errors.New("maxEntries and maxBytes must not be negative")
+	}
+	codec, err := GetCodec(cf.Codec)
+	if err != nil {
+		return err
+	}
+	bc.codec = codec
+	if cf.MaxEntries > 0 || cf.MaxBytes > 0 {
+		evict, err := newEvictPolicy(cf.Policy)
+		if err != nil {
+			return err
+		}
+		bc.Lock()
+		bc.maxEntries = cf.MaxEntries
+		bc.maxBytes = cf.MaxBytes
+		bc.policy = cf.Policy
+		bc.evict = evict
+		bc.usedBytes = 0
+		for name, itm := range bc.items {
+			if bc.maxBytes > 0 {
+				itm.size = int64(len(name)) + approxSize(itm.val)
+			}
+			bc.usedBytes += itm.size
+			evict.add(name)
+		}
+		bc.Unlock()
 	}
-	dur := time.Duration(cf["interval"]) * time.Second
-	bc.Every = cf["interval"]
+	if cf.Snapshot != "" {
+		bc.snapshot = cf.Snapshot
+		if err = bc.LoadSnapshot(cf.Snapshot); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if cf.SnapshotInterval > 0 {
+			go bc.saveEvery(time.Duration(cf.SnapshotInterval) * time.Second)
+		}
+	}
+	dur := time.Duration(cf.Interval) * time.Second
+	bc.Every = cf.Interval
 	bc.dur = dur
 	go bc.vaccuum()
 	return nil
 }
 
+// Snapshot saves the live items to the snapshot file of the config.
+// call it on shutdown, so the next start is warm.
+func (bc *MemoryCache) Snapshot() error {
+	if bc.snapshot == "" {
+		return errors.New("no snapshot file configured")
+	}
+	return bc.SaveSnapshot(bc.snapshot)
+}
+
+// SaveSnapshot saves the live items to file, gob encoded like the file adapter does.
+// the values must be encodable by gob, unless a codec is configured.
+func (bc *MemoryCache) SaveSnapshot(file string) error {
+	var items []FileCacheItem
+	bc.RLock()
+	for name, itm := range bc.items {
+		if itm.isExpire() {
+			continue
+		}
+		item := FileCacheItem{Data: itm.val, Key: name, Tags: itm.tags, Lastaccess: itm.createdTime}
+		if itm.lifespan != 0 {
+			item.Expired = itm.createdTime.Add(itm.lifespan)
+		}
+		items = append(items, item)
+	}
+	bc.RUnlock()
+	for _, item := range items {
+		if item.Data != nil {
+			gob.Register(item.Data)
+		}
+	}
+	data, err := GobEncode(items)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+	return FilePutContents(file, data)
+}
+
+// LoadSnapshot puts the items saved by SaveSnapshot into the cache.
+// the items expire at the same time as they would have without the restart,
+// the ones expired meanwhile are skipped.
+func (bc *MemoryCache) LoadSnapshot(file string) error {
+	data, err := FileGetContents(file)
+	if err != nil {
+		return err
+	}
+	var items []FileCacheItem
+	if err = GobDecode(data, &items); err != nil {
+		return err
+	}
+	now := time.Now()
+	bc.Lock()
+	defer bc.Unlock()
+	for _, item := range items {
+		var lifespan time.Duration
+		if !item.Expired.IsZero() {
+			if lifespan = item.Expired.Sub(now); lifespan <= 0 {
+				continue
+			}
+		}
+		if err = bc.set(item.Key, item.Data, lifespan, item.Tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveEvery saves the snapshot file every interval.
+func (bc *MemoryCache) saveEvery(interval time.Duration) {
+	for {
+		<-time.After(interval)
+		bc.Snapshot()
+	}
+}
+
+// Evictions returns how many items were evicted to make room since the cache started.
+// expired items are not counted.
+func (bc *MemoryCache) Evictions() uint64 {
+	bc.RLock()
+	defer bc.RUnlock()
+	return bc.evictions
+}
+
+// Codec returns the codec of memory cache, nil if values are stored as they are.
+func (bc *MemoryCache) Codec() Codec {
+	return bc.codec
+}
+
 // check expiration.
 func (bc *MemoryCache) vaccuum() {
 	if bc.Every < 1 {
@@ -217,7 +565,14 @@ func (bc *MemoryCache) vaccuum() {
 		if bc.items == nil {
 			return
 		}
+		// copy the keys first, ranging over the map while Put writes it is a data race.
+		bc.RLock()
+		names := make([]string, 0, len(bc.items))
 		for name := range bc.items {
+			names = append(names, name)
+		}
+		bc.RUnlock()
+		for _, name := range names {
 			bc.itemExpired(name)
 		}
 	}
@@ -233,12 +588,92 @@ func (bc *MemoryCache) itemExpired(name string) bool {
 		return true
 	}
 	if itm.isExpire() {
-		delete(bc.items, name)
+		bc.removeItem(name)
 		return true
 	}
 	return false
 }
 
+// MemoryCacheV2 is the CacheV2 version of memory adapter.
+type MemoryCacheV2 struct {
+	*MemoryCache
+}
+
+// NewMemoryCacheV2 returns a new MemoryCacheV2.
+func NewMemoryCacheV2() CacheV2 {
+	return &MemoryCacheV2{NewMemoryCache().(*MemoryCache)}
+}
+
+// Get cache from memory.
+// if non-existed or expired, return ErrCacheMiss.
+func (bc *MemoryCacheV2) Get(ctx context.Context, name string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if v, ok := bc.MemoryCache.get(name); ok {
+		return v, nil
+	}
+	return nil, ErrCacheMiss
+}
+
+// GetMulti gets caches from memory.
+// if non-existed or expired, the value is nil.
+func (bc *MemoryCacheV2) GetMulti(ctx context.Context, names []string) ([]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return bc.MemoryCache.GetMulti(names), nil
+}
+
+// Put cache to memory.
+func (bc *MemoryCacheV2) Put(ctx context.Context, name string, value interface{}, lifespan time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bc.MemoryCache.Put(name, value, lifespan)
+}
+
+// Delete cache in memory.
+func (bc *MemoryCacheV2) Delete(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bc.MemoryCache.Delete(name)
+}
+
+// Incr increase cache counter in memory.
+func (bc *MemoryCacheV2) Incr(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bc.MemoryCache.Incr(key)
+}
+
+// Decr decrease counter in memory.
+func (bc *MemoryCacheV2) Decr(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bc.MemoryCache.Decr(key)
+}
+
+// IsExist check cache exist in memory.
+func (bc *MemoryCacheV2) IsExist(ctx context.Context, name string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return bc.MemoryCache.IsExist(name), nil
+}
+
+// ClearAll will delete all cache in memory.
+func (bc *MemoryCacheV2) ClearAll(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bc.MemoryCache.ClearAll()
+}
+
 func init() {
 	Register("memory", NewMemoryCache)
+	RegisterV2("memory", NewMemoryCacheV2)
 }
@@ -0,0 +1,15 @@
+package metrics
+
+import (
+	"github.com/henrylee2cn/lessgo"
+)
+
+// StatsHandler responds the stats of all wrapped caches as JSON.
+// mount it at an admin route, and guard it like the other admin routes.
+var StatsHandler = lessgo.ApiHandler{
+	Desc:   "cache stats",
+	Method: "GET",
+	Handler: func(c *lessgo.Context) error {
+		return c.JSON(200, AllStats())
+	},
+}.Reg()
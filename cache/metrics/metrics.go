@@ -0,0 +1,586 @@
+// Package metrics instruments cache adapters.
+//
+// it wraps any cache.Cache, counting hits, misses, puts, deletes, evictions and errors,
+// and recording the latency of every operation in a histogram.
+//
+// Usage:
+// import(
+//   "github.com/henrylee2cn/lessgoext/cache"
+//   "github.com/henrylee2cn/lessgoext/cache/metrics"
+// )
+//
+//  bm, err := cache.NewCache("memory", `{"interval":60,"maxEntries":10000}`)
+//  mc := metrics.Wrap("users", bm) // use mc instead of bm
+//  stats := mc.Stats()
+//
+// mount StatsHandler at an admin route to see the stats of all wrapped caches:
+//  lessgo.Root(lessgo.Leaf("/admin/cache/stats", metrics.StatsHandler))
+package metrics
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/henrylee2cn/lessgoext/cache"
+)
+
+// LatencyBuckets are the upper bounds of the latency histogram buckets,
+// a last bucket without bound counts the slower operations.
+var LatencyBuckets = []time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// cache operations
+const (
+	opGet = iota
+	opGetMulti
+	opPut
+	opDelete
+	opIncr
+	opDecr
+	opIsExist
+	opClearAll
+	opIncrBy
+	opDecrBy
+	opSetNX
+	opCompareAndSwap
+	opCompareAndDelete
+	opPutWithTags
+	opInvalidateTag
+	opDeletePrefix
+	numOps
+)
+
+var opNames = [numOps]string{
+	"get", "get_multi", "put", "delete", "incr", "decr", "is_exist", "clear_all",
+	"incr_by", "decr_by", "set_nx", "compare_and_swap", "compare_and_delete",
+	"put_with_tags", "invalidate_tag", "delete_prefix",
+}
+
+// ErrUnsupported is returned by the methods of cache.AtomicCache and cache.TagCache
+// if the wrapped adapter does not implement them.
+var ErrUnsupported = errors.New("metrics: operation not supported by the cache adapter")
+
+// meter holds the counters of a wrapped cache.
+type meter struct {
+	name    string
+	backend interface{} // the wrapped adapter
+
+	hits    uint64
+	misses  uint64
+	puts    uint64
+	deletes uint64
+	errors  uint64
+	latency [numOps]histogram
+}
+
+// Cache is an instrumented cache.Cache.
+// it implements cache.AtomicCache and cache.TagCache too,
+// forwarding to the wrapped adapter or failing with ErrUnsupported.
+type Cache struct {
+	cache.Cache
+	*meter
+}
+
+// CacheV2 is an instrumented cache.CacheV2.
+type CacheV2 struct {
+	cache.CacheV2
+	*meter
+}
+
+// Stats is a snapshot of the counters of a Cache.
+type Stats struct {
+	Name     string  `json:"name"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+	// Puts counts Put, PutWithTags, and SetNX and CompareAndSwap which put.
+	Puts uint64 `json:"puts"`
+	// Deletes counts Delete, and CompareAndDelete which deleted.
+	Deletes uint64 `json:"deletes"`
+	// Evictions is reported by the adapters which evict, like a bounded memory cache.
+	Evictions uint64 `json:"evictions"`
+	// Errors counts the failed operations, a miss is not an error.
+	Errors uint64 `json:"errors"`
+	// Latency is keyed by operation: get, get_multi, put, delete, incr, decr, is_exist, clear_all,
+	// incr_by, decr_by, set_nx, compare_and_swap, compare_and_delete, put_with_tags, invalidate_tag and delete_prefix.
+	Latency map[string]Latency `json:"latency"`
+}
+
+// Latency is the latency histogram of an operation.
+type Latency struct {
+	Count   uint64        `json:"count"`
+	Mean    time.Duration `json:"mean_ns"`
+	Buckets []Bucket      `json:"buckets"`
+}
+
+// Bucket counts the operations not slower than LE, and slower than the previous bucket.
+// LE of the last bucket is math.MaxInt64.
+type Bucket struct {
+	LE    time.Duration `json:"le_ns"`
+	Count uint64        `json:"count"`
+}
+
+// evictionCounter is implemented by the adapters which evict items, like cache.MemoryCache.
+type evictionCounter interface {
+	Evictions() uint64
+}
+
+var (
+	mu     sync.RWMutex
+	meters = make(map[string]*meter)
+)
+
+// Wrap returns c instrumented, and registers it by name for AllStats and StatsHandler.
+// If Wrap is called twice with the same name, it panics.
+// use Unwrap to reach the methods of the adapter other than cache.Cache, cache.AtomicCache and cache.TagCache.
+func Wrap(name string, c cache.Cache) *Cache {
+	return &Cache{Cache: c, meter: register(name, c)}
+}
+
+// WrapV2 is like Wrap for a cache.CacheV2.
+func WrapV2(name string, c cache.CacheV2) *CacheV2 {
+	return &CacheV2{CacheV2: c, meter: register(name, c)}
+}
+
+func register(name string, backend interface{}) *meter {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := meters[name]; ok {
+		panic("metrics: Wrap called twice for cache " + name)
+	}
+	m := &meter{name: name, backend: backend}
+	meters[name] = m
+	return m
+}
+
+// Unregister removes the cache registered by name from AllStats and StatsHandler.
+func Unregister(name string) {
+	mu.Lock()
+	delete(meters, name)
+	mu.Unlock()
+}
+
+// AllStats returns the stats of all wrapped caches, ordered by name.
+func AllStats() []Stats {
+	mu.RLock()
+	list := make([]*meter, 0, len(meters))
+	for _, m := range meters {
+		list = append(list, m)
+	}
+	mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	stats := make([]Stats, len(list))
+	for i, m := range list {
+		stats[i] = m.Stats()
+	}
+	return stats
+}
+
+// Unwrap returns the wrapped adapter.
+func (mc *Cache) Unwrap() cache.Cache {
+	return mc.Cache
+}
+
+// Codec returns the codec of the wrapped adapter, so cache.GetInto works on the wrapper.
+func (mc *Cache) Codec() cache.Codec {
+	if cd, ok := mc.Cache.(cache.Coder); ok {
+		return cd.Codec()
+	}
+	return nil
+}
+
+// Get counts a hit or a miss.
+func (mc *Cache) Get(key string) interface{} {
+	start := time.Now()
+	v := mc.Cache.Get(key)
+	mc.observe(opGet, start)
+	mc.countGet(v)
+	return v
+}
+
+// GetMulti counts a hit or a miss for every key.
+func (mc *Cache) GetMulti(keys []string) []interface{} {
+	start := time.Now()
+	vs := mc.Cache.GetMulti(keys)
+	mc.observe(opGetMulti, start)
+	for _, v := range vs {
+		mc.countGet(v)
+	}
+	return vs
+}
+
+// Put counts a put.
+func (mc *Cache) Put(key string, val interface{}, timeout time.Duration) error {
+	start := time.Now()
+	err := mc.Cache.Put(key, val, timeout)
+	mc.observe(opPut, start)
+	if mc.countError(err) {
+		atomic.AddUint64(&mc.puts, 1)
+	}
+	return err
+}
+
+// Delete counts a delete.
+func (mc *Cache) Delete(key string) error {
+	start := time.Now()
+	err := mc.Cache.Delete(key)
+	mc.observe(opDelete, start)
+	if mc.countError(err) {
+		atomic.AddUint64(&mc.deletes, 1)
+	}
+	return err
+}
+
+// Incr records the latency.
+func (mc *Cache) Incr(key string) error {
+	start := time.Now()
+	err := mc.Cache.Incr(key)
+	mc.observe(opIncr, start)
+	mc.countError(err)
+	return err
+}
+
+// Decr records the latency.
+func (mc *Cache) Decr(key string) error {
+	start := time.Now()
+	err := mc.Cache.Decr(key)
+	mc.observe(opDecr, start)
+	mc.countError(err)
+	return err
+}
+
+// IsExist records the latency.
+func (mc *Cache) IsExist(key string) bool {
+	start := time.Now()
+	ok := mc.Cache.IsExist(key)
+	mc.observe(opIsExist, start)
+	return ok
+}
+
+// ClearAll records the latency.
+func (mc *Cache) ClearAll() error {
+	start := time.Now()
+	err := mc.Cache.ClearAll()
+	mc.observe(opClearAll, start)
+	mc.countError(err)
+	return err
+}
+
+// IncrBy records the latency.
+func (mc *Cache) IncrBy(key string, n int64) (int64, error) {
+	ac, ok := mc.Cache.(cache.AtomicCache)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	start := time.Now()
+	v, err := ac.IncrBy(key, n)
+	mc.observe(opIncrBy, start)
+	mc.countError(err)
+	return v, err
+}
+
+// DecrBy records the latency.
+func (mc *Cache) DecrBy(key string, n int64) (int64, error) {
+	ac, ok := mc.Cache.(cache.AtomicCache)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	start := time.Now()
+	v, err := ac.DecrBy(key, n)
+	mc.observe(opDecrBy, start)
+	mc.countError(err)
+	return v, err
+}
+
+// SetNX counts a put if the value was put.
+func (mc *Cache) SetNX(key string, val interface{}, timeout time.Duration) (bool, error) {
+	ac, ok := mc.Cache.(cache.AtomicCache)
+	if !ok {
+		return false, ErrUnsupported
+	}
+	start := time.Now()
+	ok, err := ac.SetNX(key, val, timeout)
+	mc.observe(opSetNX, start)
+	if mc.countError(err) && ok {
+		atomic.AddUint64(&mc.puts, 1)
+	}
+	return ok, err
+}
+
+// CompareAndSwap counts a put if the value was put.
+func (mc *Cache) CompareAndSwap(key string, old, new interface{}, timeout time.Duration) (bool, error) {
+	ac, ok := mc.Cache.(cache.AtomicCache)
+	if !ok {
+		return false, ErrUnsupported
+	}
+	start := time.Now()
+	ok, err := ac.CompareAndSwap(key, old, new, timeout)
+	mc.observe(opCompareAndSwap, start)
+	if mc.countError(err) && ok {
+		atomic.AddUint64(&mc.puts, 1)
+	}
+	return ok, err
+}
+
+// CompareAndDelete counts a delete if the value was deleted.
+func (mc *Cache) CompareAndDelete(key string, old interface{}) (bool, error) {
+	ac, ok := mc.Cache.(cache.AtomicCache)
+	if !ok {
+		return false, ErrUnsupported
+	}
+	start := time.Now()
+	ok, err := ac.CompareAndDelete(key, old)
+	mc.observe(opCompareAndDelete, start)
+	if mc.countError(err) && ok {
+		atomic.AddUint64(&mc.deletes, 1)
+	}
+	return ok, err
+}
+
+// PutWithTags counts a put.
+func (mc *Cache) PutWithTags(key string, val interface{}, timeout time.Duration, tags ...string) error {
+	tc, ok := mc.Cache.(cache.TagCache)
+	if !ok {
+		return ErrUnsupported
+	}
+	start := time.Now()
+	err := tc.PutWithTags(key, val, timeout, tags...)
+	mc.observe(opPutWithTags, start)
+	if mc.countError(err) {
+		atomic.AddUint64(&mc.puts, 1)
+	}
+	return err
+}
+
+// InvalidateTag records the latency.
+func (mc *Cache) InvalidateTag(tag string) error {
+	tc, ok := mc.Cache.(cache.TagCache)
+	if !ok {
+		return ErrUnsupported
+	}
+	start := time.Now()
+	err := tc.InvalidateTag(tag)
+	mc.observe(opInvalidateTag, start)
+	mc.countError(err)
+	return err
+}
+
+// DeletePrefix records the latency.
+func (mc *Cache) DeletePrefix(prefix string) error {
+	tc, ok := mc.Cache.(cache.TagCache)
+	if !ok {
+		return ErrUnsupported
+	}
+	start := time.Now()
+	err := tc.DeletePrefix(prefix)
+	mc.observe(opDeletePrefix, start)
+	mc.countError(err)
+	return err
+}
+
+// countGet counts v got from the adapter as a hit or a miss,
+// or as an error if the adapter returned one in place of the value.
+func (mc *Cache) countGet(v interface{}) {
+	if _, ok := v.(error); ok {
+		atomic.AddUint64(&mc.errors, 1)
+		return
+	}
+	miss := v == nil
+	if _, ok := mc.Cache.(*cache.FileCache); ok && v == "" {
+		// file adapter returns "" on miss.
+		miss = true
+	}
+	mc.countHit(!miss)
+}
+
+// Unwrap returns the wrapped adapter.
+func (mc *CacheV2) Unwrap() cache.CacheV2 {
+	return mc.CacheV2
+}
+
+// Get counts a hit, a miss or an error.
+func (mc *CacheV2) Get(ctx context.Context, key string) (interface{}, error) {
+	start := time.Now()
+	v, err := mc.CacheV2.Get(ctx, key)
+	mc.observe(opGet, start)
+	if mc.countError(err) || err == cache.ErrCacheMiss {
+		mc.countHit(err == nil)
+	}
+	return v, err
+}
+
+// GetMulti counts a hit or a miss for every key, or an error.
+func (mc *CacheV2) GetMulti(ctx context.Context, keys []string) ([]interface{}, error) {
+	start := time.Now()
+	vs, err := mc.CacheV2.GetMulti(ctx, keys)
+	mc.observe(opGetMulti, start)
+	if mc.countError(err) {
+		for _, v := range vs {
+			mc.countHit(v != nil)
+		}
+	}
+	return vs, err
+}
+
+// Put counts a put.
+func (mc *CacheV2) Put(ctx context.Context, key string, val interface{}, timeout time.Duration) error {
+	start := time.Now()
+	err := mc.CacheV2.Put(ctx, key, val, timeout)
+	mc.observe(opPut, start)
+	if mc.countError(err) {
+		atomic.AddUint64(&mc.puts, 1)
+	}
+	return err
+}
+
+// Delete counts a delete.
+func (mc *CacheV2) Delete(ctx context.Context, key string) error {
+	start := time.Now()
+	err := mc.CacheV2.Delete(ctx, key)
+	mc.observe(opDelete, start)
+	if mc.countError(err) {
+		atomic.AddUint64(&mc.deletes, 1)
+	}
+	return err
+}
+
+// Incr records the latency.
+func (mc *CacheV2) Incr(ctx context.Context, key string) error {
+	start := time.Now()
+	err := mc.CacheV2.Incr(ctx, key)
+	mc.observe(opIncr, start)
+	mc.countError(err)
+	return err
+}
+
+// Decr records the latency.
+func (mc *CacheV2) Decr(ctx context.Context, key string) error {
+	start := time.Now()
+	err := mc.CacheV2.Decr(ctx, key)
+	mc.observe(opDecr, start)
+	mc.countError(err)
+	return err
+}
+
+// IsExist records the latency.
+func (mc *CacheV2) IsExist(ctx context.Context, key string) (bool, error) {
+	start := time.Now()
+	ok, err := mc.CacheV2.IsExist(ctx, key)
+	mc.observe(opIsExist, start)
+	mc.countError(err)
+	return ok, err
+}
+
+// ClearAll records the latency.
+func (mc *CacheV2) ClearAll(ctx context.Context) error {
+	start := time.Now()
+	err := mc.CacheV2.ClearAll(ctx)
+	mc.observe(opClearAll, start)
+	mc.countError(err)
+	return err
+}
+
+// Stats returns a snapshot of the counters.
+func (m *meter) Stats() Stats {
+	s := Stats{
+		Name:    m.name,
+		Hits:    atomic.LoadUint64(&m.hits),
+		Misses:  atomic.LoadUint64(&m.misses),
+		Puts:    atomic.LoadUint64(&m.puts),
+		Deletes: atomic.LoadUint64(&m.deletes),
+		Errors:  atomic.LoadUint64(&m.errors),
+		Latency: make(map[string]Latency, numOps),
+	}
+	if total := s.Hits + s.Misses; total > 0 {
+		s.HitRatio = float64(s.Hits) / float64(total)
+	}
+	if ec, ok := m.backend.(evictionCounter); ok {
+		s.Evictions = ec.Evictions()
+	}
+	for op := range m.latency {
+		s.Latency[opNames[op]] = m.latency[op].snapshot()
+	}
+	return s
+}
+
+// observe records the latency of op started at start.
+func (m *meter) observe(op int, start time.Time) {
+	m.latency[op].observe(time.Since(start))
+}
+
+// countHit counts a hit or a miss.
+func (m *meter) countHit(hit bool) {
+	if hit {
+		atomic.AddUint64(&m.hits, 1)
+	} else {
+		atomic.AddUint64(&m.misses, 1)
+	}
+}
+
+// countError counts err if it is not nil or a miss, and reports whether err is nil.
+func (m *meter) countError(err error) bool {
+	if err != nil && err != cache.ErrCacheMiss {
+		atomic.AddUint64(&m.errors, 1)
+	}
+	return err == nil
+}
+
+// histogram is a lock free latency histogram over LatencyBuckets.
+type histogram struct {
+	once    sync.Once
+	count   uint64
+	sum     int64 // nanoseconds
+	buckets []uint64
+}
+
+func (h *histogram) init() {
+	h.once.Do(func() {
+		h.buckets = make([]uint64, len(LatencyBuckets)+1)
+	})
+}
+
+func (h *histogram) observe(d time.Duration) {
+	h.init()
+	i := sort.Search(len(LatencyBuckets), func(i int) bool { return d <= LatencyBuckets[i] })
+	atomic.AddUint64(&h.buckets[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	atomic.AddUint64(&h.count, 1)
+}
+
+func (h *histogram) snapshot() Latency {
+	h.init()
+	l := Latency{
+		Count:   atomic.LoadUint64(&h.count),
+		Buckets: make([]Bucket, len(h.buckets)),
+	}
+	if l.Count > 0 {
+		l.Mean = time.Duration(atomic.LoadInt64(&h.sum) / int64(l.Count))
+	}
+	for i := range h.buckets {
+		le := time.Duration(math.MaxInt64)
+		if i < len(LatencyBuckets) {
+			le = LatencyBuckets[i]
+		}
+		l.Buckets[i] = Bucket{LE: le, Count: atomic.LoadUint64(&h.buckets[i])}
+	}
+	return l
+}
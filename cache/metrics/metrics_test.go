@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/lessgoext/cache"
+)
+
+func TestMetrics(t *testing.T) {
+	bm, err := cache.NewCache("memory", `{"interval":0,"maxEntries":2}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	mc := Wrap("test", bm)
+	defer Unregister("test")
+
+	mc.Put("a", 1, time.Minute)
+	mc.Put("b", 2, time.Minute)
+	mc.Put("c", 3, time.Minute) // evicts a
+	mc.Get("a")
+	mc.Get("b")
+	mc.GetMulti([]string{"c", "none"})
+	mc.Delete("b")
+	mc.Incr("none")
+
+	s := mc.Stats()
+	if s.Name != "test" || s.Hits != 2 || s.Misses != 2 || s.HitRatio != 0.5 {
+		t.Error("hit and miss err", s)
+	}
+	if s.Puts != 3 || s.Deletes != 1 || s.Evictions != 1 || s.Errors != 0 {
+		t.Error("counter err", s)
+	}
+	get := s.Latency["get"]
+	var n uint64
+	for _, b := range get.Buckets {
+		n += b.Count
+	}
+	if get.Count != 2 || n != 2 || len(get.Buckets) != len(LatencyBuckets)+1 {
+		t.Error("latency err", get)
+	}
+
+	all := AllStats()
+	if len(all) != 1 || all[0].Name != "test" {
+		t.Error("AllStats err", all)
+	}
+	if mc.Unwrap() != bm {
+		t.Error("Unwrap err")
+	}
+}
+
+type failCache struct {
+	cache.Cache
+}
+
+func (failCache) Put(key string, val interface{}, timeout time.Duration) error {
+	return errors.New("backend down")
+}
+
+func TestMetricsErrors(t *testing.T) {
+	mc := Wrap("fail", failCache{cache.NewMemoryCache()})
+	defer Unregister("fail")
+	if mc.Put("a", 1, time.Minute) == nil {
+		t.Error("Put should fail")
+	}
+	if s := mc.Stats(); s.Errors != 1 || s.Puts != 0 {
+		t.Error("error counter err", s)
+	}
+}
+
+func TestMetricsForward(t *testing.T) {
+	bm, err := cache.NewCache("memory", `{"interval":0}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	mc := Wrap("forward", bm)
+	defer Unregister("forward")
+	var c cache.Cache = mc
+	ac, ok := c.(cache.AtomicCache)
+	if !ok {
+		t.Fatal("AtomicCache is not forwarded")
+	}
+	if ok, err := ac.SetNX("lock", "a", time.Minute); !ok || err != nil {
+		t.Error("SetNX err", err)
+	}
+	if ok, _ := ac.CompareAndDelete("lock", "a"); !ok {
+		t.Error("CompareAndDelete err")
+	}
+	if n, err := ac.IncrBy("n", 2); n != 2 || err != nil {
+		t.Error("IncrBy err", n, err)
+	}
+	tc := c.(cache.TagCache)
+	tc.PutWithTags("tagged", 1, time.Minute, "tag")
+	tc.InvalidateTag("tag")
+	if mc.IsExist("tagged") {
+		t.Error("InvalidateTag err")
+	}
+	s := mc.Stats()
+	if s.Puts != 2 || s.Deletes != 1 || s.Latency["set_nx"].Count != 1 {
+		t.Error("counter err", s)
+	}
+
+	um := Wrap("unsupported", failCache{cache.NewMemoryCache()})
+	defer Unregister("unsupported")
+	if _, err := um.SetNX("a", 1, time.Minute); err != ErrUnsupported {
+		t.Error("SetNX should be unsupported", err)
+	}
+}
+
+type errMultiCache struct {
+	cache.Cache
+}
+
+func (errMultiCache) GetMulti(keys []string) []interface{} {
+	return []interface{}{"a", nil, errors.New("backend down")}
+}
+
+func TestMetricsGetMultiErrors(t *testing.T) {
+	mc := Wrap("multi", errMultiCache{cache.NewMemoryCache()})
+	defer Unregister("multi")
+	mc.GetMulti([]string{"a", "b", "c"})
+	if s := mc.Stats(); s.Hits != 1 || s.Misses != 1 || s.Errors != 1 {
+		t.Error("GetMulti counter err", s)
+	}
+}
+
+func TestMetricsV2(t *testing.T) {
+	mc := WrapV2("v2", cache.NewMemoryCacheV2())
+	defer Unregister("v2")
+	if err := mc.StartAndGC(`{"interval":0}`); err != nil {
+		t.Fatal("init err", err)
+	}
+	ctx := context.Background()
+	mc.Put(ctx, "a", 1, time.Minute)
+	mc.Get(ctx, "a")
+	if _, err := mc.Get(ctx, "none"); err != cache.ErrCacheMiss {
+		t.Error("miss err", err)
+	}
+	s := mc.Stats()
+	if s.Hits != 1 || s.Misses != 1 || s.Puts != 1 || s.Errors != 0 {
+		t.Error("counter err", s)
+	}
+	if all := AllStats(); len(all) != 1 || all[0].Name != "v2" {
+		t.Error("AllStats err", all)
+	}
+}
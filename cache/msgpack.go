@@ -0,0 +1,595 @@
+package cache
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// msgpackCodec implements the subset of MessagePack (https://msgpack.org) a cache needs:
+// nil, bool, integers, floats, strings, bytes, arrays, maps and structs.
+// structs are encoded as maps keyed by field name, the name can be changed
+// by the tag `msgpack:"name"` and "-" skips the field.
+// types implementing encoding.BinaryMarshaler, like time.Time, are encoded as bytes.
+type msgpackCodec struct{}
+
+var (
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	e := &msgpackEncoder{}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("msgpack: Unmarshal needs a non-nil pointer")
+	}
+	d := &msgpackDecoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return errors.New("msgpack: trailing data")
+	}
+	return nil
+}
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) writeByte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *msgpackEncoder) writeUint(code byte, u uint64, size int) {
+	e.buf = append(e.buf, code)
+	for i := size - 1; i >= 0; i-- {
+		e.buf = append(e.buf, byte(u>>(8*uint(i))))
+	}
+}
+
+func (e *msgpackEncoder) encodeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.encodeUint(uint64(i))
+	case i >= -32:
+		e.writeByte(byte(i))
+	case i >= math.MinInt8:
+		e.writeUint(0xd0, uint64(i), 1)
+	case i >= math.MinInt16:
+		e.writeUint(0xd1, uint64(i), 2)
+	case i >= math.MinInt32:
+		e.writeUint(0xd2, uint64(i), 4)
+	default:
+		e.writeUint(0xd3, uint64(i), 8)
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(u uint64) {
+	switch {
+	case u <= 0x7f:
+		e.writeByte(byte(u))
+	case u <= math.MaxUint8:
+		e.writeUint(0xcc, u, 1)
+	case u <= math.MaxUint16:
+		e.writeUint(0xcd, u, 2)
+	case u <= math.MaxUint32:
+		e.writeUint(0xce, u, 4)
+	default:
+		e.writeUint(0xcf, u, 8)
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	n := uint64(len(s))
+	switch {
+	case n < 32:
+		e.writeByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		e.writeUint(0xd9, n, 1)
+	case n <= math.MaxUint16:
+		e.writeUint(0xda, n, 2)
+	default:
+		e.writeUint(0xdb, n, 4)
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encodeBytes(b []byte) {
+	n := uint64(len(b))
+	switch {
+	case n <= math.MaxUint8:
+		e.writeUint(0xc4, n, 1)
+	case n <= math.MaxUint16:
+		e.writeUint(0xc5, n, 2)
+	default:
+		e.writeUint(0xc6, n, 4)
+	}
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) encodeArrayLen(n int) {
+	switch {
+	case n < 16:
+		e.writeByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		e.writeUint(0xdc, uint64(n), 2)
+	default:
+		e.writeUint(0xdd, uint64(n), 4)
+	}
+}
+
+func (e *msgpackEncoder) encodeMapLen(n int) {
+	switch {
+	case n < 16:
+		e.writeByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		e.writeUint(0xde, uint64(n), 2)
+	default:
+		e.writeUint(0xdf, uint64(n), 4)
+	}
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.writeByte(0xc0)
+		return nil
+	}
+	if v.Type().Implements(binaryMarshalerType) && (v.Kind() != reflect.Ptr || !v.IsNil()) {
+		b, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		e.encodeBytes(b)
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.writeByte(0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.writeByte(0xc3)
+		} else {
+			e.writeByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.writeUint(0xca, uint64(math.Float32bits(float32(v.Float()))), 4)
+	case reflect.Float64:
+		e.writeUint(0xcb, math.Float64bits(v.Float()), 8)
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.writeByte(0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeBytes(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		e.encodeArrayLen(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.writeByte(0xc0)
+			return nil
+		}
+		e.encodeMapLen(v.Len())
+		for _, k := range v.MapKeys() {
+			if err := e.encode(k); err != nil {
+				return err
+			}
+			if err := e.encode(v.MapIndex(k)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := msgpackFields(v.Type())
+		e.encodeMapLen(len(fields))
+		for _, f := range fields {
+			e.encodeString(f.name)
+			if err := e.encode(v.Field(f.index)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+type msgpackField struct {
+	name  string
+	index int
+}
+
+// msgpackFields returns the encoded fields of struct type t.
+func msgpackFields(t reflect.Type) []msgpackField {
+	var fields []msgpackField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("msgpack"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			name = strings.Split(tag, ",")[0]
+		}
+		fields = append(fields, msgpackField{name, i})
+	}
+	return fields
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+func (d *msgpackDecoder) readByte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errMsgpackShort
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *msgpackDecoder) readN(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	b, err := d.readN(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// decodeAny decodes the next value into the natural Go type:
+// nil, bool, int64, uint64, float64, string, []byte, []interface{} and
+// map[string]interface{} (map[interface{}]interface{} if a key is not string).
+func (d *msgpackDecoder) decodeAny() (interface{}, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.readString(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.readArray(int(c & 0x0f))
+	case c&0xf0 == 0x80:
+		return d.readMap(int(c & 0x0f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.readUint(1 << (c - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		u, err := d.readUint(size)
+		if err != nil {
+			return nil, err
+		}
+		// sign extend
+		shift := uint(64 - 8*size)
+		return int64(u<<shift) >> shift, nil
+	case 0xca:
+		u, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.readUint(8)
+		return math.Float64frombits(u), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readUint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.readString(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readUint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.readN(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.readArray(int(n))
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.readMap(int(n))
+	}
+	return nil, fmt.Errorf("msgpack: unsupported code 0x%x", c)
+}
+
+func (d *msgpackDecoder) readString(n int) (string, error) {
+	b, err := d.readN(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) readArray(n int) ([]interface{}, error) {
+	if n > len(d.data)-d.pos { // every element takes one byte at least
+		return nil, errMsgpackShort
+	}
+	a := make([]interface{}, n)
+	for i := range a {
+		v, err := d.decodeAny()
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+func (d *msgpackDecoder) readMap(n int) (interface{}, error) {
+	if 2*n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	keys := make([]interface{}, n)
+	vals := make([]interface{}, n)
+	allString := true
+	for i := 0; i < n; i++ {
+		k, err := d.decodeAny()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := k.(string); !ok {
+			allString = false
+		}
+		if keys[i] = k; k != nil && !reflect.TypeOf(k).Comparable() {
+			return nil, fmt.Errorf("msgpack: invalid map key type %T", k)
+		}
+		if vals[i], err = d.decodeAny(); err != nil {
+			return nil, err
+		}
+	}
+	if allString {
+		m := make(map[string]interface{}, n)
+		for i, k := range keys {
+			m[k.(string)] = vals[i]
+		}
+		return m, nil
+	}
+	m := make(map[interface{}]interface{}, n)
+	for i, k := range keys {
+		m[k] = vals[i]
+	}
+	return m, nil
+}
+
+// decode decodes the next value into v, v must be settable.
+// it decodes into the natural Go type first and then assigns it,
+// cached values are small so the simplicity is worth the extra copy.
+func (d *msgpackDecoder) decode(v reflect.Value) error {
+	x, err := d.decodeAny()
+	if err != nil {
+		return err
+	}
+	return msgpackAssign(x, v)
+}
+
+func msgpackAssign(x interface{}, v reflect.Value) error {
+	if x == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(binaryUnmarshalerType) {
+		if b, ok := x.([]byte); ok {
+			return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+		}
+	}
+	mismatch := func() error {
+		return fmt.Errorf("msgpack: can not decode %T into %s", x, v.Type())
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		if err := msgpackAssign(x, p.Elem()); err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return mismatch()
+		}
+		v.Set(reflect.ValueOf(x))
+	case reflect.Bool:
+		b, ok := x.(bool)
+		if !ok {
+			return mismatch()
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch n := x.(type) {
+		case int64:
+			i = n
+		case uint64:
+			if n > math.MaxInt64 {
+				return mismatch()
+			}
+			i = int64(n)
+		default:
+			return mismatch()
+		}
+		if v.OverflowInt(i) {
+			return mismatch()
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		switch n := x.(type) {
+		case uint64:
+			u = n
+		case int64:
+			if n < 0 {
+				return mismatch()
+			}
+			u = uint64(n)
+		default:
+			return mismatch()
+		}
+		if v.OverflowUint(u) {
+			return mismatch()
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		switch n := x.(type) {
+		case float64:
+			v.SetFloat(n)
+		case int64:
+			v.SetFloat(float64(n))
+		case uint64:
+			v.SetFloat(float64(n))
+		default:
+			return mismatch()
+		}
+	case reflect.String:
+		s, ok := stringOf(x)
+		if !ok {
+			return mismatch()
+		}
+		v.SetString(s)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			s, ok := stringOf(x)
+			if !ok {
+				return mismatch()
+			}
+			v.SetBytes([]byte(s))
+			return nil
+		}
+		a, ok := x.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		s := reflect.MakeSlice(v.Type(), len(a), len(a))
+		for i, e := range a {
+			if err := msgpackAssign(e, s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		a, ok := x.([]interface{})
+		if !ok || len(a) != v.Len() {
+			return mismatch()
+		}
+		for i, e := range a {
+			if err := msgpackAssign(e, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		set := func(k, e interface{}) error {
+			kv := reflect.New(v.Type().Key()).Elem()
+			if err := msgpackAssign(k, kv); err != nil {
+				return err
+			}
+			ev := reflect.New(v.Type().Elem()).Elem()
+			if err := msgpackAssign(e, ev); err != nil {
+				return err
+			}
+			m.SetMapIndex(kv, ev)
+			return nil
+		}
+		switch mx := x.(type) {
+		case map[string]interface{}:
+			for k, e := range mx {
+				if err := set(k, e); err != nil {
+					return err
+				}
+			}
+		case map[interface{}]interface{}:
+			for k, e := range mx {
+				if err := set(k, e); err != nil {
+					return err
+				}
+			}
+		default:
+			return mismatch()
+		}
+		v.Set(m)
+	case reflect.Struct:
+		mx, ok := x.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		for _, f := range msgpackFields(v.Type()) {
+			if e, ok := mx[f.name]; ok {
+				if err := msgpackAssign(e, v.Field(f.index)); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		return mismatch()
+	}
+	return nil
+}
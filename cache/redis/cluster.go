@@ -0,0 +1,211 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// clusterSlots is the number of hash slots of a redis cluster.
+const clusterSlots = 16384
+
+// maxRedirects bounds the MOVED and ASK redirections followed by one command.
+const maxRedirects = 5
+
+// cluster routes the commands to the masters of a redis cluster by the slot of their key.
+type cluster struct {
+	seeds   []string
+	newPool func(addr string) *redis.Pool
+
+	mu    sync.RWMutex
+	slots [clusterSlots]string // address of the master serving each slot
+	pools map[string]*redis.Pool
+}
+
+// newCluster loads the slots of the cluster from the first seed node answering.
+func newCluster(seeds []string, newPool func(addr string) *redis.Pool) (*cluster, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("redis: no cluster node")
+	}
+	cl := &cluster{
+		seeds:   seeds,
+		newPool: newPool,
+		pools:   make(map[string]*redis.Pool),
+	}
+	return cl, cl.refresh()
+}
+
+// pool returns the connection pool of the node at addr.
+func (cl *cluster) pool(addr string) *redis.Pool {
+	cl.mu.RLock()
+	p, ok := cl.pools[addr]
+	cl.mu.RUnlock()
+	if ok {
+		return p
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if p, ok = cl.pools[addr]; !ok {
+		p = cl.newPool(addr)
+		cl.pools[addr] = p
+	}
+	return p
+}
+
+// anyPool returns the connection pool of a master, for the commands without key.
+func (cl *cluster) anyPool() *redis.Pool {
+	return cl.pool(cl.addr(0))
+}
+
+// masterPools returns the connection pools of all masters.
+func (cl *cluster) masterPools() []*redis.Pool {
+	cl.mu.RLock()
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, addr := range cl.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	cl.mu.RUnlock()
+	pools := make([]*redis.Pool, len(addrs))
+	for i, addr := range addrs {
+		pools[i] = cl.pool(addr)
+	}
+	return pools
+}
+
+// addr returns the address of the master serving slot, a seed if unknown.
+func (cl *cluster) addr(slot int) string {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	if addr := cl.slots[slot]; addr != "" {
+		return addr
+	}
+	return cl.seeds[0]
+}
+
+// refresh reloads the slots by CLUSTER SLOTS from the seeds and the known nodes.
+func (cl *cluster) refresh() error {
+	cl.mu.RLock()
+	addrs := append([]string(nil), cl.seeds...)
+	for addr := range cl.pools {
+		addrs = append(addrs, addr)
+	}
+	cl.mu.RUnlock()
+
+	err := errors.New("redis: no cluster node")
+	for _, addr := range addrs {
+		var slots *[clusterSlots]string
+		if slots, err = cl.loadSlots(addr); err == nil {
+			cl.mu.Lock()
+			cl.slots = *slots
+			cl.mu.Unlock()
+			return nil
+		}
+	}
+	return err
+}
+
+// loadSlots asks the node at addr for the masters of the slots.
+func (cl *cluster) loadSlots(addr string) (*[clusterSlots]string, error) {
+	c := cl.pool(addr).Get()
+	defer c.Close()
+	ranges, err := redis.Values(c.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	slots := new([clusterSlots]string)
+	for _, r := range ranges {
+		// [start, end, [host, port, id], replicas...]
+		fields, err := redis.Values(r, nil)
+		if err != nil || len(fields) < 3 {
+			return nil, errors.New("redis: bad CLUSTER SLOTS reply")
+		}
+		start, err1 := redis.Int(fields[0], nil)
+		end, err2 := redis.Int(fields[1], nil)
+		master, err3 := redis.Values(fields[2], nil)
+		if err1 != nil || err2 != nil || err3 != nil || len(master) < 2 ||
+			start < 0 || end >= clusterSlots || start > end {
+			return nil, errors.New("redis: bad CLUSTER SLOTS reply")
+		}
+		host, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		if host == "" {
+			// the node does not know its own address.
+			host, _, _ = net.SplitHostPort(addr)
+		}
+		node := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = node
+		}
+	}
+	return slots, nil
+}
+
+// withConn runs fn on a connection to the master serving key, following the redirections.
+func (cl *cluster) withConn(ctx context.Context, key string, fn func(redis.Conn) (interface{}, error)) (interface{}, error) {
+	addr := cl.addr(keySlot(key))
+	asking := false
+	for i := 0; i <= maxRedirects; i++ {
+		c, err := cl.pool(addr).GetContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if asking {
+			c.Do("ASKING")
+		}
+		reply, err := fn(c)
+		c.Close()
+
+		e, ok := err.(redis.Error)
+		if !ok {
+			return reply, err
+		}
+		// MOVED <slot> <addr> or ASK <slot> <addr>
+		fields := strings.Fields(string(e))
+		if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+			return reply, err
+		}
+		addr = fields[2]
+		asking = fields[0] == "ASK"
+		if !asking {
+			// the slot has migrated for good, reload them all.
+			cl.refresh()
+		}
+	}
+	return nil, errors.New("redis: too many cluster redirections")
+}
+
+// keySlot returns the cluster slot of key.
+// only the part of key in the first {} is hashed if not empty, so keys can be kept in one slot.
+func keySlot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(crc16(key)) % clusterSlots
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum redis cluster hashes keys by.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
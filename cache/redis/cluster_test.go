@@ -0,0 +1,98 @@
+package redis
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/henrylee2cn/lessgoext/cache"
+	"github.com/henrylee2cn/lessgoext/cache/redis/redistest"
+)
+
+func TestKeySlot(t *testing.T) {
+	for key, slot := range map[string]int{
+		"foo":                  12182,
+		"somekey":              11058,
+		"{user1000}.following": keySlot("user1000"),
+		"foo{}{bar}":           keySlot("foo{}{bar}"),
+	} {
+		if s := keySlot(key); s != slot || s != redistest.Slot(key) {
+			t.Error("keySlot err", key, s, slot)
+		}
+	}
+}
+
+func TestRedisCluster(t *testing.T) {
+	a, b := newServer(t), newServer(t)
+	defer a.Close()
+	defer b.Close()
+	slots := []redistest.SlotRange{{Start: 0, End: 8191, Addr: a.Addr()}, {Start: 8192, End: 16383, Addr: b.Addr()}}
+	a.SetSlots(slots...)
+	b.SetSlots(slots...)
+
+	bm, err := cache.NewCache("redis", `{"cluster":"`+a.Addr()+`","dbNum":"1"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	tc := bm.(cache.TagCache)
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		if err = tc.PutWithTags(keys[i], i, time.Minute, "all"); err != nil {
+			t.Error("set Error", err)
+		}
+	}
+	if len(a.Keys()) < 2 || len(b.Keys()) < 2 {
+		t.Error("keys should be spread over the nodes", a.Keys(), b.Keys())
+	}
+	for _, node := range []*redistest.Server{a, b} {
+		for _, key := range node.Keys() {
+			if s := keySlot(key); (node == a) != (s <= 8191) {
+				t.Error("key on the wrong node", key, s)
+			}
+		}
+	}
+	vv := bm.GetMulti(keys)
+	for i, v := range vv {
+		if n, _ := redis.Int(v, nil); n != i {
+			t.Error("GetMulti err", i, v)
+		}
+	}
+
+	ac := bm.(cache.AtomicCache)
+	if ok, err := ac.CompareAndSwap("key1", "1", "one", time.Minute); err != nil || !ok {
+		t.Error("CompareAndSwap err", ok, err)
+	}
+	if n, err := ac.IncrBy("counter", 3); err != nil || n != 3 {
+		t.Error("IncrBy err", n, err)
+	}
+
+	// resharding: a serves all slots now, the client learns it by MOVED.
+	slots = []redistest.SlotRange{{Start: 0, End: 16383, Addr: a.Addr()}}
+	a.SetSlots(slots...)
+	b.SetSlots(slots...)
+	b.FlushAll()
+	for _, key := range keys {
+		if err = bm.Put(key, "moved", time.Minute); err != nil {
+			t.Error("set Error after resharding", err)
+		}
+	}
+	if len(b.Keys()) != 0 {
+		t.Error("keys should be put to the new node", b.Keys())
+	}
+
+	if err = tc.InvalidateTag("all"); err != nil {
+		t.Error("InvalidateTag err", err)
+	}
+	if err = tc.DeletePrefix("count"); err != nil {
+		t.Error("DeletePrefix err", err)
+	}
+	if err = bm.ClearAll(); err != nil {
+		t.Error("ClearAll err", err)
+	}
+	if keys := a.Keys(); len(keys) != 0 {
+		t.Error("ClearAll err", keys)
+	}
+}
@@ -0,0 +1,71 @@
+package redis
+
+import (
+	"io"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Subscription is a subscription to redis channels created by Cache.Subscribe.
+// it holds a dedicated connection until closed.
+type Subscription struct {
+	psc redis.PubSubConn
+	mu  sync.Mutex // serializes the writes of Close and Receive
+}
+
+// Publish posts message to channel.
+func (rc *Cache) Publish(channel string, message string) error {
+	_, err := rc.do("PUBLISH", channel, message)
+	return err
+}
+
+// Subscribe subscribes channels on a dedicated connection of the pool.
+// in cluster mode any node will do, the messages are broadcast to all nodes.
+func (rc *Cache) Subscribe(channels ...string) (*Subscription, error) {
+	c := rc.pool().Get()
+	psc := redis.PubSubConn{Conn: c}
+	args := make([]interface{}, len(channels))
+	for i, ch := range channels {
+		args[i] = ch
+	}
+	if err := psc.Subscribe(args...); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &Subscription{psc: psc}, nil
+}
+
+// Receive blocks until a message arrives and returns its data, the readTimeout option does not apply.
+// it returns io.EOF after Close, or the error if the connection broke.
+// the subscription can not be used after an error.
+func (s *Subscription) Receive() ([]byte, error) {
+	for {
+		switch v := s.psc.ReceiveWithTimeout(0).(type) {
+		case redis.Message:
+			return v.Data, nil
+		case redis.Subscription:
+			if v.Count == 0 {
+				s.close()
+				return nil, io.EOF
+			}
+		case error:
+			s.close()
+			return nil, v
+		}
+	}
+}
+
+// Close unsubscribes all channels, it can be called while Receive is blocking.
+func (s *Subscription) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.psc.Unsubscribe()
+}
+
+// close gives the connection back to the pool.
+func (s *Subscription) close() {
+	s.mu.Lock()
+	s.psc.Close()
+	s.mu.Unlock()
+}
@@ -26,13 +26,22 @@
 //
 //  bm, err := cache.NewCache("redis", `{"conn":"127.0.0.1:11211"}`)
 //
+// with sentinels, or with a cluster:
+//  bm, err := cache.NewCache("redis", `{"sentinels":"10.0.0.1:26379;10.0.0.2:26379","masterName":"mymaster"}`)
+//  bm, err := cache.NewCache("redis", `{"cluster":"10.0.0.1:7000;10.0.0.2:7000"}`)
+//
 //  more docs http://beego.me/docs/module/cache.md
 package redis
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -47,11 +56,26 @@ var (
 
 // Cache is Redis cache adapter.
 type Cache struct {
-	p        *redis.Pool // redis connection pool
+	p        *redis.Pool // redis connection pool, replaced on failover if by sentinels
+	pMu      sync.RWMutex
 	conninfo string
 	dbNum    int
 	key      string
 	password string
+	prefix   string      // prepended to every key
+	codec    cache.Codec // nil means values are sent as they are
+
+	maxIdle     int
+	maxActive   int
+	idleTimeout time.Duration
+	wait        bool
+	dialOptions []redis.DialOption
+
+	masterName      string
+	sentinels       []string
+	sentinelOptions []redis.DialOption
+
+	cluster *cluster // nil if not in cluster mode
 }
 
 // NewRedisCache create new redis cache with default collection name.
@@ -61,29 +85,125 @@ func NewRedisCache() cache.Cache {
 
 // actually do the redis cmds
 func (rc *Cache) do(commandName string, args ...interface{}) (reply interface{}, err error) {
-	c := rc.p.Get()
+	return rc.doContext(context.Background(), commandName, args...)
+}
+
+// doContext does the redis cmd within ctx, on the node serving its first argument as key.
+func (rc *Cache) doContext(ctx context.Context, commandName string, args ...interface{}) (reply interface{}, err error) {
+	var key string
+	if len(args) > 0 {
+		key, _ = args[0].(string)
+	}
+	return rc.withConn(ctx, key, func(c redis.Conn) (interface{}, error) {
+		if deadline, ok := ctx.Deadline(); ok {
+			return redis.DoWithTimeout(c, time.Until(deadline), commandName, args...)
+		}
+		return c.Do(commandName, args...)
+	})
+}
+
+// withConn runs fn on a connection to the node serving key.
+// in cluster mode the redirections are followed,
+// with sentinels a write refused by a demoted master is tried again on the new master.
+func (rc *Cache) withConn(ctx context.Context, key string, fn func(redis.Conn) (interface{}, error)) (interface{}, error) {
+	if rc.cluster != nil {
+		return rc.cluster.withConn(ctx, key, fn)
+	}
+	p := rc.pool()
+	reply, err := runConn(ctx, p, fn)
+	if rc.masterName != "" && isReadOnly(err) {
+		rc.resetPool(p)
+		return runConn(ctx, rc.pool(), fn)
+	}
+	return reply, err
+}
+
+// runConn runs fn on a connection of p.
+func runConn(ctx context.Context, p *redis.Pool, fn func(redis.Conn) (interface{}, error)) (interface{}, error) {
+	c, err := p.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer c.Close()
+	return fn(c)
+}
+
+// pool returns the connection pool, of any node in cluster mode.
+func (rc *Cache) pool() *redis.Pool {
+	if rc.cluster != nil {
+		return rc.cluster.anyPool()
+	}
+	rc.pMu.RLock()
+	defer rc.pMu.RUnlock()
+	return rc.p
+}
 
-	return c.Do(commandName, args...)
+// pools returns the connection pools of all masters.
+func (rc *Cache) pools() []*redis.Pool {
+	if rc.cluster != nil {
+		return rc.cluster.masterPools()
+	}
+	return []*redis.Pool{rc.pool()}
 }
 
 // Get cache from redis.
 func (rc *Cache) Get(key string) interface{} {
-	if v, err := rc.do("GET", key); err == nil {
+	if v, err := rc.do("GET", rc.prefix+key); err == nil {
 		return v
 	}
 	return nil
 }
 
+// GetWithTTL get cache from redis with its remaining time to live,
+// a negative ttl means the key never expires.
+func (rc *Cache) GetWithTTL(key string) (interface{}, time.Duration) {
+	key = rc.prefix + key
+	reply, err := rc.withConn(context.Background(), key, func(c redis.Conn) (interface{}, error) {
+		c.Send("GET", key)
+		c.Send("PTTL", key)
+		if err := c.Flush(); err != nil {
+			return nil, err
+		}
+		v, err := c.Receive()
+		if err != nil {
+			return nil, err
+		}
+		ms, err := redis.Int64(c.Receive())
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{v, ms}, nil
+	})
+	if err != nil {
+		return nil, 0
+	}
+	r := reply.([]interface{})
+	if r[0] == nil {
+		return nil, 0
+	}
+	ms := r[1].(int64)
+	if ms < 0 {
+		return r[0], -1
+	}
+	return r[0], time.Duration(ms) * time.Millisecond
+}
+
 // GetMulti get cache from redis.
 func (rc *Cache) GetMulti(keys []string) []interface{} {
 	size := len(keys)
 	var rv []interface{}
-	c := rc.p.Get()
+	if rc.cluster != nil {
+		// the keys may be served by different nodes.
+		for _, key := range keys {
+			rv = append(rv, rc.Get(key))
+		}
+		return rv
+	}
+	c := rc.pool().Get()
 	defer c.Close()
 	var err error
 	for _, key := range keys {
-		err = c.Send("GET", key)
+		err = c.Send("GET", rc.prefix+key)
 		if err != nil {
 			goto ERROR
 		}
@@ -109,8 +229,13 @@ ERROR:
 }
 
 // Put put cache to redis.
+// if a codec is configured, the value is stored encoded, read it back by cache.GetInto.
 func (rc *Cache) Put(key string, val interface{}, timeout time.Duration) error {
-	var err error
+	val, err := rc.encode(val)
+	if err != nil {
+		return err
+	}
+	key = rc.prefix + key
 	if _, err = rc.do("SETEX", key, int64(timeout/time.Second), val); err != nil {
 		return err
 	}
@@ -124,6 +249,7 @@ func (rc *Cache) Put(key string, val interface{}, timeout time.Duration) error {
 // Delete delete cache in redis.
 func (rc *Cache) Delete(key string) error {
 	var err error
+	key = rc.prefix + key
 	if _, err = rc.do("DEL", key); err != nil {
 		return err
 	}
@@ -133,6 +259,7 @@ func (rc *Cache) Delete(key string) error {
 
 // IsExist check cache's existence in redis.
 func (rc *Cache) IsExist(key string) bool {
+	key = rc.prefix + key
 	v, err := redis.Bool(rc.do("EXISTS", key))
 	if err != nil {
 		return false
@@ -147,43 +274,317 @@ func (rc *Cache) IsExist(key string) bool {
 
 // Incr increase counter in redis.
 func (rc *Cache) Incr(key string) error {
-	_, err := redis.Bool(rc.do("INCRBY", key, 1))
+	_, err := redis.Bool(rc.do("INCRBY", rc.prefix+key, 1))
 	return err
 }
 
 // Decr decrease counter in redis.
 func (rc *Cache) Decr(key string) error {
-	_, err := redis.Bool(rc.do("INCRBY", key, -1))
+	_, err := redis.Bool(rc.do("INCRBY", rc.prefix+key, -1))
 	return err
 }
 
+// IncrBy adds n to counter in redis and returns the new value.
+func (rc *Cache) IncrBy(key string, n int64) (int64, error) {
+	key = rc.prefix + key
+	v, err := redis.Int64(rc.do("INCRBY", key, n))
+	if err != nil {
+		return 0, err
+	}
+	_, err = rc.do("HSET", rc.key, key, true)
+	return v, err
+}
+
+// DecrBy subtracts n from counter in redis and returns the new value.
+func (rc *Cache) DecrBy(key string, n int64) (int64, error) {
+	return rc.IncrBy(key, -n)
+}
+
+// SetNX put cache to redis only if key does not exist, by SET NX.
+// timeout is kept in milliseconds, 0 means no expiry.
+func (rc *Cache) SetNX(key string, val interface{}, timeout time.Duration) (bool, error) {
+	val, err := rc.encode(val)
+	if err != nil {
+		return false, err
+	}
+	key = rc.prefix + key
+	args := []interface{}{key, val, "NX"}
+	if ms := int64(timeout / time.Millisecond); ms > 0 {
+		args = append(args, "PX", ms)
+	}
+	reply, err := rc.do("SET", args...)
+	if err != nil || reply == nil {
+		return false, err
+	}
+	_, err = rc.do("HSET", rc.key, key, true)
+	return true, err
+}
+
+// casScript sets KEYS[1] to ARGV[2] if its value is ARGV[1], with ARGV[3] milliseconds ttl.
+var casScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// CompareAndSwap put new to redis only if the stored value equals old, by a lua script.
+// old is encoded like Put does and compared with the stored bytes.
+// timeout is kept in milliseconds, 0 means no expiry.
+func (rc *Cache) CompareAndSwap(key string, old, new interface{}, timeout time.Duration) (bool, error) {
+	old, err := rc.encode(old)
+	if err != nil {
+		return false, err
+	}
+	if new, err = rc.encode(new); err != nil {
+		return false, err
+	}
+	ms := int64(timeout / time.Millisecond)
+	if ms < 0 {
+		ms = 0
+	}
+	key = rc.prefix + key
+	return redis.Bool(rc.withConn(context.Background(), key, func(c redis.Conn) (interface{}, error) {
+		return casScript.Do(c, key, old, new, ms)
+	}))
+}
+
+// cadScript deletes KEYS[1] if its value is ARGV[1].
+var cadScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('DEL', KEYS[1])
+`)
+
+// CompareAndDelete delete cache in redis only if the stored value equals old, by a lua script.
+func (rc *Cache) CompareAndDelete(key string, old interface{}) (bool, error) {
+	old, err := rc.encode(old)
+	if err != nil {
+		return false, err
+	}
+	key = rc.prefix + key
+	ok, err := redis.Bool(rc.withConn(context.Background(), key, func(c redis.Conn) (interface{}, error) {
+		return cadScript.Do(c, key, old)
+	}))
+	if err != nil || !ok {
+		return false, err
+	}
+	_, err = rc.do("HDEL", rc.key, key)
+	return true, err
+}
+
 // ClearAll clean all cache in redis. delete this redis collection.
+// the collection is walked by HSCAN, so a big one does not block the server.
 func (rc *Cache) ClearAll() error {
-	cachedKeys, err := redis.Strings(rc.do("HKEYS", rc.key))
-	if err != nil {
+	return rc.clearAll(context.Background())
+}
+
+// clearAll deletes the keys of the collection and the collection within ctx.
+func (rc *Cache) clearAll(ctx context.Context) error {
+	cursor := 0
+	for {
+		reply, err := redis.Values(rc.doContext(ctx, "HSCAN", rc.key, cursor, "COUNT", scanCount))
+		if err != nil {
+			return err
+		}
+		var fields []string
+		if reply, err = redis.Scan(reply, &cursor, &fields); err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(fields)/2)
+		for i := 0; i < len(fields); i += 2 {
+			keys = append(keys, fields[i])
+		}
+		if err = rc.del(ctx, keys); err != nil {
+			return err
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	_, err := rc.doContext(ctx, "DEL", rc.key)
+	return err
+}
+
+// del deletes keys, one by one in cluster mode since they may hash to different slots.
+func (rc *Cache) del(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if rc.cluster != nil {
+		for _, key := range keys {
+			if _, err := rc.doContext(ctx, "DEL", key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	_, err := rc.doContext(ctx, "DEL", args...)
+	return err
+}
+
+// PutWithTags put cache to redis like Put, and adds key to the set of every tag.
+// the tag sets are kept in the collection too, so ClearAll removes them.
+func (rc *Cache) PutWithTags(key string, val interface{}, timeout time.Duration, tags ...string) error {
+	if err := rc.Put(key, val, timeout); err != nil {
 		return err
 	}
-	for _, str := range cachedKeys {
-		if _, err = rc.do("DEL", str); err != nil {
+	key = rc.prefix + key
+	for _, tag := range tags {
+		set := rc.tagKey(tag)
+		if _, err := rc.do("SADD", set, key); err != nil {
+			return err
+		}
+		if _, err := rc.do("HSET", rc.key, set, true); err != nil {
 			return err
 		}
 	}
-	_, err = rc.do("DEL", rc.key)
+	return nil
+}
+
+// InvalidateTag deletes all caches put with tag.
+// the tag set is walked by SSCAN, so a big one does not block the server.
+func (rc *Cache) InvalidateTag(tag string) error {
+	set := rc.tagKey(tag)
+	cursor := 0
+	for {
+		reply, err := redis.Values(rc.do("SSCAN", set, cursor, "COUNT", scanCount))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if reply, err = redis.Scan(reply, &cursor, &keys); err != nil {
+			return err
+		}
+		if err = rc.deleteKeys(keys); err != nil {
+			return err
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	return rc.deleteKeys([]string{set})
+}
+
+// DeletePrefix deletes all caches whose key starts with prefix.
+// the keys are found by SCAN, not by KEYS which blocks the server.
+// in cluster mode every master is scanned.
+func (rc *Cache) DeletePrefix(prefix string) error {
+	pattern := escapePattern(rc.prefix+prefix) + "*"
+	for _, p := range rc.pools() {
+		cursor := 0
+		for {
+			reply, err := redis.Values(runConn(context.Background(), p, func(c redis.Conn) (interface{}, error) {
+				return c.Do("SCAN", cursor, "MATCH", pattern, "COUNT", scanCount)
+			}))
+			if err != nil {
+				return err
+			}
+			var keys []string
+			if reply, err = redis.Scan(reply, &cursor, &keys); err != nil {
+				return err
+			}
+			if err = rc.deleteKeys(keys); err != nil {
+				return err
+			}
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// deleteKeys deletes keys and removes them from the collection.
+func (rc *Cache) deleteKeys(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := rc.del(context.Background(), keys); err != nil {
+		return err
+	}
+	args := make([]interface{}, 0, len(keys)+1)
+	args = append(args, rc.key)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	_, err := rc.do("HDEL", args...)
 	return err
 }
 
+// tagKey returns the name of the redis set holding the keys of tag.
+func (rc *Cache) tagKey(tag string) string {
+	return rc.key + ":tag:" + tag
+}
+
+// scanCount is the COUNT hint of SCAN, SSCAN and HSCAN.
+const scanCount = 100
+
+// escapePattern escapes the glob characters of SCAN MATCH in s.
+func escapePattern(s string) string {
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+// encode encodes val by the codec if configured.
+func (rc *Cache) encode(val interface{}) (interface{}, error) {
+	if rc.codec == nil {
+		return val, nil
+	}
+	return rc.codec.Marshal(val)
+}
+
+// Codec returns the codec of redis cache, nil if values are sent as they are.
+func (rc *Cache) Codec() cache.Codec {
+	return rc.codec
+}
+
 // StartAndGC start redis cache adapter.
 // config is like {"key":"collection key","conn":"connection info","dbNum":"0"}
+// the optional codec, like {"codec":"json"}, encodes values by it,
+// use "json" if the values are counters of Incr and Decr.
+// the optional prefix, like {"prefix":"app1:"}, is prepended to every key, the collection key included.
+//
+// the pool and the connections are tuned by
+// {"maxIdle":"3","maxActive":"0","idleTimeout":"180s","wait":"false","dialTimeout":"5s","readTimeout":"1s","writeTimeout":"1s"},
+// a timeout is a duration like "500ms" or a number of seconds, 0 means none.
+// {"tls":"true"} connects by TLS, the server is verified as tlsServerName (the host by default) unless tlsSkipVerify is "true".
+//
+// instead of conn, sentinels and masterName follow the master by redis sentinel,
+// like {"sentinels":"10.0.0.1:26379;10.0.0.2:26379","masterName":"mymaster","sentinelPassword":""},
+// and cluster routes the keys by slot in a redis cluster, like {"cluster":"10.0.0.1:7000;10.0.0.2:7000"}.
+// a cluster has no databases, dbNum is ignored.
+//
 // the cache item in redis are stored forever,
 // so no gc operation.
 func (rc *Cache) StartAndGC(config string) error {
 	var cf map[string]string
 	json.Unmarshal([]byte(config), &cf)
+	if cf == nil {
+		cf = make(map[string]string)
+	}
 
 	if _, ok := cf["key"]; !ok {
 		cf["key"] = DefaultKey
 	}
-	if _, ok := cf["conn"]; !ok {
+	if _, ok := cf["conn"]; !ok && cf["sentinels"] == "" && cf["cluster"] == "" {
 		return errors.New("config has no conn key")
 	}
 	if _, ok := cf["dbNum"]; !ok {
@@ -192,49 +593,289 @@ func (rc *Cache) StartAndGC(config string) error {
 	if _, ok := cf["password"]; !ok {
 		cf["password"] = ""
 	}
-	rc.key = cf["key"]
+	rc.prefix = cf["prefix"]
+	rc.key = rc.prefix + cf["key"]
 	rc.conninfo = cf["conn"]
 	rc.dbNum, _ = strconv.Atoi(cf["dbNum"])
 	rc.password = cf["password"]
+	codec, err := cache.GetCodec(cf["codec"])
+	if err != nil {
+		return err
+	}
+	rc.codec = codec
+	if err = rc.parseOptions(cf); err != nil {
+		return err
+	}
 
-	rc.connectInit()
+	if err = rc.connectInit(cf); err != nil {
+		return err
+	}
 
-	c := rc.p.Get()
+	c := rc.pool().Get()
 	defer c.Close()
 
 	return c.Err()
 }
 
+// parseOptions reads the options of the pool and of the connections.
+func (rc *Cache) parseOptions(cf map[string]string) (err error) {
+	if rc.maxIdle, err = intOption(cf, "maxIdle", 3); err != nil {
+		return err
+	}
+	if rc.maxActive, err = intOption(cf, "maxActive", 0); err != nil {
+		return err
+	}
+	if rc.idleTimeout, err = durationOption(cf, "idleTimeout", 180*time.Second); err != nil {
+		return err
+	}
+	if rc.wait, err = boolOption(cf, "wait"); err != nil {
+		return err
+	}
+	dialTimeout, err := durationOption(cf, "dialTimeout", 0)
+	if err != nil {
+		return err
+	}
+	readTimeout, err := durationOption(cf, "readTimeout", 0)
+	if err != nil {
+		return err
+	}
+	writeTimeout, err := durationOption(cf, "writeTimeout", 0)
+	if err != nil {
+		return err
+	}
+	useTLS, err := boolOption(cf, "tls")
+	if err != nil {
+		return err
+	}
+	skipVerify, err := boolOption(cf, "tlsSkipVerify")
+	if err != nil {
+		return err
+	}
+
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(dialTimeout),
+		redis.DialReadTimeout(readTimeout),
+		redis.DialWriteTimeout(writeTimeout),
+	}
+	if useTLS {
+		options = append(options,
+			redis.DialUseTLS(true),
+			redis.DialTLSConfig(&tls.Config{ServerName: cf["tlsServerName"], InsecureSkipVerify: skipVerify}),
+		)
+	}
+	rc.sentinelOptions = append(options, redis.DialPassword(cf["sentinelPassword"]))
+	rc.dialOptions = append(options[:len(options):len(options)], redis.DialPassword(rc.password))
+	if cf["cluster"] == "" {
+		rc.dialOptions = append(rc.dialOptions, redis.DialDatabase(rc.dbNum))
+	}
+	return nil
+}
+
 // connect to redis.
-func (rc *Cache) connectInit() {
-	dialFunc := func() (c redis.Conn, err error) {
-		c, err = redis.Dial("tcp", rc.conninfo)
-		if err != nil {
-			return nil, err
+func (rc *Cache) connectInit(cf map[string]string) (err error) {
+	switch {
+	case cf["cluster"] != "":
+		rc.cluster, err = newCluster(splitAddrs(cf["cluster"]), func(addr string) *redis.Pool {
+			return rc.newPool(func() (redis.Conn, error) {
+				return redis.Dial("tcp", addr, rc.dialOptions...)
+			})
+		})
+		return err
+	case cf["sentinels"] != "":
+		if rc.masterName = cf["masterName"]; rc.masterName == "" {
+			return errors.New("config has no masterName key")
 		}
+		rc.sentinels = splitAddrs(cf["sentinels"])
+		rc.p = rc.newPool(rc.dialMaster)
+	default:
+		rc.p = rc.newPool(func() (redis.Conn, error) {
+			return redis.Dial("tcp", rc.conninfo, rc.dialOptions...)
+		})
+	}
+	return nil
+}
 
-		if rc.password != "" {
-			if _, err := c.Do("AUTH", rc.password); err != nil {
-				c.Close()
-				return nil, err
+// newPool initializes a new pool dialing by dial.
+func (rc *Cache) newPool(dial func() (redis.Conn, error)) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     rc.maxIdle,
+		MaxActive:   rc.maxActive,
+		IdleTimeout: rc.idleTimeout,
+		Wait:        rc.wait,
+		Dial:        dial,
+		// a connection idle for a while may have been closed by the server or a failover.
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
 			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+// intOption returns the integer option name of cf, def if absent.
+func intOption(cf map[string]string, name string, def int) (int, error) {
+	v := cf[name]
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("redis: invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+// durationOption returns the duration option name of cf, def if absent.
+// a plain number is taken as seconds.
+func durationOption(cf map[string]string, name string, def time.Duration) (time.Duration, error) {
+	v := cf[name]
+	if v == "" {
+		return def, nil
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("redis: invalid %s %q", name, v)
+	}
+	return d, nil
+}
+
+// boolOption returns the boolean option name of cf, false if absent.
+func boolOption(cf map[string]string, name string) (bool, error) {
+	v := cf[name]
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("redis: invalid %s %q", name, v)
+	}
+	return b, nil
+}
+
+// splitAddrs splits a list of addresses separated by ';' or ','.
+func splitAddrs(s string) []string {
+	var addrs []string
+	for _, addr := range strings.FieldsFunc(s, func(r rune) bool { return r == ';' || r == ',' }) {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
 		}
+	}
+	return addrs
+}
+
+// CacheV2 is the cache.CacheV2 version of Redis cache adapter.
+// the deadline of ctx is applied to getting a connection and to each command.
+type CacheV2 struct {
+	*Cache
+}
 
-		_, selecterr := c.Do("SELECT", rc.dbNum)
-		if selecterr != nil {
-			c.Close()
-			return nil, selecterr
+// NewRedisCacheV2 create new redis cache.CacheV2 with default collection name.
+func NewRedisCacheV2() cache.CacheV2 {
+	return &CacheV2{NewRedisCache().(*Cache)}
+}
+
+// actually do the redis cmds within ctx.
+func (rc *CacheV2) do(ctx context.Context, commandName string, args ...interface{}) (reply interface{}, err error) {
+	return rc.doContext(ctx, commandName, args...)
+}
+
+// Get cache from redis.
+// if non-existed or expired, return cache.ErrCacheMiss.
+func (rc *CacheV2) Get(ctx context.Context, key string) (interface{}, error) {
+	v, err := rc.do(ctx, "GET", rc.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, cache.ErrCacheMiss
+	}
+	return v, nil
+}
+
+// GetMulti get cache from redis.
+// if non-existed or expired, the value is nil.
+func (rc *CacheV2) GetMulti(ctx context.Context, keys []string) ([]interface{}, error) {
+	if rc.cluster != nil {
+		// the keys may be served by different nodes.
+		rv := make([]interface{}, len(keys))
+		for i, key := range keys {
+			v, err := rc.do(ctx, "GET", rc.prefix+key)
+			if err != nil {
+				return nil, err
+			}
+			rv[i] = v
 		}
-		return
+		return rv, nil
+	}
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = rc.prefix + key
+	}
+	return redis.Values(rc.do(ctx, "MGET", args...))
+}
+
+// Put put cache to redis.
+func (rc *CacheV2) Put(ctx context.Context, key string, val interface{}, timeout time.Duration) error {
+	val, err := rc.encode(val)
+	if err != nil {
+		return err
+	}
+	key = rc.prefix + key
+	if _, err = rc.do(ctx, "SETEX", key, int64(timeout/time.Second), val); err != nil {
+		return err
 	}
-	// initialize a new pool
-	rc.p = &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 180 * time.Second,
-		Dial:        dialFunc,
+	_, err = rc.do(ctx, "HSET", rc.key, key, true)
+	return err
+}
+
+// Delete delete cache in redis.
+func (rc *CacheV2) Delete(ctx context.Context, key string) error {
+	key = rc.prefix + key
+	if _, err := rc.do(ctx, "DEL", key); err != nil {
+		return err
 	}
+	_, err := rc.do(ctx, "HDEL", rc.key, key)
+	return err
+}
+
+// IsExist check cache's existence in redis.
+func (rc *CacheV2) IsExist(ctx context.Context, key string) (bool, error) {
+	key = rc.prefix + key
+	v, err := redis.Bool(rc.do(ctx, "EXISTS", key))
+	if err != nil {
+		return false, err
+	}
+	if !v {
+		if _, err = rc.do(ctx, "HDEL", rc.key, key); err != nil {
+			return false, err
+		}
+	}
+	return v, nil
+}
+
+// Incr increase counter in redis.
+func (rc *CacheV2) Incr(ctx context.Context, key string) error {
+	_, err := rc.do(ctx, "INCRBY", rc.prefix+key, 1)
+	return err
+}
+
+// Decr decrease counter in redis.
+func (rc *CacheV2) Decr(ctx context.Context, key string) error {
+	_, err := rc.do(ctx, "INCRBY", rc.prefix+key, -1)
+	return err
+}
+
+// ClearAll clean all cache in redis. delete this redis collection.
+func (rc *CacheV2) ClearAll(ctx context.Context) error {
+	return rc.clearAll(ctx)
 }
 
 func init() {
 	cache.Register("redis", NewRedisCache)
+	cache.RegisterV2("redis", NewRedisCacheV2)
 }
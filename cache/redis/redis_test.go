@@ -15,16 +15,47 @@
 package redis
 
 import (
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 
 	"github.com/henrylee2cn/lessgoext/cache"
+	"github.com/henrylee2cn/lessgoext/cache/redis/redistest"
 )
 
+// newServer starts a redis stand-in, serving the lua scripts of the adapter in go.
+func newServer(t *testing.T) *redistest.Server {
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal("redis stand-in err", err)
+	}
+	srv.HandleScript(casScript.Hash(), func(call func(...interface{}) (interface{}, error), keys, args []string) (interface{}, error) {
+		if v, err := call("GET", keys[0]); err != nil || v == nil || string(v.([]byte)) != args[0] {
+			return int64(0), err
+		}
+		var err error
+		if args[2] != "0" {
+			_, err = call("SET", keys[0], args[1], "PX", args[2])
+		} else {
+			_, err = call("SET", keys[0], args[1])
+		}
+		return int64(1), err
+	})
+	srv.HandleScript(cadScript.Hash(), func(call func(...interface{}) (interface{}, error), keys, args []string) (interface{}, error) {
+		if v, err := call("GET", keys[0]); err != nil || v == nil || string(v.([]byte)) != args[0] {
+			return int64(0), err
+		}
+		return call("DEL", keys[0])
+	})
+	return srv
+}
+
 func TestRedisCache(t *testing.T) {
-	bm, err := cache.NewCache("redis", `{"conn": "127.0.0.1:6379"}`)
+	srv := newServer(t)
+	defer srv.Close()
+	bm, err := cache.NewCache("redis", `{"conn": "`+srv.Addr()+`"}`)
 	if err != nil {
 		t.Error("init err")
 	}
@@ -105,3 +136,139 @@ func TestRedisCache(t *testing.T) {
 		t.Error("clear all err")
 	}
 }
+
+func TestRedisCacheAtomic(t *testing.T) {
+	srv := newServer(t)
+	defer srv.Close()
+	bm, err := cache.NewCache("redis", `{"conn": "`+srv.Addr()+`"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	ac := bm.(cache.AtomicCache)
+	defer bm.ClearAll()
+
+	if n, err := ac.IncrBy("counter", 5); err != nil || n != 5 {
+		t.Error("IncrBy err", n, err)
+	}
+	if n, err := ac.DecrBy("counter", 7); err != nil || n != -2 {
+		t.Error("DecrBy err", n, err)
+	}
+	if ok, err := ac.SetNX("lock", "a", time.Second); err != nil || !ok {
+		t.Error("SetNX err", ok, err)
+	}
+	if ok, err := ac.SetNX("lock", "b", time.Second); err != nil || ok {
+		t.Error("SetNX of existing key should not set", ok, err)
+	}
+	if ok, err := ac.CompareAndSwap("lock", "b", "c", time.Second); err != nil || ok {
+		t.Error("CompareAndSwap with wrong old value should not set", ok, err)
+	}
+	if ok, err := ac.CompareAndSwap("lock", "a", "c", time.Second); err != nil || !ok {
+		t.Error("CompareAndSwap err", ok, err)
+	}
+	if v, _ := redis.String(bm.Get("lock"), nil); v != "c" {
+		t.Error("get err", v)
+	}
+	if ok, err := ac.CompareAndDelete("lock", "c"); err != nil || !ok {
+		t.Error("CompareAndDelete err", ok, err)
+	}
+}
+
+func TestRedisPrefix(t *testing.T) {
+	srv := newServer(t)
+	defer srv.Close()
+	bm, err := cache.NewCache("redis", `{"conn":"`+srv.Addr()+`","prefix":"app1:","maxIdle":"5","maxActive":"10","idleTimeout":"1m","dialTimeout":"1s","readTimeout":"500ms","writeTimeout":"1"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	other, err := cache.NewCache("redis", `{"conn":"`+srv.Addr()+`"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	tc := bm.(cache.TagCache)
+	tc.PutWithTags("user:1", "a", time.Minute, "users")
+	tc.Put("user:2", "b", time.Minute)
+	other.Put("user:3", "c", time.Minute)
+	if keys := strings.Join(srv.Keys(), ","); keys != "app1:beecacheRedis,app1:beecacheRedis:tag:users,app1:user:1,app1:user:2,beecacheRedis,user:3" {
+		t.Error("keys are not prefixed", keys)
+	}
+	if v, _ := redis.String(bm.Get("user:1"), nil); v != "a" {
+		t.Error("get err", v)
+	}
+	if vv := bm.GetMulti([]string{"user:1", "user:2"}); len(vv) != 2 {
+		t.Error("GetMulti err", vv)
+	}
+	if err = tc.DeletePrefix("user:"); err != nil {
+		t.Error("DeletePrefix err", err)
+	}
+	if bm.IsExist("user:2") || !other.IsExist("user:3") {
+		t.Error("DeletePrefix should delete the keys of its own prefix only")
+	}
+	if err = bm.ClearAll(); err != nil {
+		t.Error("ClearAll err", err)
+	}
+	if !other.IsExist("user:3") {
+		t.Error("ClearAll should delete the keys of its own prefix only")
+	}
+}
+
+func TestRedisOptions(t *testing.T) {
+	srv := newServer(t)
+	defer srv.Close()
+	srv.RequirePassword("secret")
+	if _, err := cache.NewCache("redis", `{"conn":"`+srv.Addr()+`","maxIdle":"many"}`); err == nil {
+		t.Error("a bad option should fail")
+	}
+	if bm, err := cache.NewCache("redis", `{"conn":"`+srv.Addr()+`"}`); err != nil || bm.Put("a", "a", time.Minute) == nil {
+		t.Error("put without password should fail", err)
+	}
+	bm, err := cache.NewCache("redis", `{"conn":"`+srv.Addr()+`","password":"secret","readTimeout":"100ms"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	sub, err := bm.(*Cache).Subscribe("news")
+	if err != nil {
+		t.Fatal("Subscribe err", err)
+	}
+	defer sub.Close()
+	// the read timeout must not break a subscription waiting for messages.
+	time.Sleep(300 * time.Millisecond)
+	if err = bm.(*Cache).Publish("news", "hello"); err != nil {
+		t.Error("Publish err", err)
+	}
+	if msg, err := sub.Receive(); err != nil || string(msg) != "hello" {
+		t.Error("Receive err", string(msg), err)
+	}
+}
+
+func TestRedisSentinel(t *testing.T) {
+	master, replica, sentinel := newServer(t), newServer(t), newServer(t)
+	defer master.Close()
+	defer replica.Close()
+	defer sentinel.Close()
+	sentinel.SetMaster("mymaster", master.Addr())
+
+	bm, err := cache.NewCache("redis", `{"sentinels":"127.0.0.1:1;`+sentinel.Addr()+`","masterName":"mymaster"}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	if err = bm.Put("a", "a", time.Minute); err != nil {
+		t.Error("set Error", err)
+	}
+	if keys := master.Keys(); len(keys) != 2 {
+		t.Error("put should go to the master", keys)
+	}
+
+	// failover: the master is demoted, the replica promoted.
+	master.SetReadOnly(true)
+	sentinel.SetMaster("mymaster", replica.Addr())
+	if err = bm.Put("b", "b", time.Minute); err != nil {
+		t.Error("set Error after failover", err)
+	}
+	if keys := replica.Keys(); len(keys) != 2 {
+		t.Error("put should go to the new master", keys)
+	}
+
+	if _, err = cache.NewCache("redis", `{"sentinels":"`+sentinel.Addr()+`","masterName":"other"}`); err == nil {
+		t.Error("an unknown master should fail")
+	}
+}
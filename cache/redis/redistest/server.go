@@ -0,0 +1,1081 @@
+// Package redistest provides an in-process redis server for tests.
+//
+// it speaks RESP and implements the commands used by the cache adapters,
+// pub/sub, the SENTINEL command of a sentinel and the slot redirections of a cluster node.
+// lua is not embedded, a script is served by a go function registered with HandleScript.
+//
+// Usage:
+//
+//	srv, err := redistest.NewServer()
+//	defer srv.Close()
+//	bm, err := cache.NewCache("redis", `{"conn":"`+srv.Addr()+`"}`)
+package redistest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScriptFunc serves a script instead of lua.
+// call runs a redis command like redis.call, keys and args are KEYS and ARGV.
+// the returned value is replied like the return value of a lua script:
+// nil, int64, int, bool, string, []byte, []interface{} or an error.
+type ScriptFunc func(call func(args ...interface{}) (interface{}, error), keys []string, args []string) (interface{}, error)
+
+// SlotRange assigns the cluster slots Start to End to the node at Addr.
+type SlotRange struct {
+	Start, End int
+	Addr       string
+}
+
+// Server is an in-process redis server.
+type Server struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	data     map[string]*entry
+	clients  map[*client]struct{}
+	channels map[string]map[*client]struct{}
+	scripts  map[string]ScriptFunc
+	masters  map[string]string // sentinel: master name to address
+	slots    []SlotRange
+	password string
+	readOnly bool
+	closed   bool
+}
+
+type entry struct {
+	kind   string // "string", "hash" or "set"
+	str    []byte
+	hash   map[string][]byte
+	set    map[string]struct{}
+	expire time.Time // zero means forever
+}
+
+type client struct {
+	conn   net.Conn
+	out    chan interface{} // replies and messages, written in order by writeLoop
+	done   chan struct{}
+	authed bool
+	subs   map[string]struct{}
+}
+
+// status is a simple string reply.
+type status string
+
+// replyError is an error reply.
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+
+var (
+	statusOK      = status("OK")
+	errWrongType  = replyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errNotInteger = replyError("ERR value is not an integer or out of range")
+	errSyntax     = replyError("ERR syntax error")
+	errReadOnly   = replyError("READONLY You can't write against a read only replica.")
+)
+
+// NewServer starts a server on a random port of 127.0.0.1.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:       ln,
+		data:     make(map[string]*entry),
+		clients:  make(map[*client]struct{}),
+		channels: make(map[string]map[*client]struct{}),
+		scripts:  make(map[string]ScriptFunc),
+		masters:  make(map[string]string),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and closes all connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	err := s.ln.Close()
+	s.DropConnections()
+	return err
+}
+
+// DropConnections closes all client connections, like a restart losing no data.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+}
+
+// RequirePassword makes clients AUTH with password before any other command.
+func (s *Server) RequirePassword(password string) {
+	s.mu.Lock()
+	s.password = password
+	s.mu.Unlock()
+}
+
+// SetReadOnly makes the server refuse writes and report the replica role, like a demoted master.
+func (s *Server) SetReadOnly(readOnly bool) {
+	s.mu.Lock()
+	s.readOnly = readOnly
+	s.mu.Unlock()
+}
+
+// SetMaster makes the server answer SENTINEL get-master-addr-by-name for name with addr.
+func (s *Server) SetMaster(name, addr string) {
+	s.mu.Lock()
+	s.masters[name] = addr
+	s.mu.Unlock()
+}
+
+// SetSlots makes the server a cluster node, answering CLUSTER SLOTS with ranges,
+// and redirecting by MOVED the commands on keys of slots served by another node.
+func (s *Server) SetSlots(ranges ...SlotRange) {
+	s.mu.Lock()
+	s.slots = ranges
+	s.mu.Unlock()
+}
+
+// HandleScript serves the script of sha1 hash by fn, for both EVAL and EVALSHA.
+func (s *Server) HandleScript(sha string, fn ScriptFunc) {
+	s.mu.Lock()
+	s.scripts[strings.ToLower(sha)] = fn
+	s.mu.Unlock()
+}
+
+// Keys returns the live keys, sorted.
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys()
+}
+
+// FlushAll removes all keys.
+func (s *Server) FlushAll() {
+	s.mu.Lock()
+	s.data = make(map[string]*entry)
+	s.mu.Unlock()
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &client{
+			conn: conn,
+			out:  make(chan interface{}, 1024),
+			done: make(chan struct{}),
+			subs: make(map[string]struct{}),
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.clients[c] = struct{}{}
+		s.mu.Unlock()
+		go s.handle(c)
+		go c.writeLoop()
+	}
+}
+
+func (s *Server) handle(c *client) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		for ch := range c.subs {
+			delete(s.channels[ch], c)
+		}
+		s.mu.Unlock()
+		close(c.done)
+		c.conn.Close()
+	}()
+	r := bufio.NewReader(c.conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if strings.ToUpper(args[0]) == "QUIT" {
+			c.write(statusOK)
+			return
+		}
+		s.exec(c, args)
+	}
+}
+
+// exec runs a command of client c and queues its replies,
+// more than one for SUBSCRIBE and UNSUBSCRIBE.
+// they are queued with s.mu held, so no published message overtakes them.
+func (s *Server) exec(c *client, args []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, reply := range s.replies(c, args) {
+		c.write(reply)
+	}
+}
+
+func (s *Server) replies(c *client, args []string) []interface{} {
+	name := strings.ToUpper(args[0])
+	if s.password != "" && !c.authed && name != "AUTH" {
+		return []interface{}{replyError("NOAUTH Authentication required.")}
+	}
+	switch name {
+	case "AUTH":
+		if len(args) != 2 {
+			return []interface{}{wrongArgs(name)}
+		}
+		if s.password == "" {
+			return []interface{}{replyError("ERR Client sent AUTH, but no password is set")}
+		}
+		if args[1] != s.password {
+			return []interface{}{replyError("ERR invalid password")}
+		}
+		c.authed = true
+		return []interface{}{statusOK}
+	case "SUBSCRIBE":
+		if len(args) < 2 {
+			return []interface{}{wrongArgs(name)}
+		}
+		var replies []interface{}
+		for _, ch := range args[1:] {
+			if s.channels[ch] == nil {
+				s.channels[ch] = make(map[*client]struct{})
+			}
+			s.channels[ch][c] = struct{}{}
+			c.subs[ch] = struct{}{}
+			replies = append(replies, []interface{}{[]byte("subscribe"), []byte(ch), int64(len(c.subs))})
+		}
+		return replies
+	case "UNSUBSCRIBE":
+		channels := args[1:]
+		if len(channels) == 0 {
+			for ch := range c.subs {
+				channels = append(channels, ch)
+			}
+			sort.Strings(channels)
+		}
+		if len(channels) == 0 {
+			return []interface{}{[]interface{}{[]byte("unsubscribe"), nil, int64(0)}}
+		}
+		var replies []interface{}
+		for _, ch := range channels {
+			delete(s.channels[ch], c)
+			delete(c.subs, ch)
+			replies = append(replies, []interface{}{[]byte("unsubscribe"), []byte(ch), int64(len(c.subs))})
+		}
+		return replies
+	case "PUBLISH":
+		if len(args) != 3 {
+			return []interface{}{wrongArgs(name)}
+		}
+		msg := []interface{}{[]byte("message"), []byte(args[1]), []byte(args[2])}
+		var n int64
+		for sub := range s.channels[args[1]] {
+			sub.write(msg)
+			n++
+		}
+		return []interface{}{n}
+	}
+	if len(c.subs) > 0 && name != "PING" {
+		return []interface{}{replyError("ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context")}
+	}
+	return []interface{}{s.command(args)}
+}
+
+// command runs a command with s.mu held, it is redis.call of the scripts too.
+func (s *Server) command(args []string) interface{} {
+	name := strings.ToUpper(args[0])
+	spec, found := commands[name]
+	if !found {
+		return replyError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	if len(args) < spec.minArgs || (spec.maxArgs > 0 && len(args) > spec.maxArgs) {
+		return wrongArgs(name)
+	}
+	if spec.write && s.readOnly {
+		return errReadOnly
+	}
+	if len(s.slots) > 0 {
+		if err := s.checkSlots(spec.keys(args)); err != nil {
+			return err
+		}
+	}
+	return spec.fn(s, args)
+}
+
+// checkSlots redirects the keys of a slot served by another node.
+func (s *Server) checkSlots(keys []string) interface{} {
+	slot := -1
+	for _, key := range keys {
+		ks := Slot(key)
+		if slot >= 0 && ks != slot {
+			return replyError("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+		slot = ks
+	}
+	if slot < 0 {
+		return nil
+	}
+	for _, r := range s.slots {
+		if slot >= r.Start && slot <= r.End {
+			if r.Addr == s.Addr() {
+				return nil
+			}
+			return replyError(fmt.Sprintf("MOVED %d %s", slot, r.Addr))
+		}
+	}
+	return replyError("CLUSTERDOWN Hash slot not served")
+}
+
+type command struct {
+	minArgs, maxArgs int // maxArgs 0 means unlimited
+	write            bool
+	keys             func(args []string) []string
+	fn               func(s *Server, args []string) interface{}
+}
+
+func firstKey(args []string) []string { return args[1:2] }
+func allKeys(args []string) []string  { return args[1:] }
+func noKeys(args []string) []string   { return nil }
+
+func scriptKeys(args []string) []string {
+	n, err := strconv.Atoi(args[2])
+	if err != nil || n < 0 || 3+n > len(args) {
+		return nil
+	}
+	return args[3 : 3+n]
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"PING":     {1, 2, false, noKeys, cmdPing},
+		"ECHO":     {2, 2, false, noKeys, func(s *Server, args []string) interface{} { return []byte(args[1]) }},
+		"SELECT":   {2, 2, false, noKeys, func(s *Server, args []string) interface{} { return statusOK }},
+		"ASKING":   {1, 1, false, noKeys, func(s *Server, args []string) interface{} { return statusOK }},
+		"ROLE":     {1, 1, false, noKeys, cmdRole},
+		"FLUSHDB":  {1, 2, true, noKeys, cmdFlush},
+		"FLUSHALL": {1, 2, true, noKeys, cmdFlush},
+		"DBSIZE":   {1, 1, false, noKeys, func(s *Server, args []string) interface{} { return int64(len(s.keys())) }},
+		"GET":      {2, 2, false, firstKey, cmdGet},
+		"SET":      {3, 0, true, firstKey, cmdSet},
+		"SETEX":    {4, 4, true, firstKey, cmdSetEx},
+		"MGET":     {2, 0, false, allKeys, cmdMGet},
+		"DEL":      {2, 0, true, allKeys, cmdDel},
+		"EXISTS":   {2, 0, false, allKeys, cmdExists},
+		"INCR":     {2, 2, true, firstKey, cmdIncr},
+		"DECR":     {2, 2, true, firstKey, cmdIncr},
+		"INCRBY":   {3, 3, true, firstKey, cmdIncr},
+		"DECRBY":   {3, 3, true, firstKey, cmdIncr},
+		"EXPIRE":   {3, 3, true, firstKey, cmdExpire},
+		"PEXPIRE":  {3, 3, true, firstKey, cmdExpire},
+		"TTL":      {2, 2, false, firstKey, cmdTTL},
+		"PTTL":     {2, 2, false, firstKey, cmdTTL},
+		"HSET":     {4, 0, true, firstKey, cmdHSet},
+		"HGET":     {3, 3, false, firstKey, cmdHGet},
+		"HDEL":     {3, 0, true, firstKey, cmdHDel},
+		"HLEN":     {2, 2, false, firstKey, cmdHLen},
+		"HSCAN":    {3, 0, false, firstKey, cmdHScan},
+		"SADD":     {3, 0, true, firstKey, cmdSAdd},
+		"SREM":     {3, 0, true, firstKey, cmdSRem},
+		"SMEMBERS": {2, 2, false, firstKey, cmdSMembers},
+		"SSCAN":    {3, 0, false, firstKey, cmdSScan},
+		"SCAN":     {2, 0, false, noKeys, cmdScan},
+		"EVAL":     {3, 0, true, scriptKeys, cmdEval},
+		"EVALSHA":  {3, 0, true, scriptKeys, cmdEval},
+		"SCRIPT":   {2, 0, false, noKeys, cmdScript},
+		"SENTINEL": {2, 0, false, noKeys, cmdSentinel},
+		"CLUSTER":  {2, 0, false, noKeys, cmdCluster},
+	}
+}
+
+func wrongArgs(name string) replyError {
+	return replyError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+}
+
+// lookup returns the live entry of key, removing it if expired.
+func (s *Server) lookup(key string) *entry {
+	e, found := s.data[key]
+	if !found {
+		return nil
+	}
+	if !e.expire.IsZero() && !time.Now().Before(e.expire) {
+		delete(s.data, key)
+		return nil
+	}
+	return e
+}
+
+// lookupKind returns the live entry of key if it is of kind, or errWrongType.
+func (s *Server) lookupKind(key, kind string) (*entry, interface{}) {
+	e := s.lookup(key)
+	if e != nil && e.kind != kind {
+		return nil, errWrongType
+	}
+	return e, nil
+}
+
+// keys returns the live keys, sorted.
+func (s *Server) keys() []string {
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		if s.lookup(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func cmdPing(s *Server, args []string) interface{} {
+	if len(args) == 2 {
+		return []byte(args[1])
+	}
+	return status("PONG")
+}
+
+func cmdRole(s *Server, args []string) interface{} {
+	if s.readOnly {
+		return []interface{}{[]byte("slave"), []byte("127.0.0.1"), int64(0), []byte("connected"), int64(0)}
+	}
+	return []interface{}{[]byte("master"), int64(0), []interface{}{}}
+}
+
+func cmdFlush(s *Server, args []string) interface{} {
+	s.data = make(map[string]*entry)
+	return statusOK
+}
+
+func cmdGet(s *Server, args []string) interface{} {
+	e, err := s.lookupKind(args[1], "string")
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return nil
+	}
+	return e.str
+}
+
+func cmdSet(s *Server, args []string) interface{} {
+	var nx, xx bool
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return replyError("ERR invalid expire time in set")
+			}
+			unit := time.Second
+			if strings.ToUpper(args[i]) == "PX" {
+				unit = time.Millisecond
+			}
+			ttl = time.Duration(n) * unit
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	exists := s.lookup(args[1]) != nil
+	if (nx && exists) || (xx && !exists) {
+		return nil
+	}
+	s.setString(args[1], []byte(args[2]), ttl)
+	return statusOK
+}
+
+func cmdSetEx(s *Server, args []string) interface{} {
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	if n <= 0 {
+		return replyError("ERR invalid expire time in setex")
+	}
+	s.setString(args[1], []byte(args[3]), time.Duration(n)*time.Second)
+	return statusOK
+}
+
+func (s *Server) setString(key string, value []byte, ttl time.Duration) {
+	e := &entry{kind: "string", str: value}
+	if ttl > 0 {
+		e.expire = time.Now().Add(ttl)
+	}
+	s.data[key] = e
+}
+
+func cmdMGet(s *Server, args []string) interface{} {
+	values := make([]interface{}, 0, len(args)-1)
+	for _, key := range args[1:] {
+		if e := s.lookup(key); e != nil && e.kind == "string" {
+			values = append(values, e.str)
+		} else {
+			values = append(values, nil)
+		}
+	}
+	return values
+}
+
+func cmdDel(s *Server, args []string) interface{} {
+	var n int64
+	for _, key := range args[1:] {
+		if s.lookup(key) != nil {
+			delete(s.data, key)
+			n++
+		}
+	}
+	return n
+}
+
+func cmdExists(s *Server, args []string) interface{} {
+	var n int64
+	for _, key := range args[1:] {
+		if s.lookup(key) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func cmdIncr(s *Server, args []string) interface{} {
+	by := int64(1)
+	if len(args) == 3 {
+		var err error
+		if by, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+			return errNotInteger
+		}
+	}
+	if name := strings.ToUpper(args[0]); name == "DECR" || name == "DECRBY" {
+		by = -by
+	}
+	e, rerr := s.lookupKind(args[1], "string")
+	if rerr != nil {
+		return rerr
+	}
+	var n int64
+	if e != nil {
+		var err error
+		if n, err = strconv.ParseInt(string(e.str), 10, 64); err != nil {
+			return errNotInteger
+		}
+	} else {
+		e = &entry{kind: "string"}
+		s.data[args[1]] = e
+	}
+	if (by > 0 && n > maxInt64-by) || (by < 0 && n < minInt64-by) {
+		return replyError("ERR increment or decrement would overflow")
+	}
+	n += by
+	e.str = []byte(strconv.FormatInt(n, 10))
+	return n
+}
+
+const (
+	maxInt64 = 1<<63 - 1
+	minInt64 = -1 << 63
+)
+
+func cmdExpire(s *Server, args []string) interface{} {
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	e := s.lookup(args[1])
+	if e == nil {
+		return int64(0)
+	}
+	unit := time.Second
+	if strings.ToUpper(args[0]) == "PEXPIRE" {
+		unit = time.Millisecond
+	}
+	e.expire = time.Now().Add(time.Duration(n) * unit)
+	s.lookup(args[1]) // a non positive ttl deletes the key
+	return int64(1)
+}
+
+func cmdTTL(s *Server, args []string) interface{} {
+	e := s.lookup(args[1])
+	if e == nil {
+		return int64(-2)
+	}
+	if e.expire.IsZero() {
+		return int64(-1)
+	}
+	unit := time.Second
+	if strings.ToUpper(args[0]) == "PTTL" {
+		unit = time.Millisecond
+	}
+	return int64((time.Until(e.expire) + unit - 1) / unit)
+}
+
+func cmdHSet(s *Server, args []string) interface{} {
+	if len(args)%2 != 0 {
+		return wrongArgs("HSET")
+	}
+	e, err := s.lookupKind(args[1], "hash")
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		e = &entry{kind: "hash", hash: make(map[string][]byte)}
+		s.data[args[1]] = e
+	}
+	var n int64
+	for i := 2; i < len(args); i += 2 {
+		if _, found := e.hash[args[i]]; !found {
+			n++
+		}
+		e.hash[args[i]] = []byte(args[i+1])
+	}
+	return n
+}
+
+func cmdHGet(s *Server, args []string) interface{} {
+	e, err := s.lookupKind(args[1], "hash")
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return nil
+	}
+	if v, found := e.hash[args[2]]; found {
+		return v
+	}
+	return nil
+}
+
+func cmdHDel(s *Server, args []string) interface{} {
+	e, err := s.lookupKind(args[1], "hash")
+	if err != nil || e == nil {
+		if err != nil {
+			return err
+		}
+		return int64(0)
+	}
+	var n int64
+	for _, field := range args[2:] {
+		if _, found := e.hash[field]; found {
+			delete(e.hash, field)
+			n++
+		}
+	}
+	if len(e.hash) == 0 {
+		delete(s.data, args[1])
+	}
+	return n
+}
+
+func cmdHLen(s *Server, args []string) interface{} {
+	e, err := s.lookupKind(args[1], "hash")
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return int64(0)
+	}
+	return int64(len(e.hash))
+}
+
+func cmdHScan(s *Server, args []string) interface{} {
+	e, err := s.lookupKind(args[1], "hash")
+	if err != nil {
+		return err
+	}
+	var fields []string
+	if e != nil {
+		for field := range e.hash {
+			fields = append(fields, field)
+		}
+	}
+	return scan(fields, args[2:], func(field string) []interface{} {
+		return []interface{}{[]byte(field), e.hash[field]}
+	})
+}
+
+func cmdSAdd(s *Server, args []string) interface{} {
+	e, err := s.lookupKind(args[1], "set")
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		e = &entry{kind: "set", set: make(map[string]struct{})}
+		s.data[args[1]] = e
+	}
+	var n int64
+	for _, member := range args[2:] {
+		if _, found := e.set[member]; !found {
+			e.set[member] = struct{}{}
+			n++
+		}
+	}
+	return n
+}
+
+func cmdSRem(s *Server, args []string) interface{} {
+	e, err := s.lookupKind(args[1], "set")
+	if err != nil || e == nil {
+		if err != nil {
+			return err
+		}
+		return int64(0)
+	}
+	var n int64
+	for _, member := range args[2:] {
+		if _, found := e.set[member]; found {
+			delete(e.set, member)
+			n++
+		}
+	}
+	if len(e.set) == 0 {
+		delete(s.data, args[1])
+	}
+	return n
+}
+
+func cmdSMembers(s *Server, args []string) interface{} {
+	e, err := s.lookupKind(args[1], "set")
+	if err != nil {
+		return err
+	}
+	members := []interface{}{}
+	if e != nil {
+		for _, member := range sortedSet(e.set) {
+			members = append(members, []byte(member))
+		}
+	}
+	return members
+}
+
+func cmdSScan(s *Server, args []string) interface{} {
+	e, err := s.lookupKind(args[1], "set")
+	if err != nil {
+		return err
+	}
+	var members []string
+	if e != nil {
+		members = sortedSet(e.set)
+	}
+	return scan(members, args[2:], func(member string) []interface{} {
+		return []interface{}{[]byte(member)}
+	})
+}
+
+func cmdScan(s *Server, args []string) interface{} {
+	return scan(s.keys(), args[1:], func(key string) []interface{} {
+		return []interface{}{[]byte(key)}
+	})
+}
+
+func sortedSet(set map[string]struct{}) []string {
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// scan pages through items by the args "cursor [MATCH pattern] [COUNT count]".
+// the cursor is the index of the next item in the sorted items.
+func scan(items []string, args []string, reply func(item string) []interface{}) interface{} {
+	sort.Strings(items)
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		return replyError("ERR invalid cursor")
+	}
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errSyntax
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				return errSyntax
+			}
+		default:
+			return errSyntax
+		}
+	}
+	page := []interface{}{}
+	for ; cursor < len(items) && count > 0; cursor, count = cursor+1, count-1 {
+		// path.Match has the glob syntax of redis, escapes included.
+		if matched, _ := path.Match(pattern, items[cursor]); matched {
+			page = append(page, reply(items[cursor])...)
+		}
+	}
+	if cursor >= len(items) {
+		cursor = 0
+	}
+	return []interface{}{[]byte(strconv.Itoa(cursor)), page}
+}
+
+func cmdEval(s *Server, args []string) interface{} {
+	sha := strings.ToLower(args[1])
+	if strings.ToUpper(args[0]) == "EVAL" {
+		sha = hash(args[1])
+	}
+	fn, found := s.scripts[sha]
+	if !found {
+		if strings.ToUpper(args[0]) == "EVAL" {
+			return replyError("ERR redistest: script " + sha + " is not handled")
+		}
+		return replyError("NOSCRIPT No matching script. Please use EVAL.")
+	}
+	n, err := strconv.Atoi(args[2])
+	if err != nil || n < 0 || 3+n > len(args) {
+		return replyError("ERR Number of keys can't be greater than number of args")
+	}
+	call := func(args ...interface{}) (interface{}, error) {
+		strs := make([]string, len(args))
+		for i, arg := range args {
+			strs[i] = fmt.Sprint(arg)
+		}
+		reply := s.command(strs)
+		if err, isErr := reply.(replyError); isErr {
+			return nil, err
+		}
+		if st, isStatus := reply.(status); isStatus {
+			return string(st), nil
+		}
+		return reply, nil
+	}
+	reply, rerr := fn(call, args[3:3+n], args[3+n:])
+	if rerr != nil {
+		if e, isErr := rerr.(replyError); isErr {
+			return e
+		}
+		return replyError("ERR " + rerr.Error())
+	}
+	return reply
+}
+
+func cmdScript(s *Server, args []string) interface{} {
+	switch strings.ToUpper(args[1]) {
+	case "LOAD":
+		if len(args) != 3 {
+			return wrongArgs("SCRIPT")
+		}
+		return []byte(hash(args[2]))
+	case "EXISTS":
+		found := make([]interface{}, 0, len(args)-2)
+		for _, sha := range args[2:] {
+			if _, ok := s.scripts[strings.ToLower(sha)]; ok {
+				found = append(found, int64(1))
+			} else {
+				found = append(found, int64(0))
+			}
+		}
+		return found
+	}
+	return errSyntax
+}
+
+func cmdSentinel(s *Server, args []string) interface{} {
+	if strings.ToLower(args[1]) != "get-master-addr-by-name" || len(args) != 3 {
+		return errSyntax
+	}
+	addr, found := s.masters[args[2]]
+	if !found {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return replyError("ERR " + err.Error())
+	}
+	return []interface{}{[]byte(host), []byte(port)}
+}
+
+func cmdCluster(s *Server, args []string) interface{} {
+	switch strings.ToUpper(args[1]) {
+	case "SLOTS":
+		if len(s.slots) == 0 {
+			return replyError("ERR This instance has cluster support disabled")
+		}
+		ranges := make([]interface{}, 0, len(s.slots))
+		for _, r := range s.slots {
+			host, port, _ := net.SplitHostPort(r.Addr)
+			p, _ := strconv.ParseInt(port, 10, 64)
+			ranges = append(ranges, []interface{}{int64(r.Start), int64(r.End), []interface{}{[]byte(host), p, []byte(hash(r.Addr))}})
+		}
+		return ranges
+	case "KEYSLOT":
+		if len(args) != 3 {
+			return wrongArgs("CLUSTER")
+		}
+		return int64(Slot(args[2]))
+	}
+	return errSyntax
+}
+
+func hash(s string) string {
+	h := sha1.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// Slot returns the cluster slot of key, honoring {hash tags}.
+func Slot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return int(crc) % 16384
+}
+
+// readCommand reads a command sent as a RESP array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		// inline command
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, errors.New("redistest: bad array length")
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if line, err = readLine(r); err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errors.New("redistest: bulk string expected")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, errors.New("redistest: bad bulk string length")
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// write queues reply to the client.
+func (c *client) write(reply interface{}) {
+	select {
+	case c.out <- reply:
+	case <-c.done:
+	}
+}
+
+// writeLoop writes the queued replies until the connection is closed.
+func (c *client) writeLoop() {
+	w := bufio.NewWriter(c.conn)
+	for {
+		select {
+		case reply := <-c.out:
+			writeReply(w, reply)
+			if len(c.out) == 0 {
+				if err := w.Flush(); err != nil {
+					return
+				}
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case status:
+		w.WriteString("+" + string(v) + "\r\n")
+	case replyError:
+		w.WriteString("-" + string(v) + "\r\n")
+	case error:
+		w.WriteString("-ERR " + v.Error() + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case int:
+		w.WriteString(":" + strconv.Itoa(v) + "\r\n")
+	case bool:
+		// like lua, true is 1 and false is nil.
+		if v {
+			w.WriteString(":1\r\n")
+		} else {
+			w.WriteString("$-1\r\n")
+		}
+	case string:
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n")
+	case []byte:
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n")
+		w.Write(v)
+		w.WriteString("\r\n")
+	case []interface{}:
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	default:
+		w.WriteString(fmt.Sprintf("-ERR redistest: unsupported reply %T\r\n", reply))
+	}
+}
@@ -0,0 +1,74 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// dialMaster dials the master named rc.masterName, as reported by the first sentinel answering.
+func (rc *Cache) dialMaster() (redis.Conn, error) {
+	addr, err := rc.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+	c, err := redis.Dial("tcp", addr, rc.dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	// a sentinel may report a demoted master until it notices the failover.
+	role, err := redis.Values(c.Do("ROLE"))
+	if err == nil && len(role) > 0 {
+		if name, _ := redis.String(role[0], nil); name != "master" {
+			err = fmt.Errorf("redis: %s is not the master but a %s", addr, name)
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// masterAddr asks the sentinels in turn for the address of the master.
+func (rc *Cache) masterAddr() (string, error) {
+	err := errors.New("redis: no sentinel")
+	for _, sentinel := range rc.sentinels {
+		var c redis.Conn
+		if c, err = redis.Dial("tcp", sentinel, rc.sentinelOptions...); err != nil {
+			continue
+		}
+		var reply []string
+		reply, err = redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", rc.masterName))
+		c.Close()
+		if err == nil && len(reply) == 2 {
+			return net.JoinHostPort(reply[0], reply[1]), nil
+		}
+		if err == nil || err == redis.ErrNil {
+			err = fmt.Errorf("redis: sentinel %s does not know master %s", sentinel, rc.masterName)
+		}
+	}
+	return "", err
+}
+
+// resetPool replaces the pool p after a failover, unless it was replaced already.
+// the connections of p are to the demoted master, they are closed.
+func (rc *Cache) resetPool(p *redis.Pool) {
+	rc.pMu.Lock()
+	defer rc.pMu.Unlock()
+	if rc.p != p {
+		return
+	}
+	rc.p = rc.newPool(rc.dialMaster)
+	// the connections in use are closed when put back.
+	p.Close()
+}
+
+// isReadOnly reports whether err is the reply of a replica to a write.
+func isReadOnly(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(e), "READONLY ")
+}
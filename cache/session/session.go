@@ -0,0 +1,306 @@
+// Package session for session provider
+//
+// a session provider storing the sessions in any cache adapter, like memory, file, redis or ssdb,
+// so the sessions reuse the backends of the cache.
+// every session expires maxlifetime seconds after it was last used.
+//
+// Usage:
+// import(
+//   _ "github.com/henrylee2cn/lessgoext/cache/redis"
+//   _ "github.com/henrylee2cn/lessgoext/cache/session"
+// )
+//
+// then name "cache" as the provider of the lessgo session manager, with a provider config like
+//
+//	{"adapter":"redis","config":"{\"conn\":\"127.0.0.1:6379\"}","prefix":"session:"}
+//
+// or register a provider of a cache at hand:
+//
+//	session.Register("mycache", cachesession.NewProvider(bm))
+package session
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	lessgosession "github.com/henrylee2cn/lessgo/session"
+
+	"github.com/henrylee2cn/lessgoext/cache"
+	"github.com/henrylee2cn/lessgoext/uuid"
+)
+
+var (
+	// DefaultAdapter is the cache adapter if the provider config has no adapter.
+	DefaultAdapter = "memory"
+	// DefaultPrefix is prepended to the session id for the cache key if the provider config has no prefix.
+	DefaultPrefix = "session:"
+)
+
+var errNoCache = errors.New("session: provider has no cache, call SessionInit first")
+
+func init() {
+	lessgosession.Register("cache", NewProvider(nil))
+}
+
+// NewSessionID returns a new session id, the 32 hex digits of a random (version 4) UUID.
+// the randomness comes from crypto/rand unless replaced by uuid.SetRand.
+func NewSessionID() (string, error) {
+	u, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(u[:]), nil
+}
+
+// Provider stores sessions in a cache adapter.
+type Provider struct {
+	mu          sync.RWMutex
+	cache       cache.Cache
+	prefix      string
+	maxlifetime time.Duration
+}
+
+// data is what a session is stored as.
+type data struct {
+	Values   map[interface{}]interface{}
+	Accessed int64 // unix nanoseconds of the last use
+}
+
+// NewProvider returns a provider storing the sessions in c.
+// if c is nil, the cache is created in method SessionInit from the provider config.
+func NewProvider(c cache.Cache) *Provider {
+	return &Provider{cache: c, prefix: DefaultPrefix}
+}
+
+// SessionInit sets the lifetime of the sessions in seconds and creates the cache if the provider has none.
+// config is like {"adapter":"redis","config":"{\"conn\":\"127.0.0.1:6379\"}","prefix":"session:"},
+// where config is the config of the cache adapter.
+func (p *Provider) SessionInit(maxlifetime int64, config string) error {
+	var cf struct {
+		Adapter string `json:"adapter"`
+		Config  string `json:"config"`
+		Prefix  string `json:"prefix"`
+	}
+	if config != "" {
+		if err := json.Unmarshal([]byte(config), &cf); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cf.Prefix != "" {
+		p.prefix = cf.Prefix
+	}
+	p.maxlifetime = time.Duration(maxlifetime) * time.Second
+	if p.cache != nil {
+		return nil
+	}
+	if cf.Adapter == "" {
+		cf.Adapter = DefaultAdapter
+	}
+	c, err := cache.NewCache(cf.Adapter, cf.Config)
+	if err != nil {
+		return err
+	}
+	p.cache = c
+	return nil
+}
+
+// SessionRead returns the session of sid, a new empty one if not existed or expired.
+// an empty sid gets a new id by NewSessionID.
+// reading a session past half its lifetime renews it.
+func (p *Provider) SessionRead(sid string) (lessgosession.Store, error) {
+	c, prefix, maxlifetime, err := p.config()
+	if err != nil {
+		return nil, err
+	}
+	if sid == "" {
+		if sid, err = NewSessionID(); err != nil {
+			return nil, err
+		}
+	}
+	d, ok := p.load(c, prefix+sid, maxlifetime)
+	if !ok {
+		d = &data{Values: make(map[interface{}]interface{})}
+	}
+	now := time.Now()
+	s := &Store{p: p, sid: sid, values: d.Values}
+	if ok && maxlifetime > 0 && now.Sub(time.Unix(0, d.Accessed)) > maxlifetime/2 {
+		// sliding expiration without waiting for a write.
+		d.Accessed = now.UnixNano()
+		if err = p.save(c, prefix+sid, d, maxlifetime); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// SessionExist reports whether the session of sid exists.
+func (p *Provider) SessionExist(sid string) bool {
+	c, prefix, maxlifetime, err := p.config()
+	if err != nil {
+		return false
+	}
+	_, ok := p.load(c, prefix+sid, maxlifetime)
+	return ok
+}
+
+// SessionRegenerate moves the session of oldsid to sid and returns it.
+// an empty sid gets a new id by NewSessionID, a missing old session gives a new empty one.
+func (p *Provider) SessionRegenerate(oldsid, sid string) (lessgosession.Store, error) {
+	c, prefix, maxlifetime, err := p.config()
+	if err != nil {
+		return nil, err
+	}
+	if sid == "" {
+		if sid, err = NewSessionID(); err != nil {
+			return nil, err
+		}
+	}
+	d, ok := p.load(c, prefix+oldsid, maxlifetime)
+	if !ok {
+		d = &data{Values: make(map[interface{}]interface{})}
+	}
+	d.Accessed = time.Now().UnixNano()
+	if err = p.save(c, prefix+sid, d, maxlifetime); err != nil {
+		return nil, err
+	}
+	if ok {
+		if err = c.Delete(prefix + oldsid); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{p: p, sid: sid, values: d.Values}, nil
+}
+
+// SessionDestroy deletes the session of sid.
+func (p *Provider) SessionDestroy(sid string) error {
+	c, prefix, _, err := p.config()
+	if err != nil {
+		return err
+	}
+	if err = c.Delete(prefix + sid); err != nil && c.IsExist(prefix+sid) {
+		return err
+	}
+	return nil
+}
+
+// SessionGC does nothing, the sessions are put with their lifetime and expire in the cache adapter,
+// whose own GC removes them.
+func (p *Provider) SessionGC() {}
+
+// SessionAll returns 0, the cache adapters can not count their keys.
+func (p *Provider) SessionAll() int {
+	return 0
+}
+
+func (p *Provider) config() (cache.Cache, string, time.Duration, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.cache == nil {
+		return nil, "", 0, errNoCache
+	}
+	return p.cache, p.prefix, p.maxlifetime, nil
+}
+
+// load gets the session stored under key.
+// a session unused for maxlifetime is expired even if the adapter still keeps it,
+// like memcache with lifetimes over 30 days or the file adapter between its sweeps.
+func (p *Provider) load(c cache.Cache, key string, maxlifetime time.Duration) (*data, bool) {
+	var b []byte
+	if cache.GetInto(c, key, &b) != nil || len(b) == 0 {
+		return nil, false
+	}
+	d := new(data)
+	if cache.GobCodec.Unmarshal(b, d) != nil {
+		return nil, false
+	}
+	if maxlifetime > 0 && time.Since(time.Unix(0, d.Accessed)) > maxlifetime {
+		c.Delete(key)
+		return nil, false
+	}
+	if d.Values == nil {
+		d.Values = make(map[interface{}]interface{})
+	}
+	return d, true
+}
+
+// save puts the session under key, gob encoded to bytes so it fits every adapter.
+func (p *Provider) save(c cache.Cache, key string, d *data, maxlifetime time.Duration) error {
+	b, err := cache.GobCodec.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return c.Put(key, b, maxlifetime)
+}
+
+// Store is a session stored in a cache adapter.
+// the values are written back by SessionRelease.
+// a value of a type other than the builtin ones must be registered by gob.Register.
+type Store struct {
+	p      *Provider
+	sid    string
+	mu     sync.RWMutex
+	values map[interface{}]interface{}
+	dirty  bool
+}
+
+// Set value in session.
+func (s *Store) Set(key, value interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	s.dirty = true
+	return nil
+}
+
+// Get value from session.
+func (s *Store) Get(key interface{}) interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.values[key]
+}
+
+// Delete value in session.
+func (s *Store) Delete(key interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	s.dirty = true
+	return nil
+}
+
+// Flush clears all values in session.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = make(map[interface{}]interface{})
+	s.dirty = true
+	return nil
+}
+
+// SessionID returns the id of session.
+func (s *Store) SessionID() string {
+	return s.sid
+}
+
+// SessionRelease saves the session if it was changed, renewing its lifetime.
+// an unchanged session is not written, so it does not overwrite the changes of concurrent requests.
+func (s *Store) SessionRelease(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return
+	}
+	c, prefix, maxlifetime, err := s.p.config()
+	if err != nil {
+		return
+	}
+	if s.p.save(c, prefix+s.sid, &data{Values: s.values, Accessed: time.Now().UnixNano()}, maxlifetime) == nil {
+		s.dirty = false
+	}
+}
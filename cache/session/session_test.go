@@ -0,0 +1,136 @@
+package session
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/lessgoext/cache"
+)
+
+func TestSessionProvider(t *testing.T) {
+	defer os.RemoveAll("cache_session")
+	for _, config := range []string{
+		`{"adapter":"memory","config":"{\"interval\":60}"}`,
+		`{"adapter":"file","config":"{\"CachePath\":\"cache_session\",\"FileSuffix\":\".bin\",\"DirectoryLevel\":2,\"EmbedExpiry\":0}","prefix":"sess_"}`,
+	} {
+		p := NewProvider(nil)
+		if err := p.SessionInit(3600, config); err != nil {
+			t.Fatal("init err", err)
+		}
+
+		s, err := p.SessionRead("")
+		if err != nil {
+			t.Fatal("read err", err)
+		}
+		sid := s.SessionID()
+		if len(sid) != 32 {
+			t.Error("session id err", sid)
+		}
+		if p.SessionExist(sid) {
+			t.Error("check err")
+		}
+		s.Set("name", "astaxie")
+		s.Set(1, 2)
+		s.SessionRelease(nil)
+		if !p.SessionExist(sid) {
+			t.Error("check err")
+		}
+
+		s, err = p.SessionRead(sid)
+		if err != nil {
+			t.Fatal("read err", err)
+		}
+		if v := s.Get("name"); v != "astaxie" {
+			t.Error("get err", v)
+		}
+		if v := s.Get(1); v != 2 {
+			t.Error("get err", v)
+		}
+
+		// regenerate
+		s, err = p.SessionRegenerate(sid, "")
+		if err != nil {
+			t.Fatal("regenerate err", err)
+		}
+		newsid := s.SessionID()
+		if newsid == sid || p.SessionExist(sid) || !p.SessionExist(newsid) {
+			t.Error("regenerate err")
+		}
+		if v := s.Get("name"); v != "astaxie" {
+			t.Error("get err", v)
+		}
+
+		// delete and flush
+		s.Delete("name")
+		s.SessionRelease(nil)
+		s, _ = p.SessionRead(newsid)
+		if s.Get("name") != nil || s.Get(1) != 2 {
+			t.Error("delete err")
+		}
+		s.Flush()
+		s.SessionRelease(nil)
+		s, _ = p.SessionRead(newsid)
+		if s.Get(1) != nil {
+			t.Error("flush err")
+		}
+
+		if err = p.SessionDestroy(newsid); err != nil {
+			t.Error("destroy err", err)
+		}
+		if p.SessionExist(newsid) {
+			t.Error("destroy err")
+		}
+		if err = p.SessionDestroy(newsid); err != nil {
+			t.Error("destroy twice err", err)
+		}
+	}
+}
+
+func TestSessionSliding(t *testing.T) {
+	bm, err := cache.NewCache("memory", `{"interval":60}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	p := NewProvider(bm)
+	if err = p.SessionInit(2, ""); err != nil {
+		t.Fatal("init err", err)
+	}
+	s, _ := p.SessionRead("")
+	sid := s.SessionID()
+	s.Set("name", "astaxie")
+	s.SessionRelease(nil)
+
+	// reading past half the lifetime renews it.
+	time.Sleep(1500 * time.Millisecond)
+	if s, _ = p.SessionRead(sid); s.Get("name") != "astaxie" {
+		t.Fatal("get err")
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if !p.SessionExist(sid) {
+		t.Error("sliding expiration err")
+	}
+
+	// unused for the lifetime, it expires.
+	time.Sleep(2500 * time.Millisecond)
+	if p.SessionExist(sid) {
+		t.Error("expiration err")
+	}
+	if s, _ = p.SessionRead(sid); s.Get("name") != nil {
+		t.Error("expired session err")
+	}
+}
+
+func TestNewSessionID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		sid, err := NewSessionID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sid) != 32 || seen[sid] {
+			t.Fatal("session id err", sid)
+		}
+		seen[sid] = true
+	}
+}
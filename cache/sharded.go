@@ -0,0 +1,298 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultShards is the number of shards used by the sharded memory adapter if not configured.
+	DefaultShards = 32
+)
+
+// memoryShard is one independently locked part of ShardedMemoryCache.
+type memoryShard struct {
+	sync.RWMutex
+	items map[string]*MemoryItem
+}
+
+// ShardedMemoryCache is a memory cache adapter for high-concurrency workloads.
+// keys are hashed across N shards, each one has its own RW locker,
+// so goroutines working on different keys rarely wait on each other.
+type ShardedMemoryCache struct {
+	shards []*memoryShard
+	dur    time.Duration
+	Every  int   // run an expiration check Every clock time
+	codec  Codec // nil means values are stored as they are
+}
+
+// NewShardedMemoryCache returns a new ShardedMemoryCache.
+// the shards are created in method StartAndGC.
+func NewShardedMemoryCache() Cache {
+	return &ShardedMemoryCache{}
+}
+
+// shard returns the shard which holds key.
+// the key is hashed by an inlined FNV-1a to avoid allocations on every call.
+func (sc *ShardedMemoryCache) shard(key string) *memoryShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return sc.shards[h%uint32(len(sc.shards))]
+}
+
+// Get cache from memory.
+// if non-existed or expired, return nil.
+func (sc *ShardedMemoryCache) Get(name string) interface{} {
+	v, _ := sc.get(name)
+	return v
+}
+
+// get returns the cached value and whether it is present and not expired.
+func (sc *ShardedMemoryCache) get(name string) (interface{}, bool) {
+	s := sc.shard(name)
+	s.RLock()
+	defer s.RUnlock()
+	if itm, ok := s.items[name]; ok && !itm.isExpire() {
+		return itm.val, true
+	}
+	return nil, false
+}
+
+// GetMulti gets caches from memory.
+// if non-existed or expired, return nil.
+func (sc *ShardedMemoryCache) GetMulti(names []string) []interface{} {
+	rc := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		rc = append(rc, sc.Get(name))
+	}
+	return rc
+}
+
+// Put cache to memory.
+// if lifespan is 0, it will be forever till restart.
+// if a codec is configured, the value is stored encoded, read it back by GetInto.
+func (sc *ShardedMemoryCache) Put(name string, value interface{}, lifespan time.Duration) error {
+	if sc.codec != nil {
+		b, err := sc.codec.Marshal(value)
+		if err != nil {
+			return err
+		}
+		value = b
+	}
+	s := sc.shard(name)
+	s.Lock()
+	defer s.Unlock()
+	s.items[name] = &MemoryItem{
+		val:         value,
+		createdTime: time.Now(),
+		lifespan:    lifespan,
+	}
+	return nil
+}
+
+// Delete cache in memory.
+func (sc *ShardedMemoryCache) Delete(name string) error {
+	s := sc.shard(name)
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.items[name]; !ok {
+		return ErrCacheMiss
+	}
+	delete(s.items, name)
+	return nil
+}
+
+// Incr increase cache counter in memory atomically.
+// it supports all (u)int types, or the integers encoded by the codec.
+func (sc *ShardedMemoryCache) Incr(key string) error {
+	s := sc.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	itm, ok := s.items[key]
+	if !ok || itm.isExpire() {
+		return ErrCacheMiss
+	}
+	_, err := itm.add(sc.codec, 1)
+	return err
+}
+
+// Decr decrease counter in memory atomically.
+func (sc *ShardedMemoryCache) Decr(key string) error {
+	s := sc.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	itm, ok := s.items[key]
+	if !ok || itm.isExpire() {
+		return ErrCacheMiss
+	}
+	_, err := itm.add(sc.codec, -1)
+	return err
+}
+
+// IsExist check cache exist in memory.
+func (sc *ShardedMemoryCache) IsExist(name string) bool {
+	s := sc.shard(name)
+	s.RLock()
+	defer s.RUnlock()
+	if itm, ok := s.items[name]; ok {
+		return !itm.isExpire()
+	}
+	return false
+}
+
+// ClearAll will delete all cache in memory.
+func (sc *ShardedMemoryCache) ClearAll() error {
+	for _, s := range sc.shards {
+		s.Lock()
+		s.items = make(map[string]*MemoryItem)
+		s.Unlock()
+	}
+	return nil
+}
+
+// shardedConfig is the JSON config of sharded memory adapter.
+type shardedConfig struct {
+	Interval int    `json:"interval"`
+	Shards   int    `json:"shards"`
+	Codec    string `json:"codec"`
+}
+
+// StartAndGC start sharded memory cache. it will check expiration in every clock time.
+// config is like {"interval":60,"shards":32}, the optional codec is the same as memory adapter.
+func (sc *ShardedMemoryCache) StartAndGC(config string) error {
+	cf := shardedConfig{
+		Interval: DefaultEvery,
+		Shards:   DefaultShards,
+	}
+	json.Unmarshal([]byte(config), &cf)
+	if cf.Shards < 1 {
+		return errors.New("shards must be greater than 0")
+	}
+	codec, err := GetCodec(cf.Codec)
+	if err != nil {
+		return err
+	}
+	sc.codec = codec
+	sc.shards = make([]*memoryShard, cf.Shards)
+	for i := range sc.shards {
+		sc.shards[i] = &memoryShard{items: make(map[string]*MemoryItem)}
+	}
+	sc.Every = cf.Interval
+	sc.dur = time.Duration(cf.Interval) * time.Second
+	go sc.vaccuum()
+	return nil
+}
+
+// Codec returns the codec of sharded memory cache, nil if values are stored as they are.
+func (sc *ShardedMemoryCache) Codec() Codec {
+	return sc.codec
+}
+
+// check expiration, one shard at a time.
+func (sc *ShardedMemoryCache) vaccuum() {
+	if sc.Every < 1 {
+		return
+	}
+	for {
+		<-time.After(sc.dur)
+		for _, s := range sc.shards {
+			s.Lock()
+			for name, itm := range s.items {
+				if itm.isExpire() {
+					delete(s.items, name)
+				}
+			}
+			s.Unlock()
+		}
+	}
+}
+
+// ShardedMemoryCacheV2 is the CacheV2 version of sharded memory adapter.
+type ShardedMemoryCacheV2 struct {
+	*ShardedMemoryCache
+}
+
+// NewShardedMemoryCacheV2 returns a new ShardedMemoryCacheV2.
+func NewShardedMemoryCacheV2() CacheV2 {
+	return &ShardedMemoryCacheV2{NewShardedMemoryCache().(*ShardedMemoryCache)}
+}
+
+// Get cache from memory.
+// if non-existed or expired, return ErrCacheMiss.
+func (sc *ShardedMemoryCacheV2) Get(ctx context.Context, name string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if v, ok := sc.ShardedMemoryCache.get(name); ok {
+		return v, nil
+	}
+	return nil, ErrCacheMiss
+}
+
+// GetMulti gets caches from memory.
+// if non-existed or expired, the value is nil.
+func (sc *ShardedMemoryCacheV2) GetMulti(ctx context.Context, names []string) ([]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return sc.ShardedMemoryCache.GetMulti(names), nil
+}
+
+// Put cache to memory.
+func (sc *ShardedMemoryCacheV2) Put(ctx context.Context, name string, value interface{}, lifespan time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return sc.ShardedMemoryCache.Put(name, value, lifespan)
+}
+
+// Delete cache in memory.
+func (sc *ShardedMemoryCacheV2) Delete(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return sc.ShardedMemoryCache.Delete(name)
+}
+
+// Incr increase cache counter in memory atomically.
+func (sc *ShardedMemoryCacheV2) Incr(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return sc.ShardedMemoryCache.Incr(key)
+}
+
+// Decr decrease counter in memory atomically.
+func (sc *ShardedMemoryCacheV2) Decr(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return sc.ShardedMemoryCache.Decr(key)
+}
+
+// IsExist check cache exist in memory.
+func (sc *ShardedMemoryCacheV2) IsExist(ctx context.Context, name string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return sc.ShardedMemoryCache.IsExist(name), nil
+}
+
+// ClearAll will delete all cache in memory.
+func (sc *ShardedMemoryCacheV2) ClearAll(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return sc.ShardedMemoryCache.ClearAll()
+}
+
+func init() {
+	Register("shardedmemory", NewShardedMemoryCache)
+	RegisterV2("shardedmemory", NewShardedMemoryCacheV2)
+}
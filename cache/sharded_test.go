@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardedMemoryCache(t *testing.T) {
+	bm, err := NewCache("shardedmemory", `{"interval":1,"shards":4}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	if err = bm.Put("astaxie", 1, time.Second); err != nil {
+		t.Error("set Error", err)
+	}
+	if v := bm.Get("astaxie"); v.(int) != 1 {
+		t.Error("get err")
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if bm.IsExist("astaxie") {
+		t.Error("check err")
+	}
+
+	if err = bm.Put("counter", 0, 0); err != nil {
+		t.Error("set Error", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				bm.Incr("counter")
+			}
+		}()
+	}
+	wg.Wait()
+	if v := bm.Get("counter"); v.(int) != 5000 {
+		t.Error("Incr is not atomic:", v)
+	}
+	if err = bm.Decr("counter"); err != nil {
+		t.Error("Decr Error", err)
+	}
+	if v := bm.Get("counter"); v.(int) != 4999 {
+		t.Error("get err")
+	}
+
+	vv := bm.GetMulti([]string{"counter", "none"})
+	if len(vv) != 2 || vv[0].(int) != 4999 || vv[1] != nil {
+		t.Error("GetMulti ERROR")
+	}
+	if err = bm.Delete("counter"); err != nil || bm.IsExist("counter") {
+		t.Error("delete err")
+	}
+	bm.Put("a", "a", 0)
+	bm.ClearAll()
+	if bm.IsExist("a") {
+		t.Error("ClearAll err")
+	}
+
+	if _, err = NewCache("shardedmemory", `{"shards":0}`); err == nil {
+		t.Error("zero shards should fail")
+	}
+}
+
+func benchmarkCacheParallel(b *testing.B, adapter string) {
+	bm, err := NewCache(adapter, `{"interval":0}`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+		bm.Put(keys[i], i, 0)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			// one write for every four reads.
+			if i%5 == 0 {
+				bm.Put(key, i, 0)
+			} else {
+				bm.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkMemoryCacheParallel(b *testing.B) {
+	benchmarkCacheParallel(b, "memory")
+}
+
+func BenchmarkShardedMemoryCacheParallel(b *testing.B) {
+	benchmarkCacheParallel(b, "shardedmemory")
+}
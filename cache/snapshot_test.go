@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type snapshotUser struct {
+	Name string
+	Age  int
+}
+
+func TestMemoryCacheSnapshot(t *testing.T) {
+	file := filepath.Join("cache_snapshot", "memory.snap")
+	defer os.RemoveAll("cache_snapshot")
+	config := `{"interval":0,"snapshot":"` + file + `"}`
+
+	bm, err := NewCache("memory", config)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	mc := bm.(*MemoryCache)
+	mc.Put("forever", 1, 0)
+	mc.Put("user", snapshotUser{"astaxie", 30}, time.Minute)
+	mc.PutWithTags("tagged", "a", time.Minute, "tag")
+	mc.Put("short", "a", 500*time.Millisecond)
+	mc.Put("expired", "a", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if err = mc.Snapshot(); err != nil {
+		t.Fatal("Snapshot err", err)
+	}
+
+	bm, err = NewCache("memory", config)
+	if err != nil {
+		t.Fatal("restart err", err)
+	}
+	if v := bm.Get("forever"); v != 1 {
+		t.Error("forever item err", v)
+	}
+	if u, ok := bm.Get("user").(snapshotUser); !ok || u.Name != "astaxie" || u.Age != 30 {
+		t.Error("struct item err", bm.Get("user"))
+	}
+	if bm.IsExist("expired") {
+		t.Error("expired item should not be loaded")
+	}
+	if !bm.IsExist("short") {
+		t.Error("short item should be loaded")
+	}
+	time.Sleep(500 * time.Millisecond)
+	if bm.IsExist("short") {
+		t.Error("short item should keep its expiry")
+	}
+	bm.(TagCache).InvalidateTag("tag")
+	if bm.IsExist("tagged") {
+		t.Error("tags should be loaded")
+	}
+
+	if err = NewMemoryCache().(*MemoryCache).Snapshot(); err == nil {
+		t.Error("Snapshot without snapshot file should fail")
+	}
+	if _, err = NewCache("memory", `{"interval":0,"snapshot":"cache_snapshot/none.snap"}`); err != nil {
+		t.Error("missing snapshot file should be ignored", err)
+	}
+}
@@ -1,6 +1,7 @@
 package ssdb
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"strconv"
@@ -16,6 +17,7 @@ import (
 type Cache struct {
 	conn     *ssdb.Client
 	conninfo []string
+	codec    cache.Codec // nil means only string values are accepted
 }
 
 //NewSsdbCache create new ssdb adapter.
@@ -78,18 +80,19 @@ func (rc *Cache) DelMulti(keys []string) error {
 }
 
 // Put put value to memcache. only support string.
+// if a codec is configured, any value is accepted and stored encoded,
+// read it back by cache.GetInto.
 func (rc *Cache) Put(key string, value interface{}, timeout time.Duration) error {
 	if rc.conn == nil {
 		if err := rc.connectInit(); err != nil {
 			return err
 		}
 	}
-	v, ok := value.(string)
-	if !ok {
-		return errors.New("value must string")
+	v, err := rc.encode(value)
+	if err != nil {
+		return err
 	}
 	var resp []string
-	var err error
 	ttl := int(timeout / time.Second)
 	if ttl < 0 {
 		resp, err = rc.conn.Do("set", key, v)
@@ -141,6 +144,79 @@ func (rc *Cache) Decr(key string) error {
 	return err
 }
 
+// IncrBy adds n to counter and returns the new value.
+func (rc *Cache) IncrBy(key string, n int64) (int64, error) {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return 0, err
+		}
+	}
+	resp, err := rc.conn.Do("incr", key, n)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) != 2 || resp[0] != "ok" {
+		return 0, errors.New("bad response")
+	}
+	return strconv.ParseInt(resp[1], 10, 64)
+}
+
+// DecrBy subtracts n from counter and returns the new value.
+func (rc *Cache) DecrBy(key string, n int64) (int64, error) {
+	return rc.IncrBy(key, -n)
+}
+
+// SetNX put value to ssdb only if key does not exist, and reports whether it was put.
+// ssdb has no setnx with ttl, so the timeout is set by a following expire:
+// if the expire fails the key is deleted again, but if the process crashes
+// between the two calls the key never expires.
+func (rc *Cache) SetNX(key string, value interface{}, timeout time.Duration) (bool, error) {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return false, err
+		}
+	}
+	v, err := rc.encode(value)
+	if err != nil {
+		return false, err
+	}
+	resp, err := rc.conn.Do("setnx", key, v)
+	if err != nil {
+		return false, err
+	}
+	if len(resp) != 2 || resp[0] != "ok" {
+		return false, errors.New("bad response")
+	}
+	if resp[1] != "1" {
+		return false, nil
+	}
+	if timeout > 0 {
+		// expire counts in seconds, round up so a short ttl still expires.
+		ttl := int((timeout + time.Second - 1) / time.Second)
+		if _, err = rc.conn.Do("expire", key, ttl); err != nil {
+			rc.conn.Do("del", key)
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// encode returns value as the string stored in ssdb.
+func (rc *Cache) encode(value interface{}) (string, error) {
+	if rc.codec != nil {
+		b, err := rc.codec.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	v, ok := value.(string)
+	if !ok {
+		return "", errors.New("value must string")
+	}
+	return v, nil
+}
+
 // IsExist check value exists in memcache.
 func (rc *Cache) IsExist(key string) bool {
 	if rc.conn == nil {
@@ -187,6 +263,82 @@ func (rc *Cache) ClearAll() error {
 	return err
 }
 
+// PutWithTags put value to ssdb like Put, and records key in the hash of every tag.
+func (rc *Cache) PutWithTags(key string, value interface{}, timeout time.Duration, tags ...string) error {
+	if err := rc.Put(key, value, timeout); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := rc.conn.Do("hset", tagKey(tag), key, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InvalidateTag deletes all values put with tag.
+func (rc *Cache) InvalidateTag(tag string) error {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return err
+		}
+	}
+	name, keyStart, limit := tagKey(tag), "", 50
+	for {
+		resp, err := rc.conn.Do("hkeys", name, keyStart, "", limit)
+		if err != nil {
+			return err
+		}
+		if len(resp) <= 1 {
+			break
+		}
+		keys := resp[1:]
+		if _, err = rc.conn.Do("multi_del", keys); err != nil {
+			return err
+		}
+		keyStart = keys[len(keys)-1]
+	}
+	_, err := rc.conn.Do("hclear", name)
+	return err
+}
+
+// DeletePrefix deletes all values whose key starts with prefix.
+func (rc *Cache) DeletePrefix(prefix string) error {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return err
+		}
+	}
+	// scan excludes keyStart, so the key equal to prefix is deleted first.
+	if _, err := rc.conn.Del(prefix); err != nil {
+		return err
+	}
+	keyStart, keyEnd, limit := prefix, prefix+"\xff", 50
+	for {
+		resp, err := rc.Scan(keyStart, keyEnd, limit)
+		if err != nil {
+			return err
+		}
+		size := len(resp)
+		if size <= 1 {
+			return nil
+		}
+		keys := []string{}
+		for i := 1; i < size; i += 2 {
+			keys = append(keys, resp[i])
+		}
+		if _, err = rc.conn.Do("multi_del", keys); err != nil {
+			return err
+		}
+		keyStart = resp[size-2]
+	}
+}
+
+// tagKey returns the name of the ssdb hash holding the keys of tag.
+func tagKey(tag string) string {
+	return "__tag:" + tag
+}
+
 // Scan key all cached in ssdb.
 func (rc *Cache) Scan(keyStart string, keyEnd string, limit int) ([]string, error) {
 	if rc.conn == nil {
@@ -203,6 +355,7 @@ func (rc *Cache) Scan(keyStart string, keyEnd string, limit int) ([]string, erro
 
 // StartAndGC start memcache adapter.
 // config string is like {"conn":"connection info"}.
+// the optional codec, like {"codec":"json"}, lets Put accept any value.
 // if connecting error, return.
 func (rc *Cache) StartAndGC(config string) error {
 	var cf map[string]string
@@ -211,6 +364,11 @@ func (rc *Cache) StartAndGC(config string) error {
 		return errors.New("config has no conn key")
 	}
 	rc.conninfo = strings.Split(cf["conn"], ";")
+	codec, err := cache.GetCodec(cf["codec"])
+	if err != nil {
+		return err
+	}
+	rc.codec = codec
 	if rc.conn == nil {
 		if err := rc.connectInit(); err != nil {
 			return err
@@ -219,6 +377,11 @@ func (rc *Cache) StartAndGC(config string) error {
 	return nil
 }
 
+// Codec returns the codec of the adapter, nil if only string values are accepted.
+func (rc *Cache) Codec() cache.Codec {
+	return rc.codec
+}
+
 // connect to memcache and keep the connection.
 func (rc *Cache) connectInit() error {
 	conninfoArray := strings.Split(rc.conninfo[0], ":")
@@ -235,6 +398,124 @@ func (rc *Cache) connectInit() error {
 	return nil
 }
 
+// CacheV2 is the cache.CacheV2 version of SSDB adapter.
+// the ssdb client has no deadline support, so ctx is only checked before each call.
+type CacheV2 struct {
+	*Cache
+}
+
+// NewSsdbCacheV2 create new ssdb cache.CacheV2 adapter.
+func NewSsdbCacheV2() cache.CacheV2 {
+	return &CacheV2{NewSsdbCache().(*Cache)}
+}
+
+// check returns the error of ctx, and connects to ssdb if not connected yet.
+func (rc *CacheV2) check(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if rc.conn == nil {
+		return rc.connectInit()
+	}
+	return nil
+}
+
+// Get get value from ssdb.
+// if non-existed or expired, return cache.ErrCacheMiss.
+func (rc *CacheV2) Get(ctx context.Context, key string) (interface{}, error) {
+	if err := rc.check(ctx); err != nil {
+		return nil, err
+	}
+	value, err := rc.conn.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, cache.ErrCacheMiss
+	}
+	return value, nil
+}
+
+// GetMulti get values from ssdb.
+// if non-existed or expired, the value is nil.
+func (rc *CacheV2) GetMulti(ctx context.Context, keys []string) ([]interface{}, error) {
+	if err := rc.check(ctx); err != nil {
+		return nil, err
+	}
+	res, err := rc.conn.Do("multi_get", keys)
+	if err != nil {
+		return nil, err
+	}
+	// the response is "ok" followed by the found key-value pairs.
+	found := make(map[string]string, len(res)/2)
+	for i := 1; i+1 < len(res); i += 2 {
+		found[res[i]] = res[i+1]
+	}
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if v, ok := found[key]; ok {
+			values[i] = v
+		}
+	}
+	return values, nil
+}
+
+// Put put value to ssdb. only support string.
+func (rc *CacheV2) Put(ctx context.Context, key string, value interface{}, timeout time.Duration) error {
+	if err := rc.check(ctx); err != nil {
+		return err
+	}
+	return rc.Cache.Put(key, value, timeout)
+}
+
+// Delete delete value in ssdb.
+func (rc *CacheV2) Delete(ctx context.Context, key string) error {
+	if err := rc.check(ctx); err != nil {
+		return err
+	}
+	return rc.Cache.Delete(key)
+}
+
+// Incr increase counter.
+func (rc *CacheV2) Incr(ctx context.Context, key string) error {
+	if err := rc.check(ctx); err != nil {
+		return err
+	}
+	return rc.Cache.Incr(key)
+}
+
+// Decr decrease counter.
+func (rc *CacheV2) Decr(ctx context.Context, key string) error {
+	if err := rc.check(ctx); err != nil {
+		return err
+	}
+	return rc.Cache.Decr(key)
+}
+
+// IsExist check value exists in ssdb.
+func (rc *CacheV2) IsExist(ctx context.Context, key string) (bool, error) {
+	if err := rc.check(ctx); err != nil {
+		return false, err
+	}
+	resp, err := rc.conn.Do("exists", key)
+	if err != nil {
+		return false, err
+	}
+	if len(resp) < 2 {
+		return false, errors.New("bad response")
+	}
+	return resp[1] == "1", nil
+}
+
+// ClearAll clear all cached in ssdb.
+func (rc *CacheV2) ClearAll(ctx context.Context) error {
+	if err := rc.check(ctx); err != nil {
+		return err
+	}
+	return rc.Cache.ClearAll()
+}
+
 func init() {
 	cache.Register("ssdb", NewSsdbCache)
+	cache.RegisterV2("ssdb", NewSsdbCacheV2)
 }
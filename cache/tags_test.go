@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func testTagCache(t *testing.T, bm TagCache) {
+	timeout := 10 * time.Second
+	bm.PutWithTags("user:1:name", "a", timeout, "user:1")
+	bm.PutWithTags("user:1:mail", "b", timeout, "user:1", "mail")
+	bm.PutWithTags("user:2:mail", "c", timeout, "user:2", "mail")
+	bm.Put("user:2:name", "d", timeout)
+	bm.Put("tenant:1", "e", timeout)
+
+	if err := bm.InvalidateTag("user:1"); err != nil {
+		t.Error("InvalidateTag err", err)
+	}
+	if bm.IsExist("user:1:name") || bm.IsExist("user:1:mail") {
+		t.Error("InvalidateTag should delete tagged keys")
+	}
+	if !bm.IsExist("user:2:mail") || !bm.IsExist("user:2:name") {
+		t.Error("InvalidateTag should keep other keys")
+	}
+	if err := bm.InvalidateTag("none"); err != nil {
+		t.Error("InvalidateTag of unknown tag err", err)
+	}
+
+	if err := bm.DeletePrefix("user:"); err != nil {
+		t.Error("DeletePrefix err", err)
+	}
+	if bm.IsExist("user:2:mail") || bm.IsExist("user:2:name") {
+		t.Error("DeletePrefix should delete matched keys")
+	}
+	if !bm.IsExist("tenant:1") {
+		t.Error("DeletePrefix should keep other keys")
+	}
+
+	// a key put again without tags leaves its old tags.
+	bm.PutWithTags("tenant:1", "e", timeout, "tenant")
+	bm.Put("tenant:1", "f", timeout)
+	if err := bm.InvalidateTag("tenant"); err != nil {
+		t.Error("InvalidateTag err", err)
+	}
+	if !bm.IsExist("tenant:1") {
+		t.Error("InvalidateTag should not delete a key put again without the tag")
+	}
+}
+
+func TestMemoryCacheTags(t *testing.T) {
+	bm, err := NewCache("memory", `{"interval":0}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	testTagCache(t, bm.(TagCache))
+}
+
+func TestFileCacheTags(t *testing.T) {
+	bm, err := NewCache("file", `{"CachePath":"cache_tags","FileSuffix":".bin","DirectoryLevel":2,"EmbedExpiry":0}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	defer os.RemoveAll("cache_tags")
+	testTagCache(t, bm.(TagCache))
+}
@@ -0,0 +1,288 @@
+// Package tiered for cache provider
+//
+// a two-level cache: an in-process memory cache (L1) in front of redis (L2).
+// reads fall through L1 to L2, writes and deletes go to both,
+// and the L1 copies of other processes are invalidated through redis pub/sub.
+//
+// depend on github.com/garyburd/redigo/redis
+//
+// Usage:
+// import(
+//   _ "github.com/henrylee2cn/lessgoext/cache/tiered"
+//   "github.com/henrylee2cn/lessgoext/cache"
+// )
+//
+//  bm, err := cache.NewCache("tiered", `{"l1":{"interval":60,"maxEntries":10000},"l2":{"conn":"127.0.0.1:6379"},"l1TTL":30,"channel":"lessgo:cache:invalidate"}`)
+package tiered
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrylee2cn/lessgoext/cache"
+	"github.com/henrylee2cn/lessgoext/cache/redis"
+)
+
+var (
+	// DefaultChannel is the redis pub/sub channel of invalidation messages.
+	DefaultChannel = "lessgo:cache:invalidate"
+	// DefaultL1TTL is how long a value read from L2 is kept in L1 at most.
+	// it bounds the staleness if an invalidation message is lost.
+	DefaultL1TTL = 60 * time.Second
+	// ReconnectDelay is the wait before subscribing again after the subscription broke.
+	ReconnectDelay = time.Second
+)
+
+// invalidation messages
+const (
+	msgDelete   = "del:"
+	msgClearAll = "clear"
+)
+
+// Cache is two-level cache adapter.
+type Cache struct {
+	l1      *cache.MemoryCache
+	l2      *redis.Cache
+	l1TTL   time.Duration
+	channel string
+
+	mu     sync.Mutex
+	sub    *redis.Subscription
+	closed bool
+
+	genMu sync.Mutex
+	gen   uint64 // bumped by every invalidation of L1
+}
+
+// NewTieredCache create new tiered cache with no config.
+// the levels are created in method StartAndGC.
+func NewTieredCache() cache.Cache {
+	return &Cache{}
+}
+
+// Get cache from L1, or from L2 and keep it in L1.
+// L1 keeps it no longer than it is left to live in L2.
+func (tc *Cache) Get(key string) interface{} {
+	if v := tc.l1.Get(key); v != nil {
+		return v
+	}
+	gen := tc.generation()
+	v, ttl := tc.l2.GetWithTTL(key)
+	if v == nil {
+		return nil
+	}
+	timeout := tc.l1TTL
+	if ttl >= 0 && (timeout <= 0 || ttl < timeout) {
+		timeout = ttl
+	}
+	if timeout != 0 {
+		tc.fill(key, v, timeout, gen)
+	}
+	return v
+}
+
+// generation returns the current count of L1 invalidations.
+func (tc *Cache) generation() uint64 {
+	tc.genMu.Lock()
+	defer tc.genMu.Unlock()
+	return tc.gen
+}
+
+// fill puts the value read from L2 into L1,
+// unless L1 was invalidated since the read began at generation gen,
+// as the value may be older than the invalidation.
+func (tc *Cache) fill(key string, v interface{}, timeout time.Duration, gen uint64) {
+	tc.genMu.Lock()
+	defer tc.genMu.Unlock()
+	if tc.gen == gen {
+		tc.l1.Put(key, v, timeout)
+	}
+}
+
+// drop deletes key from L1, or everything if all is true,
+// and cancels the fills in flight.
+func (tc *Cache) drop(key string, all bool) {
+	tc.genMu.Lock()
+	defer tc.genMu.Unlock()
+	tc.gen++
+	if all {
+		tc.l1.ClearAll()
+	} else {
+		tc.l1.Delete(key)
+	}
+}
+
+// GetMulti gets caches from L1 or L2.
+func (tc *Cache) GetMulti(keys []string) []interface{} {
+	rv := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		rv = append(rv, tc.Get(key))
+	}
+	return rv
+}
+
+// Put put cache to L2, and invalidate it in every L1.
+// L1 is filled by the next Get, so it always holds what L2 returns.
+func (tc *Cache) Put(key string, val interface{}, timeout time.Duration) error {
+	if err := tc.l2.Put(key, val, timeout); err != nil {
+		return err
+	}
+	return tc.invalidate(key)
+}
+
+// Delete delete cache in L2 and every L1.
+func (tc *Cache) Delete(key string) error {
+	if err := tc.l2.Delete(key); err != nil {
+		return err
+	}
+	return tc.invalidate(key)
+}
+
+// Incr increase counter in L2, and invalidate it in every L1.
+func (tc *Cache) Incr(key string) error {
+	if err := tc.l2.Incr(key); err != nil {
+		return err
+	}
+	return tc.invalidate(key)
+}
+
+// Decr decrease counter in L2, and invalidate it in every L1.
+func (tc *Cache) Decr(key string) error {
+	if err := tc.l2.Decr(key); err != nil {
+		return err
+	}
+	return tc.invalidate(key)
+}
+
+// IsExist check cache's existence in L1 or L2.
+func (tc *Cache) IsExist(key string) bool {
+	return tc.l1.IsExist(key) || tc.l2.IsExist(key)
+}
+
+// ClearAll clean all cache in L2 and every L1.
+func (tc *Cache) ClearAll() error {
+	if err := tc.l2.ClearAll(); err != nil {
+		return err
+	}
+	tc.drop("", true)
+	return tc.l2.Publish(tc.channel, msgClearAll)
+}
+
+// invalidate deletes key from the local L1 and tells the other processes to do so.
+func (tc *Cache) invalidate(key string) error {
+	tc.drop(key, false)
+	return tc.l2.Publish(tc.channel, msgDelete+key)
+}
+
+// tieredConfig is the JSON config of tiered adapter.
+type tieredConfig struct {
+	L1      json.RawMessage `json:"l1"`
+	L2      json.RawMessage `json:"l2"`
+	L1TTL   *int            `json:"l1TTL"`
+	Channel string          `json:"channel"`
+}
+
+// StartAndGC start tiered cache adapter.
+// config is like {"l1":{memory config},"l2":{redis config},"l1TTL":60,"channel":"lessgo:cache:invalidate"},
+// l1TTL is in seconds, l1 is optional and l2 is required.
+func (tc *Cache) StartAndGC(config string) error {
+	var cf tieredConfig
+	if err := json.Unmarshal([]byte(config), &cf); err != nil {
+		return err
+	}
+	if len(cf.L2) == 0 {
+		return errors.New("config has no l2 key")
+	}
+	if len(cf.L1) == 0 {
+		cf.L1 = json.RawMessage("{}")
+	}
+	tc.l1TTL = DefaultL1TTL
+	if cf.L1TTL != nil {
+		tc.l1TTL = time.Duration(*cf.L1TTL) * time.Second
+	}
+	tc.channel = cf.Channel
+	if tc.channel == "" {
+		tc.channel = DefaultChannel
+	}
+
+	tc.l1 = cache.NewMemoryCache().(*cache.MemoryCache)
+	if err := tc.l1.StartAndGC(string(cf.L1)); err != nil {
+		return err
+	}
+	tc.l2 = redis.NewRedisCache().(*redis.Cache)
+	if err := tc.l2.StartAndGC(string(cf.L2)); err != nil {
+		return err
+	}
+	sub, err := tc.l2.Subscribe(tc.channel)
+	if err != nil {
+		return err
+	}
+	go tc.listen(sub)
+	return nil
+}
+
+// Close stops listening to invalidation messages.
+func (tc *Cache) Close() error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.closed = true
+	if tc.sub != nil {
+		return tc.sub.Close()
+	}
+	return nil
+}
+
+// listen applies invalidation messages to L1, and subscribes again if the connection broke.
+func (tc *Cache) listen(sub *redis.Subscription) {
+	for {
+		tc.mu.Lock()
+		if tc.closed {
+			tc.mu.Unlock()
+			sub.Close()
+			return
+		}
+		tc.sub = sub
+		tc.mu.Unlock()
+
+		for {
+			msg, err := sub.Receive()
+			if err != nil {
+				break
+			}
+			tc.apply(string(msg))
+		}
+
+		// messages may be lost while reconnecting, drop everything to be safe.
+		tc.drop("", true)
+		for {
+			tc.mu.Lock()
+			closed := tc.closed
+			tc.mu.Unlock()
+			if closed {
+				return
+			}
+			time.Sleep(ReconnectDelay)
+			var err error
+			if sub, err = tc.l2.Subscribe(tc.channel); err == nil {
+				break
+			}
+		}
+	}
+}
+
+// apply applies one invalidation message to L1.
+func (tc *Cache) apply(msg string) {
+	switch {
+	case msg == msgClearAll:
+		tc.drop("", true)
+	case strings.HasPrefix(msg, msgDelete):
+		tc.drop(msg[len(msgDelete):], false)
+	}
+}
+
+func init() {
+	cache.Register("tiered", NewTieredCache)
+}
@@ -0,0 +1,160 @@
+package tiered
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/henrylee2cn/lessgoext/cache"
+	"github.com/henrylee2cn/lessgoext/cache/redis/redistest"
+)
+
+func init() {
+	// set before any listening goroutine reads it.
+	ReconnectDelay = 10 * time.Millisecond
+}
+
+func TestTieredCache(t *testing.T) {
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal("redis stand-in err", err)
+	}
+	defer srv.Close()
+	config := `{"l1":{"interval":60},"l2":{"conn":"` + srv.Addr() + `"},"l1TTL":60,"channel":"lessgo:cache:test"}`
+	// two instances stand for two processes sharing one redis.
+	a, err := cache.NewCache("tiered", config)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	defer a.(*Cache).Close()
+	b, err := cache.NewCache("tiered", config)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	defer b.(*Cache).Close()
+
+	timeoutDuration := 10 * time.Second
+	if err = a.Put("astaxie", "author", timeoutDuration); err != nil {
+		t.Error("set Error", err)
+	}
+	// let the invalidation message pass, it cancels the fills in flight.
+	time.Sleep(100 * time.Millisecond)
+	if v, _ := redis.String(b.Get("astaxie"), nil); v != "author" {
+		t.Error("get err")
+	}
+	// now b holds it in L1.
+	if !b.(*Cache).l1.IsExist("astaxie") {
+		t.Error("L1 is not filled")
+	}
+
+	if err = a.Put("astaxie", "author1", timeoutDuration); err != nil {
+		t.Error("set Error", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if v, _ := redis.String(b.Get("astaxie"), nil); v != "author1" {
+		t.Error("L1 of the other instance is not invalidated")
+	}
+
+	if err = a.Delete("astaxie"); err != nil {
+		t.Error("delete err", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if b.IsExist("astaxie") {
+		t.Error("delete err")
+	}
+
+	if err = a.Put("astaxie", 1, timeoutDuration); err != nil {
+		t.Error("set Error", err)
+	}
+	b.Get("astaxie")
+	if err = a.Incr("astaxie"); err != nil {
+		t.Error("Incr Error", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if v, _ := redis.Int(b.Get("astaxie"), nil); v != 2 {
+		t.Error("get err")
+	}
+
+	if err = a.ClearAll(); err != nil {
+		t.Error("clear all err", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if b.IsExist("astaxie") {
+		t.Error("clear all err")
+	}
+}
+
+func TestTieredReconnect(t *testing.T) {
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal("redis stand-in err", err)
+	}
+	defer srv.Close()
+	config := `{"l2":{"conn":"` + srv.Addr() + `"}}`
+	a, err := cache.NewCache("tiered", config)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	defer a.(*Cache).Close()
+	b, err := cache.NewCache("tiered", config)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	defer b.(*Cache).Close()
+
+	a.Put("astaxie", "author", 10*time.Second)
+	b.Get("astaxie")
+	srv.DropConnections()
+	time.Sleep(100 * time.Millisecond)
+	// L1 is dropped on reconnect, and the invalidation works again.
+	if b.(*Cache).l1.IsExist("astaxie") {
+		t.Error("L1 should be cleared after reconnecting")
+	}
+	b.Get("astaxie")
+	if err = a.Put("astaxie", "author1", 10*time.Second); err != nil {
+		t.Error("set Error", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if v, _ := redis.String(b.Get("astaxie"), nil); v != "author1" {
+		t.Error("L1 is not invalidated after reconnecting", v)
+	}
+}
+
+func TestTieredL1Expiry(t *testing.T) {
+	srv, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal("redis stand-in err", err)
+	}
+	defer srv.Close()
+	bm, err := cache.NewCache("tiered", `{"l2":{"conn":"`+srv.Addr()+`"},"l1TTL":60}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	tc := bm.(*Cache)
+	defer tc.Close()
+
+	// L1 keeps the value no longer than L2 does.
+	tc.Put("short", "a", time.Second)
+	// let its own invalidation message pass.
+	time.Sleep(50 * time.Millisecond)
+	if tc.Get("short") == nil || !tc.l1.IsExist("short") {
+		t.Fatal("L1 is not filled")
+	}
+	time.Sleep(time.Second)
+	if tc.Get("short") != nil {
+		t.Error("L1 outlives the expiry in L2")
+	}
+
+	// a fill older than an invalidation is dropped.
+	gen := tc.generation()
+	tc.apply(msgDelete + "stale")
+	tc.fill("stale", "old", time.Minute, gen)
+	if tc.l1.IsExist("stale") {
+		t.Error("stale fill after an invalidation")
+	}
+	tc.fill("stale", "new", time.Minute, tc.generation())
+	if !tc.l1.IsExist("stale") {
+		t.Error("fill err")
+	}
+}
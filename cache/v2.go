@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrCacheMiss is returned by CacheV2 when the key does not exist or has expired.
+var ErrCacheMiss = errors.New("cache: key not exist")
+
+// CacheV2 is the context-aware version of Cache.
+// every method reports failures through an error, so a miss (ErrCacheMiss)
+// can be told apart from an unreachable backend,
+// and ctx carries the deadline of the remote calls.
+// usage:
+//	c, err := cache.NewCacheV2("redis", `{"conn":"127.0.0.1:6379"}`)
+//	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+//	defer cancel()
+//	v, err := c.Get(ctx, "key")
+//	if err == cache.ErrCacheMiss {
+//		// load it
+//	}
+type CacheV2 interface {
+	// get cached value by key, ErrCacheMiss if non-existed or expired.
+	Get(ctx context.Context, key string) (interface{}, error)
+	// GetMulti is a batch version of Get, missed keys are nil in the result.
+	GetMulti(ctx context.Context, keys []string) ([]interface{}, error)
+	// set cached value with key and expire time.
+	Put(ctx context.Context, key string, val interface{}, timeout time.Duration) error
+	// delete cached value by key.
+	Delete(ctx context.Context, key string) error
+	// increase cached int value by key, as a counter.
+	Incr(ctx context.Context, key string) error
+	// decrease cached int value by key, as a counter.
+	Decr(ctx context.Context, key string) error
+	// check if cached value exists or not.
+	IsExist(ctx context.Context, key string) (bool, error)
+	// clear all cache.
+	ClearAll(ctx context.Context) error
+	// start gc routine based on config string settings.
+	StartAndGC(config string) error
+}
+
+// InstanceV2 is a function create a new CacheV2 Instance
+type InstanceV2 func() CacheV2
+
+var adaptersV2 = make(map[string]InstanceV2)
+
+// RegisterV2 makes a CacheV2 adapter available by the adapter name.
+// If RegisterV2 is called twice with the same name or if driver is nil,
+// it panics.
+func RegisterV2(name string, adapter InstanceV2) {
+	if adapter == nil {
+		panic("cache: RegisterV2 adapter is nil")
+	}
+	if _, ok := adaptersV2[name]; ok {
+		panic("cache: RegisterV2 called twice for adapter " + name)
+	}
+	adaptersV2[name] = adapter
+}
+
+// NewCacheV2 Create a new CacheV2 driver by adapter name and config string.
+// the config is the same as NewCache.
+func NewCacheV2(adapterName, config string) (adapter CacheV2, err error) {
+	instanceFunc, ok := adaptersV2[adapterName]
+	if !ok {
+		err = fmt.Errorf("cache: unknown adapter name %q (forgot to import?)", adapterName)
+		return
+	}
+	adapter = instanceFunc()
+	err = adapter.StartAndGC(config)
+	if err != nil {
+		adapter = nil
+	}
+	return
+}
+
+// NewCacheFromV2 wraps a CacheV2 into the old Cache interface,
+// so it can be passed to code written against Cache.
+// all calls use context.Background(), and errors of Get, GetMulti and IsExist are dropped.
+func NewCacheFromV2(c CacheV2) Cache {
+	return &v2Cache{c}
+}
+
+// v2Cache adapts CacheV2 to Cache.
+type v2Cache struct {
+	c CacheV2
+}
+
+func (w *v2Cache) Get(key string) interface{} {
+	v, err := w.c.Get(context.Background(), key)
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+func (w *v2Cache) GetMulti(keys []string) []interface{} {
+	vv, err := w.c.GetMulti(context.Background(), keys)
+	if err != nil {
+		return make([]interface{}, len(keys))
+	}
+	return vv
+}
+
+func (w *v2Cache) Put(key string, val interface{}, timeout time.Duration) error {
+	return w.c.Put(context.Background(), key, val, timeout)
+}
+
+func (w *v2Cache) Delete(key string) error {
+	return w.c.Delete(context.Background(), key)
+}
+
+func (w *v2Cache) Incr(key string) error {
+	return w.c.Incr(context.Background(), key)
+}
+
+func (w *v2Cache) Decr(key string) error {
+	return w.c.Decr(context.Background(), key)
+}
+
+func (w *v2Cache) IsExist(key string) bool {
+	ok, _ := w.c.IsExist(context.Background(), key)
+	return ok
+}
+
+func (w *v2Cache) ClearAll() error {
+	return w.c.ClearAll(context.Background())
+}
+
+func (w *v2Cache) StartAndGC(config string) error {
+	return w.c.StartAndGC(config)
+}
@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func testCacheV2(t *testing.T, bm CacheV2) {
+	ctx := context.Background()
+	if _, err := bm.Get(ctx, "astaxie"); err != ErrCacheMiss {
+		t.Error("miss err", err)
+	}
+	if err := bm.Put(ctx, "astaxie", 1, 10*time.Second); err != nil {
+		t.Error("set Error", err)
+	}
+	if v, err := bm.Get(ctx, "astaxie"); err != nil || v.(int) != 1 {
+		t.Error("get err", err)
+	}
+	if err := bm.Incr(ctx, "astaxie"); err != nil {
+		t.Error("Incr Error", err)
+	}
+	if v, _ := bm.Get(ctx, "astaxie"); v.(int) != 2 {
+		t.Error("get err")
+	}
+	if err := bm.Decr(ctx, "astaxie"); err != nil {
+		t.Error("Decr Error", err)
+	}
+	vv, err := bm.GetMulti(ctx, []string{"astaxie", "none"})
+	if err != nil || len(vv) != 2 || vv[0].(int) != 1 || vv[1] != nil {
+		t.Error("GetMulti ERROR", err)
+	}
+	if ok, err := bm.IsExist(ctx, "astaxie"); err != nil || !ok {
+		t.Error("check err", err)
+	}
+	if err := bm.Delete(ctx, "astaxie"); err != nil {
+		t.Error("delete err", err)
+	}
+	if ok, _ := bm.IsExist(ctx, "astaxie"); ok {
+		t.Error("delete err")
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := bm.Put(canceled, "astaxie", 1, 10*time.Second); err != context.Canceled {
+		t.Error("canceled context should fail", err)
+	}
+}
+
+func TestMemoryCacheV2(t *testing.T) {
+	bm, err := NewCacheV2("memory", `{"interval":0}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	testCacheV2(t, bm)
+
+	bm.Put(context.Background(), "expired", 1, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if _, err = bm.Get(context.Background(), "expired"); err != ErrCacheMiss {
+		t.Error("expired err", err)
+	}
+}
+
+func TestShardedMemoryCacheV2(t *testing.T) {
+	bm, err := NewCacheV2("shardedmemory", `{"interval":0}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	testCacheV2(t, bm)
+}
+
+func TestFileCacheV2(t *testing.T) {
+	bm, err := NewCacheV2("file", `{"CachePath":"cache_v2","FileSuffix":".bin","DirectoryLevel":2,"EmbedExpiry":0}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	defer os.RemoveAll("cache_v2")
+	testCacheV2(t, bm)
+}
+
+func TestNewCacheFromV2(t *testing.T) {
+	bm, err := NewCacheV2("memory", `{"interval":0}`)
+	if err != nil {
+		t.Fatal("init err", err)
+	}
+	c := NewCacheFromV2(bm)
+	if c.Get("astaxie") != nil {
+		t.Error("get err")
+	}
+	if err = c.Put("astaxie", "author", 10*time.Second); err != nil {
+		t.Error("set Error", err)
+	}
+	if !c.IsExist("astaxie") || c.Get("astaxie").(string) != "author" {
+		t.Error("get err")
+	}
+	if err = c.Delete("astaxie"); err != nil || c.IsExist("astaxie") {
+		t.Error("delete err")
+	}
+}
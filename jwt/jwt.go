@@ -0,0 +1,455 @@
+// Package jwt issues the JSON Web Tokens validated by middleware.JWTWithConfig.
+//
+// An Issuer mints a short-lived access token and a long-lived refresh token at login.
+// A refresh token is used once: refreshing revokes it and issues a new pair of the same family,
+// and a refresh token used twice revokes its whole family, since either it or its successor was stolen.
+// Logout revokes both tokens. The revoked token IDs (jti) are kept in a middleware.JWTDenylist,
+// which the validating middleware consults as well.
+//
+// Usage:
+// import(
+//     "github.com/henrylee2cn/lessgo"
+//     "github.com/henrylee2cn/lessgoext/cache"
+//     "github.com/henrylee2cn/lessgoext/jwt"
+//     "github.com/henrylee2cn/lessgoext/middleware"
+// )
+//
+// c, _ := cache.NewCache("redis", `{"conn":"127.0.0.1:6379"}`)
+// issuer, _ := jwt.NewIssuer(jwt.Config{SigningKey: []byte("secret"), Issuer: "demo"}, middleware.NewJWTDenylist(c))
+// lessgo.Root(
+//     lessgo.Leaf("/login", issuer.LoginHandler(checkPassword)),
+//     lessgo.Leaf("/refresh", issuer.RefreshHandler()),
+//     lessgo.Leaf("/logout", issuer.LogoutHandler()),
+//     lessgo.Branch("/api", "api", ...).Use(middleware.JWTWithConfig, issuer.JWTConfig()),
+// )
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/henrylee2cn/lessgo"
+	"github.com/henrylee2cn/lessgoext/middleware"
+	"github.com/henrylee2cn/lessgoext/uuid"
+)
+
+type (
+	// Config defines the config of an Issuer.
+	Config struct {
+		// Signing method of the tokens.
+		// Optional. Default value HS256.
+		// Possible values: HS256, HS384, HS512, RS256, RS384, RS512, ES256, ES384 and EdDSA.
+		SigningMethod string `json:"signing_method"`
+
+		// Signing key of the tokens.
+		// The secret for the HS algorithms, or a PEM encoded private key
+		// for the RS, ES and EdDSA algorithms.
+		// Required, unless PrivateKeyFile is set.
+		SigningKey []byte `json:"signing_key"`
+
+		// PrivateKeyFile is a PEM file holding the private key to sign the tokens.
+		// Optional. Default value "".
+		PrivateKeyFile string `json:"private_key_file"`
+
+		// KeyID is set as the `kid` header of the tokens, to find the key in a JWKS.
+		// Optional. Default value "".
+		KeyID string `json:"key_id"`
+
+		// Issuer is the `iss` claim of the tokens.
+		// Optional. Default value "".
+		Issuer string `json:"issuer"`
+
+		// Audience is the `aud` claim of the access tokens.
+		// Optional. Default value []string{}.
+		Audience []string `json:"audience"`
+
+		// AccessTTL is the lifetime in seconds of the access tokens.
+		// Optional. Default value 900.
+		AccessTTL int `json:"access_ttl"`
+
+		// RefreshTTL is the lifetime in seconds of the refresh tokens.
+		// Optional. Default value 604800.
+		RefreshTTL int `json:"refresh_ttl"`
+	}
+
+	// Issuer issues, refreshes and revokes tokens.
+	Issuer struct {
+		config     Config
+		method     jwtgo.SigningMethod
+		signKey    interface{}
+		verifyKey  interface{}
+		denylist   *middleware.JWTDenylist
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+	}
+
+	// TokenPair is the response of login and refresh, as of RFC 6749.
+	TokenPair struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	// Authenticator checks the credentials of a login request,
+	// and returns the subject and the extra claims of the tokens.
+	Authenticator func(c *lessgo.Context) (subject string, claims map[string]interface{}, err error)
+)
+
+const (
+	tokenUseAccess  = "access"
+	tokenUseRefresh = middleware.TokenUseRefresh
+
+	// familyPrefix is prepended to the family IDs of the refresh tokens in the denylist.
+	familyPrefix = "fam:"
+)
+
+var (
+	// DefaultConfig is the default Issuer config.
+	DefaultConfig = Config{
+		SigningMethod: middleware.AlgorithmHS256,
+		AccessTTL:     900,
+		RefreshTTL:    604800,
+	}
+
+	// ErrInvalidToken is returned for a token which is malformed, expired, revoked or of another use.
+	ErrInvalidToken = errors.New("jwt: invalid token")
+	// ErrTokenReused is returned when a refresh token is used twice, its family is revoked then.
+	ErrTokenReused = errors.New("jwt: refresh token reused")
+
+	// registeredNames are the claims set by Issuer, which the extra claims can not override.
+	registeredNames = []string{"jti", "sub", "iss", "aud", "iat", "nbf", "exp", "token_use", "fam", "ext"}
+)
+
+// NewIssuer returns an Issuer by config, revoking tokens in denylist.
+func NewIssuer(config Config, denylist *middleware.JWTDenylist) (*Issuer, error) {
+	if denylist == nil {
+		return nil, errors.New("jwt issuer requires denylist")
+	}
+	if config.SigningMethod == "" {
+		config.SigningMethod = DefaultConfig.SigningMethod
+	}
+	if config.AccessTTL <= 0 {
+		config.AccessTTL = DefaultConfig.AccessTTL
+	}
+	if config.RefreshTTL <= 0 {
+		config.RefreshTTL = DefaultConfig.RefreshTTL
+	}
+	method := jwtgo.GetSigningMethod(config.SigningMethod)
+	if method == nil {
+		return nil, fmt.Errorf("invalid jwt signing method=%s", config.SigningMethod)
+	}
+	i := &Issuer{
+		config:     config,
+		method:     method,
+		denylist:   denylist,
+		accessTTL:  time.Duration(config.AccessTTL) * time.Second,
+		refreshTTL: time.Duration(config.RefreshTTL) * time.Second,
+	}
+	data := config.SigningKey
+	if config.PrivateKeyFile != "" {
+		var err error
+		if data, err = ioutil.ReadFile(config.PrivateKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	if data == nil {
+		return nil, errors.New("jwt issuer requires signing key or private key file")
+	}
+	if strings.HasPrefix(config.SigningMethod, "HS") {
+		i.signKey, i.verifyKey = data, data
+		return i, nil
+	}
+	key, err := middleware.ParsePrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("jwt: %T is not a private key", key)
+	}
+	switch signer.(type) {
+	case *rsa.PrivateKey:
+		ok = strings.HasPrefix(config.SigningMethod, "RS")
+	case *ecdsa.PrivateKey:
+		ok = strings.HasPrefix(config.SigningMethod, "ES")
+	case ed25519.PrivateKey:
+		ok = config.SigningMethod == middleware.AlgorithmEdDSA
+	default:
+		ok = false
+	}
+	if !ok {
+		return nil, fmt.Errorf("jwt: %T is not a key of %s", key, config.SigningMethod)
+	}
+	i.signKey, i.verifyKey = key, signer.Public()
+	return i, nil
+}
+
+// JWTConfig returns the config of middleware.JWTWithConfig validating the access tokens of i,
+// which shares the denylist of i.
+func (i *Issuer) JWTConfig() middleware.JWTConfig {
+	config := middleware.DefaultJWTConfig
+	config.SigningMethod = i.config.SigningMethod
+	config.Issuer = i.config.Issuer
+	config.Audience = i.config.Audience
+	config.Denylist = i.denylist
+	if key, ok := i.verifyKey.([]byte); ok {
+		config.SigningKey = key
+		return config
+	}
+	der, err := x509.MarshalPKIXPublicKey(i.verifyKey)
+	if err != nil {
+		panic(err) // the key was parsed by NewIssuer
+	}
+	config.SigningKey = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	return config
+}
+
+// Issue returns a new pair of tokens of subject,
+// the access token carries the extra claims and the refresh token keeps them for the next pairs.
+func (i *Issuer) Issue(subject string, claims map[string]interface{}) (*TokenPair, error) {
+	if subject == "" {
+		return nil, errors.New("jwt: empty subject")
+	}
+	return i.issue(subject, claims, newID())
+}
+
+// Refresh verifies refreshToken and revokes it, then returns a new pair of tokens of the same family.
+// If refreshToken was used before, it revokes the family and returns ErrTokenReused.
+func (i *Issuer) Refresh(refreshToken string) (*TokenPair, error) {
+	claims, err := i.parse(refreshToken, tokenUseRefresh)
+	if err != nil {
+		return nil, err
+	}
+	fam, _ := claims["fam"].(string)
+	if fam == "" || i.denylist.Revoked(familyPrefix+fam) {
+		return nil, ErrInvalidToken
+	}
+	first, err := i.denylist.RevokeOnce(claims.id(), claims.expiresAt())
+	if err != nil {
+		return nil, err
+	}
+	if !first {
+		if err = i.denylist.Revoke(familyPrefix+fam, time.Now().Add(i.refreshTTL)); err != nil {
+			return nil, err
+		}
+		return nil, ErrTokenReused
+	}
+	ext, _ := claims["ext"].(map[string]interface{})
+	return i.issue(claims.subject(), ext, fam)
+}
+
+// Revoke revokes accessToken or refreshToken, either may be empty.
+// revoking a refresh token revokes its family, i.e. the tokens refreshed from the same login.
+// the refresh token is revoked first, and an expired or invalid access token beside it is skipped,
+// as there is nothing left to revoke, so a logout after the access token expired still ends the login.
+func (i *Issuer) Revoke(accessToken, refreshToken string) error {
+	if refreshToken != "" {
+		claims, err := i.parse(refreshToken, tokenUseRefresh)
+		if err != nil {
+			return err
+		}
+		fam, _ := claims["fam"].(string)
+		if fam == "" {
+			return ErrInvalidToken
+		}
+		if err = i.denylist.Revoke(familyPrefix+fam, time.Now().Add(i.refreshTTL)); err != nil {
+			return err
+		}
+	}
+	if accessToken != "" {
+		claims, err := i.parse(accessToken, tokenUseAccess)
+		if err != nil {
+			if refreshToken != "" {
+				return nil
+			}
+			return err
+		}
+		if err = i.denylist.Revoke(claims.id(), claims.expiresAt()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoginHandler returns the handler which checks the credentials by authenticate and responds a TokenPair.
+// For failed authentication, it sends "401 - Unauthorized" response.
+func (i *Issuer) LoginHandler(authenticate Authenticator) *lessgo.ApiHandler {
+	return lessgo.ApiHandler{
+		Desc:   "jwt login",
+		Method: "POST",
+		Handler: func(c *lessgo.Context) error {
+			subject, claims, err := authenticate(c)
+			if err != nil {
+				return c.Failure(http.StatusUnauthorized, err)
+			}
+			pair, err := i.Issue(subject, claims)
+			if err != nil {
+				return c.Failure(http.StatusInternalServerError, err)
+			}
+			return c.JSON(http.StatusOK, pair)
+		},
+	}.Reg()
+}
+
+// RefreshHandler returns the handler which rotates the refresh token of form param `refresh_token`
+// and responds a new TokenPair.
+// For invalid or reused refresh token, it sends "401 - Unauthorized" response.
+func (i *Issuer) RefreshHandler() *lessgo.ApiHandler {
+	return lessgo.ApiHandler{
+		Desc:   "jwt refresh",
+		Method: "POST",
+		Handler: func(c *lessgo.Context) error {
+			pair, err := i.Refresh(c.FormParam("refresh_token"))
+			switch err {
+			case nil:
+				return c.JSON(http.StatusOK, pair)
+			case ErrInvalidToken, ErrTokenReused:
+				return c.Failure(http.StatusUnauthorized, err)
+			default:
+				return c.Failure(http.StatusInternalServerError, err)
+			}
+		},
+	}.Reg()
+}
+
+// LogoutHandler returns the handler which revokes the access token of the `Authorization` header
+// and the refresh token of form param `refresh_token`, then sends "204 - No Content".
+// For an invalid refresh token, or an invalid access token without refresh token,
+// it sends "401 - Unauthorized" response.
+func (i *Issuer) LogoutHandler() *lessgo.ApiHandler {
+	return lessgo.ApiHandler{
+		Desc:   "jwt logout",
+		Method: "POST",
+		Handler: func(c *lessgo.Context) error {
+			access := c.HeaderParam(lessgo.HeaderAuthorization)
+			if l := len("Bearer"); len(access) > l+1 && access[:l] == "Bearer" {
+				access = access[l+1:]
+			} else {
+				access = ""
+			}
+			err := i.Revoke(access, c.FormParam("refresh_token"))
+			switch err {
+			case nil:
+				return c.NoContent(http.StatusNoContent)
+			case ErrInvalidToken:
+				return c.Failure(http.StatusUnauthorized, err)
+			default:
+				return c.Failure(http.StatusInternalServerError, err)
+			}
+		},
+	}.Reg()
+}
+
+func (i *Issuer) issue(subject string, ext map[string]interface{}, fam string) (*TokenPair, error) {
+	now := time.Now()
+	access := jwtgo.MapClaims{}
+	for k, v := range ext {
+		access[k] = v
+	}
+	for _, k := range registeredNames {
+		delete(access, k)
+	}
+	access["jti"] = newID()
+	access["sub"] = subject
+	access["iat"] = now.Unix()
+	access["exp"] = now.Add(i.accessTTL).Unix()
+	access["token_use"] = tokenUseAccess
+	if i.config.Issuer != "" {
+		access["iss"] = i.config.Issuer
+	}
+	if len(i.config.Audience) > 0 {
+		access["aud"] = i.config.Audience
+	}
+	refresh := jwtgo.MapClaims{
+		"jti":       newID(),
+		"sub":       subject,
+		"iat":       now.Unix(),
+		"exp":       now.Add(i.refreshTTL).Unix(),
+		"token_use": tokenUseRefresh,
+		"fam":       fam,
+	}
+	if i.config.Issuer != "" {
+		refresh["iss"] = i.config.Issuer
+	}
+	if len(ext) > 0 {
+		refresh["ext"] = ext
+	}
+
+	pair := &TokenPair{
+		TokenType: "Bearer",
+		ExpiresIn: i.config.AccessTTL,
+	}
+	var err error
+	if pair.AccessToken, err = i.sign(access); err != nil {
+		return nil, err
+	}
+	if pair.RefreshToken, err = i.sign(refresh); err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+func (i *Issuer) sign(claims jwtgo.MapClaims) (string, error) {
+	token := jwtgo.NewWithClaims(i.method, claims)
+	if i.config.KeyID != "" {
+		token.Header["kid"] = i.config.KeyID
+	}
+	return token.SignedString(i.signKey)
+}
+
+// parse returns the claims of token if it is signed by i, unexpired, unrevoked and of use.
+func (i *Issuer) parse(token, use string) (tokenClaims, error) {
+	parser := &jwtgo.Parser{ValidMethods: []string{i.config.SigningMethod}}
+	claims := jwtgo.MapClaims{}
+	_, err := parser.ParseWithClaims(token, claims, func(*jwtgo.Token) (interface{}, error) {
+		return i.verifyKey, nil
+	})
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	c := tokenClaims(claims)
+	if c["token_use"] != use || c.id() == "" || c.subject() == "" {
+		return nil, ErrInvalidToken
+	}
+	if i.config.Issuer != "" && !claims.VerifyIssuer(i.config.Issuer, true) {
+		return nil, ErrInvalidToken
+	}
+	if use == tokenUseAccess && i.denylist.Revoked(c.id()) {
+		return nil, ErrInvalidToken
+	}
+	return c, nil
+}
+
+// tokenClaims are the claims of a token parsed by Issuer.
+type tokenClaims jwtgo.MapClaims
+
+func (c tokenClaims) id() string {
+	s, _ := c["jti"].(string)
+	return s
+}
+
+func (c tokenClaims) subject() string {
+	s, _ := c["sub"].(string)
+	return s
+}
+
+func (c tokenClaims) expiresAt() time.Time {
+	exp, _ := c["exp"].(float64)
+	return time.Unix(int64(exp), 0)
+}
+
+func newID() string {
+	return uuid.New().String()
+}
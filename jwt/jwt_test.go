@@ -0,0 +1,179 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/henrylee2cn/lessgoext/cache"
+	"github.com/henrylee2cn/lessgoext/middleware"
+)
+
+func newTestIssuer(t *testing.T, config Config) *Issuer {
+	c, err := cache.NewCache("memory", `{"interval":60}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := NewIssuer(config, middleware.NewJWTDenylist(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func TestIssue(t *testing.T) {
+	i := newTestIssuer(t, Config{SigningKey: []byte("secret"), Issuer: "test", Audience: []string{"api"}})
+	pair, err := i.Issue("alice", map[string]interface{}{"role": "admin", "sub": "mallory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair.TokenType != "Bearer" || pair.ExpiresIn != 900 {
+		t.Errorf("unexpected pair %+v", pair)
+	}
+	claims, err := i.parse(pair.AccessToken, tokenUseAccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.subject() != "alice" || claims["role"] != "admin" || claims["iss"] != "test" {
+		t.Errorf("unexpected access claims %v", claims)
+	}
+	if _, err = i.parse(pair.RefreshToken, tokenUseAccess); err != ErrInvalidToken {
+		t.Errorf("refresh token accepted as access token: %v", err)
+	}
+	if _, err = i.parse(pair.AccessToken, tokenUseRefresh); err != ErrInvalidToken {
+		t.Errorf("access token accepted as refresh token: %v", err)
+	}
+	if _, err = i.Issue("", nil); err == nil {
+		t.Error("issued tokens of empty subject")
+	}
+}
+
+func TestRefreshRotation(t *testing.T) {
+	i := newTestIssuer(t, Config{SigningKey: []byte("secret")})
+	first, err := i.Issue("alice", map[string]interface{}{"role": "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := i.Refresh(first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := i.parse(second.AccessToken, tokenUseAccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.subject() != "alice" || claims["role"] != "admin" {
+		t.Errorf("claims lost by refresh: %v", claims)
+	}
+
+	// the first refresh token is used again, so the family is revoked.
+	if _, err = i.Refresh(first.RefreshToken); err != ErrTokenReused {
+		t.Fatalf("expected ErrTokenReused, got %v", err)
+	}
+	if _, err = i.Refresh(second.RefreshToken); err != ErrInvalidToken {
+		t.Fatalf("expected the family revoked, got %v", err)
+	}
+
+	// other logins are not affected.
+	other, err := i.Issue("alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = i.Refresh(other.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = i.Refresh("garbage"); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	i := newTestIssuer(t, Config{SigningKey: []byte("secret")})
+	pair, err := i.Issue("alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = i.Revoke(pair.AccessToken, pair.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = i.parse(pair.AccessToken, tokenUseAccess); err != ErrInvalidToken {
+		t.Errorf("revoked access token accepted: %v", err)
+	}
+	if _, err = i.Refresh(pair.RefreshToken); err != ErrInvalidToken {
+		t.Errorf("revoked refresh token accepted: %v", err)
+	}
+	if err = i.Revoke(pair.AccessToken, ""); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken, got %v", err)
+	}
+
+	// the refresh token is revoked even if the access token expired.
+	pair, err = i.Issue("alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := jwtgo.NewWithClaims(jwtgo.SigningMethodHS256, jwtgo.MapClaims{
+		"jti": "1", "sub": "alice", "exp": 1, "token_use": tokenUseAccess,
+	})
+	expired, err := token.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = i.Revoke(expired, pair.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = i.Refresh(pair.RefreshToken); err != ErrInvalidToken {
+		t.Errorf("refresh token accepted after logout with an expired access token: %v", err)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	i := newTestIssuer(t, Config{SigningKey: []byte("secret")})
+	token := jwtgo.NewWithClaims(jwtgo.SigningMethodHS256, jwtgo.MapClaims{
+		"jti": "1", "sub": "alice", "exp": 1, "token_use": tokenUseRefresh, "fam": "1",
+	})
+	expired, err := token.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = i.Refresh(expired); err != ErrInvalidToken {
+		t.Errorf("expired refresh token accepted: %v", err)
+	}
+}
+
+func TestJWTConfig(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := newTestIssuer(t, Config{
+		SigningMethod: middleware.AlgorithmES256,
+		SigningKey:    pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+		Issuer:        "test",
+	})
+	pair, err := i.Issue("alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = i.parse(pair.AccessToken, tokenUseAccess); err != nil {
+		t.Fatal(err)
+	}
+	config := i.JWTConfig()
+	if config.SigningMethod != middleware.AlgorithmES256 || config.Issuer != "test" || config.Denylist == nil {
+		t.Errorf("unexpected middleware config %+v", config)
+	}
+	if _, err = middleware.ParsePublicKeyFromPEM(config.SigningKey); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = NewIssuer(Config{SigningMethod: middleware.AlgorithmRS256, SigningKey: config.SigningKey}, i.denylist); err == nil {
+		t.Error("accepted a public key to sign")
+	}
+}
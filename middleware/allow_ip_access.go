@@ -18,6 +18,8 @@ var (
 )
 
 // The IPs which are allowed access.
+// Deprecated: the prefixes match strings, so "10." matches "100.x" too and no prefix fits 172.16.0.0/12,
+// use IPFilter with CIDRs instead.
 var AllowIPPrefixes = lessgo.ApiMiddleware{
 	Name:   "AllowIPPrefixes",
 	Desc:   `The IP Prefixes which are allowed access.`,
@@ -0,0 +1,473 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/henrylee2cn/lessgo"
+)
+
+type (
+	// AuthorizeConfig defines the config for authorization middleware.
+	AuthorizeConfig struct {
+		// PolicyFile is the JSON file of the AuthorizePolicy, relative to lessgo.CONFIG_DIR,
+		// it is reloaded when modified.
+		// Optional. Default value "authorize.json".
+		PolicyFile string `json:"policy_file"`
+
+		// Permissions defines the permissions of which the user must have one for the route.
+		// Optional. Default value []string{}, which requires the permissions whose routes match the request.
+		Permissions []string `json:"permissions"`
+
+		// ContextKey is the context key of the user set by the authentication middleware,
+		// a *jwt.Token, jwt.Claims, map[string]interface{} or a subject string,
+		// like the user name set by BasicAuth and BasicAuthUsers.
+		// Without it, the request is unauthorized.
+		// Optional. Default value "user".
+		ContextKey string `json:"context_key"`
+
+		// RolesClaim is the claim holding the roles of the user, an array or a string separated by spaces or commas.
+		// A dotted name reads a nested claim, e.g. "realm_access.roles".
+		// Optional. Default value "roles".
+		RolesClaim string `json:"roles_claim"`
+
+		// ReloadInterval is the period in seconds to check whether the policy file is modified.
+		// Optional. Default value 5.
+		ReloadInterval int `json:"reload_interval"`
+	}
+
+	// AuthorizePolicy defines the roles, the permissions they grant, and the routes the permissions cover.
+	AuthorizePolicy struct {
+		// Default decides the routes no permission covers, "allow" or "deny".
+		// Optional. Default value "deny".
+		Default string `json:"default"`
+
+		// Roles maps the role names to the roles.
+		Roles map[string]AuthorizeRole `json:"roles"`
+
+		// Users maps the subjects to the roles they have besides the roles of their claims.
+		Users map[string][]string `json:"users"`
+
+		// Permissions maps the permission names to the permissions.
+		Permissions map[string]AuthorizePermission `json:"permissions"`
+	}
+
+	// AuthorizeRole grants permissions.
+	AuthorizeRole struct {
+		// Permissions are the names of the granted permissions, patterns of path.Match like "articles:*".
+		Permissions []string `json:"permissions"`
+
+		// Inherits are the roles whose permissions are granted as well.
+		Inherits []string `json:"inherits"`
+	}
+
+	// AuthorizePermission covers routes, and is held by a user only if all its conditions hold.
+	AuthorizePermission struct {
+		Routes     []AuthorizeRoute     `json:"routes"`
+		Conditions []AuthorizeCondition `json:"conditions"`
+	}
+
+	// AuthorizeRoute matches the requests by path and method.
+	AuthorizeRoute struct {
+		// Path is a pattern of path.Match, a trailing "/**" matches all the sub paths.
+		Path string `json:"path"`
+
+		// Methods are the matched methods, all if empty.
+		Methods []string `json:"methods"`
+	}
+
+	// AuthorizeCondition checks a claim of the user.
+	// The claim is compared with Value, or the path param Param if set.
+	AuthorizeCondition struct {
+		Claim string      `json:"claim"`
+		Op    string      `json:"op"` // eq (default), ne, in, contains or exists, all fail if the claim is missing but exists
+		Value interface{} `json:"value"`
+		Param string      `json:"param"`
+	}
+)
+
+const (
+	authorizeAllow = "allow"
+	authorizeDeny  = "deny"
+)
+
+var (
+	// DefaultAuthorizeConfig is the default authorization middleware config.
+	DefaultAuthorizeConfig = AuthorizeConfig{
+		PolicyFile:     "authorize.json",
+		Permissions:    []string{},
+		ContextKey:     "user",
+		RolesClaim:     "roles",
+		ReloadInterval: 5,
+	}
+)
+
+// Authorize returns an authorization middleware by roles, permissions and claim conditions,
+// used after an authentication middleware like BasicAuth, JWTWithConfig or OIDCLogin.
+//
+// The policy file is like:
+//
+//	{
+//	    "default": "deny",
+//	    "roles": {
+//	        "admin": {"permissions": ["*"]},
+//	        "editor": {"permissions": ["articles:write"], "inherits": ["viewer"]},
+//	        "viewer": {"permissions": ["articles:read"]}
+//	    },
+//	    "users": {"alice": ["admin"]},
+//	    "permissions": {
+//	        "articles:read": {"routes": [{"path": "/api/articles/**", "methods": ["GET"]}]},
+//	        "articles:write": {
+//	            "routes": [{"path": "/api/articles/**", "methods": ["POST", "PUT", "DELETE"]}],
+//	            "conditions": [{"claim": "department", "op": "in", "value": ["news", "sports"]}]
+//	        }
+//	    }
+//	}
+//
+// For unknown user, it sends "401 - Unauthorized" response.
+// For user without permission, it sends "403 - Forbidden" response.
+var Authorize = lessgo.ApiMiddleware{
+	Name: "Authorize",
+	Desc: `an authorization middleware by roles, permissions and claim conditions, used after an authentication middleware.
+The policy file in the config dir is reloaded when modified, the permissions of a route may be set in its config.`,
+	Config: DefaultAuthorizeConfig,
+	Middleware: func(confObject interface{}) lessgo.MiddlewareFunc {
+		config := confObject.(AuthorizeConfig)
+		// Defaults
+		if config.PolicyFile == "" {
+			config.PolicyFile = DefaultAuthorizeConfig.PolicyFile
+		}
+		if config.ContextKey == "" {
+			config.ContextKey = DefaultAuthorizeConfig.ContextKey
+		}
+		if config.RolesClaim == "" {
+			config.RolesClaim = DefaultAuthorizeConfig.RolesClaim
+		}
+		if config.ReloadInterval <= 0 {
+			config.ReloadInterval = DefaultAuthorizeConfig.ReloadInterval
+		}
+		name := config.PolicyFile
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(lessgo.CONFIG_DIR, name)
+		}
+		file := &watchedFile{
+			name:     name,
+			interval: time.Duration(config.ReloadInterval) * time.Second,
+			load: func(name string) (interface{}, error) {
+				return LoadAuthorizePolicy(name)
+			},
+		}
+		if err := file.reload(); err != nil {
+			panic(err)
+		}
+
+		return func(next lessgo.HandlerFunc) lessgo.HandlerFunc {
+			return func(c *lessgo.Context) error {
+				claims := authorizeClaims(c, config.ContextKey)
+				if claims == nil {
+					return lessgo.ErrUnauthorized
+				}
+				policy := file.get().(*AuthorizePolicy)
+				req := c.Request()
+				if policy.allowed(req.Method, req.URL.Path, c.PathParam, claims, config.Permissions, config.RolesClaim) {
+					return next(c)
+				}
+				return lessgo.ErrForbidden
+			}
+		}
+	},
+}.Reg()
+
+// LoadAuthorizePolicy reads a policy file and checks it.
+func LoadAuthorizePolicy(name string) (*AuthorizePolicy, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	policy := new(AuthorizePolicy)
+	if err = json.Unmarshal(b, policy); err != nil {
+		return nil, fmt.Errorf("invalid authorize policy %s: %v", name, err)
+	}
+	if err = policy.check(); err != nil {
+		return nil, fmt.Errorf("invalid authorize policy %s: %v", name, err)
+	}
+	return policy, nil
+}
+
+// check returns an error for the unknown names and patterns of p.
+func (p *AuthorizePolicy) check() error {
+	switch p.Default {
+	case "":
+		p.Default = authorizeDeny
+	case authorizeAllow, authorizeDeny:
+	default:
+		return fmt.Errorf("unknown default=%s", p.Default)
+	}
+	for name, role := range p.Roles {
+		for _, inherit := range role.Inherits {
+			if _, ok := p.Roles[inherit]; !ok {
+				return fmt.Errorf("role %s inherits unknown role=%s", name, inherit)
+			}
+		}
+		for _, pattern := range role.Permissions {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("role %s has invalid permission=%s", name, pattern)
+			}
+		}
+	}
+	for name, perm := range p.Permissions {
+		for _, route := range perm.Routes {
+			if _, err := path.Match(strings.TrimSuffix(route.Path, "/**"), ""); err != nil || route.Path == "" {
+				return fmt.Errorf("permission %s has invalid route path=%s", name, route.Path)
+			}
+		}
+		for _, cond := range perm.Conditions {
+			switch cond.Op {
+			case "", "eq", "ne", "in", "contains", "exists":
+			default:
+				return fmt.Errorf("permission %s has unknown condition op=%s", name, cond.Op)
+			}
+			if cond.Claim == "" {
+				return fmt.Errorf("permission %s has a condition without claim", name)
+			}
+		}
+	}
+	return nil
+}
+
+// allowed reports whether the user of claims may access the route of the request, whose path params are read by param.
+// required are the permissions set for the route, else those covering the request.
+func (p *AuthorizePolicy) allowed(method, urlPath string, param func(string) string, claims map[string]interface{}, required []string, rolesClaim string) bool {
+	if len(required) == 0 {
+		for name, perm := range p.Permissions {
+			if perm.covers(method, urlPath) {
+				required = append(required, name)
+			}
+		}
+		if len(required) == 0 {
+			return p.Default == authorizeAllow
+		}
+	}
+	granted := p.granted(claims, rolesClaim)
+	for _, name := range required {
+		if !matchAny(granted, name) {
+			continue
+		}
+		perm, ok := p.Permissions[name]
+		if !ok || perm.holds(param, claims) {
+			return true
+		}
+	}
+	return false
+}
+
+// granted returns the permission patterns granted by the roles of the user.
+func (p *AuthorizePolicy) granted(claims map[string]interface{}, rolesClaim string) []string {
+	roles := claimStrings(claimValue(claims, rolesClaim))
+	if sub, ok := claims["sub"].(string); ok {
+		roles = append(roles, p.Users[sub]...)
+	}
+	var (
+		granted []string
+		visited = make(map[string]bool)
+	)
+	for len(roles) > 0 {
+		name := roles[len(roles)-1]
+		roles = roles[:len(roles)-1]
+		role, ok := p.Roles[name]
+		if !ok || visited[name] {
+			continue
+		}
+		visited[name] = true
+		granted = append(granted, role.Permissions...)
+		roles = append(roles, role.Inherits...)
+	}
+	return granted
+}
+
+// covers reports whether a route of p matches the request.
+func (p AuthorizePermission) covers(method, urlPath string) bool {
+	for _, route := range p.Routes {
+		if len(route.Methods) > 0 && !containsFold(route.Methods, method) {
+			continue
+		}
+		if matchRoutePath(route.Path, urlPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// holds reports whether all the conditions of p hold for the user of claims,
+// the path params of the request are read by param.
+func (p AuthorizePermission) holds(param func(string) string, claims map[string]interface{}) bool {
+	for _, cond := range p.Conditions {
+		v := claimValue(claims, cond.Claim)
+		want := cond.Value
+		if cond.Param != "" {
+			want = param(cond.Param)
+		}
+		var ok bool
+		switch cond.Op {
+		case "", "eq":
+			ok = v != nil && claimString(v) == claimString(want)
+		case "ne":
+			ok = v != nil && claimString(v) != claimString(want)
+		case "in":
+			ok = v != nil && containsString(claimStrings(want), claimString(v))
+		case "contains":
+			ok = containsString(claimStrings(v), claimString(want))
+		case "exists":
+			ok = v != nil
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// authorizeClaims returns the claims of the user in context, nil if none.
+// only the identity set by an authentication middleware counts, never the request headers.
+func authorizeClaims(c *lessgo.Context, key string) map[string]interface{} {
+	switch v := c.Get(key).(type) {
+	case *jwt.Token:
+		if v != nil {
+			return claimsMap(v.Claims)
+		}
+	case jwt.Claims:
+		return claimsMap(v)
+	case map[string]interface{}:
+		return v
+	case string:
+		if v != "" {
+			return map[string]interface{}{"sub": v}
+		}
+	}
+	return nil
+}
+
+// claimsMap returns claims as a map, by JSON for a struct.
+func claimsMap(claims jwt.Claims) map[string]interface{} {
+	if m, ok := claims.(jwt.MapClaims); ok {
+		return m
+	}
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	if json.Unmarshal(b, &m) != nil {
+		return nil
+	}
+	return m
+}
+
+// claimValue returns the claim of a dotted name, nil if none.
+func claimValue(claims map[string]interface{}, name string) interface{} {
+	if v, ok := claims[name]; ok {
+		return v
+	}
+	var v interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[part]
+	}
+	return v
+}
+
+// claimString formats a claim for comparison, the numbers of any type alike.
+func claimString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// claimStrings returns an array claim, or a string claim separated by spaces or commas.
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' })
+	case []string:
+		return v
+	case []interface{}:
+		s := make([]string, len(v))
+		for i, e := range v {
+			s[i] = claimString(e)
+		}
+		return s
+	}
+	return []string{claimString(v)}
+}
+
+// matchRoutePath reports whether urlPath matches pattern of path.Match,
+// or a pattern with a trailing "/**" matches the path or its parents.
+func matchRoutePath(pattern, urlPath string) bool {
+	prefix := strings.TrimSuffix(pattern, "/**")
+	if prefix == pattern {
+		ok, _ := path.Match(pattern, urlPath)
+		return ok
+	}
+	if prefix == "" {
+		return true
+	}
+	// match as many segments of urlPath as prefix has.
+	n := strings.Count(prefix, "/")
+	segments := strings.SplitAfterN(urlPath, "/", n+1)
+	if len(segments) < n {
+		return false
+	}
+	head := strings.TrimSuffix(strings.Join(segments[:n], ""), "/")
+	if len(segments) > n {
+		head += "/" + strings.SplitN(segments[n], "/", 2)[0]
+	}
+	ok, _ := path.Match(prefix, head)
+	return ok
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
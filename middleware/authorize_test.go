@@ -0,0 +1,246 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const testAuthorizePolicy = `{
+	"roles": {
+		"admin": {"permissions": ["*"]},
+		"editor": {"permissions": ["articles:write"], "inherits": ["viewer"]},
+		"viewer": {"permissions": ["articles:read"]},
+		"a": {"permissions": ["reports:read"], "inherits": ["b"]},
+		"b": {"inherits": ["a"]}
+	},
+	"users": {"bob": ["viewer"]},
+	"permissions": {
+		"articles:read": {"routes": [{"path": "/api/articles/**", "methods": ["GET"]}]},
+		"articles:write": {
+			"routes": [{"path": "/api/articles/**", "methods": ["post", "PUT"]}],
+			"conditions": [{"claim": "org.dept", "op": "in", "value": ["news", "sports"]}]
+		},
+		"articles:own": {
+			"routes": [{"path": "/api/users/*/articles"}],
+			"conditions": [{"claim": "sub", "param": "user"}]
+		},
+		"reports:read": {"routes": [{"path": "/api/reports"}]}
+	}
+}`
+
+// writeAuthorizePolicy writes a policy file modified at modTime.
+func writeAuthorizePolicy(t *testing.T, name, policy string, modTime time.Time) {
+	if err := ioutil.WriteFile(name, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchRoutePath(t *testing.T) {
+	cases := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/api/articles", "/api/articles", true},
+		{"/api/articles", "/api/articles/1", false},
+		{"/api/*", "/api/articles", true},
+		{"/api/*", "/api/articles/1", false},
+		{"/api/articles/**", "/api/articles", true},
+		{"/api/articles/**", "/api/articles/", true},
+		{"/api/articles/**", "/api/articles/1/comments", true},
+		{"/api/articles/**", "/api/articlesx", false},
+		{"/api/articles/**", "/api", false},
+		{"/api/*/x/**", "/api/a/x/b/c", true},
+		{"/api/*/x/**", "/api/a/y/b", false},
+		{"/**", "/", true},
+		{"/**", "/a/b", true},
+	}
+	for _, c := range cases {
+		if got := matchRoutePath(c.pattern, c.path); got != c.want {
+			t.Errorf("matchRoutePath(%s, %s) = %v, want %v", c.pattern, c.path, got, c.want)
+		}
+	}
+}
+
+func TestAuthorizeConditions(t *testing.T) {
+	claims := map[string]interface{}{
+		"sub":    "alice",
+		"level":  float64(3),
+		"groups": []interface{}{"news", "ops"},
+		"org":    map[string]interface{}{"dept": "news"},
+	}
+	params := map[string]string{"user": "alice"}
+	param := func(name string) string { return params[name] }
+	cases := []struct {
+		cond AuthorizeCondition
+		want bool
+	}{
+		{AuthorizeCondition{Claim: "sub", Value: "alice"}, true},
+		{AuthorizeCondition{Claim: "sub", Op: "eq", Value: "bob"}, false},
+		{AuthorizeCondition{Claim: "level", Value: 3}, true},
+		{AuthorizeCondition{Claim: "org.dept", Op: "eq", Value: "news"}, true},
+		{AuthorizeCondition{Claim: "sub", Param: "user"}, true},
+		{AuthorizeCondition{Claim: "org.dept", Param: "user"}, false},
+		{AuthorizeCondition{Claim: "org.dept", Op: "ne", Value: "sports"}, true},
+		{AuthorizeCondition{Claim: "org.dept", Op: "ne", Value: "news"}, false},
+		{AuthorizeCondition{Claim: "org.dept", Op: "in", Value: []interface{}{"news", "sports"}}, true},
+		{AuthorizeCondition{Claim: "org.dept", Op: "in", Value: "sports ops"}, false},
+		{AuthorizeCondition{Claim: "groups", Op: "contains", Value: "ops"}, true},
+		{AuthorizeCondition{Claim: "groups", Op: "contains", Value: "admin"}, false},
+		{AuthorizeCondition{Claim: "org", Op: "exists"}, true},
+		// every op fails on a missing claim.
+		{AuthorizeCondition{Claim: "missing", Value: ""}, false},
+		{AuthorizeCondition{Claim: "missing", Op: "ne", Value: "x"}, false},
+		{AuthorizeCondition{Claim: "org.missing", Op: "ne", Value: "x"}, false},
+		{AuthorizeCondition{Claim: "missing", Op: "in", Value: []interface{}{""}}, false},
+		{AuthorizeCondition{Claim: "missing", Op: "contains", Value: ""}, false},
+		{AuthorizeCondition{Claim: "missing", Op: "exists"}, false},
+	}
+	for _, c := range cases {
+		perm := AuthorizePermission{Conditions: []AuthorizeCondition{c.cond}}
+		if got := perm.holds(param, claims); got != c.want {
+			t.Errorf("holds(%+v) = %v, want %v", c.cond, got, c.want)
+		}
+	}
+	if m := claimsMap(&jwt.StandardClaims{Subject: "carol"}); m["sub"] != "carol" {
+		t.Errorf("claimsMap of StandardClaims = %v", m)
+	}
+}
+
+func TestAuthorizePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authorize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "authorize.json")
+	writeAuthorizePolicy(t, name, testAuthorizePolicy, time.Now())
+	policy, err := LoadAuthorizePolicy(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Default != authorizeDeny {
+		t.Errorf("Default = %s, want deny", policy.Default)
+	}
+
+	editor := map[string]interface{}{"sub": "e", "roles": "editor", "org": map[string]interface{}{"dept": "news"}}
+	outsider := map[string]interface{}{"sub": "e", "roles": []interface{}{"editor"}, "org": map[string]interface{}{"dept": "ads"}}
+	cases := []struct {
+		method, path string
+		claims       map[string]interface{}
+		required     []string
+		want         bool
+		user         string // the path param
+	}{
+		// bob has the viewer role by the users of the policy.
+		{"GET", "/api/articles/1", map[string]interface{}{"sub": "bob"}, nil, true, ""},
+		{"POST", "/api/articles/1", map[string]interface{}{"sub": "bob"}, nil, false, ""},
+		{"GET", "/api/articles/1", map[string]interface{}{"sub": "carol"}, nil, false, ""},
+		// editor inherits viewer.
+		{"GET", "/api/articles", editor, nil, true, ""},
+		{"POST", "/api/articles/1", editor, nil, true, ""},
+		{"POST", "/api/articles/1", outsider, nil, false, ""},
+		{"DELETE", "/api/articles/1", editor, nil, false, ""},
+		// the roles inheriting each other grant their permissions once.
+		{"GET", "/api/reports", map[string]interface{}{"roles": "b"}, nil, true, ""},
+		{"GET", "/api/articles/1", map[string]interface{}{"roles": "a"}, nil, false, ""},
+		{"GET", "/api/users/alice/articles", map[string]interface{}{"sub": "alice", "roles": "admin"}, nil, true, "alice"},
+		{"GET", "/api/users/bob/articles", map[string]interface{}{"sub": "alice", "roles": "admin"}, nil, false, "bob"},
+		// the routes no permission covers are denied by default.
+		{"GET", "/other", map[string]interface{}{"roles": "admin"}, nil, false, ""},
+		// the permissions of the route config replace the covering ones.
+		{"GET", "/other", map[string]interface{}{"roles": "viewer"}, []string{"articles:read"}, true, ""},
+		{"GET", "/other", map[string]interface{}{"roles": "viewer"}, []string{"reports:read"}, false, ""},
+		{"GET", "/other", map[string]interface{}{"roles": "admin"}, []string{"undefined"}, true, ""},
+	}
+	for _, c := range cases {
+		param := func(string) string { return c.user }
+		if got := policy.allowed(c.method, c.path, param, c.claims, c.required, "roles"); got != c.want {
+			t.Errorf("allowed(%s %s, %v, %v) = %v, want %v", c.method, c.path, c.claims, c.required, got, c.want)
+		}
+	}
+
+	policy.Default = authorizeAllow
+	param := func(string) string { return "" }
+	if !policy.allowed("GET", "/other", param, map[string]interface{}{"sub": "carol"}, nil, "roles") {
+		t.Error("a route no permission covers is denied by default allow")
+	}
+	if policy.allowed("POST", "/api/articles/1", param, map[string]interface{}{"sub": "carol"}, nil, "roles") {
+		t.Error("a covered route is allowed by default allow")
+	}
+}
+
+func TestLoadAuthorizePolicyErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authorize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "authorize.json")
+	for _, policy := range []string{
+		`{bad`,
+		`{"default": "maybe"}`,
+		`{"roles": {"a": {"inherits": ["none"]}}}`,
+		`{"roles": {"a": {"permissions": ["["]}}}`,
+		`{"permissions": {"p": {"routes": [{"path": ""}]}}}`,
+		`{"permissions": {"p": {"conditions": [{"claim": "sub", "op": "like"}]}}}`,
+		`{"permissions": {"p": {"conditions": [{"op": "eq"}]}}}`,
+	} {
+		writeAuthorizePolicy(t, name, policy, time.Now())
+		if _, err := LoadAuthorizePolicy(name); err == nil {
+			t.Errorf("LoadAuthorizePolicy(%s) succeeded", policy)
+		}
+	}
+	if _, err := LoadAuthorizePolicy(filepath.Join(dir, "none.json")); err == nil {
+		t.Error("LoadAuthorizePolicy of a missing file succeeded")
+	}
+}
+
+func TestAuthorizePolicyReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authorize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "authorize.json")
+	modTime := time.Now().Add(-time.Hour)
+	writeAuthorizePolicy(t, name, testAuthorizePolicy, modTime)
+	file := &watchedFile{
+		name: name,
+		load: func(name string) (interface{}, error) {
+			return LoadAuthorizePolicy(name)
+		},
+	}
+	if err = file.reload(); err != nil {
+		t.Fatal(err)
+	}
+	allowed := func() bool {
+		return file.get().(*AuthorizePolicy).allowed("GET", "/other", nil, map[string]interface{}{"sub": "bob"}, nil, "roles")
+	}
+	if allowed() {
+		t.Fatal("denied route allowed")
+	}
+	modTime = modTime.Add(time.Second)
+	writeAuthorizePolicy(t, name, `{"default": "allow"}`, modTime)
+	if !allowed() {
+		t.Error("modified policy is not reloaded")
+	}
+	// an invalid policy keeps the last valid one.
+	modTime = modTime.Add(time.Second)
+	writeAuthorizePolicy(t, name, `{bad`, modTime)
+	if !allowed() {
+		t.Error("invalid policy replaced the last valid one")
+	}
+	modTime = modTime.Add(time.Second)
+	writeAuthorizePolicy(t, name, testAuthorizePolicy, modTime)
+	if allowed() {
+		t.Error("fixed policy is not reloaded")
+	}
+}
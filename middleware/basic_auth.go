@@ -21,9 +21,15 @@ const (
 	basic = "Basic"
 )
 
+var (
+	// BasicAuthContextKey is the context key of the user name validated by BasicAuth,
+	// which Authorize and TwoFactor read by default.
+	BasicAuthContextKey = "user"
+)
+
 // BasicAuth returns an HTTP basic auth middleware.
 //
-// For valid credentials it calls the next handler.
+// For valid credentials it sets the user name in context by BasicAuthContextKey and calls the next handler.
 // For invalid credentials, it sends "401 - Unauthorized" response.
 // For empty or invalid `Authorization` header, it sends "400 - Bad Request" response.
 var BasicAuth = lessgo.ApiMiddleware{
@@ -47,6 +53,7 @@ var BasicAuth = lessgo.ApiMiddleware{
 						if cred[i] == ':' {
 							// Verify credentials
 							if config.Validator(cred[:i], cred[i+1:]) {
+								c.Set(BasicAuthContextKey, cred[:i])
 								return next(c)
 							}
 						}
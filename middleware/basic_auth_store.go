@@ -0,0 +1,428 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrylee2cn/lessgo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type (
+	// BasicAuthUsersConfig defines the config for HTTP basic auth middleware with user stores.
+	BasicAuthUsersConfig struct {
+		// Realm is the realm of the `WWW-Authenticate` header.
+		// Optional. Default value "Restricted".
+		Realm string `json:"realm"`
+
+		// Users maps the user names to their password hashes, in the formats of MatchPasswordHash.
+		// Optional. Default value map[string]string{}.
+		Users map[string]string `json:"users"`
+
+		// HtpasswdFile is an htpasswd file relative to lessgo.CONFIG_DIR, it is reloaded when modified.
+		// Optional. Default value "".
+		HtpasswdFile string `json:"htpasswd_file"`
+
+		// MaxFailures is the number of failed logins from an IP which locks it out.
+		// Optional. Default value 5.
+		MaxFailures int `json:"max_failures"`
+
+		// Lockout is the time in seconds an IP is locked out, and the period its failures are counted in.
+		// Optional. Default value 300.
+		Lockout int `json:"lockout"`
+
+		// TrustedProxies defines the IPs or CIDRs of the proxies whose `X-Forwarded-For`
+		// and `X-Real-IP` headers are honored to find the IP to lock out, like IPFilterConfig.TrustedProxies.
+		// Optional. Default value []string{}, which never honors the headers.
+		TrustedProxies []string `json:"trusted_proxies"`
+
+		// ContextKey is the context key to set the validated user name by,
+		// which Authorize and TwoFactor read.
+		// Optional. Default value "user".
+		ContextKey string `json:"context_key"`
+
+		// Validator validates the credentials the users and the htpasswd file do not,
+		// e.g. SQLBasicAuthValidator.
+		// Optional. Source only.
+		Validator BasicAuthValidator `json:"-"`
+	}
+
+	// BasicAuthDB is a database of SQLBasicAuthValidator, like the *sqlx.DB of dbservice/sqlx.
+	BasicAuthDB interface {
+		QueryRow(query string, args ...interface{}) *sql.Row
+		Rebind(query string) string
+	}
+
+	// basicAuthLockout counts the failed logins by key, an IP or a user.
+	basicAuthLockout struct {
+		max      int
+		duration time.Duration
+
+		mu     sync.Mutex
+		keys   map[string]*basicAuthFailures
+		pruned time.Time
+	}
+
+	basicAuthFailures struct {
+		count  int
+		first  time.Time
+		locked time.Time // until
+	}
+)
+
+const (
+	apr1Magic = "$apr1$"
+	md5Magic  = "$1$"
+	itoa64    = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var (
+	// DefaultBasicAuthUsersConfig is the default basic auth middleware config with user stores.
+	DefaultBasicAuthUsersConfig = BasicAuthUsersConfig{
+		Realm:       "Restricted",
+		Users:       map[string]string{},
+		MaxFailures: 5,
+		Lockout:     300,
+		ContextKey:  "user",
+	}
+
+	sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+	// dummyHash is compared for the unknown users, so they take as long as the known ones.
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// BasicAuthUsers returns an HTTP basic auth middleware validating the credentials by
+// the users of its config, an htpasswd file or a validator like SQLBasicAuthValidator.
+//
+// For valid credentials it sets the user name in context and calls the next handler.
+// For invalid credentials, it sends "401 - Unauthorized" response.
+// The client IP is the remote address, or the one forwarded by a trusted proxy.
+// For an IP locked out after repeated failures, it sends "429 - Too Many Requests" response.
+var BasicAuthUsers = lessgo.ApiMiddleware{
+	Name: "BasicAuthUsers",
+	Desc: `an HTTP basic auth middleware validating the credentials by the users of its config or an htpasswd file in the config dir.
+The password hashes may be bcrypt, SHA or apr1-MD5, an IP is locked out after repeated failures.`,
+	Config: DefaultBasicAuthUsersConfig,
+	Middleware: func(confObject interface{}) lessgo.MiddlewareFunc {
+		config := confObject.(BasicAuthUsersConfig)
+		// Defaults
+		if config.Realm == "" {
+			config.Realm = DefaultBasicAuthUsersConfig.Realm
+		}
+		if config.MaxFailures <= 0 {
+			config.MaxFailures = DefaultBasicAuthUsersConfig.MaxFailures
+		}
+		if config.Lockout <= 0 {
+			config.Lockout = DefaultBasicAuthUsersConfig.Lockout
+		}
+		if config.ContextKey == "" {
+			config.ContextKey = DefaultBasicAuthUsersConfig.ContextKey
+		}
+
+		// Initialize
+		var validators []BasicAuthValidator
+		if len(config.Users) > 0 {
+			validators = append(validators, StaticBasicAuthValidator(config.Users))
+		}
+		if config.HtpasswdFile != "" {
+			name := config.HtpasswdFile
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(lessgo.CONFIG_DIR, name)
+			}
+			validator, err := HtpasswdBasicAuthValidator(name)
+			if err != nil {
+				panic(err)
+			}
+			validators = append(validators, validator)
+		}
+		if config.Validator != nil {
+			validators = append(validators, config.Validator)
+		}
+		if len(validators) == 0 {
+			panic("basic auth middleware requires users, htpasswd file or validator")
+		}
+		rules := MustIPRules(IPFilterConfig{TrustedProxies: config.TrustedProxies})
+		lockout := &basicAuthLockout{
+			max:      config.MaxFailures,
+			duration: time.Duration(config.Lockout) * time.Second,
+			keys:     make(map[string]*basicAuthFailures),
+		}
+
+		return func(next lessgo.HandlerFunc) lessgo.HandlerFunc {
+			return func(c *lessgo.Context) error {
+				ip := c.Request().RemoteAddr
+				if clientIP := rules.ClientIP(c.Request()); clientIP != nil {
+					ip = clientIP.String()
+				}
+				if wait := lockout.attempt(ip, time.Now()); wait > 0 {
+					c.Response().Header().Set("Retry-After", strconv.FormatInt(ceilSeconds(wait), 10))
+					return lessgo.NewHTTPError(http.StatusTooManyRequests, "too many failed logins")
+				}
+				if user, password, ok := basicAuthCredentials(c); ok {
+					for _, validator := range validators {
+						if validator(user, password) {
+							lockout.succeed(ip)
+							c.Set(config.ContextKey, user)
+							return next(c)
+						}
+					}
+				}
+				// Need to return `401` for browsers to pop-up login box.
+				c.Response().Header().Set(lessgo.HeaderWWWAuthenticate, basic+` realm="`+config.Realm+`"`)
+				return lessgo.ErrUnauthorized
+			}
+		}
+	},
+}.Reg()
+
+// StaticBasicAuthValidator returns a validator of users, which maps the user names to their password hashes.
+func StaticBasicAuthValidator(users map[string]string) BasicAuthValidator {
+	return func(user, password string) bool {
+		hash, ok := users[user]
+		if !ok {
+			compareDummyHash(password)
+			return false
+		}
+		return MatchPasswordHash(hash, password)
+	}
+}
+
+// HtpasswdBasicAuthValidator returns a validator of the htpasswd file of name, which is reloaded when modified.
+// The lines are "user:hash", the hashes in the formats of MatchPasswordHash.
+func HtpasswdBasicAuthValidator(name string) (BasicAuthValidator, error) {
+	file := &watchedFile{
+		name:     name,
+		interval: 5 * time.Second,
+		load: func(name string) (interface{}, error) {
+			return loadHtpasswd(name)
+		},
+	}
+	if err := file.reload(); err != nil {
+		return nil, err
+	}
+	return func(user, password string) bool {
+		return StaticBasicAuthValidator(file.get().(map[string]string))(user, password)
+	}, nil
+}
+
+// SQLBasicAuthValidator returns a validator querying the password hash of a user
+// from the column hashColumn of table by the column userColumn, e.g.
+//
+//	middleware.SQLBasicAuthValidator(sqlx.DefaultDB(), "users", "name", "password_hash")
+//
+// The hashes are in the formats of MatchPasswordHash.
+func SQLBasicAuthValidator(db BasicAuthDB, table, userColumn, hashColumn string) (BasicAuthValidator, error) {
+	for _, name := range []string{table, userColumn, hashColumn} {
+		if !sqlIdentifier.MatchString(name) {
+			return nil, fmt.Errorf("invalid basic auth sql identifier=%s", name)
+		}
+	}
+	query := db.Rebind(fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", hashColumn, table, userColumn))
+	return func(user, password string) bool {
+		var hash string
+		if err := db.QueryRow(query, user).Scan(&hash); err != nil {
+			if err != sql.ErrNoRows {
+				lessgo.Log.Error("basic auth: %v", err)
+			}
+			compareDummyHash(password)
+			return false
+		}
+		return MatchPasswordHash(hash, password)
+	}, nil
+}
+
+// MatchPasswordHash reports whether password matches hash, which is one of
+// bcrypt ("$2y$..."), SHA-1 ("{SHA}..."), apr1-MD5 ("$apr1$..."), MD5-crypt ("$1$...")
+// or the plain password prefixed by "{PLAIN}".
+// The comparison takes constant time.
+func MatchPasswordHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return constantTimeEqual(hash[len("{SHA}"):], base64.StdEncoding.EncodeToString(sum[:]))
+	case strings.HasPrefix(hash, apr1Magic):
+		return constantTimeEqual(hash, md5Crypt(password, hash, apr1Magic))
+	case strings.HasPrefix(hash, md5Magic):
+		return constantTimeEqual(hash, md5Crypt(password, hash, md5Magic))
+	case strings.HasPrefix(hash, "{PLAIN}"):
+		return constantTimeEqual(hash[len("{PLAIN}"):], password)
+	}
+	// unknown formats like crypt(3) never match.
+	return false
+}
+
+// loadHtpasswd reads the users of an htpasswd file.
+func loadHtpasswd(name string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid htpasswd line in %s: %q", name, line)
+		}
+		users[line[:i]] = line[i+1:]
+	}
+	return users, scanner.Err()
+}
+
+// md5Crypt returns the MD5-crypt hash of password with the salt of setting, like "$apr1$salt$...".
+func md5Crypt(password, setting, magic string) string {
+	salt := strings.TrimPrefix(setting, magic)
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic))
+	d.Write([]byte(salt))
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	mixin := alt.Sum(nil)
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(mixin)
+		} else {
+			d.Write(mixin[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	final := d.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pw)
+		} else {
+			d.Write(final)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 != 0 {
+			d.Write(final)
+		} else {
+			d.Write(pw)
+		}
+		final = d.Sum(nil)
+	}
+
+	out := make([]byte, 0, 22)
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return magic + salt + "$" + string(out)
+}
+
+// attempt returns how long key is still locked out, or counts a login of key as failed until it succeeds,
+// and locks key out after max failures.
+// the login is counted before the credentials are checked, so concurrent logins can not exceed max either.
+func (l *basicAuthLockout) attempt(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.keys[key]; ok && now.Before(f.locked) {
+		return f.locked.Sub(now)
+	}
+	if now.Sub(l.pruned) > l.duration {
+		for k, f := range l.keys {
+			if now.Sub(f.first) > l.duration && now.After(f.locked) {
+				delete(l.keys, k)
+			}
+		}
+		l.pruned = now
+	}
+	f, ok := l.keys[key]
+	if !ok || now.Sub(f.first) > l.duration {
+		f = &basicAuthFailures{first: now}
+		l.keys[key] = f
+	}
+	f.count++
+	if f.count >= l.max {
+		f.count, f.first, f.locked = 0, now, now.Add(l.duration)
+	}
+	return 0
+}
+
+// succeed forgets the failures of key, including the login counted by attempt.
+func (l *basicAuthLockout) succeed(key string) {
+	l.mu.Lock()
+	delete(l.keys, key)
+	l.mu.Unlock()
+}
+
+// basicAuthCredentials returns the user and password of the basic auth header.
+func basicAuthCredentials(c *lessgo.Context) (user, password string, ok bool) {
+	auth := c.HeaderParam(lessgo.HeaderAuthorization)
+	l := len(basic)
+	if len(auth) <= l+1 || auth[:l] != basic {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[l+1:])
+	if err != nil {
+		return "", "", false
+	}
+	cred := string(b)
+	i := strings.IndexByte(cred, ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return cred[:i], cred[i+1:], true
+}
+
+func compareDummyHash(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMatchPasswordHash(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := []string{
+		string(bcryptHash),
+		"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/",
+		"$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/",
+		"{PLAIN}password",
+	}
+	for _, hash := range hashes {
+		if !MatchPasswordHash(hash, "password") {
+			t.Errorf("MatchPasswordHash(%s) of the password = false", hash)
+		}
+		if MatchPasswordHash(hash, "Password") || MatchPasswordHash(hash, "") {
+			t.Errorf("MatchPasswordHash(%s) of a wrong password = true", hash)
+		}
+	}
+	// unknown formats never match, even the password itself.
+	for _, hash := range []string{"password", "saltsalt", "", "$5$rounds=5000$salt$hash"} {
+		if MatchPasswordHash(hash, hash) {
+			t.Errorf("MatchPasswordHash(%s) of an unknown format = true", hash)
+		}
+	}
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, ".htpasswd")
+	content := "# users\n\nalice:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/\r\n  bob:{PLAIN}pa:ss  \n"
+	if err = ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := loadHtpasswd(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users["alice"] != "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/" || users["bob"] != "{PLAIN}pa:ss" {
+		t.Errorf("loadHtpasswd = %v", users)
+	}
+
+	validator, err := HtpasswdBasicAuthValidator(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !validator("alice", "password") || !validator("bob", "pa:ss") {
+		t.Error("htpasswd validator refused a valid password")
+	}
+	if validator("alice", "pa:ss") || validator("carol", "password") {
+		t.Error("htpasswd validator accepted an invalid password")
+	}
+
+	for _, content := range []string{"alice\n", ":{PLAIN}password\n"} {
+		if err = ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = loadHtpasswd(name); err == nil {
+			t.Errorf("loadHtpasswd(%q) succeeded", content)
+		}
+	}
+	if _, err = loadHtpasswd(filepath.Join(dir, "none")); err == nil {
+		t.Error("loadHtpasswd of a missing file succeeded")
+	}
+}
+
+func TestBasicAuthLockout(t *testing.T) {
+	l := &basicAuthLockout{max: 3, duration: time.Minute, keys: make(map[string]*basicAuthFailures)}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if wait := l.attempt("1.2.3.4", now); wait != 0 {
+			t.Fatalf("attempt %d is locked out for %v", i, wait)
+		}
+	}
+	if wait := l.attempt("1.2.3.4", now.Add(time.Second)); wait != 59*time.Second {
+		t.Errorf("attempt after max failures is locked out for %v", wait)
+	}
+	if wait := l.attempt("5.6.7.8", now); wait != 0 {
+		t.Errorf("another key is locked out for %v", wait)
+	}
+	if wait := l.attempt("1.2.3.4", now.Add(time.Minute)); wait != 0 {
+		t.Errorf("attempt after the lockout is locked out for %v", wait)
+	}
+
+	// a success forgets the failures.
+	l.attempt("9.9.9.9", now)
+	l.attempt("9.9.9.9", now)
+	l.succeed("9.9.9.9")
+	for i := 0; i < 3; i++ {
+		if wait := l.attempt("9.9.9.9", now); wait != 0 {
+			t.Fatalf("attempt %d after a success is locked out for %v", i, wait)
+		}
+	}
+
+	// the failures older than the duration are not counted.
+	l.attempt("8.8.8.8", now)
+	l.attempt("8.8.8.8", now)
+	for i := 0; i < 2; i++ {
+		if wait := l.attempt("8.8.8.8", now.Add(2*time.Minute)); wait != 0 {
+			t.Fatalf("attempt %d after the failures expired is locked out for %v", i, wait)
+		}
+	}
+}
+
+func TestBasicAuthLockoutConcurrent(t *testing.T) {
+	l := &basicAuthLockout{max: 5, duration: time.Minute, keys: make(map[string]*basicAuthFailures)}
+	var (
+		mu      sync.Mutex
+		allowed int
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if l.attempt("1.2.3.4", time.Now()) == 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 5 {
+		t.Errorf("%d concurrent attempts are allowed, want 5", allowed)
+	}
+}
@@ -0,0 +1,217 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/henrylee2cn/lessgo"
+)
+
+type (
+	// IPFilterConfig defines the config for IP filter middleware.
+	IPFilterConfig struct {
+		// Allow defines the IPs or CIDRs which are allowed access, e.g. "192.168.0.0/16" or "fc00::/7".
+		// Optional. Default value []string{}, which allows any IP not denied.
+		Allow []string `json:"allow"`
+
+		// Deny defines the IPs or CIDRs which are denied access, it takes precedence over Allow.
+		// Optional. Default value []string{}.
+		Deny []string `json:"deny"`
+
+		// TrustedProxies defines the IPs or CIDRs of the proxies whose `X-Forwarded-For`
+		// and `X-Real-IP` headers are honored.
+		// The client IP is the right-most address of `X-Forwarded-For` not in TrustedProxies,
+		// when the request comes from a trusted proxy.
+		// Optional. Default value []string{}, which never honors the headers.
+		TrustedProxies []string `json:"trusted_proxies"`
+	}
+
+	// IPRules decides the client IP of a request and whether it is allowed, by an IPFilterConfig.
+	IPRules struct {
+		allow   []*net.IPNet
+		deny    []*net.IPNet
+		trusted []*net.IPNet
+	}
+)
+
+var (
+	// LANNets are the loopback, private and link-local networks of IPv4 and IPv6.
+	LANNets = []string{
+		"127.0.0.0/8",
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"169.254.0.0/16",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	}
+
+	// DefaultIPFilterConfig is the default IP filter middleware config.
+	DefaultIPFilterConfig = IPFilterConfig{
+		Allow: LANNets,
+	}
+
+	lanRules = MustIPRules(IPFilterConfig{Allow: LANNets})
+)
+
+// IPFilter returns a middleware which allows or denies access by the client IP.
+//
+// The IP matches the CIDRs of the allow and deny lists, both IPv4 and IPv6.
+// `X-Forwarded-For` is honored only from the trusted proxies, so a client can not forge its IP.
+// For a denied IP, it sends "403 - Forbidden" response.
+var IPFilter = lessgo.ApiMiddleware{
+	Name: "IPFilter",
+	Desc: `allows or denies access by the client IP matching the CIDRs of the allow and deny lists, both IPv4 and IPv6.
+The deny list takes precedence, an empty allow list allows any IP not denied.
+'X-Forwarded-For' is honored only from the trusted proxies, so a client can not forge its IP.`,
+	Config: DefaultIPFilterConfig,
+	Middleware: func(confObject interface{}) lessgo.MiddlewareFunc {
+		rules := MustIPRules(confObject.(IPFilterConfig))
+		return func(next lessgo.HandlerFunc) lessgo.HandlerFunc {
+			return func(c *lessgo.Context) error {
+				ip := rules.ClientIP(c.Request())
+				if rules.Allowed(ip) {
+					return next(c)
+				}
+				return c.Failure(http.StatusForbidden, errors.New(`Not allow your ip access: `+ipString(ip)))
+			}
+		}
+	},
+}.Reg()
+
+// NewIPRules parses the lists of config.
+// an entry is an IP or a CIDR.
+func NewIPRules(config IPFilterConfig) (*IPRules, error) {
+	var (
+		rules = new(IPRules)
+		err   error
+	)
+	if rules.allow, err = parseIPNets(config.Allow); err != nil {
+		return nil, err
+	}
+	if rules.deny, err = parseIPNets(config.Deny); err != nil {
+		return nil, err
+	}
+	if rules.trusted, err = parseIPNets(config.TrustedProxies); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// MustIPRules is like NewIPRules but panics if a list can not be parsed.
+func MustIPRules(config IPFilterConfig) *IPRules {
+	rules, err := NewIPRules(config)
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+// Allowed reports whether ip is allowed access.
+// a nil ip is allowed only if no list restricts.
+func (rules *IPRules) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(rules.allow) == 0 && len(rules.deny) == 0
+	}
+	if containsIP(rules.deny, ip) {
+		return false
+	}
+	return len(rules.allow) == 0 || containsIP(rules.allow, ip)
+}
+
+// ClientIP returns the IP of the client of r, nil if unknown.
+// the headers set by proxies are honored only if r comes from a trusted proxy.
+func (rules *IPRules) ClientIP(r *http.Request) net.IP {
+	ip := parseIP(r.RemoteAddr)
+	if ip == nil || !containsIP(rules.trusted, ip) {
+		return ip
+	}
+	// Walk X-Forwarded-For from the nearest hop, every trusted proxy appends its peer.
+	hops := strings.Split(strings.Join(r.Header[lessgo.HeaderXForwardedFor], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseIP(hops[i])
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(rules.trusted, hop) {
+			return ip
+		}
+	}
+	if realIP := parseIP(r.Header.Get(lessgo.HeaderXRealIP)); realIP != nil && containsIP(rules.trusted, ip) {
+		return realIP
+	}
+	return ip
+}
+
+// IsLAN reports whether the address, an IP with or without port, is in LANNets.
+func IsLAN(addr string) bool {
+	ip := parseIP(addr)
+	return ip != nil && lanRules.Allowed(ip)
+}
+
+// parseIPNets parses IPs and CIDRs, an IP is a network of itself.
+func parseIPNets(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if strings.Contains(s, "/") {
+			_, ipnet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ip filter cidr=%s", s)
+			}
+			nets = append(nets, ipnet)
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip filter ip=%s", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// parseIP parses an IP with or without port, like "10.0.0.1", "10.0.0.1:80" or "[::1]:80".
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i] // zone of a link-local IPv6
+	}
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4 // IPv4-mapped IPv6 matches IPv4 CIDRs
+	}
+	return ip
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	return ip.String()
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	rules := MustIPRules(IPFilterConfig{TrustedProxies: []string{"10.0.0.0/8", "fd00::/8"}})
+	cases := []struct {
+		remote    string
+		forwarded []string
+		realIP    string
+		want      string
+	}{
+		{remote: "203.0.113.7:5000", want: "203.0.113.7"},
+		// the headers of an untrusted peer are forged.
+		{remote: "203.0.113.7:5000", forwarded: []string{"1.2.3.4"}, want: "203.0.113.7"},
+		{remote: "203.0.113.7:5000", realIP: "1.2.3.4", want: "203.0.113.7"},
+		{remote: "10.0.0.1:5000", forwarded: []string{"1.2.3.4"}, want: "1.2.3.4"},
+		// the hops left of the first untrusted one are set by the client.
+		{remote: "10.0.0.1:5000", forwarded: []string{"6.6.6.6, 1.2.3.4, 10.0.0.2"}, want: "1.2.3.4"},
+		{remote: "10.0.0.1:5000", forwarded: []string{"6.6.6.6, 1.2.3.4", "10.0.0.2"}, want: "1.2.3.4"},
+		{remote: "10.0.0.1:5000", forwarded: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{remote: "10.0.0.1:5000", forwarded: []string{"1.2.3.4, bogus"}, want: "10.0.0.1"},
+		{remote: "10.0.0.1:5000", realIP: "1.2.3.4", want: "1.2.3.4"},
+		{remote: "10.0.0.1:5000", forwarded: []string{"10.0.0.2"}, realIP: "1.2.3.4", want: "1.2.3.4"},
+		{remote: "10.0.0.1:5000", forwarded: []string{"5.6.7.8"}, realIP: "1.2.3.4", want: "5.6.7.8"},
+		// IPv4-mapped IPv6 addresses match the IPv4 CIDRs.
+		{remote: "[::ffff:10.0.0.1]:5000", forwarded: []string{"1.2.3.4"}, want: "1.2.3.4"},
+		{remote: "10.0.0.1:5000", forwarded: []string{"::ffff:1.2.3.4"}, want: "1.2.3.4"},
+		{remote: "[fd00::1]:5000", forwarded: []string{"2001:db8::1"}, want: "2001:db8::1"},
+		{remote: "[2001:db8::2]:5000", forwarded: []string{"2001:db8::1"}, want: "2001:db8::2"},
+		{remote: "pipe", forwarded: []string{"1.2.3.4"}, want: "unknown"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		for _, v := range c.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if c.realIP != "" {
+			r.Header.Set("X-Real-IP", c.realIP)
+		}
+		if got := ipString(rules.ClientIP(r)); got != c.want {
+			t.Errorf("ClientIP(%s, %q, %q) = %s, want %s", c.remote, c.forwarded, c.realIP, got, c.want)
+		}
+	}
+}
+
+func TestIPRulesAllowed(t *testing.T) {
+	rules := MustIPRules(IPFilterConfig{Allow: []string{"192.168.0.0/16", "2001:db8::/32"}, Deny: []string{"192.168.1.0/24"}})
+	cases := map[string]bool{
+		"192.168.2.1":          true,
+		"192.168.1.5":          false,
+		"8.8.8.8":              false,
+		"::ffff:192.168.2.1":   true,
+		"[2001:db8::1]:80":     true,
+		"2001:db9::1":          false,
+		"fe80::1%eth0":         false,
+		"192.168.2.1:8080":     true,
+		"[::ffff:192.168.1.5]": false,
+	}
+	for addr, want := range cases {
+		if got := rules.Allowed(parseIP(addr)); got != want {
+			t.Errorf("Allowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if rules.Allowed(nil) {
+		t.Error("an unknown IP is allowed by an allow list")
+	}
+	if !MustIPRules(IPFilterConfig{}).Allowed(nil) {
+		t.Error("an unknown IP is denied without lists")
+	}
+	if !IsLAN("[fe80::1%eth0]:80") || !IsLAN("127.0.0.1") || IsLAN("8.8.8.8") {
+		t.Error("IsLAN")
+	}
+	if _, err := NewIPRules(IPFilterConfig{Allow: []string{"192.168.0.0/33"}}); err == nil {
+		t.Error("an invalid CIDR is accepted")
+	}
+	if _, err := NewIPRules(IPFilterConfig{TrustedProxies: []string{"proxy"}}); err == nil {
+		t.Error("an invalid IP is accepted")
+	}
+}
@@ -1,26 +1,60 @@
 package middleware
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/henrylee2cn/lessgo"
+	"github.com/henrylee2cn/lessgoext/cache"
 )
 
 type (
 	// JWTConfig defines the config for JWT auth middleware.
 	JWTConfig struct {
 		// Signing key to validate token.
-		// Required.
+		// The secret for the HS algorithms, or a PEM encoded public key or certificate
+		// for the RS, ES and EdDSA algorithms.
+		// Required, unless PublicKeyFile or JWKSURL is set.
 		SigningKey []byte `json:"signing_key"`
 
 		// Signing method, used to check token signing method.
 		// Optional. Default value HS256.
+		// Possible values: HS256, HS384, HS512, RS256, RS384, RS512, ES256, ES384 and EdDSA.
 		SigningMethod string `json:"signing_method"`
 
+		// PublicKeyFile is a PEM file holding the public key or certificate to validate token.
+		// Optional. Default value "".
+		PublicKeyFile string `json:"public_key_file"`
+
+		// JWKSURL is the URL or the local file of a JSON Web Key Set holding the keys to validate token,
+		// they are chosen by the `kid` header of token.
+		// Optional. Default value "".
+		JWKSURL string `json:"jwks_url"`
+
+		// JWKSRefresh is the period in seconds to reload the JWKS,
+		// it is reloaded early too if a token has an unknown `kid`.
+		// Optional. Default value 3600.
+		JWKSRefresh int `json:"jwks_refresh"`
+
+		// Issuer is the required `iss` claim of token.
+		// Optional. Default value "", which does not check it.
+		Issuer string `json:"issuer"`
+
+		// Audience defines the `aud` claims of which token must have one.
+		// Optional. Default value []string{}, which does not check it.
+		Audience []string `json:"audience"`
+
+		// Leeway is the clock skew in seconds tolerated when checking the `exp`, `nbf` and `iat` claims.
+		// Optional. Default value 0.
+		Leeway int `json:"leeway"`
+
 		// Context key to store user information from the token into context.
 		// Optional. Default value "user".
 		ContextKey string `json:"context_key"`
@@ -31,25 +65,86 @@ type (
 		// Possible values:
 		// - "header:<name>"
 		// - "query:<name>"
+		// - "cookie:<name>"
+		// - "form:<name>"
 		TokenLookup string `json:"token_lookup"`
+
+		// Claims returns a new value of the custom claims type the token is parsed into,
+		// jwt.MapClaims if nil.
+		// The registered claims are checked whatever the type, and a type implementing
+		// `Validate() error` is validated by it as well.
+		// Any other type but jwt.MapClaims and jwt.StandardClaims is validated by its `Valid()`,
+		// which checks its own registered claims without the leeway.
+		// Optional. Source only.
+		Claims func() jwt.Claims `json:"-"`
+
+		// Denylist rejects the tokens whose `jti` was revoked, e.g. by logout.
+		// Optional. Source only, share it with the token issuer.
+		Denylist *JWTDenylist `json:"-"`
+
+		// DenylistAdapter is the name of the cache adapter of the denylist if Denylist is nil,
+		// it must be a shared one like redis to see the revocations of the issuer.
+		// Optional. Default value "", which means no denylist.
+		DenylistAdapter string `json:"denylist_adapter"`
+
+		// DenylistAdapterConfig is the config passed to cache.NewCache for the denylist.
+		// Optional. Default value "".
+		DenylistAdapterConfig string `json:"denylist_adapter_config"`
 	}
 
 	jwtExtractor func(*lessgo.Context) (string, error)
+
+	// jwtValidator parses and validates tokens by a JWTConfig.
+	jwtValidator struct {
+		config JWTConfig
+		key    interface{} // static key, nil if from jwks
+		jwks   *jwks
+		parser *jwt.Parser
+		leeway time.Duration
+	}
+
+	// registeredClaims are the registered claims of RFC 7519 checked by jwtValidator,
+	// read from the payload whatever the claims type of the token.
+	registeredClaims struct {
+		ID        string      `json:"jti"`
+		Issuer    string      `json:"iss"`
+		Audience  audience    `json:"aud"`
+		ExpiresAt json.Number `json:"exp"`
+		NotBefore json.Number `json:"nbf"`
+		IssuedAt  json.Number `json:"iat"`
+		TokenUse  string      `json:"token_use"`
+	}
+
+	// audience is the `aud` claim, a string or an array of strings.
+	audience []string
 )
 
 const (
 	bearer = "Bearer"
+
+	// TokenUseRefresh is the `token_use` claim of the refresh tokens,
+	// which are never accepted in place of access tokens.
+	TokenUseRefresh = "refresh"
 )
 
 // Algorithims
 const (
 	AlgorithmHS256 = "HS256"
+	AlgorithmHS384 = "HS384"
+	AlgorithmHS512 = "HS512"
+	AlgorithmRS256 = "RS256"
+	AlgorithmRS384 = "RS384"
+	AlgorithmRS512 = "RS512"
+	AlgorithmES256 = "ES256"
+	AlgorithmES384 = "ES384"
+	AlgorithmEdDSA = "EdDSA"
 )
 
 var (
 	// DefaultJWTConfig is the default JWT auth middleware config.
 	DefaultJWTConfig = JWTConfig{
 		SigningMethod: AlgorithmHS256,
+		JWKSRefresh:   3600,
 		ContextKey:    "user",
 		TokenLookup:   "header:" + lessgo.HeaderAuthorization,
 	}
@@ -63,23 +158,19 @@ var (
 //
 var JWTWithConfig = lessgo.ApiMiddleware{
 	Name:   "JWTWithConfig",
-	Desc:   `JWT基本的第三方授权中间件，使用前请先在源码配置处理函数。`,
+	Desc:   `JWT基本的第三方授权中间件，支持HS、RS、ES与EdDSA签名算法，密钥可来自PEM文件或定期刷新的JWKS，使用前请先在源码配置处理函数。`,
 	Config: DefaultJWTConfig,
 	Middleware: func(confObject interface{}) lessgo.MiddlewareFunc {
 		config := confObject.(JWTConfig)
 		// Defaults
-		if config.SigningKey == nil {
-			panic("jwt middleware requires signing key")
-		}
-		if config.SigningMethod == "" {
-			config.SigningMethod = DefaultJWTConfig.SigningMethod
-		}
-		if config.ContextKey == "" {
-			config.ContextKey = DefaultJWTConfig.ContextKey
-		}
 		if config.TokenLookup == "" {
 			config.TokenLookup = DefaultJWTConfig.TokenLookup
 		}
+		validator, err := newJWTValidator(config)
+		if err != nil {
+			panic(err)
+		}
+		config = validator.config
 
 		// Initialize
 		parts := strings.Split(config.TokenLookup, ":")
@@ -87,6 +178,10 @@ var JWTWithConfig = lessgo.ApiMiddleware{
 		switch parts[0] {
 		case "query":
 			extractor = jwtFromQuery(parts[1])
+		case "cookie":
+			extractor = jwtFromCookie(parts[1])
+		case "form":
+			extractor = jwtFromForm(parts[1])
 		}
 
 		return func(next lessgo.HandlerFunc) lessgo.HandlerFunc {
@@ -95,15 +190,8 @@ var JWTWithConfig = lessgo.ApiMiddleware{
 				if err != nil {
 					return lessgo.NewHTTPError(http.StatusBadRequest, err.Error())
 				}
-				token, err := jwt.Parse(auth, func(t *jwt.Token) (interface{}, error) {
-					// Check the signing method
-					if t.Method.Alg() != config.SigningMethod {
-						return nil, fmt.Errorf("unexpected jwt signing method=%v", t.Header["alg"])
-					}
-					return config.SigningKey, nil
-
-				})
-				if err == nil && token.Valid {
+				token, err := validator.parse(auth)
+				if err == nil {
 					// Store user information from token into context.
 					c.Set(config.ContextKey, token)
 					return next(c)
@@ -114,6 +202,202 @@ var JWTWithConfig = lessgo.ApiMiddleware{
 	},
 }
 
+// newJWTValidator fills the defaults of config and loads its keys.
+func newJWTValidator(config JWTConfig) (*jwtValidator, error) {
+	if config.SigningMethod == "" {
+		config.SigningMethod = DefaultJWTConfig.SigningMethod
+	}
+	if config.JWKSRefresh <= 0 {
+		config.JWKSRefresh = DefaultJWTConfig.JWKSRefresh
+	}
+	if config.ContextKey == "" {
+		config.ContextKey = DefaultJWTConfig.ContextKey
+	}
+	if jwt.GetSigningMethod(config.SigningMethod) == nil {
+		return nil, fmt.Errorf("invalid jwt signing method=%s", config.SigningMethod)
+	}
+
+	v := &jwtValidator{
+		config: config,
+		parser: &jwt.Parser{
+			ValidMethods:         []string{config.SigningMethod},
+			UseJSONNumber:        true,
+			SkipClaimsValidation: true, // checked with leeway by validate
+		},
+		leeway: time.Duration(config.Leeway) * time.Second,
+	}
+	if config.Denylist == nil && config.DenylistAdapter != "" {
+		c, err := cache.NewCache(config.DenylistAdapter, config.DenylistAdapterConfig)
+		if err != nil {
+			return nil, fmt.Errorf("jwt denylist: %v", err)
+		}
+		v.config.Denylist = NewJWTDenylist(c)
+	}
+	hmac := strings.HasPrefix(config.SigningMethod, "HS")
+	switch {
+	case config.JWKSURL != "":
+		v.jwks = newJWKS(config.JWKSURL, time.Duration(config.JWKSRefresh)*time.Second)
+		if err := v.jwks.reload(0); err != nil {
+			// the key server may come up later, the keys are reloaded on demand.
+			lessgo.Log.Warn("jwt: load jwks %s: %v", config.JWKSURL, err)
+		}
+	case hmac:
+		if config.SigningKey == nil {
+			return nil, errors.New("jwt middleware requires signing key")
+		}
+		v.key = config.SigningKey
+	default:
+		data := config.SigningKey
+		if config.PublicKeyFile != "" {
+			var err error
+			if data, err = ioutil.ReadFile(config.PublicKeyFile); err != nil {
+				return nil, err
+			}
+		}
+		if data == nil {
+			return nil, errors.New("jwt middleware requires signing key, public key file or jwks url")
+		}
+		key, err := ParsePublicKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+		if err = checkKeyType(config.SigningMethod, key); err != nil {
+			return nil, err
+		}
+		v.key = key
+	}
+	return v, nil
+}
+
+// parse returns the token of auth if it is signed by a valid key and its claims are valid.
+func (v *jwtValidator) parse(auth string) (*jwt.Token, error) {
+	var claims jwt.Claims = jwt.MapClaims{}
+	if v.config.Claims != nil {
+		claims = v.config.Claims()
+	}
+	token, err := v.parser.ParseWithClaims(auth, claims, v.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	if err = v.validate(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// keyFunc returns the key to verify token by.
+func (v *jwtValidator) keyFunc(t *jwt.Token) (interface{}, error) {
+	// Check the signing method
+	if t.Method.Alg() != v.config.SigningMethod {
+		return nil, fmt.Errorf("unexpected jwt signing method=%v", t.Header["alg"])
+	}
+	if v.jwks == nil {
+		return v.key, nil
+	}
+	kid, _ := t.Header["kid"].(string)
+	key, err := v.jwks.key(kid)
+	if err != nil {
+		return nil, err
+	}
+	// a key of another type could be abused to forge tokens.
+	if err = checkKeyType(v.config.SigningMethod, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// validate checks the registered claims of token with leeway and the denylist, then its custom validation.
+func (v *jwtValidator) validate(token *jwt.Token) error {
+	parts := strings.Split(token.Raw, ".")
+	payload, err := jwt.DecodeSegment(parts[1])
+	if err != nil {
+		return err
+	}
+	var rc registeredClaims
+	if err = json.Unmarshal(payload, &rc); err != nil {
+		return err
+	}
+	now := time.Now()
+	if t, ok := numericDate(rc.ExpiresAt); ok && now.After(t.Add(v.leeway)) {
+		return errors.New("token is expired")
+	}
+	if t, ok := numericDate(rc.NotBefore); ok && now.Before(t.Add(-v.leeway)) {
+		return errors.New("token is not valid yet")
+	}
+	if t, ok := numericDate(rc.IssuedAt); ok && now.Before(t.Add(-v.leeway)) {
+		return errors.New("token used before issued")
+	}
+	if v.config.Issuer != "" && rc.Issuer != v.config.Issuer {
+		return fmt.Errorf("unexpected jwt issuer=%s", rc.Issuer)
+	}
+	if len(v.config.Audience) > 0 && !rc.Audience.containsAny(v.config.Audience) {
+		return errors.New("unexpected jwt audience")
+	}
+	if rc.TokenUse == TokenUseRefresh {
+		return errors.New("refresh token used as access token")
+	}
+	if v.config.Denylist != nil && rc.ID != "" && v.config.Denylist.Revoked(rc.ID) {
+		return errors.New("token is revoked")
+	}
+	switch claims := token.Claims.(type) {
+	case interface{ Validate() error }:
+		return claims.Validate()
+	case jwt.MapClaims, *jwt.MapClaims, jwt.StandardClaims, *jwt.StandardClaims:
+		// checked above with the leeway.
+		return nil
+	default:
+		return claims.Valid()
+	}
+}
+
+// maxNumericDate bounds the NumericDate claims in seconds, far beyond any real date
+// and still in the range of time.Time.
+const maxNumericDate = 1 << 40
+
+// numericDate converts a NumericDate claim, which may have a fraction.
+// a huge value is clamped, so it can not overflow into the past.
+func numericDate(n json.Number) (time.Time, bool) {
+	if n == "" {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil && !math.IsInf(f, 0) {
+		return time.Time{}, false
+	}
+	if f > maxNumericDate {
+		f = maxNumericDate
+	} else if f < -maxNumericDate {
+		f = -maxNumericDate
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))), true
+}
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return err
+	}
+	*a = ss
+	return nil
+}
+
+func (a audience) containsAny(list []string) bool {
+	for _, s := range a {
+		for _, t := range list {
+			if s == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // jwtFromHeader returns a `jwtExtractor` that extracts token from the provided
 // request header.
 func jwtFromHeader(header string) jwtExtractor {
@@ -138,3 +422,27 @@ func jwtFromQuery(param string) jwtExtractor {
 		return token, nil
 	}
 }
+
+// jwtFromCookie returns a `jwtExtractor` that extracts token from the provided
+// cookie.
+func jwtFromCookie(name string) jwtExtractor {
+	return func(c *lessgo.Context) (string, error) {
+		cookie, err := c.Cookie(name)
+		if err != nil || cookie.Value == "" {
+			return "", errors.New("empty jwt in cookie")
+		}
+		return cookie.Value, nil
+	}
+}
+
+// jwtFromForm returns a `jwtExtractor` that extracts token from the provided form
+// parameter.
+func jwtFromForm(param string) jwtExtractor {
+	return func(c *lessgo.Context) (string, error) {
+		token := c.FormParam(param)
+		if token == "" {
+			return "", errors.New("empty jwt in form param")
+		}
+		return token, nil
+	}
+}
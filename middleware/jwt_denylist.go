@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/henrylee2cn/lessgoext/cache"
+)
+
+// JWTDenylist keeps the IDs (jti) of the revoked tokens in a cache adapter,
+// each until the token expires by itself.
+// a shared adapter like redis revokes the tokens on all the instances.
+type JWTDenylist struct {
+	cache  cache.Cache
+	prefix string
+}
+
+// DefaultJWTDenylistPrefix is prepended to the revoked IDs for the cache keys.
+var DefaultJWTDenylistPrefix = "jwt:denylist:"
+
+// NewJWTDenylist returns a denylist stored in c.
+func NewJWTDenylist(c cache.Cache) *JWTDenylist {
+	return &JWTDenylist{cache: c, prefix: DefaultJWTDenylistPrefix}
+}
+
+// Revoke adds id to the denylist until the time the token expires,
+// a zero time keeps it forever.
+func (d *JWTDenylist) Revoke(id string, until time.Time) error {
+	_, err := d.RevokeOnce(id, until)
+	return err
+}
+
+// RevokeOnce is like Revoke, and reports whether id was not revoked before.
+// it is atomic if the adapter implements cache.AtomicCache,
+// so of concurrent calls with the same id only one gets true.
+func (d *JWTDenylist) RevokeOnce(id string, until time.Time) (bool, error) {
+	var timeout time.Duration
+	if !until.IsZero() {
+		if timeout = time.Until(until); timeout <= 0 {
+			// expired, it can not be used anyway.
+			return !d.Revoked(id), nil
+		}
+	}
+	key := d.prefix + id
+	if ac, ok := d.cache.(cache.AtomicCache); ok {
+		return ac.SetNX(key, "1", timeout)
+	}
+	if d.cache.IsExist(key) {
+		return false, nil
+	}
+	return true, d.cache.Put(key, "1", timeout)
+}
+
+// Revoked reports whether id is in the denylist.
+func (d *JWTDenylist) Revoked(id string) bool {
+	return d.cache.IsExist(d.prefix + id)
+}
@@ -0,0 +1,323 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+type (
+	// SigningMethodEd25519 implements the EdDSA signing method of RFC 8037 with Ed25519 keys,
+	// which jwt-go lacks.
+	// Sign expects an ed25519.PrivateKey and Verify an ed25519.PublicKey.
+	SigningMethodEd25519 struct{}
+
+	// jwks is a JSON Web Key Set loaded from a URL or a local file, and reloaded periodically.
+	// it is reloaded on demand, so no goroutine outlives a middleware rebuilt by the admin.
+	jwks struct {
+		location string
+		refresh  time.Duration
+		client   *http.Client
+
+		mu      sync.RWMutex
+		keys    map[string]interface{} // kid -> public key
+		loaded  time.Time
+		tried   time.Time
+		loading sync.Mutex
+	}
+
+	// jwk is a JSON Web Key of RFC 7517, only the members of public keys are read.
+	jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		Crv string `json:"crv"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+)
+
+const (
+	// jwksMissRefresh bounds how often a key id not in the set reloads it,
+	// so forged key ids can not hammer the key server.
+	jwksMissRefresh = 10 * time.Second
+	jwksTimeout     = 10 * time.Second
+)
+
+// SigningMethodEdDSA is the EdDSA signing method, registered as "EdDSA" in jwt-go.
+var SigningMethodEdDSA = &SigningMethodEd25519{}
+
+func init() {
+	jwt.RegisterSigningMethod(AlgorithmEdDSA, func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+// Alg returns "EdDSA".
+func (m *SigningMethodEd25519) Alg() string {
+	return AlgorithmEdDSA
+}
+
+// Verify checks the base64url signature of signingString by an ed25519.PublicKey.
+func (m *SigningMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok || len(publicKey) != ed25519.PublicKeySize {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return errors.New("ed25519: verification error")
+	}
+	return nil
+}
+
+// Sign signs signingString by an ed25519.PrivateKey and returns the base64url signature.
+func (m *SigningMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok || len(privateKey) != ed25519.PrivateKeySize {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+// ParsePublicKeyFromPEM parses a PEM encoded PKIX public key or certificate,
+// and returns the *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey in it.
+func ParsePublicKeyFromPEM(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("jwt: key must be pem encoded")
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		return cert.PublicKey, nil
+	}
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("jwt: unknown public key in pem")
+}
+
+// ParsePrivateKeyFromPEM parses a PEM encoded PKCS#8, PKCS#1 or SEC 1 private key,
+// and returns the *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey in it.
+func ParsePrivateKeyFromPEM(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("jwt: key must be pem encoded")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("jwt: unknown private key in pem")
+}
+
+// checkKeyType returns an error if key can not verify the tokens of alg.
+func checkKeyType(alg string, key interface{}) error {
+	var ok bool
+	switch {
+	case strings.HasPrefix(alg, "HS"):
+		_, ok = key.([]byte)
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		_, ok = key.(*rsa.PublicKey)
+	case strings.HasPrefix(alg, "ES"):
+		_, ok = key.(*ecdsa.PublicKey)
+	case alg == AlgorithmEdDSA:
+		_, ok = key.(ed25519.PublicKey)
+	}
+	if !ok {
+		return fmt.Errorf("jwt: %T is not a key of %s", key, alg)
+	}
+	return nil
+}
+
+func newJWKS(location string, refresh time.Duration) *jwks {
+	return &jwks{
+		location: location,
+		refresh:  refresh,
+		client:   &http.Client{Timeout: jwksTimeout},
+	}
+}
+
+// key returns the public key of kid, reloading the set if it is stale or misses kid.
+// an empty kid matches the only key of the set.
+func (s *jwks) key(kid string) (interface{}, error) {
+	s.mu.RLock()
+	stale := time.Since(s.loaded) > s.refresh
+	s.mu.RUnlock()
+	if stale {
+		s.reload(jwksMissRefresh)
+	}
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+	// the keys may have been rotated since loaded.
+	if err := s.reload(jwksMissRefresh); err != nil {
+		return nil, err
+	}
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("jwt: unknown key id %q", kid)
+}
+
+func (s *jwks) lookup(kid string) (interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// reload loads the set again unless it was tried within the last interval.
+// the keys loaded before are kept if it fails.
+func (s *jwks) reload(interval time.Duration) error {
+	s.loading.Lock()
+	defer s.loading.Unlock()
+	s.mu.RLock()
+	recent := time.Since(s.tried) < interval
+	s.mu.RUnlock()
+	if recent {
+		return nil
+	}
+	keys, err := s.load()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tried = time.Now()
+	if err != nil {
+		return err
+	}
+	s.keys, s.loaded = keys, s.tried
+	return nil
+}
+
+func (s *jwks) load() (map[string]interface{}, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if strings.HasPrefix(s.location, "http://") || strings.HasPrefix(s.location, "https://") {
+		var resp *http.Response
+		if resp, err = s.client.Get(s.location); err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("jwt: get jwks %s: %s", s.location, resp.Status)
+		}
+		data, err = ioutil.ReadAll(resp.Body)
+	} else {
+		data, err = ioutil.ReadFile(s.location)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+// parseJWKS returns the signature keys of a JSON Web Key Set by their key ids,
+// the keys of unknown types are skipped.
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("jwt: invalid jwks: %v", err)
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey returns the public key of k, nil if of an unknown type.
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := decodeBigInt(k.N)
+		e, err2 := decodeBigInt(k.E)
+		if err1 != nil || err2 != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("jwt: invalid rsa jwk %q", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err1 := decodeBigInt(k.X)
+		y, err2 := decodeBigInt(k.Y)
+		if err1 != nil || err2 != nil || !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("jwt: invalid ec jwk %q", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := jwt.DecodeSegment(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("jwt: invalid okp jwk %q", k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := jwt.DecodeSegment(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,474 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/henrylee2cn/lessgo"
+)
+
+type (
+	// OIDCLoginConfig defines the config for OpenID Connect login middleware.
+	OIDCLoginConfig struct {
+		// Issuer is the URL of the identity provider,
+		// its discovery document is at Issuer + "/.well-known/openid-configuration".
+		// Required.
+		Issuer string `json:"issuer"`
+
+		// ClientID is the client identifier registered at the identity provider.
+		// Required.
+		ClientID string `json:"client_id"`
+
+		// ClientSecret is the client secret registered at the identity provider,
+		// sent by HTTP basic auth to the token endpoint.
+		// Optional. Default value "", which is a public client protected by PKCE only.
+		ClientSecret string `json:"client_secret"`
+
+		// RedirectURL is the absolute URL of the callback registered at the identity provider,
+		// its path must be routed through this middleware, which handles it.
+		// Required.
+		RedirectURL string `json:"redirect_url"`
+
+		// Scopes are the scopes requested, "openid" is always requested.
+		// Optional. Default value []string{"openid", "profile", "email"}.
+		Scopes []string `json:"scopes"`
+
+		// SigningMethod is the algorithm of the ID tokens, the HS algorithms use ClientSecret as key,
+		// the others the keys of the JWKS of the identity provider.
+		// Optional. Default value RS256.
+		SigningMethod string `json:"signing_method"`
+
+		// JWKSRefresh is the period in seconds to reload the JWKS of the identity provider.
+		// Optional. Default value 3600.
+		JWKSRefresh int `json:"jwks_refresh"`
+
+		// Leeway is the clock skew in seconds tolerated when checking the ID tokens.
+		// Optional. Default value 0.
+		Leeway int `json:"leeway"`
+
+		// Context key to store the ID token, a *jwt.Token with jwt.MapClaims, into context.
+		// Optional. Default value "user".
+		ContextKey string `json:"context_key"`
+
+		// ContextClaims maps the names of the ID token claims to the context keys they are stored under,
+		// e.g. {"email": "email"}.
+		// Optional. Default value map[string]string{}.
+		ContextClaims map[string]string `json:"context_claims"`
+
+		// CookiePrefix is prepended to the names of the cookies of the login state and the ID token.
+		// Optional. Default value "oidc_".
+		CookiePrefix string `json:"cookie_prefix"`
+
+		// Domain of the cookies.
+		// Optional. Default value none.
+		CookieDomain string `json:"cookie_domain"`
+
+		// Indicates if the cookies are secure, they always are for TLS requests.
+		// Optional. Default value false.
+		CookieSecure bool `json:"cookie_secure"`
+
+		// LoginTimeout is the time in seconds a user has to log in at the identity provider.
+		// Optional. Default value 600.
+		LoginTimeout int `json:"login_timeout"`
+	}
+
+	// oidcClient runs the authorization code flow of a OIDCLoginConfig.
+	// the discovery document is loaded on demand, so the identity provider may come up later.
+	oidcClient struct {
+		config       OIDCLoginConfig
+		callbackPath string
+		client       *http.Client
+
+		mu        sync.Mutex
+		discovery *oidcDiscovery
+		validator *jwtValidator
+		tried     time.Time
+	}
+
+	// oidcDiscovery is the part of the OpenID Provider Metadata used by oidcClient.
+	oidcDiscovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+
+	// oidcTokenResponse is the response of the token endpoint.
+	oidcTokenResponse struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+)
+
+const oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+var (
+	// DefaultOIDCLoginConfig is the default OpenID Connect login middleware config.
+	DefaultOIDCLoginConfig = OIDCLoginConfig{
+		Scopes:        []string{"openid", "profile", "email"},
+		SigningMethod: AlgorithmRS256,
+		JWKSRefresh:   3600,
+		ContextKey:    "user",
+		ContextClaims: map[string]string{},
+		CookiePrefix:  "oidc_",
+		LoginTimeout:  600,
+	}
+)
+
+// OIDCLogin returns an OpenID Connect login middleware,
+// which runs the authorization code flow with PKCE against an identity provider.
+//
+// A request without a valid ID token cookie is redirected to the identity provider,
+// or for a request other than GET and HEAD, it sends "401 - Unauthorized" response.
+// The callback checks the state, exchanges the code, verifies the ID token and its nonce,
+// then stores the ID token in a cookie and redirects back to the requested URL.
+// For valid ID token, it sets it in context like JWTWithConfig and calls next handler.
+var OIDCLogin = lessgo.ApiMiddleware{
+	Name: "OIDCLogin",
+	Desc: `an OpenID Connect login middleware, which runs the authorization code flow with PKCE against an identity provider.
+The path of the redirect url must be routed through it, the ID token is verified by the JWKS of the discovery document.`,
+	Config: DefaultOIDCLoginConfig,
+	Middleware: func(confObject interface{}) lessgo.MiddlewareFunc {
+		o, err := newOIDCClient(confObject.(OIDCLoginConfig))
+		if err != nil {
+			panic(err)
+		}
+		config := o.config
+		cookieName := func(name string) string { return config.CookiePrefix + name }
+
+		return func(next lessgo.HandlerFunc) lessgo.HandlerFunc {
+			return func(c *lessgo.Context) error {
+				req := c.Request()
+				if req.URL.Path == o.callbackPath {
+					return o.callback(c)
+				}
+				if cookie, err := c.Cookie(cookieName("id_token")); err == nil {
+					if token, err := o.verify(cookie.Value, ""); err == nil {
+						o.setContext(c, token)
+						return next(c)
+					}
+				}
+				if (req.Method != lessgo.GET && req.Method != lessgo.HEAD) ||
+					req.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+					return lessgo.ErrUnauthorized
+				}
+
+				// Start login
+				state, nonce, verifier := randomToken(), randomToken(), randomToken()
+				authURL, err := o.authCodeURL(state, nonce, verifier)
+				if err != nil {
+					lessgo.Log.Warn("oidc login: %v", err)
+					return lessgo.NewHTTPError(http.StatusServiceUnavailable, "identity provider unavailable")
+				}
+				maxAge := config.LoginTimeout
+				o.setCookie(c, cookieName("state"), state, maxAge)
+				o.setCookie(c, cookieName("nonce"), nonce, maxAge)
+				o.setCookie(c, cookieName("verifier"), verifier, maxAge)
+				o.setCookie(c, cookieName("return"), req.URL.RequestURI(), maxAge)
+				return c.Redirect(http.StatusFound, authURL)
+			}
+		}
+	},
+}.Reg()
+
+// newOIDCClient fills the defaults of config and checks it.
+func newOIDCClient(config OIDCLoginConfig) (*oidcClient, error) {
+	if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.New("oidc login middleware requires issuer, client id and redirect url")
+	}
+	redirect, err := url.Parse(config.RedirectURL)
+	if err != nil || !redirect.IsAbs() {
+		return nil, fmt.Errorf("invalid oidc redirect url=%s", config.RedirectURL)
+	}
+	if config.SigningMethod == "" {
+		config.SigningMethod = DefaultOIDCLoginConfig.SigningMethod
+	}
+	if jwt.GetSigningMethod(config.SigningMethod) == nil || config.SigningMethod == jwt.SigningMethodNone.Alg() {
+		return nil, fmt.Errorf("invalid oidc signing method=%s", config.SigningMethod)
+	}
+	if strings.HasPrefix(config.SigningMethod, "HS") && config.ClientSecret == "" {
+		return nil, fmt.Errorf("oidc signing method=%s requires client secret", config.SigningMethod)
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = DefaultOIDCLoginConfig.Scopes
+	}
+	hasOpenID := false
+	for _, scope := range config.Scopes {
+		hasOpenID = hasOpenID || scope == "openid"
+	}
+	if !hasOpenID {
+		config.Scopes = append([]string{"openid"}, config.Scopes...)
+	}
+	if config.JWKSRefresh <= 0 {
+		config.JWKSRefresh = DefaultOIDCLoginConfig.JWKSRefresh
+	}
+	if config.ContextKey == "" {
+		config.ContextKey = DefaultOIDCLoginConfig.ContextKey
+	}
+	if config.CookiePrefix == "" {
+		config.CookiePrefix = DefaultOIDCLoginConfig.CookiePrefix
+	}
+	if config.LoginTimeout <= 0 {
+		config.LoginTimeout = DefaultOIDCLoginConfig.LoginTimeout
+	}
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	path := redirect.Path
+	if path == "" {
+		path = "/"
+	}
+	return &oidcClient{
+		config:       config,
+		callbackPath: path,
+		client:       &http.Client{Timeout: jwksTimeout},
+	}, nil
+}
+
+// callback finishes the login at the redirect url.
+func (o *oidcClient) callback(c *lessgo.Context) error {
+	cookieValue := func(name string) string {
+		cookie, err := c.Cookie(o.config.CookiePrefix + name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+	state, nonce, verifier := cookieValue("state"), cookieValue("nonce"), cookieValue("verifier")
+	returnURL := cookieValue("return")
+	for _, name := range []string{"state", "nonce", "verifier", "return"} {
+		o.setCookie(c, o.config.CookiePrefix+name, "", -1)
+	}
+
+	if state == "" || c.QueryParam("state") != state {
+		return lessgo.NewHTTPError(http.StatusBadRequest, "invalid oidc state")
+	}
+	if e := c.QueryParam("error"); e != "" {
+		return lessgo.NewHTTPError(http.StatusUnauthorized, "oidc login failed: "+e)
+	}
+	raw, token, err := o.exchange(c.QueryParam("code"), verifier, nonce)
+	if err != nil {
+		lessgo.Log.Warn("oidc login: %v", err)
+		return lessgo.ErrUnauthorized
+	}
+	maxAge := 0 // session cookie if no exp
+	if exp, ok := token.Claims.(jwt.MapClaims)["exp"].(json.Number); ok {
+		if t, ok := numericDate(exp); ok {
+			maxAge = int(time.Until(t) / time.Second)
+		}
+	}
+	o.setCookie(c, o.config.CookiePrefix+"id_token", raw, maxAge)
+	if !isLocalURL(returnURL) {
+		returnURL = "/"
+	}
+	return c.Redirect(http.StatusFound, returnURL)
+}
+
+// setContext stores token and the claims of ContextClaims into context.
+func (o *oidcClient) setContext(c *lessgo.Context, token *jwt.Token) {
+	c.Set(o.config.ContextKey, token)
+	claims := token.Claims.(jwt.MapClaims)
+	for name, key := range o.config.ContextClaims {
+		if v, ok := claims[name]; ok {
+			c.Set(key, v)
+		}
+	}
+}
+
+// setCookie sets a cookie of the flow, a negative maxAge deletes it.
+func (o *oidcClient) setCookie(c *lessgo.Context, name, value string, maxAge int) {
+	c.Response().SetCookie(&http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   o.config.CookieDomain,
+		MaxAge:   maxAge,
+		Secure:   o.config.CookieSecure || c.IsTLS(),
+		HttpOnly: true,
+	})
+}
+
+// provider returns the discovery document and the ID token validator,
+// loading them unless tried within the last jwksMissRefresh.
+func (o *oidcClient) provider() (*oidcDiscovery, *jwtValidator, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.discovery != nil {
+		return o.discovery, o.validator, nil
+	}
+	if time.Since(o.tried) < jwksMissRefresh {
+		return nil, nil, errors.New("oidc discovery failed recently")
+	}
+	o.tried = time.Now()
+	var d oidcDiscovery
+	if err := o.getJSON(o.config.Issuer+oidcDiscoveryPath, &d); err != nil {
+		return nil, nil, err
+	}
+	// the issuer must be the one configured, see OpenID Connect Discovery 1.0 section 4.3.
+	if strings.TrimSuffix(d.Issuer, "/") != o.config.Issuer {
+		return nil, nil, fmt.Errorf("oidc discovery: unexpected issuer=%s", d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" {
+		return nil, nil, errors.New("oidc discovery: missing authorization or token endpoint")
+	}
+	jwtConfig := JWTConfig{
+		SigningMethod: o.config.SigningMethod,
+		JWKSURL:       d.JWKSURI,
+		JWKSRefresh:   o.config.JWKSRefresh,
+		Issuer:        d.Issuer,
+		Audience:      []string{o.config.ClientID},
+		Leeway:        o.config.Leeway,
+		ContextKey:    o.config.ContextKey,
+	}
+	if strings.HasPrefix(o.config.SigningMethod, "HS") {
+		jwtConfig.SigningKey, jwtConfig.JWKSURL = []byte(o.config.ClientSecret), ""
+	} else if d.JWKSURI == "" {
+		return nil, nil, errors.New("oidc discovery: missing jwks_uri")
+	}
+	validator, err := newJWTValidator(jwtConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	o.discovery, o.validator = &d, validator
+	return o.discovery, o.validator, nil
+}
+
+// authCodeURL returns the URL of the authorization endpoint to log in,
+// with the S256 challenge of verifier.
+func (o *oidcClient) authCodeURL(state, nonce, verifier string) (string, error) {
+	d, _, err := o.provider()
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.config.ClientID},
+		"redirect_uri":          {o.config.RedirectURL},
+		"scope":                 {strings.Join(o.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// exchange redeems code at the token endpoint, and returns the verified ID token.
+func (o *oidcClient) exchange(code, verifier, nonce string) (string, *jwt.Token, error) {
+	if code == "" || verifier == "" || nonce == "" {
+		return "", nil, errors.New("missing code, verifier or nonce")
+	}
+	d, _, err := o.provider()
+	if err != nil {
+		return "", nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if o.config.ClientSecret == "" {
+		form.Set("client_id", o.config.ClientID)
+	}
+	req, err := http.NewRequest(lessgo.POST, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set(lessgo.HeaderContentType, "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(o.config.ClientSecret))
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	var tr oidcTokenResponse
+	if err = json.Unmarshal(body, &tr); err != nil && resp.StatusCode == http.StatusOK {
+		return "", nil, fmt.Errorf("invalid token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.Error != "" {
+		return "", nil, fmt.Errorf("token endpoint: %s %s %s", resp.Status, tr.Error, tr.ErrorDescription)
+	}
+	if tr.IDToken == "" {
+		return "", nil, errors.New("token response without id_token")
+	}
+	token, err := o.verify(tr.IDToken, nonce)
+	if err != nil {
+		return "", nil, err
+	}
+	return tr.IDToken, token, nil
+}
+
+// verify returns the ID token of raw if it is valid,
+// with the nonce claim of the login unless nonce is empty.
+func (o *oidcClient) verify(raw, nonce string) (*jwt.Token, error) {
+	_, validator, err := o.provider()
+	if err != nil {
+		return nil, err
+	}
+	token, err := validator.parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("id token without sub")
+	}
+	// with several audiences, the authorized party must be this client.
+	if azp, ok := claims["azp"].(string); ok && azp != o.config.ClientID {
+		return nil, fmt.Errorf("unexpected id token azp=%s", azp)
+	}
+	if nonce != "" {
+		if n, _ := claims["nonce"].(string); n != nonce {
+			return nil, errors.New("unexpected id token nonce")
+		}
+	}
+	return token, nil
+}
+
+func (o *oidcClient) getJSON(location string, v interface{}) error {
+	resp, err := o.client.Get(location)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s: %s", location, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// randomToken returns 32 random bytes in base64url, for the state, nonce and PKCE verifier.
+func randomToken() string {
+	b, err := generateSalt(32)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// isLocalURL reports whether u is a path of this site, so redirecting to it is not an open redirect.
+func isLocalURL(u string) bool {
+	return strings.HasPrefix(u, "/") && !strings.HasPrefix(u, "//") && !strings.HasPrefix(u, "/\\")
+}
@@ -0,0 +1,258 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// fakeIDP is an in-process OpenID Connect identity provider.
+type fakeIDP struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	issuer   string // issuer of the discovery document and the ID tokens, the server URL if empty
+	audience string // audience of the ID tokens, the client id if empty
+
+	mu    sync.Mutex
+	codes map[string]url.Values // code -> authorization request
+}
+
+func newFakeIDP(t *testing.T) *fakeIDP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIDP{key: key, codes: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(oidcDiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.iss(),
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" {
+			http.Error(w, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		code := randomToken()
+		idp.mu.Lock()
+		idp.codes[code] = q
+		idp.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		q, ok := idp.codes[r.FormValue("code")]
+		delete(idp.codes, r.FormValue("code"))
+		idp.mu.Unlock()
+		id, secret, _ := r.BasicAuth()
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		switch {
+		case !ok || r.FormValue("redirect_uri") != q.Get("redirect_uri"):
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		case id != q.Get("client_id") || secret != "secret":
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		case base64.RawURLEncoding.EncodeToString(challenge[:]) != q.Get("code_challenge"):
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "pkce"})
+			return
+		}
+		aud := idp.audience
+		if aud == "" {
+			aud = q.Get("client_id")
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":   idp.iss(),
+			"sub":   "alice",
+			"aud":   aud,
+			"email": "alice@example.com",
+			"nonce": q.Get("nonce"),
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = "k1"
+		raw, _ := token.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": raw})
+	})
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *fakeIDP) iss() string {
+	if idp.issuer != "" {
+		return idp.issuer
+	}
+	return idp.URL
+}
+
+// login runs the authorization request and returns the code and state of the callback.
+func (idp *fakeIDP) login(t *testing.T, o *oidcClient, state, nonce, verifier string) (code, gotState string) {
+	authURL, err := o.authCodeURL(state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("unexpected authorization response %s %v", resp.Status, err)
+	}
+	if callback.Path != o.callbackPath {
+		t.Fatalf("redirected to %s, expected %s", callback.Path, o.callbackPath)
+	}
+	return callback.Query().Get("code"), callback.Query().Get("state")
+}
+
+func newTestOIDCClient(t *testing.T, idp *fakeIDP) *oidcClient {
+	o, err := newOIDCClient(OIDCLoginConfig{
+		Issuer:       idp.URL,
+		ClientID:     "app",
+		ClientSecret: "secret",
+		RedirectURL:  "http://app.example.com/auth/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newFakeIDP(t)
+	defer idp.Close()
+	o := newTestOIDCClient(t, idp)
+
+	code, state := idp.login(t, o, "s1", "n1", "v1")
+	if state != "s1" {
+		t.Fatalf("state %q, expected s1", state)
+	}
+	raw, token, err := o.exchange(code, "v1", "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["sub"] != "alice" || claims["email"] != "alice@example.com" {
+		t.Errorf("unexpected claims %v", claims)
+	}
+	// the ID token of the cookie is verified without the nonce.
+	if _, err = o.verify(raw, ""); err != nil {
+		t.Error(err)
+	}
+	// a code is redeemed once.
+	if _, _, err = o.exchange(code, "v1", "n1"); err == nil {
+		t.Error("code redeemed twice")
+	}
+}
+
+func TestOIDCLoginRejects(t *testing.T) {
+	idp := newFakeIDP(t)
+	defer idp.Close()
+	o := newTestOIDCClient(t, idp)
+
+	code, _ := idp.login(t, o, "s1", "n1", "v1")
+	if _, _, err := o.exchange(code, "other", "n1"); err == nil {
+		t.Error("accepted a wrong PKCE verifier")
+	}
+	code, _ = idp.login(t, o, "s1", "n1", "v1")
+	if _, _, err := o.exchange(code, "v1", "other"); err == nil {
+		t.Error("accepted a wrong nonce")
+	}
+
+	idp.audience = "another-app"
+	code, _ = idp.login(t, o, "s1", "n1", "v1")
+	if _, _, err := o.exchange(code, "v1", "n1"); err == nil {
+		t.Error("accepted an ID token of another audience")
+	}
+
+	idp.audience = ""
+	o.config.ClientSecret = "wrong"
+	code, _ = idp.login(t, o, "s1", "n1", "v1")
+	if _, _, err := o.exchange(code, "v1", "n1"); err == nil {
+		t.Error("accepted a wrong client secret")
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"iss": idp.URL, "sub": "alice", "aud": "app"})
+	forged, _ := token.SignedString([]byte("secret"))
+	if _, err := o.verify(forged, ""); err == nil {
+		t.Error("accepted an ID token of another algorithm")
+	}
+}
+
+func TestOIDCLoginDiscoveryIssuer(t *testing.T) {
+	idp := newFakeIDP(t)
+	defer idp.Close()
+	idp.issuer = "https://evil.example.com"
+	o := newTestOIDCClient(t, idp)
+	if _, err := o.authCodeURL("s1", "n1", "v1"); err == nil {
+		t.Error("accepted a discovery document of another issuer")
+	}
+}
+
+func TestNewOIDCClient(t *testing.T) {
+	for _, config := range []OIDCLoginConfig{
+		{ClientID: "app", RedirectURL: "http://app/cb"},
+		{Issuer: "http://idp", ClientID: "app", RedirectURL: "/cb"},
+		{Issuer: "http://idp", ClientID: "app", RedirectURL: "http://app/cb", SigningMethod: "HS256"},
+		{Issuer: "http://idp", ClientID: "app", RedirectURL: "http://app/cb", SigningMethod: "none"},
+	} {
+		if _, err := newOIDCClient(config); err == nil {
+			t.Errorf("accepted config %+v", config)
+		}
+	}
+	o, err := newOIDCClient(OIDCLoginConfig{Issuer: "http://idp/", ClientID: "app", RedirectURL: "http://app/cb", Scopes: []string{"email"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.config.Issuer != "http://idp" || o.callbackPath != "/cb" || o.config.Scopes[0] != "openid" {
+		t.Errorf("unexpected config %+v", o.config)
+	}
+}
+
+func TestIsLocalURL(t *testing.T) {
+	for u, local := range map[string]bool{
+		"/":                   true,
+		"/a?b=c":              true,
+		"":                    false,
+		"//evil.com":          false,
+		"/\\evil.com":         false,
+		"https://evil.com/a":  false,
+		"javascript:alert(1)": false,
+	} {
+		if isLocalURL(u) != local {
+			t.Errorf("isLocalURL(%q) != %v", u, local)
+		}
+	}
+}
@@ -1,35 +1,45 @@
 package middleware
 
 import (
-	"bytes"
 	"errors"
 	"net/http"
 
 	"github.com/henrylee2cn/lessgo"
 )
 
+type (
+	// OnlyLANAccessConfig defines the config for OnlyLANAccess middleware.
+	OnlyLANAccessConfig struct {
+		// TrustedProxies defines the IPs or CIDRs of the proxies whose `X-Forwarded-For`
+		// and `X-Real-IP` headers are honored, like IPFilterConfig.TrustedProxies.
+		// Optional. Default value []string{}, which never honors the headers.
+		TrustedProxies []string `json:"trusted_proxies"`
+	}
+)
+
 var (
-	lanPrefix_1 = []byte("::")
-	lanPrefix_2 = []byte("127.")
-	lanPrefix_3 = []byte("192.168.")
-	lanPrefix_4 = []byte("10.")
+	// DefaultOnlyLANAccessConfig is the default OnlyLANAccess middleware config.
+	DefaultOnlyLANAccessConfig = OnlyLANAccessConfig{}
 )
 
 // Only allow LAN access.
+// LAN is the loopback, private and link-local networks of LANNets, both IPv4 and IPv6.
+// the client IP is the remote address, or the one forwarded by a trusted proxy.
 var OnlyLANAccess = lessgo.ApiMiddleware{
-	Name: "OnlyLANAccess",
-	Desc: `Only allow LAN access.`,
-	Middleware: func(next lessgo.HandlerFunc) lessgo.HandlerFunc {
-		return func(c *lessgo.Context) error {
-			remoteAddress := []byte(c.RealRemoteAddr())
-			if bytes.HasPrefix(remoteAddress, lanPrefix_1) ||
-				bytes.HasPrefix(remoteAddress, lanPrefix_2) ||
-				bytes.HasPrefix(remoteAddress, lanPrefix_3) ||
-				bytes.HasPrefix(remoteAddress, lanPrefix_4) {
-				return next(c)
+	Name:   "OnlyLANAccess",
+	Desc:   `Only allow LAN access, 'X-Forwarded-For' is honored only from the trusted proxies.`,
+	Config: DefaultOnlyLANAccessConfig,
+	Middleware: func(confObject interface{}) lessgo.MiddlewareFunc {
+		config := confObject.(OnlyLANAccessConfig)
+		rules := MustIPRules(IPFilterConfig{Allow: LANNets, TrustedProxies: config.TrustedProxies})
+		return func(next lessgo.HandlerFunc) lessgo.HandlerFunc {
+			return func(c *lessgo.Context) error {
+				ip := rules.ClientIP(c.Request())
+				if rules.Allowed(ip) {
+					return next(c)
+				}
+				return c.Failure(http.StatusForbidden, errors.New(`Only allow LAN access, but your ip is `+ipString(ip)))
 			}
-
-			return c.Failure(http.StatusForbidden, errors.New(`Only allow LAN access, but your ip is `+c.RealRemoteAddr()))
 		}
 	},
 }.Reg()
@@ -0,0 +1,471 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/henrylee2cn/lessgo"
+	"github.com/henrylee2cn/lessgoext/cache"
+)
+
+type (
+	// RateLimitConfig defines the config for rate limit middleware.
+	RateLimitConfig struct {
+		// Algorithm is the way requests are counted.
+		// Optional. Default value "token_bucket".
+		// Possible values:
+		// - "token_bucket": bursts up to Burst requests, refilled at Rate per Period.
+		// - "sliding_window": up to Rate requests in any Period, estimated from the counts
+		//   of the current and the previous fixed windows.
+		Algorithm string `json:"algorithm"`
+
+		// Rate is the number of requests allowed per Period.
+		// Optional. Default value 60.
+		Rate int `json:"rate"`
+
+		// Period is the length of the rate period in seconds.
+		// Optional. Default value 60.
+		Period int `json:"period"`
+
+		// Burst is the capacity of the token bucket.
+		// Optional. Default value Rate.
+		Burst int `json:"burst"`
+
+		// KeyLookup is a string in the form of "<source>" or "<source>:<name>" that is used
+		// to identify the client limited.
+		// A request without the key is limited by its client IP.
+		// Optional. Default value "ip".
+		// Possible values:
+		// - "ip", the client IP resolved through TrustedProxies
+		// - "header:<name>"
+		// - "jwt:<context key>", the subject of the token stored by JWTWithConfig.
+		KeyLookup string `json:"key_lookup"`
+
+		// TrustedProxies defines the IPs or CIDRs of the proxies whose `X-Forwarded-For`
+		// and `X-Real-IP` headers are honored, like IPFilterConfig.TrustedProxies.
+		// Optional. Default value []string{}, which never honors the headers.
+		TrustedProxies []string `json:"trusted_proxies"`
+
+		// Adapter is the name of the cache adapter storing the counters,
+		// a shared one like redis makes the limits shared across the instances.
+		// The adapters implementing cache.AtomicCache count exactly under concurrency.
+		// Optional. Default value "memory".
+		Adapter string `json:"adapter"`
+
+		// AdapterConfig is the config passed to cache.NewCache.
+		// Optional. Default value `{"interval":60}`.
+		AdapterConfig string `json:"adapter_config"`
+
+		// KeyPrefix is prepended to every counter key.
+		// Optional. Default value "ratelimit:".
+		KeyPrefix string `json:"key_prefix"`
+	}
+
+	// rateLimiter takes a request of key and reports the state of its limit.
+	rateLimiter interface {
+		take(key string, now time.Time) (rateLimitResult, error)
+	}
+
+	rateLimitResult struct {
+		allowed    bool
+		limit      int
+		remaining  int
+		reset      time.Duration // until the limit is fully restored
+		retryAfter time.Duration // until a request is allowed again
+	}
+
+	tokenBucket struct {
+		store    rateLimitStore
+		burst    float64
+		perToken time.Duration // refill interval of one token
+	}
+
+	slidingWindow struct {
+		store  rateLimitStore
+		rate   int
+		period time.Duration
+	}
+
+	// rateLimitStore keeps the counters in a cache adapter,
+	// atomically if it implements cache.AtomicCache, best effort otherwise.
+	rateLimitStore struct {
+		cache  cache.Cache
+		atomic cache.AtomicCache
+	}
+
+	rateLimitKeyExtractor func(*lessgo.Context) string
+)
+
+// Rate limit algorithms
+const (
+	RateLimitTokenBucket   = "token_bucket"
+	RateLimitSlidingWindow = "sliding_window"
+)
+
+const (
+	headerRateLimitLimit     = "X-RateLimit-Limit"
+	headerRateLimitRemaining = "X-RateLimit-Remaining"
+	headerRateLimitReset     = "X-RateLimit-Reset"
+	headerRetryAfter         = "Retry-After"
+
+	// rateLimitCASRetries bounds the compare-and-swap attempts of one request,
+	// a request losing them all is limited.
+	rateLimitCASRetries = 8
+)
+
+var (
+	// DefaultRateLimitConfig is the default rate limit middleware config.
+	DefaultRateLimitConfig = RateLimitConfig{
+		Algorithm:     RateLimitTokenBucket,
+		Rate:          60,
+		Period:        60,
+		KeyLookup:     "ip",
+		Adapter:       "memory",
+		AdapterConfig: `{"interval":60}`,
+		KeyPrefix:     "ratelimit:",
+	}
+)
+
+// RateLimit returns a rate limit middleware.
+//
+// For the requests within the limit, it calls next handler.
+// For the others, it sends "429 - Too Many Requests" with a `Retry-After` header.
+// Every response gets the `X-RateLimit-Limit`, `X-RateLimit-Remaining` and `X-RateLimit-Reset` headers.
+// If the counters can not be stored, the requests are let through.
+var RateLimit = lessgo.ApiMiddleware{
+	Name: "RateLimit",
+	Desc: `a rate limit middleware by the token bucket or sliding window algorithm, keyed by client IP, JWT subject or a header.
+'X-Forwarded-For' is honored only from the trusted proxies, so a client can not get a new limit by forging its IP.
+The requests over the limit get "429 - Too Many Requests" with a 'Retry-After' header.
+The counters are stored in a cache adapter, a shared one like redis makes the limits shared across the instances.`,
+	Config: DefaultRateLimitConfig,
+	Middleware: func(confObject interface{}) lessgo.MiddlewareFunc {
+		config := confObject.(RateLimitConfig)
+		// Defaults
+		if config.Algorithm == "" {
+			config.Algorithm = DefaultRateLimitConfig.Algorithm
+		}
+		if config.Rate <= 0 {
+			config.Rate = DefaultRateLimitConfig.Rate
+		}
+		if config.Period <= 0 {
+			config.Period = DefaultRateLimitConfig.Period
+		}
+		if config.Burst <= 0 {
+			config.Burst = config.Rate
+		}
+		if config.KeyLookup == "" {
+			config.KeyLookup = DefaultRateLimitConfig.KeyLookup
+		}
+		if config.Adapter == "" {
+			config.Adapter = DefaultRateLimitConfig.Adapter
+			if config.AdapterConfig == "" {
+				config.AdapterConfig = DefaultRateLimitConfig.AdapterConfig
+			}
+		}
+		if config.KeyPrefix == "" {
+			config.KeyPrefix = DefaultRateLimitConfig.KeyPrefix
+		}
+
+		// Initialize
+		c, err := cache.NewCache(config.Adapter, config.AdapterConfig)
+		if err != nil {
+			panic(fmt.Errorf("rate limit: %v", err))
+		}
+		store := rateLimitStore{cache: c}
+		store.atomic, _ = c.(cache.AtomicCache)
+		period := time.Duration(config.Period) * time.Second
+		var limiter rateLimiter
+		switch config.Algorithm {
+		case RateLimitTokenBucket:
+			limiter = &tokenBucket{
+				store:    store,
+				burst:    float64(config.Burst),
+				perToken: period / time.Duration(config.Rate),
+			}
+		case RateLimitSlidingWindow:
+			limiter = &slidingWindow{store: store, rate: config.Rate, period: period}
+		default:
+			panic(fmt.Errorf("invalid rate limit algorithm=%s", config.Algorithm))
+		}
+		rules := MustIPRules(IPFilterConfig{TrustedProxies: config.TrustedProxies})
+		extractor := rateLimitKeyExtractorOf(config.KeyLookup, rules)
+
+		return func(next lessgo.HandlerFunc) lessgo.HandlerFunc {
+			return func(c *lessgo.Context) error {
+				key := extractor(c)
+				if key == "" {
+					key = rateLimitIPKey(rules, c.Request())
+				}
+				r, err := limiter.take(config.KeyPrefix+key, time.Now())
+				if err != nil {
+					lessgo.Log.Warn("rate limit: %v", err)
+					return next(c)
+				}
+				r.setHeaders(c.Response().Header())
+				if !r.allowed {
+					return lessgo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
+				}
+				return next(c)
+			}
+		}
+	},
+}.Reg()
+
+// rateLimitKeyExtractorOf returns the `rateLimitKeyExtractor` of a KeyLookup,
+// the client IP is resolved by rules.
+// the keys are prefixed by their source, so an IP never collides with a header value.
+func rateLimitKeyExtractorOf(lookup string, rules *IPRules) rateLimitKeyExtractor {
+	parts := strings.SplitN(lookup, ":", 2)
+	switch parts[0] {
+	case "header":
+		if len(parts) < 2 || parts[1] == "" {
+			panic(fmt.Errorf("invalid rate limit key_lookup=%s", lookup))
+		}
+		name := parts[1]
+		return func(c *lessgo.Context) string {
+			if v := c.HeaderParam(name); v != "" {
+				return "header:" + v
+			}
+			return ""
+		}
+	case "jwt":
+		contextKey := DefaultJWTConfig.ContextKey
+		if len(parts) == 2 && parts[1] != "" {
+			contextKey = parts[1]
+		}
+		return func(c *lessgo.Context) string {
+			if sub := jwtSubject(c.Get(contextKey)); sub != "" {
+				return "jwt:" + sub
+			}
+			return ""
+		}
+	case "ip":
+		return func(c *lessgo.Context) string {
+			return rateLimitIPKey(rules, c.Request())
+		}
+	}
+	panic(fmt.Errorf("invalid rate limit key_lookup=%s", lookup))
+}
+
+// rateLimitIPKey returns the key of the client IP of r resolved by rules,
+// or of the remote address if the IP is unknown.
+func rateLimitIPKey(rules *IPRules, r *http.Request) string {
+	if ip := rules.ClientIP(r); ip != nil {
+		return "ip:" + ip.String()
+	}
+	return "ip:" + r.RemoteAddr
+}
+
+// jwtSubject returns the subject of a token stored by JWTWithConfig.
+func jwtSubject(v interface{}) string {
+	token, ok := v.(*jwt.Token)
+	if !ok {
+		return ""
+	}
+	switch claims := token.Claims.(type) {
+	case jwt.MapClaims:
+		sub, _ := claims["sub"].(string)
+		return sub
+	case *jwt.StandardClaims:
+		return claims.Subject
+	case interface{ GetSubject() string }:
+		return claims.GetSubject()
+	}
+	return ""
+}
+
+// setHeaders sets the rate limit headers of r, and `Retry-After` if the request is refused.
+func (r rateLimitResult) setHeaders(header http.Header) {
+	header.Set(headerRateLimitLimit, strconv.Itoa(r.limit))
+	header.Set(headerRateLimitRemaining, strconv.Itoa(r.remaining))
+	header.Set(headerRateLimitReset, strconv.FormatInt(ceilSeconds(r.reset), 10))
+	if !r.allowed {
+		header.Set(headerRetryAfter, strconv.FormatInt(ceilSeconds(r.retryAfter), 10))
+	}
+}
+
+// ceilSeconds rounds d up to whole seconds for the headers.
+func ceilSeconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// take refills the bucket for the time passed since the last request and takes a token.
+// the bucket is stored as "<tokens>,<unix nanoseconds>" and swapped atomically.
+func (tb *tokenBucket) take(key string, now time.Time) (rateLimitResult, error) {
+	for i := 0; i < rateLimitCASRetries; i++ {
+		old, ok, err := tb.store.get(key)
+		if err != nil {
+			return rateLimitResult{}, err
+		}
+		tokens := tb.burst
+		if ok {
+			tokens = tb.refill(old, now)
+		}
+		r := rateLimitResult{limit: int(tb.burst)}
+		if tokens < 1 {
+			r.remaining = 0
+			r.retryAfter = time.Duration((1 - tokens) * float64(tb.perToken))
+			r.reset = time.Duration((tb.burst - tokens) * float64(tb.perToken))
+			return r, nil
+		}
+		tokens--
+		r.allowed = true
+		r.remaining = int(tokens)
+		r.reset = time.Duration((tb.burst - tokens) * float64(tb.perToken))
+		state := strconv.FormatFloat(tokens, 'f', -1, 64) + "," + strconv.FormatInt(now.UnixNano(), 10)
+		// a full bucket is the same as none, so the state is kept until it refills.
+		timeout := r.reset + time.Second
+		var swapped bool
+		if ok {
+			swapped, err = tb.store.compareAndSwap(key, old, state, timeout)
+		} else {
+			swapped, err = tb.store.setNX(key, state, timeout)
+		}
+		if err != nil {
+			return rateLimitResult{}, err
+		}
+		if swapped {
+			return r, nil
+		}
+	}
+	return rateLimitResult{limit: int(tb.burst), retryAfter: tb.perToken, reset: tb.perToken}, nil
+}
+
+// refill returns the tokens of the stored state after refilling them until now.
+func (tb *tokenBucket) refill(state string, now time.Time) float64 {
+	parts := strings.SplitN(state, ",", 2)
+	if len(parts) != 2 {
+		return tb.burst
+	}
+	tokens, err1 := strconv.ParseFloat(parts[0], 64)
+	last, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return tb.burst
+	}
+	if elapsed := now.Sub(time.Unix(0, last)); elapsed > 0 {
+		tokens += float64(elapsed) / float64(tb.perToken)
+	}
+	return math.Min(tokens, tb.burst)
+}
+
+// take counts the request in the current fixed window, and estimates the count of the sliding one
+// by weighting the count of the previous window with its part still in the sliding window.
+func (sw *slidingWindow) take(key string, now time.Time) (rateLimitResult, error) {
+	window := now.UnixNano() / int64(sw.period)
+	elapsed := time.Duration(now.UnixNano() % int64(sw.period))
+	curKey := key + ":" + strconv.FormatInt(window, 10)
+	prevKey := key + ":" + strconv.FormatInt(window-1, 10)
+
+	prev, err := sw.store.count(prevKey)
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	// a window is needed until the end of the next one.
+	cur, err := sw.store.incr(curKey, 2*sw.period-elapsed)
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	weight := 1 - float64(elapsed)/float64(sw.period)
+	estimate := float64(prev)*weight + float64(cur)
+
+	r := rateLimitResult{limit: sw.rate, reset: sw.period - elapsed}
+	if prev > 0 {
+		// the previous window leaves the sliding one at the end of the current.
+		r.reset += sw.period
+	}
+	if estimate <= float64(sw.rate) {
+		r.allowed = true
+		r.remaining = int(float64(sw.rate) - estimate)
+		return r, nil
+	}
+
+	// uncount the request refused, so a client retrying too fast is not locked out.
+	if err = sw.store.decr(curKey); err != nil {
+		return rateLimitResult{}, err
+	}
+	cur--
+	if cur >= int64(sw.rate) || prev == 0 {
+		r.retryAfter = sw.period - elapsed
+	} else {
+		// wait for the weight of the previous window to drop below the room left by the current
+		// and the request retried.
+		room := float64(int64(sw.rate)-cur-1) / float64(prev)
+		r.retryAfter = time.Duration((1-room)*float64(sw.period)) - elapsed
+	}
+	if r.retryAfter <= 0 {
+		r.retryAfter = time.Second
+	}
+	return r, nil
+}
+
+// get returns the string stored under key.
+func (s rateLimitStore) get(key string) (string, bool, error) {
+	var v string
+	switch err := cache.GetInto(s.cache, key, &v); err {
+	case nil:
+		return v, true, nil
+	case cache.ErrCacheMiss:
+		return "", false, nil
+	default:
+		return "", false, err
+	}
+}
+
+// count returns the counter of key, 0 if missing.
+func (s rateLimitStore) count(key string) (int64, error) {
+	var n int64
+	switch err := cache.GetInto(s.cache, key, &n); err {
+	case nil, cache.ErrCacheMiss:
+		return n, nil
+	default:
+		return 0, err
+	}
+}
+
+// incr adds 1 to the counter of key and returns it, a new counter expires after timeout.
+func (s rateLimitStore) incr(key string, timeout time.Duration) (int64, error) {
+	if s.atomic != nil {
+		if _, err := s.atomic.SetNX(key, int64(0), timeout); err != nil {
+			return 0, err
+		}
+		return s.atomic.IncrBy(key, 1)
+	}
+	n, err := s.count(key)
+	if err != nil {
+		return 0, err
+	}
+	n++
+	return n, s.cache.Put(key, n, timeout)
+}
+
+// decr subtracts 1 from the counter of key.
+func (s rateLimitStore) decr(key string) error {
+	if s.atomic != nil {
+		_, err := s.atomic.DecrBy(key, 1)
+		return err
+	}
+	return s.cache.Decr(key)
+}
+
+func (s rateLimitStore) setNX(key, val string, timeout time.Duration) (bool, error) {
+	if s.atomic != nil {
+		return s.atomic.SetNX(key, val, timeout)
+	}
+	return true, s.cache.Put(key, val, timeout)
+}
+
+func (s rateLimitStore) compareAndSwap(key, old, new string, timeout time.Duration) (bool, error) {
+	if s.atomic != nil {
+		return s.atomic.CompareAndSwap(key, old, new, timeout)
+	}
+	return true, s.cache.Put(key, new, timeout)
+}
@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/lessgoext/cache"
+)
+
+// plainCache hides the atomic operations of the adapter, so the store counts best effort.
+type plainCache struct {
+	cache.Cache
+}
+
+// newRateLimitStores returns an atomic and a best effort store on memory caches.
+func newRateLimitStores(t *testing.T) map[string]rateLimitStore {
+	stores := make(map[string]rateLimitStore)
+	for _, name := range []string{"atomic", "plain"} {
+		c, err := cache.NewCache("memory", `{"interval":0}`)
+		if err != nil {
+			t.Fatal("init err", err)
+		}
+		if name == "atomic" {
+			stores[name] = rateLimitStore{cache: c, atomic: c.(cache.AtomicCache)}
+		} else {
+			stores[name] = rateLimitStore{cache: plainCache{c}}
+		}
+	}
+	return stores
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	for name, store := range newRateLimitStores(t) {
+		tb := &tokenBucket{store: store, burst: 3, perToken: time.Second}
+		for i := 2; i >= 0; i-- {
+			r, err := tb.take("k", now)
+			if err != nil || !r.allowed || r.remaining != i || r.limit != 3 {
+				t.Fatalf("%s: take %d = %+v, %v", name, i, r, err)
+			}
+		}
+		r, err := tb.take("k", now)
+		if err != nil || r.allowed || r.retryAfter != time.Second || r.reset != 3*time.Second {
+			t.Fatalf("%s: take of empty bucket = %+v, %v", name, r, err)
+		}
+		// one token refills per second, never more than the burst.
+		if r, err = tb.take("k", now.Add(1500*time.Millisecond)); err != nil || !r.allowed || r.remaining != 0 {
+			t.Fatalf("%s: take after refill = %+v, %v", name, r, err)
+		}
+		if r, err = tb.take("k", now.Add(time.Hour)); err != nil || !r.allowed || r.remaining != 2 {
+			t.Fatalf("%s: take after full refill = %+v, %v", name, r, err)
+		}
+		if r, err = tb.take("other", now); err != nil || !r.allowed || r.remaining != 2 {
+			t.Fatalf("%s: take of another key = %+v, %v", name, r, err)
+		}
+	}
+}
+
+func TestTokenBucketConcurrent(t *testing.T) {
+	store := newRateLimitStores(t)["atomic"]
+	tb := &tokenBucket{store: store, burst: 10, perToken: time.Hour}
+	now := time.Now()
+	var (
+		mu      sync.Mutex
+		allowed int
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r, err := tb.take("k", now); err == nil && r.allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed > 10 {
+		t.Errorf("allowed %d requests of a bucket of 10", allowed)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	period := 10 * time.Second
+	start := time.Unix(0, 100*int64(period))
+	for name, store := range newRateLimitStores(t) {
+		sw := &slidingWindow{store: store, rate: 2, period: period}
+		for i := 1; i >= 0; i-- {
+			r, err := sw.take("k", start)
+			if err != nil || !r.allowed || r.remaining != i || r.reset != period {
+				t.Fatalf("%s: take %d = %+v, %v", name, i, r, err)
+			}
+		}
+		r, err := sw.take("k", start)
+		if err != nil || r.allowed || r.retryAfter != period {
+			t.Fatalf("%s: take over the rate = %+v, %v", name, r, err)
+		}
+		// half of the previous window, 1 request, is still in the sliding one.
+		now := start.Add(period + period/2)
+		if r, err = sw.take("k", now); err != nil || !r.allowed || r.remaining != 0 || r.reset != period+period/2 {
+			t.Fatalf("%s: take in the next window = %+v, %v", name, r, err)
+		}
+		if r, err = sw.take("k", now); err != nil || r.allowed || r.retryAfter != period/2 {
+			t.Fatalf("%s: take over the estimate = %+v, %v", name, r, err)
+		}
+		// the refused requests are not counted.
+		if r, err = sw.take("k", start.Add(2*period)); err != nil || !r.allowed {
+			t.Fatalf("%s: take after the previous window left = %+v, %v", name, r, err)
+		}
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	header := make(http.Header)
+	rateLimitResult{allowed: true, limit: 60, remaining: 59, reset: 1500 * time.Millisecond}.setHeaders(header)
+	if header.Get(headerRateLimitLimit) != "60" || header.Get(headerRateLimitRemaining) != "59" ||
+		header.Get(headerRateLimitReset) != "2" || header.Get(headerRetryAfter) != "" {
+		t.Errorf("headers of an allowed request: %v", header)
+	}
+	header = make(http.Header)
+	rateLimitResult{limit: 60, reset: time.Minute, retryAfter: 100 * time.Millisecond}.setHeaders(header)
+	if header.Get(headerRateLimitRemaining) != "0" || header.Get(headerRateLimitReset) != "60" ||
+		header.Get(headerRetryAfter) != "1" {
+		t.Errorf("headers of a refused request: %v", header)
+	}
+}
+
+func TestRateLimitIPKey(t *testing.T) {
+	rules := MustIPRules(IPFilterConfig{TrustedProxies: []string{"10.0.0.1"}})
+	cases := []struct {
+		remote, forwarded, want string
+	}{
+		{"203.0.113.7:5000", "", "ip:203.0.113.7"},
+		// a forged header of an untrusted client is ignored.
+		{"203.0.113.7:5000", "198.51.100.1", "ip:203.0.113.7"},
+		{"10.0.0.1:5000", "198.51.100.1", "ip:198.51.100.1"},
+		{"pipe", "198.51.100.1", "ip:pipe"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if got := rateLimitIPKey(rules, r); got != c.want {
+			t.Errorf("rateLimitIPKey(%s, %s) = %s, want %s", c.remote, c.forwarded, got, c.want)
+		}
+	}
+}
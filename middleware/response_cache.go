@@ -0,0 +1,537 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/henrylee2cn/lessgo"
+	"github.com/henrylee2cn/lessgoext/cache"
+)
+
+type (
+	// ResponseCacheConfig defines the config for response cache middleware.
+	ResponseCacheConfig struct {
+		// Adapter is the name of the cache adapter storing the responses,
+		// the adapters out of package cache must be imported, e.g. `_ "github.com/henrylee2cn/lessgoext/cache/redis"`.
+		// Optional. Default value "memory".
+		Adapter string `json:"adapter"`
+
+		// AdapterConfig is the config passed to cache.NewCache.
+		// Optional. Default value `{"interval":60}`.
+		AdapterConfig string `json:"adapter_config"`
+
+		// KeyPrefix is prepended to every cache key.
+		// Optional. Default value "response:".
+		KeyPrefix string `json:"key_prefix"`
+
+		// TTL is the time to live of a cached response in seconds.
+		// Optional. Default value 60.
+		TTL int `json:"ttl"`
+
+		// RouteTTLs overrides TTL for the request paths matching a pattern of path.Match,
+		// e.g. {"/api/news/*": 300}, the longest matching pattern wins.
+		// A TTL not greater than 0 disables caching for the route.
+		// Optional. Default value nil.
+		RouteTTLs map[string]int `json:"route_ttls"`
+
+		// IgnoreQuery leaves the query string out of the cache key.
+		// Optional. Default value false.
+		IgnoreQuery bool `json:"ignore_query"`
+
+		// KeyHeaders defines the request headers whose values are part of the cache key,
+		// besides the ones named by the `Vary` response header.
+		// Optional. Default value []string{}.
+		KeyHeaders []string `json:"key_headers"`
+
+		// Statuses defines the response status codes which can be cached.
+		// Optional. Default value []int{200}.
+		Statuses []int `json:"statuses"`
+
+		// MaxBodySize is the largest response body in bytes which can be cached.
+		// Optional. Default value 1MB.
+		MaxBodySize int64 `json:"max_body_size"`
+
+		// BypassPaths defines the patterns of path.Match for the request paths never cached.
+		// Optional. Default value []string{}.
+		BypassPaths []string `json:"bypass_paths"`
+
+		// BypassHeaders defines the request headers whose presence bypasses the cache.
+		// Optional. Default value []string{}.
+		BypassHeaders []string `json:"bypass_headers"`
+
+		// CacheAuthorized allows caching the requests with an `Authorization` header,
+		// which are shared between users then.
+		// Optional. Default value false.
+		CacheAuthorized bool `json:"cache_authorized"`
+
+		// KeyCookies defines the cookies whose values are part of the cache key,
+		// the requests carrying other cookies bypass the cache unless CacheCookies is set.
+		// Optional. Default value []string{}.
+		KeyCookies []string `json:"key_cookies"`
+
+		// CacheCookies allows caching the requests with cookies not in KeyCookies,
+		// like a session cookie, which are shared between users then.
+		// Optional. Default value false.
+		CacheCookies bool `json:"cache_cookies"`
+
+		// StatusHeader is the response header telling whether the response is a cache HIT or MISS.
+		// Optional. Default value "X-Cache".
+		StatusHeader string `json:"status_header"`
+	}
+
+	// responseCacheEntry is a cached response.
+	// an entry of a response with a `Vary` header holds only the Vary names under the key of the request,
+	// the response itself is stored under a key made of the values of those request headers.
+	responseCacheEntry struct {
+		Vary   []string
+		Status int
+		Header http.Header
+		Body   []byte
+		Stored int64 // unix time
+	}
+
+	responseCacheWriter struct {
+		http.ResponseWriter
+		status   int
+		header   http.Header
+		body     bytes.Buffer
+		limit    int64
+		overflow bool
+	}
+)
+
+const (
+	headerCacheControl = "Cache-Control"
+	headerPragma       = "Pragma"
+	headerETag         = "ETag"
+	headerIfNoneMatch  = "If-None-Match"
+	headerAge          = "Age"
+	headerRange        = "Range"
+	headerAccept       = "Accept"
+	mimeEventStream    = "text/event-stream"
+)
+
+var (
+	// DefaultResponseCacheConfig is the default response cache middleware config.
+	DefaultResponseCacheConfig = ResponseCacheConfig{
+		Adapter:       "memory",
+		AdapterConfig: `{"interval":60}`,
+		KeyPrefix:     "response:",
+		TTL:           60,
+		Statuses:      []int{http.StatusOK},
+		MaxBodySize:   1 << 20,
+		StatusHeader:  "X-Cache",
+	}
+)
+
+// ResponseCache returns a middleware which caches GET responses in a cache adapter.
+//
+// The cache key is made of the path, the query and the configured request headers,
+// and the request headers named by the `Vary` response header.
+// A cached response gets an `ETag`, so a matching `If-None-Match` is answered with "304 - Not Modified".
+// The requests with `Cache-Control: no-store` never touch the cache, the ones with `no-cache` refresh it.
+// The requests with an `Authorization` header or cookies out of KeyCookies, websocket upgrades
+// and event streams bypass the cache.
+// The responses with `Set-Cookie`, `Vary: *` or `Cache-Control: no-store, no-cache or private` are not cached,
+// `s-maxage` or `max-age` of the response overrides the configured TTL.
+var ResponseCache = lessgo.ApiMiddleware{
+	Name: "ResponseCache",
+	Desc: `a middleware which caches GET responses (status, headers and body) in a cache adapter.
+The cache key is made of the path, the query, the configured request headers and the ones named by the 'Vary' response header.
+A cached response gets an 'ETag', so a matching 'If-None-Match' is answered with "304 - Not Modified".`,
+	Config: DefaultResponseCacheConfig,
+	Middleware: func(confObject interface{}) lessgo.MiddlewareFunc {
+		config := confObject.(ResponseCacheConfig)
+		// Defaults
+		if config.Adapter == "" {
+			config.Adapter = DefaultResponseCacheConfig.Adapter
+			if config.AdapterConfig == "" {
+				config.AdapterConfig = DefaultResponseCacheConfig.AdapterConfig
+			}
+		}
+		if config.KeyPrefix == "" {
+			config.KeyPrefix = DefaultResponseCacheConfig.KeyPrefix
+		}
+		if config.TTL == 0 {
+			config.TTL = DefaultResponseCacheConfig.TTL
+		}
+		if len(config.Statuses) == 0 {
+			config.Statuses = DefaultResponseCacheConfig.Statuses
+		}
+		if config.MaxBodySize == 0 {
+			config.MaxBodySize = DefaultResponseCacheConfig.MaxBodySize
+		}
+		if config.StatusHeader == "" {
+			config.StatusHeader = DefaultResponseCacheConfig.StatusHeader
+		}
+
+		// Initialize
+		store, err := cache.NewCache(config.Adapter, config.AdapterConfig)
+		if err != nil {
+			panic(fmt.Errorf("response cache: %v", err))
+		}
+		statuses := make(map[int]bool, len(config.Statuses))
+		for _, code := range config.Statuses {
+			statuses[code] = true
+		}
+
+		return func(next lessgo.HandlerFunc) lessgo.HandlerFunc {
+			return func(c *lessgo.Context) error {
+				req := c.Request()
+				if req.Method != lessgo.GET && req.Method != lessgo.HEAD {
+					return next(c)
+				}
+				ttl := config.routeTTL(req.URL.Path)
+				if ttl <= 0 || config.bypass(req) {
+					return next(c)
+				}
+				reqDirectives := cacheControl(req.Header)
+				if _, ok := reqDirectives["no-store"]; ok {
+					return next(c)
+				}
+				_, refresh := reqDirectives["no-cache"]
+				if strings.Contains(req.Header.Get(headerPragma), "no-cache") {
+					refresh = true
+				}
+
+				res := c.Response()
+				key := config.requestKey(req)
+				if !refresh {
+					if entry, ok := loadResponse(store, key, req); ok {
+						res.Header().Set(config.StatusHeader, "HIT")
+						return entry.serve(c)
+					}
+				}
+				if req.Method == lessgo.HEAD {
+					// a HEAD response has no body to be served to GET requests.
+					return next(c)
+				}
+
+				// Capture the response while writing it through.
+				res.Header().Set(config.StatusHeader, "MISS")
+				rw := res.Writer()
+				w := &responseCacheWriter{ResponseWriter: rw, limit: config.MaxBodySize}
+				res.SetWriter(w)
+				defer res.SetWriter(rw)
+				if err := next(c); err != nil {
+					return err
+				}
+
+				if w.status == 0 || !statuses[w.status] || w.overflow {
+					return nil
+				}
+				if ttl = storableTTL(w.header, ttl); ttl <= 0 {
+					return nil
+				}
+				w.header.Del(config.StatusHeader)
+				entry := &responseCacheEntry{
+					Status: w.status,
+					Header: w.header,
+					Body:   w.body.Bytes(),
+					Stored: time.Now().Unix(),
+				}
+				if entry.Header.Get(headerETag) == "" {
+					sum := sha1.Sum(entry.Body)
+					entry.Header.Set(headerETag, `W/"`+hex.EncodeToString(sum[:])+`"`)
+				}
+				if err := storeResponse(store, key, req, entry, time.Duration(ttl)*time.Second); err != nil {
+					lessgo.Log.Warn("response cache: %v", err)
+				}
+				return nil
+			}
+		}
+	},
+}.Reg()
+
+// routeTTL returns the TTL in seconds for the request path.
+func (config *ResponseCacheConfig) routeTTL(p string) int {
+	ttl, longest := config.TTL, -1
+	for pattern, t := range config.RouteTTLs {
+		if len(pattern) > longest {
+			if ok, _ := path.Match(pattern, p); ok {
+				ttl, longest = t, len(pattern)
+			}
+		}
+	}
+	return ttl
+}
+
+// bypass reports whether the request must not use the cache.
+func (config *ResponseCacheConfig) bypass(req *http.Request) bool {
+	if !config.CacheAuthorized && req.Header.Get(lessgo.HeaderAuthorization) != "" {
+		return true
+	}
+	if req.Header.Get(headerRange) != "" || req.Header.Get(lessgo.HeaderUpgrade) != "" ||
+		strings.Contains(req.Header.Get(headerAccept), mimeEventStream) {
+		return true
+	}
+	if !config.CacheCookies {
+		for _, cookie := range req.Cookies() {
+			if !containsString(config.KeyCookies, cookie.Name) {
+				return true
+			}
+		}
+	}
+	for _, h := range config.BypassHeaders {
+		if _, ok := req.Header[http.CanonicalHeaderKey(h)]; ok {
+			return true
+		}
+	}
+	for _, pattern := range config.BypassPaths {
+		if ok, _ := path.Match(pattern, req.URL.Path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// requestKey returns the cache key of the request, before any `Vary` of the response.
+// GET and HEAD requests share the key.
+func (config *ResponseCacheConfig) requestKey(req *http.Request) string {
+	var buf bytes.Buffer
+	buf.WriteString(req.Host)
+	buf.WriteString(req.URL.Path)
+	if !config.IgnoreQuery {
+		// Sort the query so the order of the params does not matter.
+		buf.WriteByte('?')
+		buf.WriteString(req.URL.Query().Encode())
+	}
+	writeHeaderValues(&buf, req, config.KeyHeaders)
+	for _, name := range config.KeyCookies {
+		buf.WriteString("\ncookie:")
+		buf.WriteString(name)
+		if cookie, err := req.Cookie(name); err == nil {
+			buf.WriteByte('=')
+			buf.WriteString(cookie.Value)
+		}
+	}
+	return config.KeyPrefix + hashKey(buf.Bytes())
+}
+
+// variantKey returns the key of the response varying on the request headers names under key.
+func variantKey(key string, req *http.Request, names []string) string {
+	var buf bytes.Buffer
+	writeHeaderValues(&buf, req, names)
+	return key + ":" + hashKey(buf.Bytes())
+}
+
+func writeHeaderValues(buf *bytes.Buffer, req *http.Request, names []string) {
+	for _, name := range names {
+		buf.WriteByte('\n')
+		buf.WriteString(http.CanonicalHeaderKey(name))
+		buf.WriteByte(':')
+		buf.WriteString(strings.Join(req.Header[http.CanonicalHeaderKey(name)], ","))
+	}
+}
+
+// hashKey keeps the keys short and free of the characters some backends reject, like memcache.
+func hashKey(b []byte) string {
+	sum := sha1.Sum(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadResponse gets the cached response of the request.
+func loadResponse(store cache.Cache, key string, req *http.Request) (*responseCacheEntry, bool) {
+	entry, ok := getEntry(store, key)
+	if ok && len(entry.Vary) > 0 {
+		entry, ok = getEntry(store, variantKey(key, req, entry.Vary))
+	}
+	return entry, ok && entry.Status != 0
+}
+
+// storeResponse caches the response of the request.
+func storeResponse(store cache.Cache, key string, req *http.Request, entry *responseCacheEntry, timeout time.Duration) error {
+	vary := varyNames(entry.Header)
+	if len(vary) > 0 {
+		if err := putEntry(store, key, &responseCacheEntry{Vary: vary}, timeout); err != nil {
+			return err
+		}
+		key = variantKey(key, req, vary)
+	}
+	return putEntry(store, key, entry, timeout)
+}
+
+// getEntry decodes the entry of key, which is stored as bytes so it fits every adapter.
+func getEntry(store cache.Cache, key string) (*responseCacheEntry, bool) {
+	var b []byte
+	if cache.GetInto(store, key, &b) != nil || len(b) == 0 {
+		return nil, false
+	}
+	entry := new(responseCacheEntry)
+	if cache.GobCodec.Unmarshal(b, entry) != nil {
+		return nil, false
+	}
+	return entry, true
+}
+
+func putEntry(store cache.Cache, key string, entry *responseCacheEntry, timeout time.Duration) error {
+	b, err := cache.GobCodec.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return store.Put(key, b, timeout)
+}
+
+// serve writes the cached response, or "304 - Not Modified" if the `If-None-Match` of the request matches.
+func (entry *responseCacheEntry) serve(c *lessgo.Context) error {
+	req := c.Request()
+	res := c.Response()
+	header := res.Header()
+	for k, v := range entry.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	age := time.Now().Unix() - entry.Stored
+	if age < 0 {
+		age = 0
+	}
+	header.Set(headerAge, strconv.FormatInt(age, 10))
+	if etagMatch(req.Header.Get(headerIfNoneMatch), entry.Header.Get(headerETag)) {
+		header.Del(lessgo.HeaderContentType)
+		header.Del(lessgo.HeaderContentLength)
+		return c.NoContent(http.StatusNotModified)
+	}
+	header.Set(lessgo.HeaderContentLength, strconv.Itoa(len(entry.Body)))
+	res.WriteHeader(entry.Status)
+	if req.Method == lessgo.HEAD {
+		return nil
+	}
+	_, err := res.Write(entry.Body)
+	return err
+}
+
+// etagMatch reports whether an `If-None-Match` list matches etag, by the weak comparison.
+func etagMatch(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// storableTTL returns the TTL in seconds a response can be cached for, 0 if it must not be cached.
+func storableTTL(header http.Header, ttl int) int {
+	if header.Get(lessgo.HeaderSetCookie) != "" {
+		return 0
+	}
+	for _, name := range varyNames(header) {
+		if name == "*" {
+			return 0
+		}
+	}
+	directives := cacheControl(header)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[d]; ok {
+			return 0
+		}
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := directives[d]; ok {
+			if age, err := strconv.Atoi(v); err == nil {
+				return age
+			}
+		}
+	}
+	return ttl
+}
+
+// cacheControl parses the `Cache-Control` header into directives and their values.
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, line := range header[headerCacheControl] {
+		for _, d := range strings.Split(line, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, value := d, ""
+			if i := strings.IndexByte(d, '='); i >= 0 {
+				name, value = d[:i], strings.Trim(d[i+1:], `"`)
+			}
+			directives[strings.ToLower(name)] = value
+		}
+	}
+	return directives
+}
+
+// varyNames returns the sorted distinct canonical header names of the `Vary` header,
+// middlewares like Gzip and CORS add theirs on every request.
+func varyNames(header http.Header) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, line := range header[lessgo.HeaderVary] {
+		for _, name := range strings.Split(line, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (w *responseCacheWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.header = cloneHeader(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseCacheWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+		w.header = cloneHeader(w.Header())
+	}
+	if !w.overflow {
+		if int64(w.body.Len()+len(b)) > w.limit {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends the buffered data to the client, for the streamed responses.
+func (w *responseCacheWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection, the response is not cached then.
+func (w *responseCacheWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response cache: the ResponseWriter does not implement http.Hijacker")
+	}
+	w.overflow = true
+	return h.Hijack()
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, v := range h {
+		h2[k] = append([]string(nil), v...)
+	}
+	return h2
+}
@@ -0,0 +1,639 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrylee2cn/lessgo"
+	"github.com/henrylee2cn/lessgoext/cache"
+	"github.com/henrylee2cn/lessgoext/otp"
+	"github.com/henrylee2cn/lessgoext/otp/totp"
+)
+
+type (
+	// TwoFactorConfig defines the config for two-factor authentication middleware.
+	TwoFactorConfig struct {
+		// Secret is the key to sign the cookie of the verified devices.
+		// Required.
+		Secret []byte `json:"secret"`
+
+		// Issuer is the name shown by the authenticator apps.
+		// Optional. Default value "lessgo".
+		Issuer string `json:"issuer"`
+
+		// ContextKey is the context key of the user set by the primary authentication middleware,
+		// like the ContextKey of Authorize. Without it, the request is unauthorized.
+		// Optional. Default value "user".
+		ContextKey string `json:"context_key"`
+
+		// EnrollPath is the path to enroll: GET responds a new secret and its QR code,
+		// POST with form param `code` confirms it and responds the recovery codes.
+		// Optional. Default value "/2fa/enroll".
+		EnrollPath string `json:"enroll_path"`
+
+		// VerifyPath is the path to POST the form params `code`, a TOTP or recovery code,
+		// and `remember` to remember the device.
+		// Optional. Default value "/2fa/verify".
+		VerifyPath string `json:"verify_path"`
+
+		// CodeHeader is a header whose code is verified for the request only, for API clients.
+		// Optional. Default value "X-TOTP-Code".
+		CodeHeader string `json:"code_header"`
+
+		// Optional allows the users not enrolled yet.
+		// Optional. Default value false, which sends them "403 - Forbidden" response.
+		Optional bool `json:"optional"`
+
+		// Name of the cookie of the verified devices.
+		// Optional. Default value "2fa".
+		CookieName string `json:"cookie_name"`
+
+		// Indicates if the cookie is secure, it always is for TLS requests.
+		// Optional. Default value false.
+		CookieSecure bool `json:"cookie_secure"`
+
+		// SessionTTL is the time in seconds a verification lasts within the browser session.
+		// Optional. Default value 43200.
+		SessionTTL int `json:"session_ttl"`
+
+		// RememberTTL is the time in seconds a remembered device needs no code.
+		// Optional. Default value 2592000.
+		RememberTTL int `json:"remember_ttl"`
+
+		// Skew is the number of 30 seconds periods a code may be early or late.
+		// Optional. Default value 1.
+		Skew int `json:"skew"`
+
+		// RecoveryCodes is the number of the recovery codes given at enrolment.
+		// Optional. Default value 10.
+		RecoveryCodes int `json:"recovery_codes"`
+
+		// MaxFailures is the number of wrong codes of a user which locks the user out.
+		// Optional. Default value 5.
+		MaxFailures int `json:"max_failures"`
+
+		// Lockout is the time in seconds a user is locked out, and the period the failures are counted in.
+		// Optional. Default value 300.
+		Lockout int `json:"lockout"`
+
+		// QRSize is the width and height in pixels of the QR code.
+		// Optional. Default value 200.
+		QRSize int `json:"qr_size"`
+
+		// Store keeps the secrets of the users, shared by the instances should implement TwoFactorSwapper.
+		// Optional. Source only, a cache store of StoreAdapter if nil.
+		Store TwoFactorStore `json:"-"`
+
+		// StoreAdapter is the name of the cache adapter of the secrets if Store is nil,
+		// it must be a persistent one like file or redis.
+		// Optional. Default value "file".
+		StoreAdapter string `json:"store_adapter"`
+
+		// StoreAdapterConfig is the config passed to cache.NewCache for the secrets.
+		// Optional. Default value `{"CachePath":"cache/2fa"}`.
+		StoreAdapterConfig string `json:"store_adapter_config"`
+	}
+
+	// TwoFactorStore keeps the two-factor accounts of the users.
+	TwoFactorStore interface {
+		// Get returns the account of user, nil if none.
+		Get(user string) (*TwoFactorAccount, error)
+		// Put stores the account of user.
+		Put(user string, account *TwoFactorAccount) error
+		// Delete removes the account of user, who is not enrolled any more.
+		Delete(user string) error
+	}
+
+	// TwoFactorSwapper is implemented by the stores which update an account atomically,
+	// so a code can not be used twice by concurrent requests to several instances.
+	TwoFactorSwapper interface {
+		// Swap stores account of user only if the stored account is still old, a copy of the account returned by Get,
+		// and reports whether it did.
+		Swap(user string, old, account *TwoFactorAccount) (bool, error)
+	}
+
+	// TwoFactorAccount is the two-factor state of a user.
+	TwoFactorAccount struct {
+		// Secret is the confirmed base32 TOTP secret, "" if not enrolled.
+		Secret string `json:"secret"`
+		// Pending is the secret of an unconfirmed enrolment.
+		Pending string `json:"pending"`
+		// RecoveryCodes are the SHA-256 hex of the unused recovery codes.
+		RecoveryCodes []string `json:"recovery_codes"`
+		// LastCounter is the time step of the last accepted code, so a code is accepted once.
+		LastCounter int64 `json:"last_counter"`
+
+		// stored is the JSON read by the cacheTwoFactorStore, which Swap compares.
+		stored string
+	}
+
+	// cacheTwoFactorStore keeps the accounts as JSON in a cache adapter.
+	cacheTwoFactorStore struct {
+		cache  cache.Cache
+		prefix string
+	}
+
+	// twoFactor verifies the codes of a TwoFactorConfig.
+	twoFactor struct {
+		config  TwoFactorConfig
+		lockout *basicAuthLockout
+		// locks serialize the updates of the accounts within the process, by the hash of the user.
+		locks [64]sync.Mutex
+	}
+)
+
+const (
+	twoFactorPeriod = 30
+	// twoFactorSwapRetries bounds the tries to update an account changed concurrently.
+	twoFactorSwapRetries = 3
+	// twoFactorStoreTTL keeps the accounts in the cache adapters which require a timeout.
+	twoFactorStoreTTL = 10 * 365 * 24 * time.Hour
+)
+
+var (
+	// DefaultTwoFactorConfig is the default two-factor authentication middleware config.
+	DefaultTwoFactorConfig = TwoFactorConfig{
+		Issuer:             "lessgo",
+		ContextKey:         "user",
+		EnrollPath:         "/2fa/enroll",
+		VerifyPath:         "/2fa/verify",
+		CodeHeader:         "X-TOTP-Code",
+		CookieName:         "2fa",
+		SessionTTL:         43200,
+		RememberTTL:        2592000,
+		Skew:               1,
+		RecoveryCodes:      10,
+		MaxFailures:        5,
+		Lockout:            300,
+		QRSize:             200,
+		StoreAdapter:       "file",
+		StoreAdapterConfig: `{"CachePath":"cache/2fa"}`,
+	}
+
+	errTwoFactorLocked  = lessgo.NewHTTPError(http.StatusTooManyRequests, "too many wrong two factor codes")
+	errTwoFactorInvalid = lessgo.NewHTTPError(http.StatusForbidden, "invalid two factor code")
+	errTwoFactorCode    = lessgo.NewHTTPError(http.StatusForbidden, "two factor code required")
+	errTwoFactorEnroll  = lessgo.NewHTTPError(http.StatusForbidden, "two factor enrolment required")
+)
+
+// TwoFactor returns a two-factor authentication middleware by TOTP codes,
+// used after a primary authentication middleware like BasicAuthUsers, JWTWithConfig or OIDCLogin.
+//
+// The enroll and verify paths must be routed through it, which handles them.
+// A verified device gets a signed cookie, for the browser session or remembered for RememberTTL.
+// For user not enrolled, it sends "403 - Forbidden" response unless Optional.
+// For unverified device, it sends "403 - Forbidden" response.
+var TwoFactor = lessgo.ApiMiddleware{
+	Name: "TwoFactor",
+	Desc: `a two-factor authentication middleware by TOTP codes, used after a primary authentication middleware.
+It handles the enrolment with QR code and recovery codes, and remembers the verified devices by a signed cookie.`,
+	Config: DefaultTwoFactorConfig,
+	Middleware: func(confObject interface{}) lessgo.MiddlewareFunc {
+		tf, err := newTwoFactor(confObject.(TwoFactorConfig))
+		if err != nil {
+			panic(err)
+		}
+		config := tf.config
+
+		return func(next lessgo.HandlerFunc) lessgo.HandlerFunc {
+			return func(c *lessgo.Context) error {
+				sub, _ := authorizeClaims(c, config.ContextKey)["sub"].(string)
+				if sub == "" {
+					return lessgo.ErrUnauthorized
+				}
+				req := c.Request()
+				switch req.URL.Path {
+				case config.EnrollPath:
+					return tf.enroll(c, sub)
+				case config.VerifyPath:
+					if req.Method == lessgo.POST {
+						return tf.verify(c, sub)
+					}
+				}
+				account, err := config.Store.Get(sub)
+				if err != nil {
+					return err
+				}
+				if account == nil || account.Secret == "" {
+					if config.Optional {
+						return next(c)
+					}
+					return errTwoFactorEnroll
+				}
+				if tf.verified(c, sub, account) {
+					return next(c)
+				}
+				if code := c.HeaderParam(config.CodeHeader); code != "" {
+					if _, err = tf.check(sub, code); err != nil {
+						return err
+					}
+					return next(c)
+				}
+				return errTwoFactorCode
+			}
+		}
+	},
+}.Reg()
+
+// NewCacheTwoFactorStore returns a TwoFactorStore keeping the accounts in c,
+// which must be a persistent adapter like file or redis.
+func NewCacheTwoFactorStore(c cache.Cache) TwoFactorStore {
+	return &cacheTwoFactorStore{cache: c, prefix: "2fa:"}
+}
+
+func (s *cacheTwoFactorStore) Get(user string) (*TwoFactorAccount, error) {
+	var data string
+	if err := cache.GetInto(s.cache, s.prefix+user, &data); err != nil {
+		if err == cache.ErrCacheMiss {
+			return nil, nil
+		}
+		return nil, err
+	}
+	account := &TwoFactorAccount{stored: data}
+	if err := json.Unmarshal([]byte(data), account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (s *cacheTwoFactorStore) Put(user string, account *TwoFactorAccount) error {
+	data, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	return s.cache.Put(s.prefix+user, string(data), twoFactorStoreTTL)
+}
+
+func (s *cacheTwoFactorStore) Delete(user string) error {
+	return s.cache.Delete(s.prefix + user)
+}
+
+// Swap is atomic if the cache adapter implements cache.AtomicCache, else it is a Put.
+// old is compared by the JSON Get read, encoding it again may differ, e.g. an empty array for null.
+func (s *cacheTwoFactorStore) Swap(user string, old, account *TwoFactorAccount) (bool, error) {
+	ac, ok := s.cache.(cache.AtomicCache)
+	if !ok {
+		return true, s.Put(user, account)
+	}
+	o := old.stored
+	if o == "" {
+		b, err := json.Marshal(old)
+		if err != nil {
+			return false, err
+		}
+		o = string(b)
+	}
+	data, err := json.Marshal(account)
+	if err != nil {
+		return false, err
+	}
+	return ac.CompareAndSwap(s.prefix+user, o, string(data), twoFactorStoreTTL)
+}
+
+// newTwoFactor fills the defaults of config and opens its store.
+func newTwoFactor(config TwoFactorConfig) (*twoFactor, error) {
+	if config.Secret == nil {
+		return nil, errors.New("two factor secret must be provided")
+	}
+	if config.Issuer == "" {
+		config.Issuer = DefaultTwoFactorConfig.Issuer
+	}
+	if config.ContextKey == "" {
+		config.ContextKey = DefaultTwoFactorConfig.ContextKey
+	}
+	if config.EnrollPath == "" {
+		config.EnrollPath = DefaultTwoFactorConfig.EnrollPath
+	}
+	if config.VerifyPath == "" {
+		config.VerifyPath = DefaultTwoFactorConfig.VerifyPath
+	}
+	if config.CodeHeader == "" {
+		config.CodeHeader = DefaultTwoFactorConfig.CodeHeader
+	}
+	if config.CookieName == "" {
+		config.CookieName = DefaultTwoFactorConfig.CookieName
+	}
+	if config.SessionTTL <= 0 {
+		config.SessionTTL = DefaultTwoFactorConfig.SessionTTL
+	}
+	if config.RememberTTL <= 0 {
+		config.RememberTTL = DefaultTwoFactorConfig.RememberTTL
+	}
+	if config.Skew <= 0 {
+		config.Skew = DefaultTwoFactorConfig.Skew
+	}
+	if config.RecoveryCodes <= 0 {
+		config.RecoveryCodes = DefaultTwoFactorConfig.RecoveryCodes
+	}
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = DefaultTwoFactorConfig.MaxFailures
+	}
+	if config.Lockout <= 0 {
+		config.Lockout = DefaultTwoFactorConfig.Lockout
+	}
+	if config.QRSize <= 0 {
+		config.QRSize = DefaultTwoFactorConfig.QRSize
+	}
+	if config.Store == nil {
+		if config.StoreAdapter == "" {
+			config.StoreAdapter = DefaultTwoFactorConfig.StoreAdapter
+			config.StoreAdapterConfig = DefaultTwoFactorConfig.StoreAdapterConfig
+		}
+		c, err := cache.NewCache(config.StoreAdapter, config.StoreAdapterConfig)
+		if err != nil {
+			return nil, fmt.Errorf("two factor store: %v", err)
+		}
+		config.Store = NewCacheTwoFactorStore(c)
+	}
+	return &twoFactor{
+		config: config,
+		lockout: &basicAuthLockout{
+			max:      config.MaxFailures,
+			duration: time.Duration(config.Lockout) * time.Second,
+			keys:     make(map[string]*basicAuthFailures),
+		},
+	}, nil
+}
+
+// enroll responds a new pending secret for GET, and confirms it by a code for POST.
+// an enrolled user must verify the device before enrolling again.
+func (tf *twoFactor) enroll(c *lessgo.Context, user string) error {
+	defer tf.lock(user)()
+	account, err := tf.config.Store.Get(user)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		account = new(TwoFactorAccount)
+	} else if account.Secret != "" && !tf.verified(c, user, account) {
+		return errTwoFactorCode
+	}
+
+	if c.Request().Method != lessgo.POST {
+		key, err := tf.newPending(user, account)
+		if err != nil {
+			return err
+		}
+		img, err := key.Image(tf.config.QRSize, tf.config.QRSize)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err = png.Encode(&buf, img); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, map[string]string{
+			"secret": key.Secret(),
+			"url":    key.String(),
+			"qr":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+		})
+	}
+
+	codes, err := tf.confirm(user, account, c.FormParam("code"))
+	if err != nil {
+		return err
+	}
+	c.Response().SetCookie(tf.cookie(user, account, false, c.IsTLS()))
+	return c.JSON(http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// newPending stores a new pending secret in the account of user, and returns its key.
+// the caller must hold the lock of user.
+func (tf *twoFactor) newPending(user string, account *TwoFactorAccount) (*otp.Key, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      tf.config.Issuer,
+		AccountName: user,
+		SecretSize:  20,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	account.Pending = key.Secret()
+	if err = tf.config.Store.Put(user, account); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// confirm makes the pending secret of the account of user confirmed by code the secret,
+// and returns the new recovery codes.
+// the caller must hold the lock of user.
+func (tf *twoFactor) confirm(user string, account *TwoFactorAccount, code string) ([]string, error) {
+	if account.Pending == "" {
+		return nil, lessgo.NewHTTPError(http.StatusBadRequest, "no pending two factor enrolment")
+	}
+	if tf.lockout.attempt(user, time.Now()) > 0 {
+		return nil, errTwoFactorLocked
+	}
+	counter, ok := tf.validate(account.Pending, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return nil, errTwoFactorInvalid
+	}
+	tf.lockout.succeed(user)
+	codes, hashes, err := newRecoveryCodes(tf.config.RecoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+	account.Secret, account.Pending = account.Pending, ""
+	account.RecoveryCodes, account.LastCounter = hashes, counter
+	if err = tf.config.Store.Put(user, account); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// verify checks the code of the form, and sets the cookie of the verified device.
+func (tf *twoFactor) verify(c *lessgo.Context, user string) error {
+	remember, _ := strconv.ParseBool(c.FormParam("remember"))
+	cookie, err := tf.verifyCode(user, c.FormParam("code"), remember, c.IsTLS())
+	if err != nil {
+		return err
+	}
+	c.Response().SetCookie(cookie)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// verifyCode checks code, and returns the cookie of the verified device.
+func (tf *twoFactor) verifyCode(user, code string, remember, tls bool) (*http.Cookie, error) {
+	account, err := tf.check(user, code)
+	if err != nil {
+		return nil, err
+	}
+	return tf.cookie(user, account, remember, tls), nil
+}
+
+// check accepts a TOTP code once, or uses up a recovery code, and returns the updated account.
+// the account is loaded and stored under the lock of user, and swapped if the store is a TwoFactorSwapper,
+// so concurrent requests can not use a code twice.
+func (tf *twoFactor) check(user, code string) (*TwoFactorAccount, error) {
+	defer tf.lock(user)()
+	now := time.Now()
+	if tf.lockout.attempt(user, now) > 0 {
+		return nil, errTwoFactorLocked
+	}
+	code = strings.TrimSpace(code)
+	for try := 0; try < twoFactorSwapRetries; try++ {
+		account, err := tf.config.Store.Get(user)
+		if err != nil {
+			return nil, err
+		}
+		if account == nil || account.Secret == "" {
+			return nil, errTwoFactorEnroll
+		}
+		old := *account
+		old.RecoveryCodes = append(account.RecoveryCodes[:0:0], account.RecoveryCodes...)
+		if counter, ok := tf.validate(account.Secret, code, now); ok && counter > account.LastCounter {
+			account.LastCounter = counter
+		} else if i := recoveryCodeIndex(account.RecoveryCodes, code); i >= 0 {
+			account.RecoveryCodes = append(account.RecoveryCodes[:i:i], account.RecoveryCodes[i+1:]...)
+		} else {
+			return nil, errTwoFactorInvalid
+		}
+		swapper, ok := tf.config.Store.(TwoFactorSwapper)
+		if !ok {
+			err = tf.config.Store.Put(user, account)
+		} else if ok, err = swapper.Swap(user, &old, account); err == nil && !ok {
+			// changed by another instance, check the code against the new state.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tf.lockout.succeed(user)
+		return account, nil
+	}
+	return nil, errTwoFactorInvalid
+}
+
+// lock locks the accounts of the same hash as user, and returns the unlock.
+func (tf *twoFactor) lock(user string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(user))
+	mu := &tf.locks[h.Sum32()%uint32(len(tf.locks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// validate returns the time step of code if it is valid for secret within the skew.
+func (tf *twoFactor) validate(secret, code string, now time.Time) (int64, bool) {
+	if len(code) != otp.DigitsSix.Length() {
+		return 0, false
+	}
+	for i := 0; i <= tf.config.Skew; i++ {
+		for _, step := range []int{i, -i} {
+			t := now.Add(time.Duration(step*twoFactorPeriod) * time.Second)
+			ok, _ := totp.ValidateCustom(code, secret, t, totp.ValidateOpts{
+				Period:    twoFactorPeriod,
+				Digits:    otp.DigitsSix,
+				Algorithm: otp.AlgorithmSHA1,
+			})
+			if ok {
+				return t.Unix() / twoFactorPeriod, true
+			}
+			if i == 0 {
+				break
+			}
+		}
+	}
+	return 0, false
+}
+
+// verified reports whether the cookie of the device is valid for user and the current secret,
+// so enrolling again forgets the remembered devices.
+func (tf *twoFactor) verified(c *lessgo.Context, user string, account *TwoFactorAccount) bool {
+	cookie, err := c.Cookie(tf.config.CookieName)
+	return err == nil && tf.validCookie(cookie.Value, user, account, time.Now())
+}
+
+// validCookie reports whether the cookie value is signed for user and the current secret, and not expired at now.
+func (tf *twoFactor) validCookie(value, user string, account *TwoFactorAccount, now time.Time) bool {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || string(name) != user {
+		return false
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.Unix() > exp {
+		return false
+	}
+	sig, err := hex.DecodeString(parts[2])
+	return err == nil && hmac.Equal(sig, tf.sign(user, exp, account.Secret))
+}
+
+// cookie returns the cookie marking the device verified, for the browser session or remembered.
+// it is secure if configured or the request is over TLS.
+func (tf *twoFactor) cookie(user string, account *TwoFactorAccount, remember, tls bool) *http.Cookie {
+	ttl, maxAge := tf.config.SessionTTL, 0
+	if remember {
+		ttl, maxAge = tf.config.RememberTTL, tf.config.RememberTTL
+	}
+	exp := time.Now().Unix() + int64(ttl)
+	return &http.Cookie{
+		Name:     tf.config.CookieName,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(exp, 10) + "." + hex.EncodeToString(tf.sign(user, exp, account.Secret)),
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   tf.config.CookieSecure || tls,
+		HttpOnly: true,
+	}
+}
+
+func (tf *twoFactor) sign(user string, exp int64, secret string) []byte {
+	h := hmac.New(sha256.New, tf.config.Secret)
+	fmt.Fprintf(h, "%s\x00%d\x00%s", user, exp, secret)
+	return h.Sum(nil)
+}
+
+// newRecoveryCodes returns n random codes like "abcde-fghij" and their hashes.
+func newRecoveryCodes(n int) (codes, hashes []string, err error) {
+	codes, hashes = make([]string, n), make([]string, n)
+	for i := range codes {
+		b, err := generateSalt(7)
+		if err != nil {
+			return nil, nil, err
+		}
+		s := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+func recoveryCodeIndex(hashes []string, code string) int {
+	if code == "" {
+		return -1
+	}
+	h := hashRecoveryCode(code)
+	for i, e := range hashes {
+		if hmac.Equal([]byte(e), []byte(h)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// hashRecoveryCode ignores the case and dashes of code.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
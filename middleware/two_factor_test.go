@@ -0,0 +1,232 @@
+package middleware
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/lessgoext/otp/totp"
+)
+
+// newTestTwoFactor returns a two factor middleware on a memory store.
+func newTestTwoFactor(t *testing.T) *twoFactor {
+	tf, err := newTwoFactor(TwoFactorConfig{Secret: []byte("secret"), StoreAdapter: "memory", StoreAdapterConfig: `{"interval":0}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tf
+}
+
+// totpCode returns the code of secret at now plus steps periods.
+func totpCode(t *testing.T, secret string, steps int) string {
+	code, err := totp.GenerateCode(secret, time.Now().Add(time.Duration(steps)*30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// enrollTwoFactor enrolls user, and returns the account and the recovery codes.
+func enrollTwoFactor(t *testing.T, tf *twoFactor, user string) (*TwoFactorAccount, []string) {
+	account := new(TwoFactorAccount)
+	key, err := tf.newPending(user, account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := tf.confirm(user, account, totpCode(t, key.Secret(), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return account, codes
+}
+
+func TestTwoFactorEnroll(t *testing.T) {
+	tf := newTestTwoFactor(t)
+	account := new(TwoFactorAccount)
+	if _, err := tf.confirm("alice", account, "123456"); err == nil {
+		t.Fatal("confirm without a pending secret succeeded")
+	}
+	key, err := tf.newPending("alice", account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := tf.config.Store.Get("alice"); err != nil || stored.Pending != key.Secret() || stored.Secret != "" {
+		t.Fatalf("pending account = %+v, %v", stored, err)
+	}
+	if _, err = tf.confirm("alice", account, totpCode(t, key.Secret(), 5)); err != errTwoFactorInvalid {
+		t.Fatalf("confirm of a wrong code = %v", err)
+	}
+	codes, err := tf.confirm("alice", account, " "+totpCode(t, key.Secret(), 0)+" ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := tf.config.Store.Get("alice")
+	if err != nil || stored.Secret != key.Secret() || stored.Pending != "" || stored.LastCounter == 0 {
+		t.Fatalf("enrolled account = %+v, %v", stored, err)
+	}
+	if len(codes) != 10 || len(stored.RecoveryCodes) != 10 || recoveryCodeIndex(stored.RecoveryCodes, codes[3]) != 3 {
+		t.Fatalf("recovery codes = %v, %v", codes, stored.RecoveryCodes)
+	}
+	if _, err = tf.confirm("alice", account, totpCode(t, key.Secret(), 0)); err == nil {
+		t.Error("confirm of a confirmed enrolment succeeded")
+	}
+
+	// the wrong codes at enrolment lock the user out.
+	account = new(TwoFactorAccount)
+	if key, err = tf.newPending("bob", account); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		tf.confirm("bob", account, "000000")
+	}
+	if _, err = tf.confirm("bob", account, totpCode(t, key.Secret(), 0)); err != errTwoFactorLocked {
+		t.Errorf("confirm after max failures = %v", err)
+	}
+}
+
+func TestTwoFactorCheck(t *testing.T) {
+	tf := newTestTwoFactor(t)
+	if _, err := tf.check("alice", "123456"); err != errTwoFactorEnroll {
+		t.Fatalf("check of a user not enrolled = %v", err)
+	}
+	account, codes := enrollTwoFactor(t, tf, "alice")
+
+	// the code of the enrolment is used.
+	if _, err := tf.check("alice", totpCode(t, account.Secret, 0)); err != errTwoFactorInvalid {
+		t.Fatalf("check of a replayed code = %v", err)
+	}
+	next := totpCode(t, account.Secret, 1)
+	if _, err := tf.check("alice", next); err != nil {
+		t.Fatalf("check of a fresh code = %v", err)
+	}
+	if _, err := tf.check("alice", next); err != errTwoFactorInvalid {
+		t.Fatalf("check of a code used twice = %v", err)
+	}
+
+	// each recovery code is accepted once, whatever its case and spaces.
+	for i, code := range codes {
+		if i%2 == 0 {
+			code = " " + strings.ToUpper(code)
+		}
+		if _, err := tf.check("alice", code); err != nil {
+			t.Fatalf("check of recovery code %d = %v", i, err)
+		}
+		if _, err := tf.check("alice", code); err != errTwoFactorInvalid {
+			t.Fatalf("check of used recovery code %d = %v", i, err)
+		}
+	}
+	// the account with no recovery code left still accepts the TOTP codes,
+	// its empty codes are stored as [], not null.
+	stored, err := tf.config.Store.Get("alice")
+	if err != nil || stored.RecoveryCodes == nil || len(stored.RecoveryCodes) != 0 {
+		t.Fatalf("account after the recovery codes = %+v, %v", stored, err)
+	}
+	stored.LastCounter = 0
+	if err = tf.config.Store.Put("alice", stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tf.check("alice", totpCode(t, account.Secret, 0)); err != nil {
+		t.Fatalf("check after the last recovery code = %v", err)
+	}
+
+	// the wrong codes lock the user out, even with a valid code.
+	for i := 0; i < 5; i++ {
+		tf.check("alice", "000000")
+	}
+	if _, err := tf.check("alice", totpCode(t, account.Secret, 1)); err != errTwoFactorLocked {
+		t.Errorf("check after max failures = %v", err)
+	}
+}
+
+func TestTwoFactorCheckConcurrent(t *testing.T) {
+	tf := newTestTwoFactor(t)
+	account, _ := enrollTwoFactor(t, tf, "alice")
+	// another instance sharing the store.
+	other := &twoFactor{config: tf.config, lockout: tf.lockout}
+	code := totpCode(t, account.Secret, 1)
+	var (
+		mu       sync.Mutex
+		accepted int
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(tf *twoFactor) {
+			defer wg.Done()
+			if _, err := tf.check("alice", code); err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}([]*twoFactor{tf, other}[i%2])
+	}
+	wg.Wait()
+	if accepted != 1 {
+		t.Errorf("a code is accepted %d times", accepted)
+	}
+}
+
+func TestTwoFactorVerify(t *testing.T) {
+	tf := newTestTwoFactor(t)
+	account, codes := enrollTwoFactor(t, tf, "alice")
+	if cookie, err := tf.verifyCode("alice", "000000", false, false); err != errTwoFactorInvalid || cookie != nil {
+		t.Fatalf("verifyCode of a wrong code = %v, %v", cookie, err)
+	}
+	cookie, err := tf.verifyCode("alice", totpCode(t, account.Secret, 1), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie.Name != "2fa" || cookie.MaxAge != 0 || cookie.Secure || !cookie.HttpOnly {
+		t.Errorf("session cookie = %+v", cookie)
+	}
+	if !tf.validCookie(cookie.Value, "alice", account, time.Now()) {
+		t.Error("cookie of verifyCode is invalid")
+	}
+	if cookie, err = tf.verifyCode("alice", codes[0], true, true); err != nil {
+		t.Fatal(err)
+	}
+	if cookie.MaxAge != 2592000 || !cookie.Secure {
+		t.Errorf("remembered cookie = %+v", cookie)
+	}
+}
+
+func TestTwoFactorCookie(t *testing.T) {
+	tf := newTestTwoFactor(t)
+	account, _ := enrollTwoFactor(t, tf, "alice")
+	value := tf.cookie("alice", account, false, false).Value
+	now := time.Now()
+	if !tf.validCookie(value, "alice", account, now) {
+		t.Fatal("valid cookie refused")
+	}
+	if tf.validCookie(value, "bob", account, now) {
+		t.Error("cookie of another user accepted")
+	}
+	if tf.validCookie(value, "alice", account, now.Add(13*time.Hour)) {
+		t.Error("expired cookie accepted")
+	}
+	if !tf.validCookie(tf.cookie("alice", account, true, false).Value, "alice", account, now.Add(13*time.Hour)) {
+		t.Error("remembered cookie expired with the session")
+	}
+	parts := strings.Split(value, ".")
+	for _, v := range []string{
+		value + "0",
+		parts[0] + "." + parts[1] + "1." + parts[2],
+		parts[0] + "." + parts[1],
+		"",
+	} {
+		if tf.validCookie(v, "alice", account, now) {
+			t.Errorf("tampered cookie %q accepted", v)
+		}
+	}
+	// enrolling again invalidates the cookies of the old secret.
+	renewed, _ := enrollTwoFactor(t, tf, "alice")
+	if tf.validCookie(value, "alice", renewed, now) {
+		t.Error("cookie of the old secret accepted")
+	}
+	other := &twoFactor{config: tf.config}
+	other.config.Secret = []byte("other")
+	if other.validCookie(value, "alice", account, now) {
+		t.Error("cookie signed by another key accepted")
+	}
+}
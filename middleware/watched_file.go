@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/henrylee2cn/lessgo"
+)
+
+// watchedFile is a config file loaded again on demand when modified,
+// so no goroutine outlives a middleware rebuilt by the admin.
+type watchedFile struct {
+	name     string
+	interval time.Duration // period to check whether the file is modified
+	load     func(name string) (interface{}, error)
+
+	mu      sync.RWMutex
+	value   interface{}
+	modTime time.Time
+	checked time.Time
+}
+
+// get returns the value loaded from the file, reloading it if modified.
+// the last valid value is kept if the file can not be loaded.
+func (f *watchedFile) get() interface{} {
+	f.mu.RLock()
+	value, due := f.value, time.Since(f.checked) >= f.interval
+	f.mu.RUnlock()
+	if due {
+		if err := f.reload(); err != nil {
+			lessgo.Log.Warn("reload %s: %v", f.name, err)
+		}
+		f.mu.RLock()
+		value = f.value
+		f.mu.RUnlock()
+	}
+	return value
+}
+
+// reload loads the file if modified since loaded.
+func (f *watchedFile) reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.value != nil && time.Since(f.checked) < f.interval {
+		return nil // reloaded by another request
+	}
+	f.checked = time.Now()
+	info, err := os.Stat(f.name)
+	if err != nil {
+		return err
+	}
+	if f.value != nil && info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+	value, err := f.load(f.name)
+	if err != nil {
+		return err
+	}
+	f.value, f.modTime = value, info.ModTime()
+	return nil
+}
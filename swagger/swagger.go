@@ -11,6 +11,7 @@ import (
 	"sync"
 
 	"github.com/henrylee2cn/lessgo"
+	"github.com/henrylee2cn/lessgoext/middleware"
 	"github.com/henrylee2cn/lessgoext/myconfig"
 )
 
@@ -22,10 +23,13 @@ import (
 /**
  * 注册"/apidoc"路由
  * 配置文件config/apidoc_allow.myconfig说明
- * 参数"checkrealip=true"，表示以真实ip为准进行过滤访问
  * 参数"freeaccess=true"，表示允许任意ip访问
- * 参数"freeaccess=false ipprefix="，为空表示不允许任何ip访问
- * 参数"freeaccess=false ipprefix=192;202"，表示仅允许以192或202开头的ip访问
+ * 参数"freeaccess=false allow="，为空表示不允许任何ip访问
+ * 参数"freeaccess=false allow=192.168.0.0/16;fc00::/7"，表示仅允许这些IP或CIDR网段访问
+ * 参数"deny=192.168.1.0/24"，表示禁止这些IP或CIDR网段访问，优先于allow
+ * 参数"trustedproxies=10.0.0.1"，表示仅当直连IP属于这些可信代理时，才以X-Forwarded-For中的真实ip为准
+ * 旧版参数"ipprefix=192.168.;10."启动时转换为CIDR网段并取代allow，无法转换时不允许任何ip访问
+ * 旧版参数"checkrealip"已废弃，请改用trustedproxies
  */
 func Reg() {
 	lessgo.Root(
@@ -34,10 +38,10 @@ func Reg() {
 	)
 	if apidocConfig.FreeAccess {
 		lessgo.Log.Sys(`Swagger API's URL path is '/apidoc' [free access]`)
-	} else if len(apidocConfig.IpPrefix) == 0 {
+	} else if len(apidocConfig.Allow) == 0 {
 		lessgo.Log.Sys(`Swagger API's URL path is '/apidoc' [no access]`)
-	} else if apidocConfig.CheckRealIp {
-		lessgo.Log.Sys(`Swagger API's URL path is '/apidoc' [check real ip for filter]`)
+	} else if len(apidocConfig.TrustedProxies) > 0 {
+		lessgo.Log.Sys(`Swagger API's URL path is '/apidoc' [check real ip behind trusted proxies for filter]`)
 	} else {
 		lessgo.Log.Sys(`Swagger API's URL path is '/apidoc' [check direct ip for filter]`)
 	}
@@ -85,7 +89,7 @@ var (
 		Default:     "",
 	}
 
-	// 拦截IP前缀的中间件
+	// 按IP或CIDR网段拦截的中间件
 	allowApidoc = lessgo.ApiMiddleware{
 		Name: "allowApidoc",
 		Middleware: func(next lessgo.HandlerFunc) lessgo.HandlerFunc {
@@ -94,65 +98,110 @@ var (
 					return next(c)
 				}
 
-				if len(apidocConfig.IpPrefix) == 0 {
+				if apidocRules == nil {
 					return c.Failure(http.StatusForbidden, errors.New(`no access`))
 				}
 
-				var remoteAddress string
-				if apidocConfig.CheckRealIp {
-					remoteAddress = c.RealRemoteAddr()
-				} else {
-					remoteAddress = c.Request().RemoteAddr
-				}
-				for _, ipPrefix := range apidocConfig.IpPrefix {
-					if strings.HasPrefix(remoteAddress, ipPrefix) {
-						return next(c)
-					}
+				ip := apidocRules.ClientIP(c.Request())
+				if apidocRules.Allowed(ip) {
+					return next(c)
 				}
 
-				return c.Failure(http.StatusForbidden, errors.New(`not allow to access: `+remoteAddress))
+				return c.Failure(http.StatusForbidden, fmt.Errorf("not allow to access: %v", ip))
 			}
 		},
 	}.Reg()
 )
 
-// 配置被允许访问的ip前缀规则
+// 配置被允许访问的IP规则
 type ApidocAllow struct {
-	CheckRealIp bool //是否检查真实IP
-	FreeAccess  bool //允许任意IP访问
-	IpPrefix    []string
+	FreeAccess     bool     //允许任意IP访问
+	Allow          []string //允许访问的IP或CIDR网段
+	Deny           []string //禁止访问的IP或CIDR网段，优先于Allow
+	TrustedProxies []string //可信代理的IP或CIDR网段，仅采信来自可信代理的X-Forwarded-For
+	CheckRealIp    bool     //已废弃，请改用TrustedProxies
+	IpPrefix       []string //已废弃，启动时转换为CIDR网段并取代Allow
 }
 
 var apidocConfig = func() *ApidocAllow {
 	conf := &ApidocAllow{
-		CheckRealIp: false,
-		FreeAccess:  false,
-		IpPrefix: []string{
-			"[:",
-			"::",
-			"127.",
-			"192.168.",
-			"10.",
-		},
+		FreeAccess: false,
+		Allow:      append([]string(nil), middleware.LANNets...),
 	}
 	err := myconfig.Sync(conf)
 	if err != nil {
 		lessgo.Log.Error("%s", err.Error())
-		return conf
 	}
+	if err = migrateApidocAllow(conf); err != nil {
+		// 旧版限制无法转换时，不允许任何IP访问
+		lessgo.Log.Error("%s", err.Error())
+		conf.FreeAccess = false
+		conf.Allow = nil
+	}
+	return conf
+}()
 
-	ipPrefixMap := map[string]bool{}
-	for _, ipPrefix := range conf.IpPrefix {
-		if len(ipPrefix) > 0 {
-			ipPrefixMap[ipPrefix] = true
+// 将旧版配置的IP前缀转换为CIDR网段，取代Allow，以免放宽旧版的限制
+func migrateApidocAllow(conf *ApidocAllow) error {
+	if conf.CheckRealIp && len(conf.TrustedProxies) == 0 {
+		lessgo.Log.Warn("apidoc: CheckRealIp is deprecated, X-Forwarded-For is honored only from TrustedProxies")
+	}
+	var allow []string
+	for _, prefix := range conf.IpPrefix {
+		if prefix = strings.TrimSpace(prefix); prefix == "" {
+			continue
+		}
+		cidr, err := ipPrefixCIDR(prefix)
+		if err != nil {
+			return err
 		}
+		allow = append(allow, cidr)
 	}
-	conf.IpPrefix = conf.IpPrefix[:0]
-	for ipPrefix := range ipPrefixMap {
-		conf.IpPrefix = append(conf.IpPrefix, ipPrefix)
+	conf.IpPrefix = nil
+	if len(allow) > 0 {
+		lessgo.Log.Warn("apidoc: IpPrefix is deprecated and replaces Allow, remove it to use Allow")
+		conf.Allow = allow
 	}
+	return nil
+}
 
-	return conf
+// 将IP前缀转换为CIDR网段，如"192.168."转为"192.168.0.0/16"，"10.0.0.1"转为"10.0.0.1/32"
+func ipPrefixCIDR(prefix string) (string, error) {
+	switch prefix {
+	case "[:", "::":
+		// 旧版默认的IPv6本机前缀
+		return "::1/128", nil
+	}
+	octets := strings.Split(strings.TrimSuffix(prefix, "."), ".")
+	if len(octets) > 4 || (len(octets) < 4 && !strings.HasSuffix(prefix, ".")) {
+		return "", errors.New("apidoc: can not convert ipprefix " + prefix + " to a CIDR, set allow instead")
+	}
+	ip := make([]byte, 4)
+	for i, octet := range octets {
+		n, err := strconv.Atoi(octet)
+		if err != nil || n < 0 || n > 255 {
+			return "", errors.New("apidoc: can not convert ipprefix " + prefix + " to a CIDR, set allow instead")
+		}
+		ip[i] = byte(n)
+	}
+	return fmt.Sprintf("%d.%d.%d.%d/%d", ip[0], ip[1], ip[2], ip[3], 8*len(octets)), nil
+}
+
+// apidocRules为nil时不允许任何IP访问
+var apidocRules = func() *middleware.IPRules {
+	if len(apidocConfig.Allow) == 0 {
+		return nil
+	}
+	rules, err := middleware.NewIPRules(middleware.IPFilterConfig{
+		Allow:          apidocConfig.Allow,
+		Deny:           apidocConfig.Deny,
+		TrustedProxies: apidocConfig.TrustedProxies,
+	})
+	if err != nil {
+		lessgo.Log.Error("%s", err.Error())
+		return nil
+	}
+	return rules
 }()
 
 // 构建api文档Swagger对象
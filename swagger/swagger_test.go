@@ -0,0 +1,52 @@
+package swagger
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIPPrefixCIDR(t *testing.T) {
+	cases := map[string]string{
+		"[:":       "::1/128",
+		"::":       "::1/128",
+		"127.":     "127.0.0.0/8",
+		"192.168.": "192.168.0.0/16",
+		"10.1.2.":  "10.1.2.0/24",
+		"10.1.2.3": "10.1.2.3/32",
+	}
+	for prefix, want := range cases {
+		if got, err := ipPrefixCIDR(prefix); err != nil || got != want {
+			t.Errorf("ipPrefixCIDR(%s) = %s, %v, want %s", prefix, got, err, want)
+		}
+	}
+	// the prefixes matching a part of an octet can not be converted.
+	for _, prefix := range []string{"192.168", "1.2.3.4.5", "256.", "a.", "10..", "fe80:"} {
+		if got, err := ipPrefixCIDR(prefix); err == nil {
+			t.Errorf("ipPrefixCIDR(%s) = %s, want an error", prefix, got)
+		}
+	}
+}
+
+func TestMigrateApidocAllow(t *testing.T) {
+	conf := &ApidocAllow{
+		Allow:    []string{"10.0.0.0/8", "192.168.0.0/16"},
+		IpPrefix: []string{"192.168.1.", " ", "[:"},
+	}
+	if err := migrateApidocAllow(conf); err != nil {
+		t.Fatal(err)
+	}
+	// the old prefixes replace Allow, so they keep restricting the access.
+	if want := []string{"192.168.1.0/24", "::1/128"}; !reflect.DeepEqual(conf.Allow, want) || conf.IpPrefix != nil {
+		t.Errorf("migrated Allow = %v, IpPrefix = %v, want %v", conf.Allow, conf.IpPrefix, want)
+	}
+
+	conf = &ApidocAllow{Allow: []string{"10.0.0.0/8"}}
+	if err := migrateApidocAllow(conf); err != nil || !reflect.DeepEqual(conf.Allow, []string{"10.0.0.0/8"}) {
+		t.Errorf("Allow without IpPrefix = %v, %v", conf.Allow, err)
+	}
+
+	conf = &ApidocAllow{Allow: []string{"10.0.0.0/8"}, IpPrefix: []string{"192.168"}}
+	if err := migrateApidocAllow(conf); err == nil {
+		t.Error("an unconvertible IpPrefix is accepted")
+	}
+}